@@ -0,0 +1,156 @@
+package csibroker
+
+import (
+	"fmt"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	AccessTypeMount = "mount"
+	AccessTypeBlock = "block"
+)
+
+type ErrUnsupportedAccessType struct {
+	AccessType string
+	Supported  []string
+}
+
+func (e ErrUnsupportedAccessType) Error() string {
+	return fmt.Sprintf("access type %q is not supported by this service (supported: %v)", e.AccessType, e.Supported)
+}
+
+type ErrInvalidAccessMode struct {
+	Mode csi.VolumeCapability_AccessMode_Mode
+}
+
+func (e ErrInvalidAccessMode) Error() string {
+	if _, ok := csi.VolumeCapability_AccessMode_Mode_name[int32(e.Mode)]; !ok {
+		return fmt.Sprintf("access_mode.mode %d is not a recognized access mode", e.Mode)
+	}
+	return fmt.Sprintf("access_mode.mode %s is not a usable access mode", e.Mode)
+}
+
+// isKnownAccessMode reports whether mode names an access mode other than
+// UNKNOWN, e.g. "SINGLE_NODE_WRITER".
+func isKnownAccessMode(mode string) bool {
+	value, ok := csi.VolumeCapability_AccessMode_Mode_value[mode]
+	return ok && value != int32(csi.VolumeCapability_AccessMode_UNKNOWN)
+}
+
+func isKnownAccessType(accessType string) bool {
+	return accessType == AccessTypeMount || accessType == AccessTypeBlock
+}
+
+func accessTypeOf(capability *csi.VolumeCapability) string {
+	switch capability.GetAccessType().(type) {
+	case *csi.VolumeCapability_Mount:
+		return AccessTypeMount
+	case *csi.VolumeCapability_Block:
+		return AccessTypeBlock
+	default:
+		return ""
+	}
+}
+
+// applyAccessTypes fills in the service's default access type on
+// capabilities that name none, then rejects any access type the service
+// does not list as supported.
+func applyAccessTypes(service Service, capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if capability.GetAccessType() == nil {
+			switch service.DefaultAccessType {
+			case AccessTypeMount:
+				capability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+			case AccessTypeBlock:
+				capability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+			}
+		}
+
+		accessType := accessTypeOf(capability)
+		if accessType == "" || len(service.SupportedAccessTypes) == 0 {
+			continue
+		}
+		if !containsString(service.SupportedAccessTypes, accessType) {
+			return ErrUnsupportedAccessType{AccessType: accessType, Supported: service.SupportedAccessTypes}
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAccessModes fills in the service's default access mode on
+// capabilities that give none, then rejects any capability whose access
+// mode is UNKNOWN or not a mode of the CSI spec. Capabilities without an
+// access mode are passed on as they are when the service has no default.
+func applyAccessModes(service Service, capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if capability.GetAccessMode() == nil {
+			if service.DefaultAccessMode == "" {
+				continue
+			}
+			capability.AccessMode = &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[service.DefaultAccessMode]),
+			}
+		}
+
+		mode := capability.GetAccessMode().GetMode()
+		if !isKnownAccessMode(mode.String()) {
+			return ErrInvalidAccessMode{Mode: mode}
+		}
+	}
+
+	return nil
+}
+
+// volumeAccessModes records, by volume ID, the access mode each volume was
+// requested with. Of several capabilities, a multi-node mode is recorded in
+// preference, since the volume must then allow attachment to several nodes.
+func volumeAccessModes(requests []*csi.CreateVolumeRequest, volumes []*csi.Volume) map[string]string {
+	modes := map[string]string{}
+	for i, volume := range volumes {
+		if i >= len(requests) || volume.GetVolumeId() == "" {
+			continue
+		}
+		for _, capability := range requests[i].GetVolumeCapabilities() {
+			mode := capability.GetAccessMode().GetMode()
+			if mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+				continue
+			}
+			if modes[volume.GetVolumeId()] == "" || isMultiNodeAccessMode(mode.String()) {
+				modes[volume.GetVolumeId()] = mode.String()
+			}
+		}
+	}
+	if len(modes) == 0 {
+		return nil
+	}
+	return modes
+}
+
+func isMultiNodeAccessMode(mode string) bool {
+	return strings.HasPrefix(mode, "MULTI_NODE_")
+}
+
+// deviceTypeFor is the device type of a bind's mount of a volume: the
+// service's device_type when set, otherwise dedicated for volumes requested
+// with a single-node access mode and shared for any other.
+func deviceTypeFor(service Service, accessMode string) string {
+	if service.DeviceType != "" {
+		return service.DeviceType
+	}
+	if isKnownAccessMode(accessMode) && !isMultiNodeAccessMode(accessMode) {
+		return DeviceTypeDedicated
+	}
+	return DeviceTypeShared
+}
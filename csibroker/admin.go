@@ -0,0 +1,394 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+)
+
+const (
+	defaultInstancesLimit = 100
+	maxInstancesLimit     = 500
+	redactedValue         = "[REDACTED]"
+)
+
+var secretKeyMarkers = []string{"secret", "password", "token", "credential", "key"}
+
+type AdminInstance struct {
+	InstanceID       string            `json:"instance_id"`
+	ServiceID        string            `json:"service_id"`
+	PlanID           string            `json:"plan_id"`
+	OrganizationGUID string            `json:"organization_guid"`
+	SpaceGUID        string            `json:"space_guid"`
+	Name             string            `json:"name,omitempty"`
+	VolumeID         string            `json:"volume_id,omitempty"`
+	VolumeContext    map[string]string `json:"volume_context,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+type AdminServicesResponse struct {
+	Services []Service `json:"services"`
+}
+
+type AdminInstancesResponse struct {
+	Instances []AdminInstance `json:"instances"`
+	Total     int             `json:"total"`
+	Limit     int             `json:"limit"`
+	Offset    int             `json:"offset"`
+}
+
+//go:generate counterfeiter -o csibroker_fake/fake_reconciler.go . Reconciler
+type Reconciler interface {
+	Reconcile(ctx context.Context) (ReconcileReport, error)
+	PruneOrphanedInstances(report ReconcileReport) ([]string, error)
+	LastReconcile() (ReconcileSummary, bool)
+}
+
+//go:generate counterfeiter -o csibroker_fake/fake_instance_lister.go . InstanceLister
+type InstanceLister interface {
+	ListInstances() (map[string]brokerstore.ServiceInstance, error)
+}
+
+// ListInstances returns the stored instances, read under the store lock.
+func (b *Broker) ListInstances() (map[string]brokerstore.ServiceInstance, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return retrieveInstances(b.store)
+}
+
+type adminHandler struct {
+	logger           lager.Logger
+	lister           InstanceLister
+	servicesRegistry ServicesRegistry
+	reconciler       Reconciler
+	rotator          BindingRotator
+}
+
+// NewAdminHandler serves the operator endpoints under /admin. It performs no
+// authentication of its own; callers are expected to wrap it.
+func NewAdminHandler(logger lager.Logger, lister InstanceLister, servicesRegistry ServicesRegistry, reconciler Reconciler, rotator BindingRotator) http.Handler {
+	handler := &adminHandler{
+		logger:           logger.Session("admin"),
+		lister:           lister,
+		servicesRegistry: servicesRegistry,
+		reconciler:       reconciler,
+		rotator:          rotator,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/services", handler.listServices)
+	mux.HandleFunc("/admin/instances", handler.listInstances)
+	mux.HandleFunc("/admin/reconcile", handler.reconcile)
+	mux.HandleFunc("/admin/reconcile/last", handler.lastReconcile)
+	mux.HandleFunc("/admin/bindings/", handler.rotateBinding)
+	return mux
+}
+
+// listServices returns the services as configured in the specfile, including
+// the driver settings the OSB catalog leaves out. Secrets in provision
+// defaults and auth token endpoints are redacted.
+func (h *adminHandler) listServices(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.Session("list-services")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := AdminServicesResponse{Services: []Service{}}
+	for _, brokerService := range h.servicesRegistry.BrokerServices() {
+		service, err := h.servicesRegistry.Service(brokerService.ID)
+		if err != nil {
+			logger.Error("retrieve-service-failed", err, lager.Data{"serviceID": brokerService.ID})
+			writeAdminError(w, http.StatusInternalServerError, "failed to retrieve services")
+			return
+		}
+		response.Services = append(response.Services, redactService(service))
+	}
+
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func (h *adminHandler) listInstances(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.Session("list-instances")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultInstancesLimit)
+	if err != nil || limit <= 0 {
+		writeAdminError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	if limit > maxInstancesLimit {
+		limit = maxInstancesLimit
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeAdminError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	selectors, err := parseLabelSelectors(query["label"])
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	instances, err := h.lister.ListInstances()
+	if err != nil {
+		logger.Error("retrieve-instances-failed", err)
+		writeAdminError(w, http.StatusInternalServerError, "failed to retrieve instances")
+		return
+	}
+
+	serviceID := query.Get("service_id")
+	organizationGUID := query.Get("organization_guid")
+
+	matched := []AdminInstance{}
+	for instanceID, instance := range instances {
+		if serviceID != "" && instance.ServiceID != serviceID {
+			continue
+		}
+		if organizationGUID != "" && instance.OrganizationGUID != organizationGUID {
+			continue
+		}
+		result := adminInstance(instanceID, instance)
+		if !matchesLabels(result.Labels, selectors) {
+			continue
+		}
+		matched = append(matched, result)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].InstanceID < matched[j].InstanceID })
+
+	response := AdminInstancesResponse{
+		Instances: []AdminInstance{},
+		Total:     len(matched),
+		Limit:     limit,
+		Offset:    offset,
+	}
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		response.Instances = matched[offset:end]
+	}
+
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func (h *adminHandler) reconcile(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.Session("reconcile")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	prune := false
+	if value := r.URL.Query().Get("prune"); value != "" {
+		var err error
+		prune, err = strconv.ParseBool(value)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "prune must be a boolean")
+			return
+		}
+	}
+
+	report, err := h.reconciler.Reconcile(r.Context())
+	if err != nil {
+		logger.Error("reconcile-failed", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if prune {
+		report.PrunedInstances, err = h.reconciler.PruneOrphanedInstances(report)
+		if err != nil {
+			logger.Error("prune-failed", err)
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// lastReconcile returns the summary of the most recent reconcile, whether
+// run at startup or through POST /admin/reconcile.
+func (h *adminHandler) lastReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	summary, ok := h.reconciler.LastReconcile()
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "no reconcile has run")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, summary)
+}
+
+// rotateBinding serves POST /admin/bindings/{id}/rotate.
+func (h *adminHandler) rotateBinding(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.Session("rotate-binding")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/bindings/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "rotate" {
+		writeAdminError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	binding, err := h.rotator.RotateBinding(r.Context(), parts[0])
+	switch err.(type) {
+	case nil:
+		writeAdminJSON(w, http.StatusOK, binding)
+	case ErrBindingNotFound:
+		writeAdminError(w, http.StatusNotFound, err.Error())
+	case ErrBindingRotationNotAllowed:
+		writeAdminError(w, http.StatusForbidden, err.Error())
+	default:
+		logger.Error("rotate-binding-failed", err, lager.Data{"bindingID": parts[0]})
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func adminInstance(instanceID string, instance brokerstore.ServiceInstance) AdminInstance {
+	result := AdminInstance{
+		InstanceID:       instanceID,
+		ServiceID:        instance.ServiceID,
+		PlanID:           instance.PlanID,
+		OrganizationGUID: instance.OrganizationGUID,
+		SpaceGUID:        instance.SpaceGUID,
+	}
+
+	fingerprint, err := getFingerprint(instance.ServiceFingerPrint)
+	if err != nil {
+		result.Error = "unreadable fingerprint"
+		return result
+	}
+
+	result.Name = fingerprint.Name
+	result.Labels = fingerprint.Labels
+	if fingerprint.Volume != nil {
+		result.VolumeID = fingerprint.Volume.VolumeId
+		result.VolumeContext = redactSecrets(fingerprint.Volume.VolumeContext)
+	}
+
+	return result
+}
+
+func redactService(service Service) Service {
+	if len(service.ProvisionDefaults) > 0 {
+		service.ProvisionDefaults = redactProvisionDefaults(service.ProvisionDefaults)
+	}
+	if service.AuthToken != nil {
+		authToken := *service.AuthToken
+		// Endpoints may carry credentials in their user info or query.
+		if endpoint, err := url.Parse(authToken.Endpoint); err != nil || endpoint.User != nil || endpoint.RawQuery != "" {
+			authToken.Endpoint = redactedValue
+		}
+		service.AuthToken = &authToken
+	}
+	return service
+}
+
+// redactProvisionDefaults redacts every secret of a CreateVolumeRequest and
+// those parameters whose names look secret.
+func redactProvisionDefaults(defaults json.RawMessage) json.RawMessage {
+	var request map[string]json.RawMessage
+	if json.Unmarshal(defaults, &request) != nil {
+		return json.RawMessage(strconv.Quote(redactedValue))
+	}
+
+	var secrets map[string]string
+	if json.Unmarshal(request["secrets"], &secrets) == nil && len(secrets) > 0 {
+		for key := range secrets {
+			secrets[key] = redactedValue
+		}
+		request["secrets"], _ = json.Marshal(secrets)
+	}
+	var parameters map[string]string
+	if json.Unmarshal(request["parameters"], &parameters) == nil && len(parameters) > 0 {
+		request["parameters"], _ = json.Marshal(redactSecrets(parameters))
+	}
+
+	redacted, err := json.Marshal(request)
+	if err != nil {
+		return json.RawMessage(strconv.Quote(redactedValue))
+	}
+	return redacted
+}
+
+func redactSecrets(values map[string]string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	redacted := make(map[string]string, len(values))
+	for key, value := range values {
+		redacted[key] = value
+		if isSecretKey(key) {
+			redacted[key] = redactedValue
+		}
+	}
+	return redacted
+}
+
+func isSecretKey(key string) bool {
+	lowerKey := strings.ToLower(key)
+	for _, marker := range secretKeyMarkers {
+		if strings.Contains(lowerKey, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func queryInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, description string) {
+	writeAdminJSON(w, status, map[string]string{"description": description})
+}
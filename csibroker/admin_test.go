@@ -0,0 +1,455 @@
+package csibroker_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AdminHandler", func() {
+	var (
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		fakeReconciler       *csibroker_fake.FakeReconciler
+		fakeRotator          *csibroker_fake.FakeBindingRotator
+		handler              http.Handler
+		recorder             *httptest.ResponseRecorder
+		method               string
+		path                 string
+		response             csibroker.AdminInstancesResponse
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeReconciler = &csibroker_fake.FakeReconciler{}
+		fakeRotator = &csibroker_fake.FakeBindingRotator{}
+		broker, err := csibroker.New(
+			lagertest.NewTestLogger("test-admin"),
+			&os_fake.FakeOs{},
+			fakeclock.NewFakeClock(time.Unix(1500000000, 0)),
+			fakeStore,
+			fakeServicesRegistry,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		handler = csibroker.NewAdminHandler(lagertest.NewTestLogger("test-admin"), broker, fakeServicesRegistry, fakeReconciler, fakeRotator)
+		recorder = httptest.NewRecorder()
+		method = "GET"
+		path = "/admin/instances"
+		response = csibroker.AdminInstancesResponse{}
+
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+			"instance-b": {
+				ServiceID:        "service-one",
+				PlanID:           "plan-one",
+				OrganizationGUID: "org-one",
+				SpaceGUID:        "space-one",
+				ServiceFingerPrint: csibroker.ServiceFingerPrint{
+					Name: "volume-b",
+					Volume: &csi.Volume{
+						VolumeId:      "volume-id-b",
+						VolumeContext: map[string]string{"share": "server:/b", "accessSecret": "hunter2"},
+					},
+					Labels: map[string]string{"team": "payments", "env": "prod"},
+				},
+			},
+			"instance-a": {
+				ServiceID:        "service-two",
+				PlanID:           "plan-two",
+				OrganizationGUID: "org-two",
+				SpaceGUID:        "space-two",
+				ServiceFingerPrint: map[string]interface{}{
+					"Name":   "volume-a",
+					"Volume": map[string]interface{}{"volume_id": "volume-id-a"},
+					"Labels": map[string]interface{}{"team": "payments", "env": "dev"},
+				},
+			},
+		}, nil)
+	})
+
+	JustBeforeEach(func() {
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		if recorder.Code == http.StatusOK {
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		}
+	})
+
+	Context("when a self-check record outlived its run", func() {
+		BeforeEach(func() {
+			instances, _ := fakeStore.RetrieveAllInstanceDetails()
+			instances["csibroker-self-check-0123abcd"] = brokerstore.ServiceInstance{ServiceID: "csibroker-self-check-0123abcd"}
+		})
+
+		It("leaves it out of the listing", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(response.Total).To(Equal(2))
+			for _, instance := range response.Instances {
+				Expect(instance.InstanceID).NotTo(HavePrefix("csibroker-self-check-"))
+			}
+		})
+	})
+
+	It("lists every stored instance ordered by instance ID", func() {
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(response.Total).To(Equal(2))
+		Expect(response.Instances).To(HaveLen(2))
+		Expect(response.Instances[0].InstanceID).To(Equal("instance-a"))
+		Expect(response.Instances[0].VolumeID).To(Equal("volume-id-a"))
+		Expect(response.Instances[1]).To(Equal(csibroker.AdminInstance{
+			InstanceID:       "instance-b",
+			ServiceID:        "service-one",
+			PlanID:           "plan-one",
+			OrganizationGUID: "org-one",
+			SpaceGUID:        "space-one",
+			Name:             "volume-b",
+			VolumeID:         "volume-id-b",
+			VolumeContext:    map[string]string{"share": "server:/b", "accessSecret": "[REDACTED]"},
+			Labels:           map[string]string{"team": "payments", "env": "prod"},
+		}))
+	})
+
+	It("includes the labels of stored fingerprints", func() {
+		Expect(response.Instances[0].Labels).To(Equal(map[string]string{"team": "payments", "env": "dev"}))
+	})
+
+	Context("when filtering by service ID", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?service_id=service-one"
+		})
+
+		It("returns only matching instances", func() {
+			Expect(response.Total).To(Equal(1))
+			Expect(response.Instances[0].InstanceID).To(Equal("instance-b"))
+		})
+	})
+
+	Context("when filtering by organization", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?organization_guid=org-two"
+		})
+
+		It("returns only matching instances", func() {
+			Expect(response.Total).To(Equal(1))
+			Expect(response.Instances[0].InstanceID).To(Equal("instance-a"))
+		})
+	})
+
+	Context("when filtering by label", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?label=team=payments"
+		})
+
+		It("returns the instances carrying the label", func() {
+			Expect(response.Total).To(Equal(2))
+		})
+
+		Context("when several labels are given", func() {
+			BeforeEach(func() {
+				path = "/admin/instances?label=team=payments&label=env=prod"
+			})
+
+			It("returns only instances carrying all of them", func() {
+				Expect(response.Total).To(Equal(1))
+				Expect(response.Instances[0].InstanceID).To(Equal("instance-b"))
+			})
+		})
+
+		Context("when no instance carries the label", func() {
+			BeforeEach(func() {
+				path = "/admin/instances?label=team=ledger"
+			})
+
+			It("returns no instances", func() {
+				Expect(response.Total).To(Equal(0))
+				Expect(response.Instances).To(BeEmpty())
+			})
+		})
+
+		Context("when the label is not a key=value pair", func() {
+			BeforeEach(func() {
+				path = "/admin/instances?label=team"
+			})
+
+			It("responds with a bad request", func() {
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+				Expect(recorder.Body.String()).To(ContainSubstring("key=value"))
+			})
+		})
+	})
+
+	Context("when paginating", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?limit=1&offset=1"
+		})
+
+		It("returns the requested page and the total", func() {
+			Expect(response.Total).To(Equal(2))
+			Expect(response.Limit).To(Equal(1))
+			Expect(response.Offset).To(Equal(1))
+			Expect(response.Instances).To(HaveLen(1))
+			Expect(response.Instances[0].InstanceID).To(Equal("instance-b"))
+		})
+	})
+
+	Context("when the limit exceeds the cap", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?limit=100000"
+		})
+
+		It("caps it", func() {
+			Expect(response.Limit).To(Equal(500))
+		})
+	})
+
+	Context("when the limit is invalid", func() {
+		BeforeEach(func() {
+			path = "/admin/instances?limit=zero"
+		})
+
+		It("responds with a bad request", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when the store fails", func() {
+		BeforeEach(func() {
+			fakeStore.RetrieveAllInstanceDetailsReturns(nil, errors.New("badness"))
+		})
+
+		It("responds with an internal server error", func() {
+			Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+		})
+	})
+
+	Context("when the method is not GET", func() {
+		BeforeEach(func() {
+			method = "POST"
+		})
+
+		It("is rejected", func() {
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+
+	Describe("GET /admin/services", func() {
+		var services map[string][]map[string]interface{}
+
+		BeforeEach(func() {
+			path = "/admin/services"
+			services = nil
+
+			fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{{ID: "service-one"}})
+			fakeServicesRegistry.ServiceReturns(csibroker.Service{
+				DriverName:        "some-driver",
+				ConnAddr:          "127.0.0.1:50051",
+				ProvisionDefaults: json.RawMessage(`{"name":"volume","parameters":{"share":"server:/","apiKey":"abc"},"secrets":{"user":"admin"}}`),
+				AuthToken:         &csibroker.AuthToken{Endpoint: "https://tokens.example.com/token?client_secret=xyz"},
+				Service:           brokerapi.Service{ID: "service-one", Name: "some-service", Plans: []brokerapi.ServicePlan{{ID: "plan-one"}}},
+			}, nil)
+		})
+
+		JustBeforeEach(func() {
+			if recorder.Code == http.StatusOK {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &services)).To(Succeed())
+			}
+		})
+
+		It("returns the configured services with their driver settings", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(fakeServicesRegistry.ServiceArgsForCall(0)).To(Equal("service-one"))
+			Expect(services["services"]).To(HaveLen(1))
+
+			service := services["services"][0]
+			Expect(service["id"]).To(Equal("service-one"))
+			Expect(service["driver_name"]).To(Equal("some-driver"))
+			Expect(service["connection_address"]).To(Equal("127.0.0.1:50051"))
+			Expect(service["plans"]).To(HaveLen(1))
+		})
+
+		It("redacts secrets", func() {
+			service := services["services"][0]
+			Expect(service["provision_defaults"]).To(Equal(map[string]interface{}{
+				"name":       "volume",
+				"parameters": map[string]interface{}{"share": "server:/", "apiKey": "[REDACTED]"},
+				"secrets":    map[string]interface{}{"user": "[REDACTED]"},
+			}))
+			Expect(service["auth_token"]).To(Equal(map[string]interface{}{"endpoint": "[REDACTED]"}))
+			Expect(recorder.Body.String()).NotTo(ContainSubstring("xyz"))
+		})
+
+		Context("when a service cannot be retrieved", func() {
+			BeforeEach(func() {
+				fakeServicesRegistry.ServiceReturns(csibroker.Service{}, errors.New("badness"))
+			})
+
+			It("responds with an internal server error", func() {
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+			})
+		})
+	})
+
+	Describe("POST /admin/bindings/{id}/rotate", func() {
+		BeforeEach(func() {
+			method = "POST"
+			path = "/admin/bindings/some-binding-id/rotate"
+			fakeRotator.RotateBindingReturns(brokerapi.Binding{Credentials: map[string]interface{}{"rotated": true}}, nil)
+		})
+
+		It("rotates the binding and returns it", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			_, bindingID := fakeRotator.RotateBindingArgsForCall(0)
+			Expect(bindingID).To(Equal("some-binding-id"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"rotated":true`))
+		})
+
+		Context("when the binding does not exist", func() {
+			BeforeEach(func() {
+				fakeRotator.RotateBindingReturns(brokerapi.Binding{}, csibroker.ErrBindingNotFound{BindingID: "some-binding-id"})
+			})
+
+			It("responds with not found", func() {
+				Expect(recorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("when the service does not allow rotation", func() {
+			BeforeEach(func() {
+				fakeRotator.RotateBindingReturns(brokerapi.Binding{}, csibroker.ErrBindingRotationNotAllowed{ServiceID: "service-one"})
+			})
+
+			It("responds with forbidden", func() {
+				Expect(recorder.Code).To(Equal(http.StatusForbidden))
+			})
+		})
+
+		Context("when the path is not a rotation", func() {
+			BeforeEach(func() {
+				path = "/admin/bindings/some-binding-id"
+			})
+
+			It("responds with not found", func() {
+				Expect(recorder.Code).To(Equal(http.StatusNotFound))
+				Expect(fakeRotator.RotateBindingCallCount()).To(Equal(0))
+			})
+		})
+	})
+
+	Describe("GET /admin/reconcile/last", func() {
+		var summary csibroker.ReconcileSummary
+
+		BeforeEach(func() {
+			path = "/admin/reconcile/last"
+			summary = csibroker.ReconcileSummary{}
+			fakeReconciler.LastReconcileReturns(csibroker.ReconcileSummary{
+				Time:              time.Unix(1500000000, 0).UTC(),
+				OrphanedInstances: 2,
+				UnknownVolumes:    1,
+				PrunedInstances:   []string{"instance-a"},
+			}, true)
+		})
+
+		JustBeforeEach(func() {
+			if recorder.Code == http.StatusOK {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &summary)).To(Succeed())
+			}
+		})
+
+		It("returns the summary of the last reconcile", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(summary.OrphanedInstances).To(Equal(2))
+			Expect(summary.UnknownVolumes).To(Equal(1))
+			Expect(summary.PrunedInstances).To(ConsistOf("instance-a"))
+			Expect(fakeReconciler.ReconcileCallCount()).To(Equal(0))
+		})
+
+		Context("when no reconcile has run", func() {
+			BeforeEach(func() {
+				fakeReconciler.LastReconcileReturns(csibroker.ReconcileSummary{}, false)
+			})
+
+			It("responds with not found", func() {
+				Expect(recorder.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("POST /admin/reconcile", func() {
+		var report csibroker.ReconcileReport
+
+		BeforeEach(func() {
+			method = "POST"
+			path = "/admin/reconcile"
+			report = csibroker.ReconcileReport{}
+
+			fakeReconciler.ReconcileReturns(csibroker.ReconcileReport{
+				OrphanedInstances: []csibroker.ReconcileInstance{{InstanceID: "instance-a", ServiceID: "service-two", VolumeID: "volume-id-a"}},
+				UnknownVolumes:    []csibroker.ReconcileVolume{{ServiceID: "service-two", VolumeID: "stray"}},
+			}, nil)
+			fakeReconciler.PruneOrphanedInstancesReturns([]string{"instance-a"}, nil)
+		})
+
+		JustBeforeEach(func() {
+			if recorder.Code == http.StatusOK {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+			}
+		})
+
+		It("returns the reconcile report without pruning", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(fakeReconciler.ReconcileCallCount()).To(Equal(1))
+			Expect(fakeReconciler.PruneOrphanedInstancesCallCount()).To(Equal(0))
+			Expect(report.OrphanedInstances).To(HaveLen(1))
+			Expect(report.UnknownVolumes).To(HaveLen(1))
+			Expect(report.PrunedInstances).To(BeEmpty())
+		})
+
+		Context("when pruning is requested", func() {
+			BeforeEach(func() {
+				path = "/admin/reconcile?prune=true"
+			})
+
+			It("prunes the orphaned instances and reports them", func() {
+				Expect(fakeReconciler.PruneOrphanedInstancesCallCount()).To(Equal(1))
+				Expect(fakeReconciler.PruneOrphanedInstancesArgsForCall(0).OrphanedInstances).To(HaveLen(1))
+				Expect(report.PrunedInstances).To(ConsistOf("instance-a"))
+			})
+		})
+
+		Context("when reconciling fails", func() {
+			BeforeEach(func() {
+				fakeReconciler.ReconcileReturns(csibroker.ReconcileReport{}, errors.New("driver badness"))
+			})
+
+			It("responds with an internal server error", func() {
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(recorder.Body.String()).To(ContainSubstring("driver badness"))
+			})
+		})
+
+		Context("when the method is not POST", func() {
+			BeforeEach(func() {
+				method = "GET"
+			})
+
+			It("is rejected", func() {
+				Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+				Expect(fakeReconciler.ReconcileCallCount()).To(Equal(0))
+			})
+		})
+	})
+})
@@ -0,0 +1,45 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// specAdvertisedCapacities holds the "advertised_capacity" of each plan in
+// a specfile, read separately like its order.
+type specAdvertisedCapacities []struct {
+	Plans []struct {
+		AdvertisedCapacity string `json:"advertised_capacity"`
+	} `json:"plans"`
+}
+
+// advertiseCapacities shows each plan's advertised capacity, e.g. "100Gi",
+// as a bullet of its catalog metadata. It is for display only: provisions
+// are bounded by plan_capacities. Services must still be in specfile order.
+func advertiseCapacities(serviceSpec []byte, services []Service) error {
+	var capacities specAdvertisedCapacities
+	err := json.Unmarshal(serviceSpec, &capacities)
+	if err != nil {
+		return ErrInvalidSpecFile{err}
+	}
+
+	for i := range services {
+		for j, plan := range capacities[i].Plans {
+			if plan.AdvertisedCapacity == "" {
+				continue
+			}
+			if _, err := ParseCapacity(plan.AdvertisedCapacity); err != nil {
+				return ErrInvalidService{Index: i, Reason: fmt.Sprintf("advertised_capacity of plan %q: %s", services[i].Plans[j].ID, err)}
+			}
+
+			if services[i].Plans[j].Metadata == nil {
+				services[i].Plans[j].Metadata = &brokerapi.ServicePlanMetadata{}
+			}
+			metadata := services[i].Plans[j].Metadata
+			metadata.Bullets = append(metadata.Bullets, fmt.Sprintf("Capacity: up to %s", plan.AdvertisedCapacity))
+		}
+	}
+	return nil
+}
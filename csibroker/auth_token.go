@@ -0,0 +1,157 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const DefaultAuthTokenRefreshInterval = 5 * time.Minute
+
+// AuthToken configures the bearer token sent with every CSI call to a
+// service's driver. The token is read from File or fetched from Endpoint,
+// exactly one of which must be set, and cached for RefreshInterval.
+type AuthToken struct {
+	File     string `json:"file,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// RefreshInterval defaults to DefaultAuthTokenRefreshInterval. A shorter
+	// expires_in from the endpoint takes precedence.
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+func (a AuthToken) validate() error {
+	if (a.File == "") == (a.Endpoint == "") {
+		return errors.New(`auth_token requires exactly one of "file" and "endpoint"`)
+	}
+	if a.RefreshInterval < 0 {
+		return errors.New("auth_token refresh_interval must not be negative")
+	}
+	return nil
+}
+
+// tokenEndpointResponse is the body expected from an auth token endpoint.
+type tokenEndpointResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type authTokenSource struct {
+	config     AuthToken
+	clock      clock.Clock
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+// AuthTokenUnaryClientInterceptor adds an "authorization: Bearer <token>"
+// header to every unary call. A call fails with Unauthenticated, without
+// reaching the driver, while no token can be obtained.
+func AuthTokenUnaryClientInterceptor(clock clock.Clock, config AuthToken) grpc.UnaryClientInterceptor {
+	source := &authTokenSource{
+		config:     config,
+		clock:      clock,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		token, err := source.get(ctx)
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "failed to obtain auth token: %s", err)
+		}
+
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (s *authTokenSource) get(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	if s.token != "" && now.Before(s.refreshAt) {
+		return s.token, nil
+	}
+
+	refreshInterval := time.Duration(s.config.RefreshInterval)
+	if refreshInterval == 0 {
+		refreshInterval = DefaultAuthTokenRefreshInterval
+	}
+
+	var (
+		token     string
+		expiresIn time.Duration
+		err       error
+	)
+	if s.config.File != "" {
+		token, err = s.readFile()
+	} else {
+		token, expiresIn, err = s.fetch(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if expiresIn > 0 && expiresIn < refreshInterval {
+		refreshInterval = expiresIn
+	}
+	s.token = token
+	s.refreshAt = now.Add(refreshInterval)
+
+	return token, nil
+}
+
+func (s *authTokenSource) readFile() (string, error) {
+	contents, err := ioutil.ReadFile(s.config.File)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("auth token file %s is empty", s.config.File)
+	}
+	return token, nil
+}
+
+func (s *authTokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	request, err := http.NewRequest(http.MethodGet, s.config.Endpoint, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	response, err := s.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("auth token endpoint returned %d", response.StatusCode)
+	}
+
+	var body tokenEndpointResponse
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		return "", 0, err
+	}
+	if body.AccessToken == "" {
+		return "", 0, errors.New("auth token endpoint returned no access_token")
+	}
+
+	return body.AccessToken, time.Duration(body.ExpiresIn) * time.Second, nil
+}
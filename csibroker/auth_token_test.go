@@ -0,0 +1,144 @@
+package csibroker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AuthTokenUnaryClientInterceptor", func() {
+	var (
+		fakeClock   *fakeclock.FakeClock
+		config      csibroker.AuthToken
+		interceptor grpc.UnaryClientInterceptor
+		invocations int
+		sentTokens  []string
+	)
+
+	invoke := func() error {
+		return interceptor(context.TODO(), "/csi.v1.Controller/CreateVolume", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				invocations++
+				md, _ := metadata.FromOutgoingContext(ctx)
+				sentTokens = append(sentTokens, md.Get("authorization")...)
+				return nil
+			})
+	}
+
+	BeforeEach(func() {
+		fakeClock = fakeclock.NewFakeClock(time.Now())
+		invocations = 0
+		sentTokens = nil
+	})
+
+	JustBeforeEach(func() {
+		interceptor = csibroker.AuthTokenUnaryClientInterceptor(fakeClock, config)
+	})
+
+	Context("when the token is read from a file", func() {
+		var tokenFile string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "auth-token")
+			Expect(err).NotTo(HaveOccurred())
+			tokenFile = filepath.Join(dir, "token")
+			Expect(ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600)).To(Succeed())
+
+			config = csibroker.AuthToken{File: tokenFile, RefreshInterval: csibroker.Duration(time.Minute)}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(tokenFile))
+		})
+
+		It("sends it as a bearer token", func() {
+			Expect(invoke()).To(Succeed())
+			Expect(sentTokens).To(Equal([]string{"Bearer first-token"}))
+		})
+
+		It("re-reads the file once the refresh interval has passed", func() {
+			Expect(invoke()).To(Succeed())
+			Expect(ioutil.WriteFile(tokenFile, []byte("second-token"), 0600)).To(Succeed())
+
+			Expect(invoke()).To(Succeed())
+			fakeClock.Increment(time.Minute)
+			Expect(invoke()).To(Succeed())
+
+			Expect(sentTokens).To(Equal([]string{"Bearer first-token", "Bearer first-token", "Bearer second-token"}))
+		})
+
+		Context("when the file cannot be read", func() {
+			BeforeEach(func() {
+				config.File = filepath.Join(filepath.Dir(tokenFile), "missing")
+			})
+
+			It("fails the call without invoking it", func() {
+				err := invoke()
+				Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+				Expect(invocations).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when the token is fetched from an endpoint", func() {
+		var (
+			server     *httptest.Server
+			statusCode int
+			requests   int
+		)
+
+		BeforeEach(func() {
+			statusCode = http.StatusOK
+			requests = 0
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(statusCode)
+				w.Write([]byte(`{"access_token": "endpoint-token", "expires_in": 30}`))
+			}))
+
+			config = csibroker.AuthToken{Endpoint: server.URL}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("sends the fetched token and refreshes it when it expires", func() {
+			Expect(invoke()).To(Succeed())
+			Expect(invoke()).To(Succeed())
+			Expect(requests).To(Equal(1))
+
+			fakeClock.Increment(30 * time.Second)
+			Expect(invoke()).To(Succeed())
+			Expect(requests).To(Equal(2))
+
+			Expect(sentTokens).To(ConsistOf("Bearer endpoint-token", "Bearer endpoint-token", "Bearer endpoint-token"))
+		})
+
+		Context("when the endpoint fails", func() {
+			BeforeEach(func() {
+				statusCode = http.StatusInternalServerError
+			})
+
+			It("fails the call without invoking it", func() {
+				err := invoke()
+				Expect(status.Code(err)).To(Equal(codes.Unauthenticated))
+				Expect(invocations).To(Equal(0))
+			})
+		})
+	})
+})
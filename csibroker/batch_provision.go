@@ -0,0 +1,114 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	DefaultBatchProvisionConcurrency = 4
+	maxBatchProvisionRequests        = 500
+)
+
+// BatchProvisionRequest is one provision of a POST /admin/batch-provision,
+// with the fields the platform would otherwise send.
+type BatchProvisionRequest struct {
+	InstanceID       string          `json:"instance_id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+}
+
+// BatchProvisionResult reports one provision with the HTTP status the OSB
+// API would have responded with.
+type BatchProvisionResult struct {
+	InstanceID string `json:"instance_id"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type BatchProvisionResponse struct {
+	Results []BatchProvisionResult `json:"results"`
+}
+
+// NewBatchProvisionHandler serves POST /admin/batch-provision, which takes a
+// JSON array of BatchProvisionRequests and provisions them through broker,
+// at most concurrency at a time. The response lists a result for every
+// request, in the order given; one provision failing does not stop the
+// others.
+func NewBatchProvisionHandler(logger lager.Logger, broker brokerapi.ServiceBroker, concurrency int) http.Handler {
+	logger = logger.Session("admin-batch-provision")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var requests []BatchProvisionRequest
+		if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "body must be a JSON array of provision requests")
+			return
+		}
+		if len(requests) > maxBatchProvisionRequests {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("at most %d provision requests may be sent at once", maxBatchProvisionRequests))
+			return
+		}
+		for i, request := range requests {
+			if request.InstanceID == "" || request.ServiceID == "" || request.PlanID == "" {
+				writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("request %d must name an instance_id, service_id and plan_id", i))
+				return
+			}
+		}
+
+		logger.Info("start", lager.Data{"count": len(requests)})
+		defer logger.Info("end")
+
+		response := BatchProvisionResponse{Results: make([]BatchProvisionResult, len(requests))}
+		slots := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for i, request := range requests {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, request BatchProvisionRequest) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				response.Results[i] = batchProvision(r.Context(), logger, broker, request)
+			}(i, request)
+		}
+		wg.Wait()
+
+		writeAdminJSON(w, http.StatusOK, response)
+	})
+}
+
+func batchProvision(ctx context.Context, logger lager.Logger, broker brokerapi.ServiceBroker, request BatchProvisionRequest) BatchProvisionResult {
+	result := BatchProvisionResult{InstanceID: request.InstanceID, Status: http.StatusCreated}
+
+	details := brokerapi.ProvisionDetails{
+		ServiceID:        request.ServiceID,
+		PlanID:           request.PlanID,
+		OrganizationGUID: request.OrganizationGUID,
+		SpaceGUID:        request.SpaceGUID,
+		RawParameters:    request.Parameters,
+	}
+	_, err := broker.Provision(ctx, request.InstanceID, details, false)
+	if err != nil {
+		logger.Error("provision-failed", err, lager.Data{"instanceID": request.InstanceID})
+		result.Status = http.StatusInternalServerError
+		if failure, ok := err.(*brokerapi.FailureResponse); ok {
+			result.Status = failure.ValidatedStatusCode(logger)
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
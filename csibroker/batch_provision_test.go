@@ -0,0 +1,163 @@
+package csibroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type provisionRecordingBroker struct {
+	brokerapi.ServiceBroker
+
+	mutex    sync.Mutex
+	details  map[string]brokerapi.ProvisionDetails
+	running  int
+	maxInUse int
+	release  chan struct{}
+	failures map[string]error
+}
+
+func (b *provisionRecordingBroker) Provision(_ context.Context, instanceID string, details brokerapi.ProvisionDetails, _ bool) (brokerapi.ProvisionedServiceSpec, error) {
+	b.mutex.Lock()
+	b.details[instanceID] = details
+	b.running++
+	if b.running > b.maxInUse {
+		b.maxInUse = b.running
+	}
+	b.mutex.Unlock()
+
+	if b.release != nil {
+		<-b.release
+	}
+
+	b.mutex.Lock()
+	b.running--
+	b.mutex.Unlock()
+	return brokerapi.ProvisionedServiceSpec{}, b.failures[instanceID]
+}
+
+func (b *provisionRecordingBroker) inUse() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.running
+}
+
+var _ = Describe("BatchProvisionHandler", func() {
+	var (
+		broker   *provisionRecordingBroker
+		handler  http.Handler
+		method   string
+		body     string
+		recorder *httptest.ResponseRecorder
+		response csibroker.BatchProvisionResponse
+	)
+
+	BeforeEach(func() {
+		broker = &provisionRecordingBroker{
+			details:  map[string]brokerapi.ProvisionDetails{},
+			failures: map[string]error{},
+		}
+		handler = csibroker.NewBatchProvisionHandler(lagertest.NewTestLogger("test-batch"), broker, 2)
+		method = "POST"
+		body = `[
+			{"instance_id": "instance-1", "service_id": "some-service-id", "plan_id": "some-plan-id", "organization_guid": "some-org", "space_guid": "some-space", "parameters": {"name": "one"}},
+			{"instance_id": "instance-2", "service_id": "some-service-id", "plan_id": "some-plan-id"},
+			{"instance_id": "instance-3", "service_id": "some-service-id", "plan_id": "some-plan-id"}
+		]`
+	})
+
+	JustBeforeEach(func() {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, "/admin/batch-provision", strings.NewReader(body)))
+		response = csibroker.BatchProvisionResponse{}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+	})
+
+	It("provisions every request through the broker", func() {
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(response.Results).To(Equal([]csibroker.BatchProvisionResult{
+			{InstanceID: "instance-1", Status: http.StatusCreated},
+			{InstanceID: "instance-2", Status: http.StatusCreated},
+			{InstanceID: "instance-3", Status: http.StatusCreated},
+		}))
+
+		details := broker.details["instance-1"]
+		Expect(details.ServiceID).To(Equal("some-service-id"))
+		Expect(details.PlanID).To(Equal("some-plan-id"))
+		Expect(details.OrganizationGUID).To(Equal("some-org"))
+		Expect(details.SpaceGUID).To(Equal("some-space"))
+		Expect(details.RawParameters).To(MatchJSON(`{"name": "one"}`))
+	})
+
+	Context("when provisions take a while", func() {
+		BeforeEach(func() {
+			broker.release = make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(broker.release)
+				Eventually(broker.inUse).Should(Equal(2))
+				Consistently(broker.inUse).Should(Equal(2))
+			}()
+		})
+
+		It("runs at most the given number at once", func() {
+			Expect(broker.maxInUse).To(Equal(2))
+			Expect(response.Results).To(HaveLen(3))
+		})
+	})
+
+	Context("when a provision fails", func() {
+		BeforeEach(func() {
+			broker.failures["instance-2"] = brokerapi.ErrInstanceAlreadyExists
+		})
+
+		It("reports it and provisions the others", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(response.Results[1].Status).To(Equal(http.StatusConflict))
+			Expect(response.Results[1].Error).To(Equal(brokerapi.ErrInstanceAlreadyExists.Error()))
+			Expect(response.Results[2].Status).To(Equal(http.StatusCreated))
+			Expect(broker.details).To(HaveLen(3))
+		})
+	})
+
+	Context("when a request is missing its ids", func() {
+		BeforeEach(func() {
+			body = `[{"instance_id": "instance-1"}]`
+		})
+
+		It("rejects the batch without provisioning", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(broker.details).To(BeEmpty())
+		})
+	})
+
+	Context("when the body is not an array", func() {
+		BeforeEach(func() {
+			body = `{"instance_id": "instance-1"}`
+		})
+
+		It("rejects it", func() {
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when the method is not POST", func() {
+		BeforeEach(func() {
+			method = "GET"
+		})
+
+		It("responds with method not allowed", func() {
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
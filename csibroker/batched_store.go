@@ -0,0 +1,155 @@
+package csibroker
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// BatchedStore coalesces Save calls on a wrapped store and writes at most
+// once per window, plus a final flush when it is stopped.
+//
+// Save only marks the state dirty, so an operation can report success before
+// its state has been written. A crash inside the window loses those changes
+// even though the driver resources were created or deleted. Use it only when
+// that trade-off is acceptable.
+type BatchedStore struct {
+	store  brokerstore.Store
+	logger lager.Logger
+	clock  clock.Clock
+	window time.Duration
+
+	mutex sync.Mutex
+	dirty bool
+}
+
+func NewBatchedStore(logger lager.Logger, store brokerstore.Store, clock clock.Clock, window time.Duration) *BatchedStore {
+	return &BatchedStore{
+		store:  store,
+		logger: logger.Session("batched-store"),
+		clock:  clock,
+		window: window,
+	}
+}
+
+// Run flushes pending changes every window until signalled, then flushes
+// once more before returning.
+func (s *BatchedStore) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := s.clock.NewTicker(s.window)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.Flush(); err != nil {
+				s.logger.Error("flush-failed", err)
+			}
+		case <-signals:
+			return s.Flush()
+		}
+	}
+}
+
+// Flush writes the wrapped store if anything changed since the last write.
+func (s *BatchedStore) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	err := s.store.Save(s.logger)
+	if err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *BatchedStore) Save(logger lager.Logger) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dirty = true
+	return nil
+}
+
+func (s *BatchedStore) Restore(logger lager.Logger) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Restore(logger)
+}
+
+func (s *BatchedStore) Cleanup() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.Cleanup()
+}
+
+func (s *BatchedStore) RetrieveInstanceDetails(id string) (brokerstore.ServiceInstance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.RetrieveInstanceDetails(id)
+}
+
+func (s *BatchedStore) RetrieveBindingDetails(id string) (brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.RetrieveBindingDetails(id)
+}
+
+func (s *BatchedStore) RetrieveAllInstanceDetails() (map[string]brokerstore.ServiceInstance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.RetrieveAllInstanceDetails()
+}
+
+func (s *BatchedStore) RetrieveAllBindingDetails() (map[string]brokerapi.BindDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.RetrieveAllBindingDetails()
+}
+
+func (s *BatchedStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.CreateInstanceDetails(id, details)
+}
+
+func (s *BatchedStore) CreateBindingDetails(id string, details brokerapi.BindDetails) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.CreateBindingDetails(id, details)
+}
+
+func (s *BatchedStore) DeleteInstanceDetails(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteInstanceDetails(id)
+}
+
+func (s *BatchedStore) DeleteBindingDetails(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.DeleteBindingDetails(id)
+}
+
+func (s *BatchedStore) IsInstanceConflict(id string, details brokerstore.ServiceInstance) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.IsInstanceConflict(id, details)
+}
+
+func (s *BatchedStore) IsBindingConflict(id string, details brokerapi.BindDetails) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.IsBindingConflict(id, details)
+}
@@ -0,0 +1,83 @@
+package csibroker_test
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BatchedStore", func() {
+	var (
+		fakeStore    *brokerstorefakes.FakeStore
+		fakeClock    *fakeclock.FakeClock
+		logger       *lagertest.TestLogger
+		batchedStore *csibroker.BatchedStore
+		process      ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
+		logger = lagertest.NewTestLogger("test-batched-store")
+		batchedStore = csibroker.NewBatchedStore(logger, fakeStore, fakeClock, time.Second)
+		process = ifrit.Invoke(batchedStore)
+	})
+
+	AfterEach(func() {
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive())
+	})
+
+	It("passes reads and writes through to the wrapped store", func() {
+		err := batchedStore.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{ServiceID: "some-service-id"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
+	})
+
+	It("coalesces saves within a window into one underlying save", func() {
+		for i := 0; i < 5; i++ {
+			Expect(batchedStore.Save(logger)).To(Succeed())
+		}
+		Expect(fakeStore.SaveCallCount()).To(Equal(0))
+
+		fakeClock.WaitForWatcherAndIncrement(time.Second)
+		Eventually(fakeStore.SaveCallCount).Should(Equal(1))
+
+		fakeClock.Increment(time.Second)
+		Consistently(fakeStore.SaveCallCount).Should(Equal(1))
+	})
+
+	It("flushes pending saves when stopped", func() {
+		Expect(batchedStore.Save(logger)).To(Succeed())
+
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+		Expect(fakeStore.SaveCallCount()).To(Equal(1))
+	})
+
+	Context("when the underlying save fails", func() {
+		BeforeEach(func() {
+			fakeStore.SaveReturnsOnCall(0, errors.New("badness"))
+		})
+
+		It("retries on the next window", func() {
+			Expect(batchedStore.Save(logger)).To(Succeed())
+
+			fakeClock.WaitForWatcherAndIncrement(time.Second)
+			Eventually(fakeStore.SaveCallCount).Should(Equal(1))
+
+			fakeClock.Increment(time.Second)
+			Eventually(fakeStore.SaveCallCount).Should(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,48 @@
+package csibroker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// bindSchema returns the parameters schema the catalog advertises for
+// binding to the plan, or nil when it has none.
+func bindSchema(service Service, planID string) map[string]interface{} {
+	for _, plan := range service.Plans {
+		if plan.ID == planID && plan.Schemas != nil {
+			return plan.Schemas.Binding.Create.Parameters
+		}
+	}
+	return nil
+}
+
+// validateBindSchemas checks the binding schema of every plan of a service
+// that enforces them.
+func validateBindSchemas(service Service) error {
+	for _, plan := range service.Plans {
+		schema := bindSchema(service, plan.ID)
+		if schema == nil {
+			continue
+		}
+		if err := checkSchema(schema, ""); err != nil {
+			return fmt.Errorf("binding schema of plan %q: %s", plan.ID, err)
+		}
+	}
+	return nil
+}
+
+// validateBindParameters rejects, with a 400 the platform shows to the user,
+// bind parameters that do not match the plan's binding schema.
+func validateBindParameters(service Service, planID string, params map[string]interface{}) error {
+	schema := bindSchema(service, planID)
+	if schema == nil {
+		return nil
+	}
+
+	if err := validateSchema(schema, params, ""); err != nil {
+		return brokerapi.NewFailureResponse(fmt.Errorf("invalid bind parameters: %s", err), http.StatusBadRequest, "invalid-bind-parameters")
+	}
+	return nil
+}
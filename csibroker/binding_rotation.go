@@ -0,0 +1,222 @@
+package csibroker
+
+import (
+	"context"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type ErrBindingNotFound struct {
+	BindingID string
+}
+
+func (e ErrBindingNotFound) Error() string {
+	return fmt.Sprintf("binding %s not found", e.BindingID)
+}
+
+type ErrBindingRotationNotAllowed struct {
+	ServiceID string
+}
+
+func (e ErrBindingRotationNotAllowed) Error() string {
+	return fmt.Sprintf("service %s does not allow binding rotation", e.ServiceID)
+}
+
+//go:generate counterfeiter -o csibroker_fake/fake_binding_rotator.go . BindingRotator
+type BindingRotator interface {
+	RotateBinding(ctx context.Context, bindingID string) (brokerapi.Binding, error)
+}
+
+// RotateBinding refreshes the volume contexts of the binding's instance from
+// the driver's ListVolumes and binds again with the stored bind details, so
+// that credentials the backend has rotated reach the binding. Apps pick the
+// new binding up when they are rebound or restaged. The instance lock is held
+// throughout, so an Unbind or Deprovision cannot interleave with the rebind.
+func (b *Broker) RotateBinding(ctx context.Context, bindingID string) (brokerapi.Binding, error) {
+	logger := b.logger.Session("rotate-binding", lager.Data{"bindingID": bindingID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	err := b.ensureRestored(logger)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	b.mutex.Lock()
+	bindDetails, err := b.store.RetrieveBindingDetails(bindingID)
+	b.mutex.Unlock()
+	if err != nil {
+		return brokerapi.Binding{}, ErrBindingNotFound{BindingID: bindingID}
+	}
+
+	service, err := b.servicesRegistry.Service(bindDetails.ServiceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if !service.AllowBindingRotation {
+		return brokerapi.Binding{}, ErrBindingRotationNotAllowed{ServiceID: bindDetails.ServiceID}
+	}
+	err = b.probeController(ctx, bindDetails.ServiceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	instanceID, err := b.bindingInstance(bindingID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	unlock := b.instanceLocks.lock(instanceID)
+	defer unlock()
+
+	// read again now that the lock is held: the binding may have been
+	// unbound while it was being waited for
+	b.mutex.Lock()
+	bindDetails, err = b.store.RetrieveBindingDetails(bindingID)
+	if err != nil {
+		b.mutex.Unlock()
+		return brokerapi.Binding{}, ErrBindingNotFound{BindingID: bindingID}
+	}
+	instanceDetails, err := b.store.RetrieveInstanceDetails(instanceID)
+	b.mutex.Unlock()
+	if err != nil {
+		return brokerapi.Binding{}, ErrBindingNotFound{BindingID: bindingID}
+	}
+	fingerprint, err := getFingerprint(instanceDetails.ServiceFingerPrint)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if _, ok := fingerprint.BindingMounts[bindingID]; !ok {
+		return brokerapi.Binding{}, ErrBindingNotFound{BindingID: bindingID}
+	}
+
+	err = b.refreshVolumeContexts(ctx, logger, bindDetails.ServiceID, fingerprint)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	err = b.prepareRebind(logger, instanceID, bindingID, instanceDetails, fingerprint)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	binding, err := b.bind(ctx, logger, instanceID, bindingID, bindDetails, &LifecycleEventData{})
+	if err != nil {
+		logger.Error("rebind-failed", err)
+		b.restoreBinding(logger, instanceID, bindingID, bindDetails, instanceDetails)
+		return brokerapi.Binding{}, err
+	}
+
+	return binding, nil
+}
+
+// bindingInstance finds the instance whose fingerprint records the binding.
+func (b *Broker) bindingInstance(bindingID string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	instances, err := retrieveInstances(b.store)
+	if err != nil {
+		return "", err
+	}
+	for instanceID, instanceDetails := range instances {
+		fingerprint, err := getFingerprint(instanceDetails.ServiceFingerPrint)
+		if err != nil {
+			continue
+		}
+		if _, ok := fingerprint.BindingMounts[bindingID]; ok {
+			return instanceID, nil
+		}
+	}
+	return "", ErrBindingNotFound{BindingID: bindingID}
+}
+
+// refreshVolumeContexts replaces the contexts of the fingerprint's volumes
+// with the driver's. Listing stops as soon as every volume has been seen.
+// Drivers that do not implement ListVolumes leave the contexts as they are.
+func (b *Broker) refreshVolumeContexts(ctx context.Context, logger lager.Logger, serviceID string, fingerprint *ServiceFingerPrint) error {
+	controllerClient, err := b.servicesRegistry.ControllerClient(serviceID)
+	if err != nil {
+		return err
+	}
+
+	volumes := map[string]*csi.Volume{}
+	for _, volume := range append([]*csi.Volume{fingerprint.Volume}, fingerprint.AdditionalVolumes...) {
+		volumes[volume.GetVolumeId()] = volume
+	}
+
+	var token string
+	for len(volumes) > 0 {
+		response, err := controllerClient.ListVolumes(ctx, &csi.ListVolumesRequest{
+			MaxEntries:    b.reconcilePageSize,
+			StartingToken: token,
+		})
+		if status.Code(err) == codes.Unimplemented {
+			logger.Info("list-volumes-unimplemented")
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, entry := range response.GetEntries() {
+			if volume, ok := volumes[entry.GetVolume().GetVolumeId()]; ok {
+				volume.VolumeContext = entry.GetVolume().GetVolumeContext()
+				delete(volumes, volume.GetVolumeId())
+			}
+		}
+
+		token = response.GetNextToken()
+		if token == "" {
+			return nil
+		}
+	}
+	return nil
+}
+
+// prepareRebind stores the refreshed fingerprint and removes the binding
+// details so that bind can record them again.
+func (b *Broker) prepareRebind(logger lager.Logger, instanceID, bindingID string, instanceDetails brokerstore.ServiceInstance, fingerprint *ServiceFingerPrint) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.replaceFingerprint(logger, instanceID, instanceDetails, fingerprint)
+	if err != nil {
+		return err
+	}
+	err = b.store.DeleteBindingDetails(bindingID)
+	if err != nil {
+		return err
+	}
+	return b.store.Save(logger)
+}
+
+// restoreBinding puts back the binding details and the instance record as
+// they were before a failed rebind, so the binding keeps its mounts.
+func (b *Broker) restoreBinding(logger lager.Logger, instanceID, bindingID string, bindDetails brokerapi.BindDetails, instanceDetails brokerstore.ServiceInstance) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := b.store.RetrieveBindingDetails(bindingID); err != nil {
+		if err := b.store.CreateBindingDetails(bindingID, bindDetails); err != nil {
+			logger.Error("restore-binding-details-failed", err)
+		}
+	}
+
+	err := b.store.DeleteInstanceDetails(instanceID)
+	if err == nil {
+		err = b.store.CreateInstanceDetails(instanceID, instanceDetails)
+	}
+	if err != nil {
+		logger.Error("restore-instance-details-failed", err, lager.Data{"instanceID": instanceID})
+	}
+
+	if err := b.store.Save(logger); err != nil {
+		logger.Error("save-failed", err)
+	}
+}
@@ -0,0 +1,160 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/csishim/csi_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotateBinding", func() {
+	var (
+		broker               *csibroker.Broker
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		fakeControllerClient *csi_fake.FakeControllerClient
+		bindDetails          brokerapi.BindDetails
+		binding              brokerapi.Binding
+		err                  error
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeControllerClient = &csi_fake.FakeControllerClient{}
+
+		fakeServicesRegistry.ServiceReturns(csibroker.Service{AllowBindingRotation: true}, nil)
+		fakeServicesRegistry.ControllerClientReturns(fakeControllerClient, nil)
+		fakeServicesRegistry.IdentityClientReturns(&csi_fake.FakeIdentityClient{}, nil)
+		fakeServicesRegistry.DriverNameReturns("some-driver", nil)
+
+		bindDetails = brokerapi.BindDetails{AppGUID: "some-app-guid", ServiceID: "some-service-id"}
+		fakeStore.RetrieveBindingDetailsReturns(bindDetails, nil)
+
+		instance := brokerstore.ServiceInstance{
+			ServiceID: "some-service-id",
+			ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+				Volume:        &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"password": "old-password"}},
+				BindingMounts: map[string][]brokerapi.VolumeMount{"some-binding-id": nil},
+			},
+		}
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{"some-instance-id": instance}, nil)
+		fakeStore.RetrieveInstanceDetailsStub = func(string) (brokerstore.ServiceInstance, error) {
+			if fakeStore.CreateInstanceDetailsCallCount() == 0 {
+				return instance, nil
+			}
+			_, stored := fakeStore.CreateInstanceDetailsArgsForCall(fakeStore.CreateInstanceDetailsCallCount() - 1)
+			return stored, nil
+		}
+
+		fakeControllerClient.ListVolumesReturns(&csi.ListVolumesResponse{
+			Entries: []*csi.ListVolumesResponse_Entry{{
+				Volume: &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"password": "new-password"}},
+			}},
+		}, nil)
+
+		broker, err = csibroker.New(
+			lagertest.NewTestLogger("test-rotate-binding"),
+			&os_fake.FakeOs{},
+			fakeclock.NewFakeClock(time.Unix(1500000000, 0)),
+			fakeStore,
+			fakeServicesRegistry,
+		)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		binding, err = broker.RotateBinding(context.TODO(), "some-binding-id")
+	})
+
+	It("binds again with the volume context the driver now lists", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(binding.VolumeMounts).To(HaveLen(1))
+		Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"password": "new-password"}))
+
+		Expect(fakeStore.DeleteBindingDetailsArgsForCall(0)).To(Equal("some-binding-id"))
+		id, details := fakeStore.CreateBindingDetailsArgsForCall(0)
+		Expect(id).To(Equal("some-binding-id"))
+		Expect(details).To(Equal(bindDetails))
+	})
+
+	Context("when the driver pages its volumes", func() {
+		BeforeEach(func() {
+			fakeControllerClient.ListVolumesReturns(&csi.ListVolumesResponse{
+				Entries: []*csi.ListVolumesResponse_Entry{{
+					Volume: &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"password": "new-password"}},
+				}},
+				NextToken: "more",
+			}, nil)
+		})
+
+		It("stops listing once the instance's volumes have been seen", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeControllerClient.ListVolumesCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when binding again fails", func() {
+		BeforeEach(func() {
+			fakeServicesRegistry.DriverNameReturns("", errors.New("no driver"))
+		})
+
+		It("restores the instance as it was, binding mounts included", func() {
+			Expect(err).To(MatchError("no driver"))
+
+			id, restored := fakeStore.CreateInstanceDetailsArgsForCall(fakeStore.CreateInstanceDetailsCallCount() - 1)
+			Expect(id).To(Equal("some-instance-id"))
+			fingerprint, ok := restored.ServiceFingerPrint.(*csibroker.ServiceFingerPrint)
+			Expect(ok).To(BeTrue())
+			Expect(fingerprint.Volume.VolumeContext).To(Equal(map[string]string{"password": "old-password"}))
+			Expect(fingerprint.BindingMounts).To(HaveKey("some-binding-id"))
+		})
+	})
+
+	Context("when the driver does not list volumes", func() {
+		BeforeEach(func() {
+			fakeControllerClient.ListVolumesReturns(nil, status.Error(codes.Unimplemented, "no"))
+		})
+
+		It("binds again with the stored volume context", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"password": "old-password"}))
+		})
+	})
+
+	Context("when the service does not allow rotation", func() {
+		BeforeEach(func() {
+			fakeServicesRegistry.ServiceReturns(csibroker.Service{}, nil)
+		})
+
+		It("refuses", func() {
+			Expect(err).To(Equal(csibroker.ErrBindingRotationNotAllowed{ServiceID: "some-service-id"}))
+			Expect(fakeStore.DeleteBindingDetailsCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the binding does not exist", func() {
+		BeforeEach(func() {
+			fakeStore.RetrieveBindingDetailsReturns(brokerapi.BindDetails{}, errors.New("not found"))
+		})
+
+		It("reports it as not found", func() {
+			Expect(err).To(Equal(csibroker.ErrBindingNotFound{BindingID: "some-binding-id"}))
+		})
+	})
+})
@@ -0,0 +1,106 @@
+package csibroker
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// capacityUnits maps the accepted size suffixes to their multipliers. SI
+// suffixes are powers of 1000 and IEC suffixes powers of 1024. Lower-case
+// suffixes other than the SI "k" are left out so that "m" cannot be read as
+// either mega or milli.
+var capacityUnits = map[string]int64{
+	"": 1, "B": 1,
+	"k": 1e3, "kB": 1e3, "K": 1e3, "KB": 1e3,
+	"M": 1e6, "MB": 1e6,
+	"G": 1e9, "GB": 1e9,
+	"T": 1e12, "TB": 1e12,
+	"P": 1e15, "PB": 1e15,
+	"Ki": 1 << 10, "KiB": 1 << 10,
+	"Mi": 1 << 20, "MiB": 1 << 20,
+	"Gi": 1 << 30, "GiB": 1 << 30,
+	"Ti": 1 << 40, "TiB": 1 << 40,
+	"Pi": 1 << 50, "PiB": 1 << 50,
+}
+
+var capacityPattern = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z]*)\s*$`)
+
+type ErrInvalidCapacity struct {
+	Value  string
+	Reason string
+}
+
+func (e ErrInvalidCapacity) Error() string {
+	return fmt.Sprintf("invalid capacity %q: %s", e.Value, e.Reason)
+}
+
+// ParseCapacity converts a size such as "10Gi", "5GB" or "1048576" to bytes.
+func ParseCapacity(value string) (int64, error) {
+	match := capacityPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, ErrInvalidCapacity{Value: value, Reason: "expected a number optionally followed by a unit such as GB or GiB"}
+	}
+
+	multiplier, ok := capacityUnits[match[2]]
+	if !ok {
+		return 0, ErrInvalidCapacity{Value: value, Reason: fmt.Sprintf("unknown unit %q", match[2])}
+	}
+
+	amount, ok := new(big.Rat).SetString(match[1])
+	if !ok {
+		return 0, ErrInvalidCapacity{Value: value, Reason: "malformed number"}
+	}
+	bytes := amount.Mul(amount, new(big.Rat).SetInt64(multiplier))
+	if !bytes.IsInt() {
+		return 0, ErrInvalidCapacity{Value: value, Reason: "does not come to a whole number of bytes"}
+	}
+	if bytes.Sign() == 0 {
+		return 0, ErrInvalidCapacity{Value: value, Reason: "must be greater than zero"}
+	}
+	if bytes.Num().Cmp(big.NewInt(math.MaxInt64)) > 0 {
+		return 0, ErrInvalidCapacity{Value: value, Reason: "too large"}
+	}
+
+	return bytes.Num().Int64(), nil
+}
+
+// applyCapacity sets the required bytes of the request from a human-readable
+// capacity. It refuses to override required bytes given explicitly.
+func applyCapacity(configuration *csi.CreateVolumeRequest, capacity string) error {
+	requiredBytes, err := ParseCapacity(capacity)
+	if err != nil {
+		return err
+	}
+
+	if configuration.CapacityRange == nil {
+		configuration.CapacityRange = &csi.CapacityRange{}
+	}
+	if configuration.CapacityRange.RequiredBytes != 0 {
+		return ErrInvalidCapacity{Value: capacity, Reason: "conflicts with capacity_range.required_bytes"}
+	}
+	configuration.CapacityRange.RequiredBytes = requiredBytes
+
+	return nil
+}
+
+// validateCapacityRange rejects negative bounds and a limit below the
+// required size. Zero leaves a bound unset.
+func validateCapacityRange(capacityRange *csi.CapacityRange) error {
+	required, limit := capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes()
+
+	if required < 0 {
+		return fmt.Errorf("capacity_range.required_bytes must not be negative, got %d", required)
+	}
+	if limit < 0 {
+		return fmt.Errorf("capacity_range.limit_bytes must not be negative, got %d", limit)
+	}
+	if required > 0 && limit > 0 && limit < required {
+		return fmt.Errorf("capacity_range.limit_bytes (%d) must not be less than capacity_range.required_bytes (%d)", limit, required)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package csibroker_test
+
+import (
+	"code.cloudfoundry.org/csibroker/csibroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseCapacity", func() {
+	It("accepts SI and IEC units", func() {
+		expected := map[string]int64{
+			"1048576": 1048576,
+			"512B":    512,
+			"5GB":     5000000000,
+			"5G":      5000000000,
+			"10Gi":    10737418240,
+			"10GiB":   10737418240,
+			"1.5Ki":   1536,
+			"2 TB":    2000000000000,
+		}
+		for value, bytes := range expected {
+			parsed, err := csibroker.ParseCapacity(value)
+			Expect(err).NotTo(HaveOccurred(), value)
+			Expect(parsed).To(Equal(bytes), value)
+		}
+	})
+
+	It("rejects ambiguous or invalid sizes", func() {
+		for _, value := range []string{"", "Gi", "10gb", "10m", "-1Gi", "1.0000001", "0", "10XB", "99999999PiB"} {
+			_, err := csibroker.ParseCapacity(value)
+			Expect(err).To(BeAssignableToTypeOf(csibroker.ErrInvalidCapacity{}), value)
+		}
+	})
+})
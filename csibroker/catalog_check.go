@@ -0,0 +1,101 @@
+package csibroker
+
+import (
+	"sort"
+
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+)
+
+// StrandedInstances returns, per service ID, the stored instances whose
+// service is no longer in the catalog. Bind, unbind and deprovision all fail
+// for such instances.
+func StrandedInstances(store brokerstore.Store, registry ServicesRegistry) (map[string][]string, error) {
+	instances, err := retrieveInstances(store)
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, service := range registry.BrokerServices() {
+		known[service.ID] = true
+	}
+
+	stranded := map[string][]string{}
+	for instanceID, instance := range instances {
+		if !known[instance.ServiceID] {
+			stranded[instance.ServiceID] = append(stranded[instance.ServiceID], instanceID)
+		}
+	}
+	for _, instanceIDs := range stranded {
+		sort.Strings(instanceIDs)
+	}
+
+	return stranded, nil
+}
+
+// SpecChange is a change to a service's driver settings since some of its
+// stored instances were provisioned.
+type SpecChange struct {
+	ServiceID   string   `json:"service_id"`
+	Field       string   `json:"field"`
+	Previous    string   `json:"previous"`
+	Current     string   `json:"current"`
+	InstanceIDs []string `json:"instance_ids"`
+}
+
+// IncompatibleSpecChanges returns the changes to driver_name and
+// connection_address that affect stored instances. Deprovisioning such an
+// instance would ask a driver that never created its volume. Instances
+// provisioned before the driver was recorded, and instances of services no
+// longer in the catalog, are not checked.
+func IncompatibleSpecChanges(store brokerstore.Store, registry ServicesRegistry) ([]SpecChange, error) {
+	instances, err := retrieveInstances(store)
+	if err != nil {
+		return nil, err
+	}
+
+	type changeKey struct{ serviceID, field, previous, current string }
+	changes := map[changeKey][]string{}
+	for instanceID, instance := range instances {
+		service, err := registry.Service(instance.ServiceID)
+		if err != nil {
+			continue
+		}
+		fingerprint, err := getFingerprint(instance.ServiceFingerPrint)
+		if err != nil {
+			continue
+		}
+
+		if fingerprint.DriverName != "" && fingerprint.DriverName != service.DriverName {
+			key := changeKey{instance.ServiceID, "driver_name", fingerprint.DriverName, service.DriverName}
+			changes[key] = append(changes[key], instanceID)
+		}
+		if fingerprint.ConnAddr != "" && fingerprint.ConnAddr != service.ConnAddr {
+			key := changeKey{instance.ServiceID, "connection_address", fingerprint.ConnAddr, service.ConnAddr}
+			changes[key] = append(changes[key], instanceID)
+		}
+	}
+
+	result := []SpecChange{}
+	for key, instanceIDs := range changes {
+		sort.Strings(instanceIDs)
+		result = append(result, SpecChange{
+			ServiceID:   key.serviceID,
+			Field:       key.field,
+			Previous:    key.previous,
+			Current:     key.current,
+			InstanceIDs: instanceIDs,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ServiceID != result[j].ServiceID {
+			return result[i].ServiceID < result[j].ServiceID
+		}
+		if result[i].Field != result[j].Field {
+			return result[i].Field < result[j].Field
+		}
+		return result[i].Previous < result[j].Previous
+	})
+
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package csibroker_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StrandedInstances", func() {
+	var (
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{{ID: "current-service"}})
+	})
+
+	It("groups instances of unknown services by service ID", func() {
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+			"instance-1": {ServiceID: "current-service"},
+			"instance-2": {ServiceID: "removed-service"},
+			"instance-3": {ServiceID: "removed-service"},
+		}, nil)
+
+		stranded, err := csibroker.StrandedInstances(fakeStore, fakeServicesRegistry)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stranded).To(Equal(map[string][]string{"removed-service": {"instance-2", "instance-3"}}))
+	})
+
+	It("returns nothing when every instance belongs to a known service", func() {
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+			"instance-1": {ServiceID: "current-service"},
+		}, nil)
+
+		stranded, err := csibroker.StrandedInstances(fakeStore, fakeServicesRegistry)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stranded).To(BeEmpty())
+	})
+
+	It("returns store errors", func() {
+		fakeStore.RetrieveAllInstanceDetailsReturns(nil, errors.New("badness"))
+
+		_, err := csibroker.StrandedInstances(fakeStore, fakeServicesRegistry)
+		Expect(err).To(MatchError("badness"))
+	})
+})
+
+var _ = Describe("IncompatibleSpecChanges", func() {
+	var (
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeServicesRegistry.ServiceStub = func(serviceID string) (csibroker.Service, error) {
+			if serviceID != "current-service" {
+				return csibroker.Service{}, csibroker.ErrServiceNotFound{ID: serviceID}
+			}
+			return csibroker.Service{DriverName: "new-driver", ConnAddr: "0.0.0.0:1000"}, nil
+		}
+	})
+
+	It("lists the changed fields with the instances they affect", func() {
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+			"instance-1": {ServiceID: "current-service", ServiceFingerPrint: &csibroker.ServiceFingerPrint{DriverName: "old-driver", ConnAddr: "0.0.0.0:1000"}},
+			"instance-2": {ServiceID: "current-service", ServiceFingerPrint: &csibroker.ServiceFingerPrint{DriverName: "old-driver", ConnAddr: "0.0.0.0:2000"}},
+			"instance-3": {ServiceID: "current-service", ServiceFingerPrint: &csibroker.ServiceFingerPrint{DriverName: "new-driver", ConnAddr: "0.0.0.0:1000"}},
+			"instance-4": {ServiceID: "current-service", ServiceFingerPrint: &csibroker.ServiceFingerPrint{}},
+			"instance-5": {ServiceID: "removed-service", ServiceFingerPrint: &csibroker.ServiceFingerPrint{DriverName: "old-driver"}},
+		}, nil)
+
+		changes, err := csibroker.IncompatibleSpecChanges(fakeStore, fakeServicesRegistry)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(Equal([]csibroker.SpecChange{
+			{ServiceID: "current-service", Field: "connection_address", Previous: "0.0.0.0:2000", Current: "0.0.0.0:1000", InstanceIDs: []string{"instance-2"}},
+			{ServiceID: "current-service", Field: "driver_name", Previous: "old-driver", Current: "new-driver", InstanceIDs: []string{"instance-1", "instance-2"}},
+		}))
+	})
+
+	It("returns store errors", func() {
+		fakeStore.RetrieveAllInstanceDetailsReturns(nil, errors.New("badness"))
+
+		_, err := csibroker.IncompatibleSpecChanges(fakeStore, fakeServicesRegistry)
+		Expect(err).To(MatchError("badness"))
+	})
+})
@@ -0,0 +1,64 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// specOrders holds the "order" of each service and plan in a specfile. Plans
+// are brokerapi types, which have no room for it, so it is read separately.
+type specOrders []struct {
+	Order *int `json:"order"`
+	Plans []struct {
+		Order *int `json:"order"`
+	} `json:"plans"`
+}
+
+// orderCatalog sorts services, and the plans of each service, by their
+// "order" in the specfile. Entries without an order keep their specfile
+// order after all those with one.
+func orderCatalog(serviceSpec []byte, services []Service) error {
+	var orders specOrders
+	err := json.Unmarshal(serviceSpec, &orders)
+	if err != nil {
+		return err
+	}
+
+	for i := range services {
+		var planOrders []*int
+		for _, plan := range orders[i].Plans {
+			planOrders = append(planOrders, plan.Order)
+		}
+
+		plans := services[i].Plans
+		sort.Stable(byOrder{orders: planOrders, swap: func(a, b int) { plans[a], plans[b] = plans[b], plans[a] }})
+	}
+
+	var serviceOrders []*int
+	for _, service := range orders {
+		serviceOrders = append(serviceOrders, service.Order)
+	}
+	sort.Stable(byOrder{orders: serviceOrders, swap: func(a, b int) { services[a], services[b] = services[b], services[a] }})
+
+	return nil
+}
+
+// byOrder sorts a slice alongside the orders of its elements.
+type byOrder struct {
+	orders []*int
+	swap   func(a, b int)
+}
+
+func (o byOrder) Len() int { return len(o.orders) }
+
+func (o byOrder) Less(a, b int) bool {
+	if o.orders[a] == nil || o.orders[b] == nil {
+		return o.orders[b] == nil && o.orders[a] != nil
+	}
+	return *o.orders[a] < *o.orders[b]
+}
+
+func (o byOrder) Swap(a, b int) {
+	o.orders[a], o.orders[b] = o.orders[b], o.orders[a]
+	o.swap(a, b)
+}
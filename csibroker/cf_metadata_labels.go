@@ -0,0 +1,60 @@
+package csibroker
+
+import (
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const DefaultCFMetadataLabelPrefix = "cf-"
+
+type ErrCFMetadataLabelCollision struct {
+	Key string
+}
+
+func (e ErrCFMetadataLabelCollision) Error() string {
+	return fmt.Sprintf("parameter '%s' is reserved for Cloud Foundry metadata", e.Key)
+}
+
+type cfMetadataLabels struct {
+	prefix          string
+	failOnCollision bool
+}
+
+// WithCFMetadataLabels adds the instance ID, org, space and plan of a
+// provision to the parameters of the volumes it creates, under keys such as
+// "<prefix>instance-id", so that volumes can be traced back to Cloud Foundry.
+// A parameter the caller already set under one of these keys is kept, or the
+// provision is rejected if failOnCollision is set.
+func WithCFMetadataLabels(prefix string, failOnCollision bool) Option {
+	return func(b *Broker) {
+		b.cfMetadataLabels = &cfMetadataLabels{prefix: prefix, failOnCollision: failOnCollision}
+	}
+}
+
+func (l *cfMetadataLabels) apply(request *csi.CreateVolumeRequest, instanceID string, details brokerapi.ProvisionDetails) error {
+	labels := map[string]string{
+		l.prefix + "instance-id": instanceID,
+		l.prefix + "org-guid":    details.OrganizationGUID,
+		l.prefix + "space-guid":  details.SpaceGUID,
+		l.prefix + "plan-id":     details.PlanID,
+	}
+
+	if request.Parameters == nil {
+		request.Parameters = map[string]string{}
+	}
+	for key, value := range labels {
+		if _, ok := request.Parameters[key]; ok {
+			if l.failOnCollision {
+				return ErrCFMetadataLabelCollision{Key: key}
+			}
+			continue
+		}
+		if value != "" {
+			request.Parameters[key] = value
+		}
+	}
+
+	return nil
+}
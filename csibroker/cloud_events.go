@@ -0,0 +1,150 @@
+package csibroker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultCloudEventsBufferSize = 100
+	DefaultCloudEventsTimeout    = 10 * time.Second
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsSource      = "urn:cloudfoundry:csibroker"
+	cloudEventsTypePrefix  = "org.cloudfoundry.csibroker."
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type CloudEvent struct {
+	SpecVersion     string             `json:"specversion"`
+	ID              string             `json:"id"`
+	Source          string             `json:"source"`
+	Type            string             `json:"type"`
+	Time            time.Time          `json:"time"`
+	DataContentType string             `json:"datacontenttype"`
+	Data            LifecycleEventData `json:"data"`
+}
+
+// LifecycleEventData describes the outcome of one broker operation.
+type LifecycleEventData struct {
+	InstanceID       string `json:"instance_id"`
+	BindingID        string `json:"binding_id,omitempty"`
+	ServiceID        string `json:"service_id"`
+	PlanID           string `json:"plan_id,omitempty"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	// Outcome is "succeeded" or "failed".
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CloudEventEmitter POSTs lifecycle events to a sink in the background.
+// Emitting never blocks: when the buffer is full the event is dropped and
+// logged, and failed deliveries are not retried.
+type CloudEventEmitter struct {
+	logger lager.Logger
+	clock  clock.Clock
+	sink   string
+	client *http.Client
+	events chan CloudEvent
+}
+
+func NewCloudEventEmitter(logger lager.Logger, clock clock.Clock, sink string, bufferSize int, timeout time.Duration) *CloudEventEmitter {
+	return &CloudEventEmitter{
+		logger: logger.Session("cloud-events"),
+		clock:  clock,
+		sink:   sink,
+		client: &http.Client{Timeout: timeout},
+		events: make(chan CloudEvent, bufferSize),
+	}
+}
+
+// Run delivers queued events until signalled. Events still queued then are
+// dropped.
+func (e *CloudEventEmitter) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	for {
+		select {
+		case event := <-e.events:
+			if err := e.post(event); err != nil {
+				e.logger.Error("delivery-failed", err, lager.Data{"id": event.ID, "type": event.Type})
+			}
+		case <-signals:
+			if len(e.events) > 0 {
+				e.logger.Info("events-dropped-on-shutdown", lager.Data{"count": len(e.events)})
+			}
+			return nil
+		}
+	}
+}
+
+// Emit queues an event of type operation.outcome, e.g. provision.succeeded.
+func (e *CloudEventEmitter) Emit(operation Operation, data LifecycleEventData) {
+	event := CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              newCloudEventID(),
+		Source:          cloudEventsSource,
+		Type:            cloudEventsTypePrefix + string(operation) + "." + data.Outcome,
+		Time:            e.clock.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	select {
+	case e.events <- event:
+	default:
+		e.logger.Info("event-dropped", lager.Data{"id": event.ID, "type": event.Type})
+	}
+}
+
+func (e *CloudEventEmitter) post(event CloudEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Post(e.sink, cloudEventsContentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sink returned %d", response.StatusCode)
+	}
+	return nil
+}
+
+func newCloudEventID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// emitLifecycleEvent reports the outcome of an operation when an emitter is
+// configured.
+func (b *Broker) emitLifecycleEvent(operation Operation, data LifecycleEventData, err error) {
+	if b.cloudEvents == nil {
+		return
+	}
+
+	data.Outcome = "succeeded"
+	if err != nil {
+		data.Outcome = "failed"
+		data.Error = err.Error()
+	}
+	b.cloudEvents.Emit(operation, data)
+}
@@ -0,0 +1,96 @@
+package csibroker_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/tedsuo/ifrit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CloudEventEmitter", func() {
+	var (
+		logger     *lagertest.TestLogger
+		fakeClock  *fakeclock.FakeClock
+		server     *httptest.Server
+		statusCode int
+		received   chan csibroker.CloudEvent
+		emitter    *csibroker.CloudEventEmitter
+		process    ifrit.Process
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-cloud-events")
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
+		statusCode = http.StatusAccepted
+		received = make(chan csibroker.CloudEvent, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/cloudevents+json"))
+			var event csibroker.CloudEvent
+			Expect(json.NewDecoder(r.Body).Decode(&event)).To(Succeed())
+			received <- event
+			w.WriteHeader(statusCode)
+		}))
+		emitter = csibroker.NewCloudEventEmitter(logger, fakeClock, server.URL, 1, time.Second)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("when running", func() {
+		BeforeEach(func() {
+			process = ifrit.Invoke(emitter)
+		})
+
+		AfterEach(func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+
+		It("posts each event to the sink", func() {
+			emitter.Emit(csibroker.OperationBind, csibroker.LifecycleEventData{InstanceID: "some-instance-id", BindingID: "some-binding-id", Outcome: "succeeded"})
+
+			var event csibroker.CloudEvent
+			Eventually(received).Should(Receive(&event))
+			Expect(event.SpecVersion).To(Equal("1.0"))
+			Expect(event.ID).NotTo(BeEmpty())
+			Expect(event.Type).To(Equal("org.cloudfoundry.csibroker.bind.succeeded"))
+			Expect(event.Time).To(BeTemporally("==", fakeClock.Now()))
+			Expect(event.Data.BindingID).To(Equal("some-binding-id"))
+		})
+
+		Context("when the sink fails", func() {
+			BeforeEach(func() {
+				statusCode = http.StatusInternalServerError
+			})
+
+			It("logs the failure and carries on", func() {
+				emitter.Emit(csibroker.OperationProvision, csibroker.LifecycleEventData{Outcome: "failed"})
+				Eventually(received).Should(Receive())
+				Eventually(logger.Buffer()).Should(gbytes.Say("delivery-failed"))
+
+				emitter.Emit(csibroker.OperationProvision, csibroker.LifecycleEventData{Outcome: "succeeded"})
+				Eventually(received).Should(Receive())
+			})
+		})
+	})
+
+	Context("when the buffer is full", func() {
+		It("drops the event without blocking", func() {
+			emitter.Emit(csibroker.OperationProvision, csibroker.LifecycleEventData{Outcome: "succeeded"})
+			emitter.Emit(csibroker.OperationProvision, csibroker.LifecycleEventData{Outcome: "succeeded"})
+			Expect(logger.Buffer()).To(gbytes.Say("event-dropped"))
+		})
+	})
+})
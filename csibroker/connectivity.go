@@ -0,0 +1,43 @@
+package csibroker
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type ConnectivityReport struct {
+	// Reachable holds the names of the services whose plugins answered.
+	Reachable   []string        `json:"reachable"`
+	Unreachable []ServiceHealth `json:"unreachable"`
+}
+
+func (r ConnectivityReport) AllReachable() bool {
+	return len(r.Unreachable) == 0
+}
+
+// ValidateConnectivity probes every service's CSI plugin, giving each
+// probeTimeout to answer, so that a wrong connection_address shows at
+// startup rather than on the first provision.
+func ValidateConnectivity(ctx context.Context, logger lager.Logger, servicesRegistry ServicesRegistry, probeTimeout time.Duration) ConnectivityReport {
+	logger = logger.Session("validate-connectivity")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	report := ConnectivityReport{Reachable: []string{}, Unreachable: []ServiceHealth{}}
+	for _, service := range servicesRegistry.BrokerServices() {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		health := probeService(probeCtx, servicesRegistry, service.ID, service.Name)
+		cancel()
+
+		if health.Reachable {
+			report.Reachable = append(report.Reachable, service.Name)
+		} else {
+			report.Unreachable = append(report.Unreachable, health)
+		}
+	}
+
+	logger.Info("connectivity-report", lager.Data{"reachable": report.Reachable, "unreachable": report.Unreachable})
+	return report
+}
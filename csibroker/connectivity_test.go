@@ -0,0 +1,68 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/csishim/csi_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateConnectivity", func() {
+	var (
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		reachableClient      *csi_fake.FakeIdentityClient
+		unreachableClient    *csi_fake.FakeIdentityClient
+		report               csibroker.ConnectivityReport
+	)
+
+	BeforeEach(func() {
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		reachableClient = &csi_fake.FakeIdentityClient{}
+		unreachableClient = &csi_fake.FakeIdentityClient{}
+		unreachableClient.ProbeReturns(nil, errors.New("connection refused"))
+
+		fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{
+			{ID: "good-service-id", Name: "good-service"},
+			{ID: "bad-service-id", Name: "bad-service"},
+			{ID: "unknown-service-id", Name: "unknown-service"},
+		})
+		fakeServicesRegistry.IdentityClientStub = func(serviceID string) (csi.IdentityClient, error) {
+			switch serviceID {
+			case "good-service-id":
+				return reachableClient, nil
+			case "bad-service-id":
+				return unreachableClient, nil
+			}
+			return nil, errors.New("dial badness")
+		}
+	})
+
+	JustBeforeEach(func() {
+		report = csibroker.ValidateConnectivity(context.Background(), lagertest.NewTestLogger("test-connectivity"), fakeServicesRegistry, time.Second)
+	})
+
+	It("reports which services answered a probe", func() {
+		Expect(report.AllReachable()).To(BeFalse())
+		Expect(report.Reachable).To(Equal([]string{"good-service"}))
+		Expect(report.Unreachable).To(Equal([]csibroker.ServiceHealth{
+			{ServiceID: "bad-service-id", ServiceName: "bad-service", Error: "connection refused"},
+			{ServiceID: "unknown-service-id", ServiceName: "unknown-service", Error: "dial badness"},
+		}))
+	})
+
+	It("bounds each probe by the probe timeout", func() {
+		ctx, _, _ := reachableClient.ProbeArgsForCall(0)
+		deadline, ok := ctx.Deadline()
+		Expect(ok).To(BeTrue())
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Second), time.Second))
+	})
+})
@@ -0,0 +1,89 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const volumeContentSourceKey = "volume_content_source"
+
+var errAmbiguousContentSource = errors.New("volume_content_source must name either a snapshot or a volume, not both")
+
+type ErrContentSourceNotFound struct {
+	Type string
+	ID   string
+}
+
+func (e ErrContentSourceNotFound) Error() string {
+	return fmt.Sprintf("volume_content_source %s %q does not exist", e.Type, e.ID)
+}
+
+// checkContentSource rejects a raw CreateVolumeRequest whose content source
+// names both a snapshot and a volume. It has to look at the raw JSON since
+// only one of the two survives decoding.
+func checkContentSource(fields map[string]json.RawMessage) error {
+	raw, ok := fields[volumeContentSourceKey]
+	if !ok {
+		return nil
+	}
+
+	var source map[string]json.RawMessage
+	if json.Unmarshal(raw, &source) != nil {
+		return nil
+	}
+	if _, ok := source["snapshot"]; !ok {
+		return nil
+	}
+	if _, ok := source["volume"]; !ok {
+		return nil
+	}
+	return errAmbiguousContentSource
+}
+
+// validateContentSource asks the driver whether the snapshot or volume a
+// request is to be created from exists: ListSnapshots looks up snapshots and
+// ValidateVolumeCapabilities volumes. Drivers that implement neither call
+// are left to report a missing source themselves.
+func validateContentSource(ctx context.Context, logger lager.Logger, controllerClient csi.ControllerClient, request *csi.CreateVolumeRequest) error {
+	source := request.GetVolumeContentSource()
+
+	if snapshotID := source.GetSnapshot().GetSnapshotId(); snapshotID != "" {
+		response, err := controllerClient.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+		if status.Code(err) == codes.Unimplemented {
+			logger.Info("content-source-unchecked", lager.Data{"snapshotID": snapshotID})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(response.GetEntries()) == 0 {
+			return ErrContentSourceNotFound{Type: "snapshot", ID: snapshotID}
+		}
+	}
+
+	if volumeID := source.GetVolume().GetVolumeId(); volumeID != "" {
+		_, err := controllerClient.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           volumeID,
+			VolumeCapabilities: request.GetVolumeCapabilities(),
+		})
+		if status.Code(err) == codes.Unimplemented {
+			logger.Info("content-source-unchecked", lager.Data{"volumeID": volumeID})
+			return nil
+		}
+		if isNotFound(err) {
+			return ErrContentSourceNotFound{Type: "volume", ID: volumeID}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package csibroker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CSIVersion is the version of the CSI spec the broker is built against.
+// Drivers of any later 1.x version understand its requests, since newer
+// minor versions only add optional fields and RPCs.
+const CSIVersion = "1.0.0"
+
+var csiVersionPattern = regexp.MustCompile(`^v?([0-9]+)\.([0-9]+)(?:\.[0-9]+)?$`)
+
+type ErrCSIVersionMismatch struct {
+	ServiceID     string
+	DriverVersion string
+}
+
+func (e ErrCSIVersionMismatch) Error() string {
+	driverVersion := "an older CSI version"
+	if e.DriverVersion != "" {
+		driverVersion = "CSI " + e.DriverVersion
+	}
+	return fmt.Sprintf("driver for service %s does not serve CSI %s, the broker's version; it appears to speak %s", e.ServiceID, CSIVersion, driverVersion)
+}
+
+func csiMajorVersion(version string) (int, bool) {
+	match := csiVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return 0, false
+	}
+	major, err := strconv.Atoi(match[1])
+	return major, err == nil
+}
+
+// checkCSIVersion turns a probe rejected as unimplemented, which is how a
+// driver without the v1 identity service answers, into an
+// ErrCSIVersionMismatch. Once the probe succeeds it logs the plugin info and
+// warns if the service declares a CSI version the broker does not speak.
+func (b *Broker) checkCSIVersion(ctx context.Context, identityClient csi.IdentityClient, service Service, serviceID string, probeErr error) error {
+	logger := b.logger.Session("check-csi-version", lager.Data{"serviceID": serviceID, "brokerCSIVersion": CSIVersion, "serviceCSIVersion": service.CSIVersion})
+
+	if status.Code(probeErr) == codes.Unimplemented {
+		err := ErrCSIVersionMismatch{ServiceID: serviceID, DriverVersion: service.CSIVersion}
+		logger.Error("csi-version-mismatch", err)
+		return err
+	}
+	if probeErr != nil {
+		return probeErr
+	}
+
+	if major, ok := csiMajorVersion(service.CSIVersion); ok && major != 1 {
+		logger.Info("csi-version-mismatch")
+	}
+
+	pluginInfo, err := identityClient.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		logger.Info("plugin-info-unavailable", lager.Data{"error": err.Error()})
+		return nil
+	}
+	logger.Info("plugin-info", lager.Data{"name": pluginInfo.GetName(), "vendorVersion": pluginInfo.GetVendorVersion(), "manifest": pluginInfo.GetManifest()})
+
+	return nil
+}
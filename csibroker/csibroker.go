@@ -5,31 +5,49 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"path"
+	"strconv"
+	"strings"
 
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/service-broker-store/brokerstore"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/protobuf/jsonpb"
 	"github.com/pivotal-cf/brokerapi"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	PermissionVolumeMount = brokerapi.RequiredPermission("volume_mount")
 	DefaultContainerPath  = "/var/vcap/data"
+	DefaultProbeTimeout   = 5 * time.Second
+
+	DeviceTypeShared    = "shared"
+	DeviceTypeDedicated = "dedicated"
+
+	firstProbeRetryBackoff   = 500 * time.Millisecond
+	bindInstancePollInterval = 100 * time.Millisecond
 )
 
 var ErrEmptySpecFile = errors.New("At least one service must be provided in specfile")
 
 type ErrInvalidService struct {
 	Index int
+	// Reason, when set, says what is wrong with the service.
+	Reason string
 }
 
 func (e ErrInvalidService) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("Invalid service in specfile at index %d: %s", e.Index, e.Reason)
+	}
 	return fmt.Sprintf("Invalid service in specfile at index %d", e.Index)
 }
 
@@ -41,14 +59,220 @@ func (e ErrInvalidSpecFile) Error() string {
 	return fmt.Sprintf("Invalid specfile %s", e.err.Error())
 }
 
+type ErrDriverNotReady struct {
+	ServiceID string
+	Timeout   time.Duration
+}
+
+func (e ErrDriverNotReady) Error() string {
+	return fmt.Sprintf("driver not ready: service %s did not answer a probe within %s", e.ServiceID, e.Timeout)
+}
+
+type ErrInvalidMountPath struct {
+	Path   string
+	Reason string
+}
+
+func (e ErrInvalidMountPath) Error() string {
+	return fmt.Sprintf("mount path %q %s", e.Path, e.Reason)
+}
+
+type ErrRequestedIDMismatch struct {
+	Requested string
+	Actual    string
+}
+
+func (e ErrRequestedIDMismatch) Error() string {
+	return fmt.Sprintf("driver created volume %q but %q was requested", e.Actual, e.Requested)
+}
+
+type ErrMaxBindingsReached struct {
+	InstanceID  string
+	MaxBindings int
+}
+
+func (e ErrMaxBindingsReached) Error() string {
+	return fmt.Sprintf("instance %s already has the maximum of %d bindings", e.InstanceID, e.MaxBindings)
+}
+
+// ErrEmptyVolumeID reports an instance whose stored volume ID is empty, as
+// left behind by a corrupted store or a provision that failed part way.
+type ErrEmptyVolumeID struct {
+	InstanceID string
+}
+
+func (e ErrEmptyVolumeID) Error() string {
+	return fmt.Sprintf("instance %s has no stored volume ID, so there is no volume to delete", e.InstanceID)
+}
+
 type ServiceFingerPrint struct {
 	Name   string
 	Volume *csi.Volume
+	// SnapshotID is the snapshot the volume was provisioned from, if any.
+	// Such snapshots are the caller's and are never deleted by the broker.
+	SnapshotID string
+	// MaintenanceVersion is the plan maintenance version the instance was
+	// provisioned or last upgraded at.
+	MaintenanceVersion string
+	// AdditionalVolumes are further volumes owned by the instance. Each is
+	// mounted next to Volume on bind.
+	AdditionalVolumes []*csi.Volume `json:",omitempty"`
+	// BindingMounts records, per binding ID, the volume mounts handed to the
+	// platform on bind, with secret attributes redacted.
+	BindingMounts map[string][]brokerapi.VolumeMount `json:",omitempty"`
+	// DriverName and ConnAddr record the service's driver at provision, so
+	// that a specfile pointing the instance at another driver is noticed.
+	DriverName string `json:",omitempty"`
+	ConnAddr   string `json:",omitempty"`
+	// Labels are the caller's labels from the provision parameters.
+	Labels map[string]string `json:",omitempty"`
+	// AccessModes are the access modes the volumes were requested with,
+	// keyed by volume ID, e.g. "SINGLE_NODE_WRITER".
+	AccessModes map[string]string `json:",omitempty"`
+}
+
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
 }
 
 type Service struct {
 	DriverName string `json:"driver_name"`
 	ConnAddr   string `json:"connection_address"`
+	// NodeConnAddr is the address of the node plugin's identity service in
+	// deployments that run it apart from the controller plugin. When set,
+	// the node plugin is probed alongside the controller.
+	NodeConnAddr string `json:"node_connection_address,omitempty"`
+
+	// PollInterval is a hint, surfaced in LastOperation descriptions, of how
+	// often the platform should poll operations on this service.
+	PollInterval Duration `json:"poll_interval,omitempty"`
+	// ExpectedOperationDuration is used to estimate when an operation on this
+	// service will complete.
+	ExpectedOperationDuration Duration `json:"expected_operation_duration,omitempty"`
+	// ProvisionDefaults is a CreateVolumeRequest used when a provision carries
+	// no parameters. Without it such provisions are rejected.
+	ProvisionDefaults json.RawMessage `json:"provision_defaults,omitempty"`
+	// MaintenanceInfo holds the current maintenance version of each plan,
+	// keyed by plan ID. Provision records it on the instance.
+	MaintenanceInfo map[string]MaintenanceInfo `json:"maintenance_info,omitempty"`
+	// RequestedIDParameter is the driver parameter that a provision's
+	// "requested_id" is copied into. Drivers that derive volume IDs from
+	// their parameters can use it to reproduce existing volume IDs.
+	RequestedIDParameter string `json:"requested_id_parameter,omitempty"`
+	// EnforceRequestedID fails a provision whose created volume does not
+	// carry the requested ID.
+	EnforceRequestedID bool `json:"enforce_requested_id,omitempty"`
+	// PlanToStorageClass maps each plan ID to the storage class its volumes
+	// are created with, passed to the driver as StorageClassParameter. When
+	// set it must map every plan.
+	PlanToStorageClass map[string]string `json:"plan_to_storage_class,omitempty"`
+	// StorageClassParameter defaults to DefaultStorageClassParameter.
+	StorageClassParameter string `json:"storage_class_parameter,omitempty"`
+	// DefaultUID and DefaultGID set the mount ownership of binds whose
+	// callers give none. Either a string or a number is accepted.
+	DefaultUID interface{} `json:"default_uid,omitempty"`
+	DefaultGID interface{} `json:"default_gid,omitempty"`
+	// DefaultAccessType ("mount" or "block") is applied to requested volume
+	// capabilities that name no access type.
+	DefaultAccessType string `json:"default_access_type,omitempty"`
+	// SupportedAccessTypes lists the access types the driver can serve.
+	// Capabilities asking for any other type are rejected. Empty allows all.
+	SupportedAccessTypes []string `json:"supported_access_types,omitempty"`
+	// DefaultVolumeCapabilities is a JSON array of CSI VolumeCapabilities
+	// used for requested volumes that give none.
+	DefaultVolumeCapabilities json.RawMessage `json:"default_volume_capabilities,omitempty"`
+	// DefaultAccessMode, e.g. "SINGLE_NODE_WRITER", is applied to requested
+	// volume capabilities that give no access mode.
+	DefaultAccessMode string `json:"default_access_mode,omitempty"`
+	// SupportedOperations switches individual broker operations off for the
+	// service, e.g. {"update": false}.
+	SupportedOperations map[Operation]bool `json:"supported_operations,omitempty"`
+	// OriginatingIdentityParameter, when set, forwards the JSON identity of
+	// the platform user behind a request to the driver under this key: as a
+	// CreateVolume parameter on provision and a DeleteVolume secret on
+	// deprovision.
+	OriginatingIdentityParameter string `json:"originating_identity_parameter,omitempty"`
+	// ProbeRetryOnFirstFailure is how many times a failed probe is retried,
+	// with exponential backoff, until the driver has first been found ready.
+	ProbeRetryOnFirstFailure int `json:"probe_retry_on_first_failure,omitempty"`
+	// AllowServiceKeys permits binds without an app, i.e. service keys. Their
+	// credentials carry the mounts, with secrets redacted, for inspection.
+	AllowServiceKeys bool `json:"allow_service_keys,omitempty"`
+	// DeviceType fixes the device_type of the volume mounts returned on
+	// bind. Unless set, it follows each volume's access mode: "dedicated"
+	// for single-node modes, "shared" for multi-node or unrecorded ones.
+	DeviceType string `json:"device_type,omitempty"`
+	// DefaultReadonly mounts binds read-only unless the caller passes
+	// "readonly": false.
+	DefaultReadonly bool `json:"default_readonly,omitempty"`
+	// AuthToken, when set, sends a bearer token with every CSI call to the
+	// service's driver.
+	AuthToken *AuthToken `json:"auth_token,omitempty"`
+	// GRPC, when set, overrides the broker-wide gRPC settings for dialling
+	// the service's driver.
+	GRPC *GRPCConfig `json:"grpc,omitempty"`
+	// DashboardURLTemplate, when set, is rendered with DashboardURLData and
+	// returned to the platform as the dashboard URL of each instance.
+	DashboardURLTemplate string `json:"dashboard_url_template,omitempty"`
+	// VolumeName, when set, checks the names of created volumes against the
+	// backend's naming rules, optionally rewriting them to fit.
+	VolumeName *VolumeNameRules `json:"volume_name,omitempty"`
+	// WaitForReady, when set, holds back the response to a provision until
+	// the driver confirms the created volumes or this long has passed.
+	// WaitForReadyInterval is the time between checks.
+	WaitForReady         Duration `json:"wait_for_ready,omitempty"`
+	WaitForReadyInterval Duration `json:"wait_for_ready_interval,omitempty"`
+	// CSIVersion is the CSI spec version the driver implements, e.g. "1.2".
+	// It only informs the checks made when the driver is first probed.
+	CSIVersion string `json:"csi_version,omitempty"`
+	// Order places the service in the catalog: services are listed by
+	// ascending order, then those without one in specfile order. Plans
+	// take an "order" of their own in the same way.
+	Order *int `json:"order,omitempty"`
+	// AllowedMountConfigKeys limits the keys a bind's "mount_config" may
+	// add to the mount config handed to the driver. Empty allows any key
+	// the broker does not set itself.
+	AllowedMountConfigKeys []string `json:"allowed_mount_config_keys,omitempty"`
+	// BindContextAllow limits the volume context keys passed to the node
+	// plugin in a binding's mount config to those it lists, and
+	// BindContextDeny withholds those it lists. Without either the whole
+	// volume context is passed.
+	BindContextAllow []string `json:"bind_context_allow,omitempty"`
+	BindContextDeny  []string `json:"bind_context_deny,omitempty"`
+	// OrgQuota, when set, limits the instances and capacity of the service
+	// each org may provision.
+	OrgQuota *OrgQuota `json:"org_quota,omitempty"`
+	// MaxBindings is the most bindings, service keys included, an instance
+	// of the service may have at once. Zero means no limit.
+	MaxBindings int `json:"max_bindings,omitempty"`
+	// AllowBindingRotation permits operators to rotate the service's
+	// bindings through the admin API.
+	AllowBindingRotation bool `json:"allow_binding_rotation,omitempty"`
+	// DefaultPlanID is the plan used for provisions that name none. Without
+	// it such provisions are rejected.
+	DefaultPlanID string `json:"default_plan_id,omitempty"`
+	// PlanCapacities bounds the volume size on each plan, keyed by plan ID.
+	PlanCapacities map[string]PlanCapacity `json:"plan_capacities,omitempty"`
+	// RequiredParameters are CSI parameters every provisioned volume must
+	// carry with a non-empty value, however they were set.
+	RequiredParameters []string `json:"required_parameters,omitempty"`
+	// EnforceBindSchema rejects binds whose parameters do not match the
+	// binding schema the catalog advertises for the plan. Plans without one
+	// accept any parameters.
+	EnforceBindSchema bool `json:"enforce_bind_schema,omitempty"`
+	// LabelParameters forwards instance labels to the driver, mapping a label
+	// key to the CreateVolume parameter it is set as. Other labels are only
+	// recorded by the broker.
+	LabelParameters map[string]string `json:"label_parameters,omitempty"`
+	// ParameterTemplates default CreateVolume parameters to Go templates
+	// rendered with ParameterTemplateData. Parameters the caller sets are
+	// kept.
+	ParameterTemplates map[string]string `json:"parameter_templates,omitempty"`
+	// CheckVolumeOnBind asks the driver on every bind whether the instance's
+	// volumes still exist, failing binds to volumes deleted on the backend at
+	// the cost of a driver call per bind.
+	CheckVolumeOnBind bool `json:"check_volume_on_bind,omitempty"`
 
 	brokerapi.Service
 }
@@ -65,7 +289,49 @@ type Broker struct {
 	clock            clock.Clock
 	servicesRegistry ServicesRegistry
 	store            brokerstore.Store
-	controllerProbed bool
+	parameterSets    *ParameterSets
+	operations       *operations
+
+	reconcilePageSize int32
+	probeTimeout      time.Duration
+	allowedMountPaths []string
+	cfMetadataLabels  *cfMetadataLabels
+
+	parameterDeprecations ParameterDeprecations
+
+	restoreRetries int
+	restoreBackoff time.Duration
+	// restored is false while the state could not be restored from the store;
+	// guarded by mutex.
+	restored bool
+
+	parameterFormat  string
+	orgQuota         int
+	provisionWebhook *ProvisionWebhook
+	bindInstanceWait time.Duration
+	redactKeys       map[string]bool
+
+	deprovisionWebhook *DeprovisionWebhook
+	cloudEvents        *CloudEventEmitter
+	probeBreaker       *probeBreaker
+	syncBudget         time.Duration
+
+	preProvisionWebhook         *PreProvisionWebhook
+	allowDeprovisionEmptyVolume bool
+	rpcTimeouts                 RPCTimeouts
+	adoptExistingVolumes        bool
+
+	// reconcileSummaries holds the summary of the most recent reconcile.
+	reconcileSummaries reconcileSummaries
+
+	// instanceLocks serializes operations on the same instance; mutex only
+	// guards the store.
+	instanceLocks *instanceLocks
+
+	// probed holds, per service, the connection generation whose driver has
+	// been probed, so that a re-dialled driver is probed again.
+	probeMutex sync.Mutex
+	probed     map[string]int
 }
 
 func New(
@@ -74,6 +340,7 @@ func New(
 	clock clock.Clock,
 	store brokerstore.Store,
 	servicesRegistry ServicesRegistry,
+	opts ...Option,
 ) (*Broker, error) {
 	logger = logger.Session("new-csi-broker")
 	logger.Info("start")
@@ -86,14 +353,87 @@ func New(
 		clock:            clock,
 		store:            store,
 		servicesRegistry: servicesRegistry,
-		controllerProbed: false,
+		probed:           map[string]int{},
+		operations:       newOperations(clock),
+		instanceLocks:    newInstanceLocks(),
+		probeTimeout:     DefaultProbeTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(&theBroker)
 	}
 
-	err := store.Restore(logger)
+	err := theBroker.restore(logger)
+	theBroker.restored = err == nil
 
 	return &theBroker, err
 }
 
+// restore reads the broker's state, retrying with doubling backoff so that
+// a database that is still starting up does not fail the broker.
+func (b *Broker) restore(logger lager.Logger) error {
+	backoff := b.restoreBackoff
+	for attempt := 0; ; attempt++ {
+		err := b.store.Restore(logger)
+		if err == nil || attempt >= b.restoreRetries {
+			return err
+		}
+
+		logger.Error("restore-failed-retrying", err, lager.Data{"attempt": attempt + 1, "retries": b.restoreRetries, "backoff": backoff.String()})
+		b.clock.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// ErrStateNotRestored refuses writes while the broker runs without the state
+// it failed to restore at startup.
+var ErrStateNotRestored = errors.New("broker state has not been restored from the store yet")
+
+// ensureRestored retries a restore that failed at startup. Until one
+// succeeds, operations that save the store are refused: saving the empty
+// state would overwrite every stored instance.
+func (b *Broker) ensureRestored(logger lager.Logger) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.restored {
+		return nil
+	}
+	err := b.store.Restore(logger)
+	if err != nil {
+		logger.Error("restore-failed", err)
+		return brokerapi.NewFailureResponse(ErrStateNotRestored, http.StatusServiceUnavailable, "state-not-restored")
+	}
+	logger.Info("restored")
+	b.restored = true
+	return nil
+}
+
+// waitForInstance polls for up to bindInstanceWait for an instance that is
+// not stored yet, for a bind the platform sends just before the provision
+// finishes storing the instance. It does not hold the lock while it waits.
+func (b *Broker) waitForInstance(logger lager.Logger, instanceID string) {
+	deadline := b.clock.Now().Add(b.bindInstanceWait)
+	for {
+		b.mutex.Lock()
+		_, err := b.store.RetrieveInstanceDetails(instanceID)
+		b.mutex.Unlock()
+		if err == nil {
+			return
+		}
+
+		remaining := deadline.Sub(b.clock.Now())
+		if remaining <= 0 {
+			return
+		}
+		if remaining > bindInstancePollInterval {
+			remaining = bindInstancePollInterval
+		}
+		logger.Info("waiting-for-instance", lager.Data{"instanceID": instanceID})
+		b.clock.Sleep(remaining)
+	}
+}
+
 func (b *Broker) Services(_ context.Context) []brokerapi.Service {
 	logger := b.logger.Session("services")
 	logger.Info("start")
@@ -103,40 +443,302 @@ func (b *Broker) Services(_ context.Context) []brokerapi.Service {
 }
 
 func (b *Broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (_ brokerapi.ProvisionedServiceSpec, e error) {
-	err := b.probeController(details.ServiceID)
+	context, span := startSpan(context, OperationProvision, attribute.String("instance_id", instanceID), attribute.String("service_id", details.ServiceID))
+	defer func() { endSpan(span, e) }()
+	defer func() {
+		b.emitLifecycleEvent(OperationProvision, LifecycleEventData{
+			InstanceID:       instanceID,
+			ServiceID:        details.ServiceID,
+			PlanID:           details.PlanID,
+			OrganizationGUID: details.OrganizationGUID,
+			SpaceGUID:        details.SpaceGUID,
+		}, e)
+	}()
+
+	err := b.checkOperationSupported(details.ServiceID, OperationProvision)
 	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
-	logger := b.logger.Session("provision").WithData(lager.Data{"instanceID": instanceID, "details": details})
+	err = b.ensureRestored(b.logger.Session("provision"))
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	err = b.checkSyncBudget(details.ServiceID, asyncAllowed)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	err = b.probeController(context, details.ServiceID)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	logger := withOriginatingIdentity(b.logger.Session("provision"), context).WithData(lager.Data{"instanceID": instanceID, "details": b.redactProvisionDetails(details)})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	var configuration csi.CreateVolumeRequest
+	unlock := b.instanceLocks.lock(instanceID)
+	defer unlock()
+
+	b.startOperation(logger, instanceID, "provision", details.ServiceID)
+	defer func() {
+		b.operations.finish(instanceID, e)
+	}()
+
+	notices, err := b.checkDeprecatedParameters(logger, OperationProvision, details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	b.operations.addNotices(instanceID, notices)
+
+	service, err := b.servicesRegistry.Service(details.ServiceID)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	if details.PlanID == "" {
+		if service.DefaultPlanID == "" {
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters("plan_id is required")
+		}
+		logger.Info("provision-using-default-plan", lager.Data{"planID": service.DefaultPlanID})
+		details.PlanID = service.DefaultPlanID
+	}
 
-	logger.Debug("provision-raw-parameters", lager.Data{"RawParameters": details.RawParameters})
-	err = jsonpb.UnmarshalString(string(details.RawParameters), &configuration)
+	var (
+		configuration *csi.CreateVolumeRequest
+		brokerParams  provisionParameters
+	)
+
+	logger.Debug("provision-raw-parameters", lager.Data{"RawParameters": b.redactParameters(details.RawParameters)})
+	if hasNoParameters(details.RawParameters) && len(service.ProvisionDefaults) > 0 {
+		logger.Info("provision-using-service-defaults")
+		configuration, err = defaultCreateVolumeRequest(service.ProvisionDefaults, instanceID)
+	} else {
+		configuration, brokerParams, err = parseProvisionParameters(details.RawParameters, b.parameterFormat)
+	}
+	if _, ok := err.(ErrInvalidParameterFormat); ok || err == errAmbiguousContentSource {
+		logger.Error("provision-raw-parameters-decode-error", err)
+		return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+	}
 	if err != nil {
 		logger.Error("provision-raw-parameters-decode-error", err)
 		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrRawParamsInvalid
 	}
+
+	if brokerParams.ParameterSet != "" {
+		for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+			err = b.applyParameterSet(request, brokerParams.ParameterSet)
+			if err != nil {
+				logger.Error("provision-parameter-set-error", err)
+				return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+			}
+		}
+	}
+	if brokerParams.RequestedID != "" {
+		if service.RequestedIDParameter == "" {
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters("parameter 'requested_id' is not supported by this service")
+		}
+		if configuration.Parameters == nil {
+			configuration.Parameters = map[string]string{}
+		}
+		configuration.Parameters[service.RequestedIDParameter] = brokerParams.RequestedID
+	}
+	if len(brokerParams.Labels) > 0 {
+		err = validateLabels(brokerParams.Labels)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+		applyLabelParameters(service, brokerParams.Labels, append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...))
+	}
+	applyStorageClass(service, details.PlanID, append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...))
+	if brokerParams.Capacity != "" {
+		err = applyCapacity(configuration, brokerParams.Capacity)
+		if err != nil {
+			logger.Error("provision-capacity-error", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+	}
+	if identity, ok := OriginatingIdentityFromContext(context); ok && service.OriginatingIdentityParameter != "" {
+		if configuration.Parameters == nil {
+			configuration.Parameters = map[string]string{}
+		}
+		configuration.Parameters[service.OriginatingIdentityParameter] = identity.encodedValue()
+	}
 	if configuration.Name == "" {
-		return brokerapi.ProvisionedServiceSpec{}, errors.New("config requires a \"name\"")
+		return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters("parameter 'name' is required")
+	}
+
+	if len(service.DefaultVolumeCapabilities) > 0 {
+		for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+			if len(request.GetVolumeCapabilities()) > 0 {
+				continue
+			}
+			// decoded afresh for every request since later steps modify them
+			request.VolumeCapabilities, err = parseVolumeCapabilities(service.DefaultVolumeCapabilities)
+			if err != nil {
+				return brokerapi.ProvisionedServiceSpec{}, err
+			}
+		}
 	}
 
 	if len(configuration.GetVolumeCapabilities()) == 0 {
-		return brokerapi.ProvisionedServiceSpec{}, errors.New("config requires \"volume_capabilities\"")
+		return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters("parameter 'volume_capabilities' is required")
+	}
+
+	for i, request := range brokerParams.AdditionalVolumes {
+		if request.Name == "" || len(request.GetVolumeCapabilities()) == 0 {
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(fmt.Sprintf("additional volume %d requires parameters 'name' and 'volume_capabilities'", i))
+		}
+	}
+
+	if len(service.ParameterTemplates) > 0 {
+		data := ParameterTemplateData{
+			InstanceID: instanceID,
+			ServiceID:  details.ServiceID,
+			PlanID:     details.PlanID,
+			OrgGUID:    details.OrganizationGUID,
+			SpaceGUID:  details.SpaceGUID,
+		}
+		for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+			err = applyParameterTemplates(service.ParameterTemplates, request, data)
+			if err != nil {
+				logger.Error("provision-parameter-template-error", err)
+				return brokerapi.ProvisionedServiceSpec{}, err
+			}
+		}
+	}
+
+	if service.VolumeName != nil {
+		for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+			request.Name, err = service.VolumeName.apply(request.Name)
+			if err != nil {
+				logger.Error("provision-volume-name-error", err)
+				return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+			}
+		}
+	}
+
+	for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+		err = applyAccessTypes(service, request.GetVolumeCapabilities())
+		if err != nil {
+			logger.Error("provision-access-type-error", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+
+		err = applyAccessModes(service, request.GetVolumeCapabilities())
+		if err != nil {
+			logger.Error("provision-access-mode-error", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+
+		err = applyPlanCapacity(service, details.PlanID, request)
+		if err != nil {
+			logger.Error("provision-plan-capacity-error", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+
+		err = validateCapacityRange(request.GetCapacityRange())
+		if err != nil {
+			logger.Error("provision-capacity-range-error", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+	}
+
+	if b.cfMetadataLabels != nil {
+		for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+			err = b.cfMetadataLabels.apply(request, instanceID, details)
+			if err != nil {
+				logger.Error("provision-cf-metadata-labels-error", err)
+				return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+			}
+		}
+	}
+
+	for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+		if missing := missingParameters(service, request); len(missing) > 0 {
+			logger.Error("provision-required-parameters-missing", nil, lager.Data{"volume": request.Name, "missing": missing})
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(fmt.Sprintf("volume %q is missing required parameters: %s", request.Name, strings.Join(missing, ", ")))
+		}
+	}
+
+	err = b.checkOrgQuota(logger, service, details, append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...))
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	if b.preProvisionWebhook != nil {
+		err = b.preProvisionWebhook.check(context, logger, instanceID, details, append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...))
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
 	}
 
 	controllerClient, err := b.servicesRegistry.ControllerClient(details.ServiceID)
 	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
-	response, err := controllerClient.CreateVolume(context, &configuration)
+
+	for _, request := range append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...) {
+		err = validateContentSource(context, logger, controllerClient, request)
+		if _, ok := err.(ErrContentSourceNotFound); ok {
+			logger.Error("provision-content-source-not-found", err)
+			return brokerapi.ProvisionedServiceSpec{}, errInvalidProvisionParameters(err.Error())
+		}
+		if err != nil {
+			logger.Error("provision-content-source-check-failed", err)
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
+
+	adoptedVolumes := map[string]bool{}
+	volInfo, adopted, err := b.createVolume(context, logger, controllerClient, configuration)
 	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
+	if adopted {
+		adoptedVolumes[volInfo.GetVolumeId()] = true
+	}
+
+	if brokerParams.RequestedID != "" && service.EnforceRequestedID && volInfo.GetVolumeId() != brokerParams.RequestedID {
+		err = ErrRequestedIDMismatch{Requested: brokerParams.RequestedID, Actual: volInfo.GetVolumeId()}
+		logger.Error("provision-requested-id-mismatch", err)
+		b.rollbackVolumes(context, logger, controllerClient, withoutVolumes([]*csi.Volume{volInfo}, adoptedVolumes))
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	var additionalVolumes []*csi.Volume
+	for _, request := range brokerParams.AdditionalVolumes {
+		volume, adopted, err := b.createVolume(context, logger, controllerClient, request)
+		if adopted {
+			adoptedVolumes[volume.GetVolumeId()] = true
+		}
+		if err != nil {
+			logger.Error("provision-additional-volume-failed", err, lager.Data{"name": request.Name})
+			b.rollbackVolumes(context, logger, controllerClient, withoutVolumes(append(additionalVolumes, volInfo), adoptedVolumes))
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		additionalVolumes = append(additionalVolumes, volume)
+	}
 
-	volInfo := response.GetVolume()
+	if service.WaitForReady > 0 {
+		requests := append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...)
+		volumes := append([]*csi.Volume{volInfo}, additionalVolumes...)
+		for i, volume := range volumes {
+			err = b.waitForVolumeReady(context, logger, controllerClient, service, requests[i], volume)
+			if err != nil {
+				logger.Error("provision-volume-not-ready", err)
+				b.rollbackVolumes(context, logger, controllerClient, withoutVolumes(volumes, adoptedVolumes))
+				return brokerapi.ProvisionedServiceSpec{}, err
+			}
+		}
+	}
+
+	if b.provisionWebhook != nil {
+		volumes := append([]*csi.Volume{volInfo}, additionalVolumes...)
+		err = b.provisionWebhook.call(context, logger, instanceID, details, configuration, volumes)
+		if err != nil {
+			b.rollbackVolumes(context, logger, controllerClient, withoutVolumes(volumes, adoptedVolumes))
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
 
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
@@ -147,9 +749,27 @@ func (b *Broker) Provision(context context.Context, instanceID string, details b
 		}
 	}()
 
+	// A concurrent provision of the same instance may have stored its
+	// volumes while ours were being created.
+	if existing, err := b.store.RetrieveInstanceDetails(instanceID); err == nil {
+		redundant := redundantVolumes(existing, append([]*csi.Volume{volInfo}, additionalVolumes...))
+		if len(redundant) > 0 {
+			logger.Info("provision-instance-stored-concurrently", lager.Data{"instanceID": instanceID})
+			b.rollbackVolumes(context, logger, controllerClient, withoutVolumes(redundant, adoptedVolumes))
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		}
+	}
+
 	fingerprint := ServiceFingerPrint{
-		configuration.Name,
-		volInfo,
+		Name:               configuration.Name,
+		Volume:             volInfo,
+		SnapshotID:         configuration.GetVolumeContentSource().GetSnapshot().GetSnapshotId(),
+		MaintenanceVersion: service.MaintenanceInfo[details.PlanID].Version,
+		AdditionalVolumes:  additionalVolumes,
+		DriverName:         service.DriverName,
+		ConnAddr:           service.ConnAddr,
+		Labels:             brokerParams.Labels,
+		AccessModes:        volumeAccessModes(append([]*csi.CreateVolumeRequest{configuration}, brokerParams.AdditionalVolumes...), append([]*csi.Volume{volInfo}, additionalVolumes...)),
 	}
 	instanceDetails := brokerstore.ServiceInstance{
 		details.ServiceID,
@@ -168,18 +788,64 @@ func (b *Broker) Provision(context context.Context, instanceID string, details b
 	}
 	logger.Info("service-instance-created", lager.Data{"instanceDetails": instanceDetails})
 
-	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, nil
+	var dashboardURL string
+	if service.DashboardURLTemplate != "" {
+		dashboardURL, err = renderDashboardURL(service.DashboardURLTemplate, DashboardURLData{
+			InstanceID:       instanceID,
+			ServiceID:        details.ServiceID,
+			PlanID:           details.PlanID,
+			OrganizationGUID: details.OrganizationGUID,
+			SpaceGUID:        details.SpaceGUID,
+			Name:             configuration.Name,
+			VolumeID:         volInfo.GetVolumeId(),
+		})
+		if err != nil {
+			// the volume exists by now, so only the link is given up
+			logger.Error("render-dashboard-url-failed", err)
+		}
+	}
+
+	return brokerapi.ProvisionedServiceSpec{IsAsync: false, DashboardURL: dashboardURL, OperationData: OperationData{Operation: OperationProvision, Key: instanceID}.Encode()}, nil
 }
 
 func (b *Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (_ brokerapi.DeprovisionServiceSpec, e error) {
-	err := b.probeController(details.ServiceID)
+	context, span := startSpan(context, OperationDeprovision, attribute.String("instance_id", instanceID), attribute.String("service_id", details.ServiceID))
+	defer func() { endSpan(span, e) }()
+	event := LifecycleEventData{InstanceID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	defer func() { b.emitLifecycleEvent(OperationDeprovision, event, e) }()
+
+	err := b.checkOperationSupported(details.ServiceID, OperationDeprovision)
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	err = b.ensureRestored(b.logger.Session("deprovision"))
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	err = b.checkSyncBudget(details.ServiceID, asyncAllowed)
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	err = b.probeController(context, details.ServiceID)
 	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
-	logger := b.logger.Session("deprovision")
+	logger := withOriginatingIdentity(b.logger.Session("deprovision"), context)
 	logger.Info("start")
 	defer logger.Info("end")
 
+	unlock := b.instanceLocks.lock(instanceID)
+	defer unlock()
+
+	b.startOperation(logger, instanceID, "deprovision", details.ServiceID)
+	defer func() {
+		if e == nil {
+			b.operations.remove(instanceID)
+			return
+		}
+		b.operations.finish(instanceID, e)
+	}()
+
 	var configuration csi.DeleteVolumeRequest
 
 	if instanceID == "" {
@@ -192,12 +858,24 @@ func (b *Broker) Deprovision(context context.Context, instanceID string, details
 		return brokerapi.DeprovisionServiceSpec{}, errors.New("volume deletion requires \"service_id\"")
 	}
 
+	// read under the lock, which is not held across the driver calls below
+	b.mutex.Lock()
 	instanceDetails, err := b.store.RetrieveInstanceDetails(instanceID)
+	b.mutex.Unlock()
 	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
 	}
+	event.OrganizationGUID, event.SpaceGUID = instanceDetails.OrganizationGUID, instanceDetails.SpaceGUID
+
+	service, err := b.servicesRegistry.Service(details.ServiceID)
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
 
 	configuration.Secrets = map[string]string{}
+	if identity, ok := OriginatingIdentityFromContext(context); ok && service.OriginatingIdentityParameter != "" {
+		configuration.Secrets[service.OriginatingIdentityParameter] = identity.encodedValue()
+	}
 
 	fingerprint, err := getFingerprint(instanceDetails.ServiceFingerPrint)
 
@@ -205,16 +883,48 @@ func (b *Broker) Deprovision(context context.Context, instanceID string, details
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	configuration.VolumeId = fingerprint.Volume.VolumeId
+	configuration.VolumeId = fingerprint.Volume.GetVolumeId()
+	if configuration.VolumeId == "" {
+		logger.Info("stored-volume-id-empty", lager.Data{"instanceID": instanceID, "allowed": b.allowDeprovisionEmptyVolume})
+		if !b.allowDeprovisionEmptyVolume {
+			return brokerapi.DeprovisionServiceSpec{}, ErrEmptyVolumeID{InstanceID: instanceID}
+		}
+	}
 
 	controllerClient, err := b.servicesRegistry.ControllerClient(details.ServiceID)
 	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	_, err = controllerClient.DeleteVolume(context, &configuration)
-	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+	for _, volume := range fingerprint.AdditionalVolumes {
+		callCtx, cancel := withRPCTimeout(context, b.rpcTimeouts.deleteVolume())
+		_, err = controllerClient.DeleteVolume(callCtx, &csi.DeleteVolumeRequest{VolumeId: volume.VolumeId, Secrets: map[string]string{}})
+		cancel()
+		if err != nil && !isNotFound(err) {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+
+	// an empty volume ID names nothing to delete; only the record is removed
+	if configuration.VolumeId != "" {
+		callCtx, cancel := withRPCTimeout(context, b.rpcTimeouts.deleteVolume())
+		_, err = controllerClient.DeleteVolume(callCtx, &configuration)
+		cancel()
+		if isNotFound(err) {
+			logger.Info("volume-already-deleted", lager.Data{"volumeID": configuration.VolumeId})
+		} else if err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+
+	if b.deprovisionWebhook != nil {
+		// deferred first so that it runs once the deletion is saved and the
+		// lock released
+		defer func() {
+			if e == nil {
+				e = b.deprovisionWebhook.call(context, logger, instanceID, instanceDetails, fingerprint)
+			}
+		}()
 	}
 
 	b.mutex.Lock()
@@ -231,18 +941,57 @@ func (b *Broker) Deprovision(context context.Context, instanceID string, details
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: "deprovision"}, nil
+	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: OperationData{Operation: OperationDeprovision, Key: instanceID}.Encode()}, nil
 }
 
 func (b *Broker) Bind(context context.Context, instanceID string, bindingID string, bindDetails brokerapi.BindDetails) (_ brokerapi.Binding, e error) {
-	err := b.probeController(bindDetails.ServiceID)
+	context, span := startSpan(context, OperationBind, attribute.String("instance_id", instanceID), attribute.String("binding_id", bindingID))
+	defer func() { endSpan(span, e) }()
+	event := LifecycleEventData{InstanceID: instanceID, BindingID: bindingID, ServiceID: bindDetails.ServiceID, PlanID: bindDetails.PlanID}
+	defer func() { b.emitLifecycleEvent(OperationBind, event, e) }()
+
+	err := b.checkOperationSupported(bindDetails.ServiceID, OperationBind)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	err = b.ensureRestored(b.logger.Session("bind"))
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	err = b.probeController(context, bindDetails.ServiceID)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
-	logger := b.logger.Session("bind")
-	logger.Info("start", lager.Data{"bindingID": bindingID, "details": bindDetails})
+	logger := withOriginatingIdentity(b.logger.Session("bind"), context)
+	logger.Info("start", lager.Data{"bindingID": bindingID, "details": b.redactBindDetails(bindDetails)})
 	defer logger.Info("end")
 
+	b.startOperation(logger, bindingOperationKey(bindingID), "bind", bindDetails.ServiceID)
+	defer func() {
+		b.operations.finish(bindingOperationKey(bindingID), e)
+	}()
+
+	if b.bindInstanceWait > 0 {
+		b.waitForInstance(logger, instanceID)
+	}
+
+	// taken after waiting so that a bind cannot hold up the provision it
+	// waits for
+	unlock := b.instanceLocks.lock(instanceID)
+	defer unlock()
+
+	return b.bind(context, logger, instanceID, bindingID, bindDetails, &event)
+}
+
+// bind checks the instance's volumes where the service asks for it and
+// records the binding. Callers hold the instance lock; bind takes the store
+// lock itself.
+func (b *Broker) bind(ctx context.Context, logger lager.Logger, instanceID string, bindingID string, bindDetails brokerapi.BindDetails, event *LifecycleEventData) (_ brokerapi.Binding, e error) {
+	err := b.checkVolumesOnBind(ctx, logger, instanceID, bindDetails.ServiceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	defer func() {
@@ -257,8 +1006,15 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 	if err != nil {
 		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
 	}
+	event.OrganizationGUID, event.SpaceGUID = instanceDetails.OrganizationGUID, instanceDetails.SpaceGUID
 
-	if bindDetails.AppGUID == "" {
+	service, err := b.servicesRegistry.Service(bindDetails.ServiceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	serviceKey := bindDetails.AppGUID == ""
+	if serviceKey && !service.AllowServiceKeys {
 		return brokerapi.Binding{}, brokerapi.ErrAppGuidNotProvided
 	}
 
@@ -269,11 +1025,16 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 	}
 
 	csiVolumeId := fingerprint.Volume.VolumeId
-	csiVolumeAttributes := fingerprint.Volume.VolumeContext
+	csiVolumeAttributes := filterVolumeContext(fingerprint.Volume.VolumeContext, service)
 
 	params := make(map[string]interface{})
 
-	logger.Debug(fmt.Sprintf("bindDetails: %#v", bindDetails.RawParameters))
+	logger.Debug(fmt.Sprintf("bindDetails: %#v", b.redactParameters(bindDetails.RawParameters)))
+
+	_, err = b.checkDeprecatedParameters(logger, OperationBind, bindDetails.RawParameters)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
 
 	if bindDetails.RawParameters != nil {
 		err = json.Unmarshal(bindDetails.RawParameters, &params)
@@ -282,7 +1043,27 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 			return brokerapi.Binding{}, err
 		}
 	}
-	mode, err := evaluateMode(params)
+	if service.EnforceBindSchema {
+		if err := validateBindParameters(service, instanceDetails.PlanID, params); err != nil {
+			logger.Error("invalid-bind-parameters", err)
+			return brokerapi.Binding{}, err
+		}
+	}
+	mode, err := evaluateMode(params, service.DefaultReadonly)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	containerPath, err := evaluateContainerPath(params, instanceID, b.allowedMountPaths)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	bindingParams, err := evaluateId(params, service)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	mountConfig, err := evaluateMountConfig(params, service)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
@@ -291,6 +1072,14 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
+	if service.MaxBindings > 0 {
+		err = checkMaxBindings(instanceID, bindingID, fingerprint, service.MaxBindings)
+		if err != nil {
+			logger.Error("max-bindings-reached", err)
+			return brokerapi.Binding{}, brokerapi.NewFailureResponse(err, http.StatusForbidden, "max-bindings-reached")
+		}
+	}
+
 	logger.Info("retrieved-instance-details", lager.Data{"instanceDetails": instanceDetails})
 
 	err = b.store.CreateBindingDetails(bindingID, bindDetails)
@@ -310,32 +1099,97 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 	ret := brokerapi.Binding{
 		Credentials: struct{}{}, // if nil, cloud controller chokes on response
 		VolumeMounts: []brokerapi.VolumeMount{{
-			ContainerDir: evaluateContainerPath(params, instanceID),
+			ContainerDir: containerPath,
 			Mode:         mode,
 			Driver:       driverName,
-			DeviceType:   "shared",
+			DeviceType:   deviceTypeFor(service, fingerprint.AccessModes[csiVolumeId]),
 			Device: brokerapi.SharedDevice{
 				VolumeId: volumeId,
 				MountConfig: map[string]interface{}{
 					"id":             csiVolumeId,
 					"attributes":     csiVolumeAttributes,
-					"binding-params": evaluateId(params),
+					"binding-params": bindingParams,
 				},
 			},
 		}},
 	}
+
+	for i, volume := range fingerprint.AdditionalVolumes {
+		ret.VolumeMounts = append(ret.VolumeMounts, brokerapi.VolumeMount{
+			ContainerDir: fmt.Sprintf("%s-%d", containerPath, i+1),
+			Mode:         mode,
+			Driver:       driverName,
+			DeviceType:   deviceTypeFor(service, fingerprint.AccessModes[volume.VolumeId]),
+			Device: brokerapi.SharedDevice{
+				VolumeId: fmt.Sprintf("%s-%d", volumeId, i+1),
+				MountConfig: map[string]interface{}{
+					"id":             volume.VolumeId,
+					"attributes":     filterVolumeContext(volume.VolumeContext, service),
+					"binding-params": bindingParams,
+				},
+			},
+		})
+	}
+
+	for _, volumeMount := range ret.VolumeMounts {
+		for key, value := range mountConfig {
+			volumeMount.Device.MountConfig[key] = value
+		}
+	}
+
+	if fingerprint.BindingMounts == nil {
+		fingerprint.BindingMounts = map[string][]brokerapi.VolumeMount{}
+	}
+	fingerprint.BindingMounts[bindingID] = redactVolumeMounts(ret.VolumeMounts)
+	err = b.replaceFingerprint(logger, instanceID, instanceDetails, fingerprint)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	if serviceKey {
+		logger.Info("service-key-bound", lager.Data{"bindingID": bindingID})
+		return brokerapi.Binding{
+			Credentials: map[string]interface{}{"volume_mounts": fingerprint.BindingMounts[bindingID]},
+		}, nil
+	}
+
 	return ret, nil
 }
 
 func (b *Broker) Unbind(context context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) (e error) {
-	err := b.probeController(details.ServiceID)
+	context, span := startSpan(context, OperationUnbind, attribute.String("instance_id", instanceID), attribute.String("binding_id", bindingID))
+	defer func() { endSpan(span, e) }()
+	event := LifecycleEventData{InstanceID: instanceID, BindingID: bindingID, ServiceID: details.ServiceID, PlanID: details.PlanID}
+	defer func() { b.emitLifecycleEvent(OperationUnbind, event, e) }()
+
+	err := b.checkOperationSupported(details.ServiceID, OperationUnbind)
 	if err != nil {
 		return err
 	}
-	logger := b.logger.Session("unbind")
+	err = b.ensureRestored(b.logger.Session("unbind"))
+	if err != nil {
+		return err
+	}
+	err = b.probeController(context, details.ServiceID)
+	if err != nil {
+		return err
+	}
+	logger := withOriginatingIdentity(b.logger.Session("unbind"), context)
 	logger.Info("start")
 	defer logger.Info("end")
 
+	unlock := b.instanceLocks.lock(instanceID)
+	defer unlock()
+
+	b.startOperation(logger, bindingOperationKey(bindingID), "unbind", details.ServiceID)
+	defer func() {
+		if e == nil {
+			b.operations.remove(bindingOperationKey(bindingID))
+			return
+		}
+		b.operations.finish(bindingOperationKey(bindingID), e)
+	}()
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	defer func() {
@@ -345,9 +1199,11 @@ func (b *Broker) Unbind(context context.Context, instanceID string, bindingID st
 		}
 	}()
 
-	if _, err := b.store.RetrieveInstanceDetails(instanceID); err != nil {
+	instanceDetails, err := b.store.RetrieveInstanceDetails(instanceID)
+	if err != nil {
 		return brokerapi.ErrInstanceDoesNotExist
 	}
+	event.OrganizationGUID, event.SpaceGUID = instanceDetails.OrganizationGUID, instanceDetails.SpaceGUID
 
 	if _, err := b.store.RetrieveBindingDetails(bindingID); err != nil {
 		return brokerapi.ErrBindingDoesNotExist
@@ -356,15 +1212,116 @@ func (b *Broker) Unbind(context context.Context, instanceID string, bindingID st
 	if err := b.store.DeleteBindingDetails(bindingID); err != nil {
 		return err
 	}
+
+	fingerprint, err := getFingerprint(instanceDetails.ServiceFingerPrint)
+	if err != nil {
+		logger.Error("unreadable-fingerprint", err)
+		return nil
+	}
+	if _, ok := fingerprint.BindingMounts[bindingID]; ok {
+		delete(fingerprint.BindingMounts, bindingID)
+		return b.replaceFingerprint(logger, instanceID, instanceDetails, fingerprint)
+	}
 	return nil
 }
 
-func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
+// Update only supports upgrading an instance to the current maintenance
+// version of its plan. Plan changes and parameter updates are rejected.
+func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (_ brokerapi.UpdateServiceSpec, e error) {
+	context, span := startSpan(context, OperationUpdate, attribute.String("instance_id", instanceID), attribute.String("service_id", details.ServiceID))
+	defer func() { endSpan(span, e) }()
+
+	logger := withOriginatingIdentity(b.logger.Session("update"), context).WithData(lager.Data{"instanceID": instanceID, "details": details})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	err := b.checkOperationSupported(details.ServiceID, OperationUpdate)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if details.PlanID != "" && details.PreviousValues.PlanID != "" && details.PlanID != details.PreviousValues.PlanID {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+	}
+	if !hasNoParameters(details.RawParameters) {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(errors.New("updating volume parameters is not supported"), http.StatusUnprocessableEntity, "parameter-update-not-supported")
+	}
+
+	b.mutex.Lock()
+	_, err = b.store.RetrieveInstanceDetails(instanceID)
+	b.mutex.Unlock()
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// The vendored brokerapi neither advertises maintenance_info in the
+	// catalog nor passes on the version an update asks for, so instances keep
+	// the maintenance version they were provisioned with.
+	logger.Info("instance-unchanged")
+	return brokerapi.UpdateServiceSpec{}, nil
 }
 
 func (b *Broker) LastOperation(_ context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
-	return brokerapi.LastOperation{}, nil
+	logger := b.logger.Session("last-operation").WithData(lager.Data{"instanceID": instanceID, "operationData": operationData})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	data, err := DecodeOperationData(operationData)
+	if err != nil {
+		logger.Error("invalid-operation-data", err)
+		return brokerapi.LastOperation{}, invalidOperationDataResponse(err)
+	}
+
+	key := instanceID
+	if data.isBindingOperation() {
+		key = bindingOperationKey(data.Key)
+	}
+
+	op, ok := b.operations.get(key)
+	if !ok {
+		return brokerapi.LastOperation{}, nil
+	}
+
+	lastOperation := op.lastOperation()
+	logger.Info("operation-found", lager.Data{"state": lastOperation.State, "estimatedCompletion": op.EstimatedCompletion})
+
+	return lastOperation, nil
+}
+
+func (b *Broker) startOperation(logger lager.Logger, instanceID, operationType, serviceID string) {
+	op := operation{
+		Type:      operationType,
+		StartedAt: b.clock.Now(),
+	}
+
+	if service, err := b.servicesRegistry.Service(serviceID); err == nil {
+		op.PollInterval = time.Duration(service.PollInterval)
+		if service.ExpectedOperationDuration > 0 {
+			op.EstimatedCompletion = op.StartedAt.Add(time.Duration(service.ExpectedOperationDuration))
+		}
+	}
+
+	logger.Info("operation-started", lager.Data{"operation": operationType, "estimatedCompletion": op.EstimatedCompletion})
+	b.operations.start(instanceID, op)
+}
+
+// checkMaxBindings counts the bindings recorded in the instance's fingerprint
+// other than bindingID, so that repeating a bind is never refused.
+func checkMaxBindings(instanceID, bindingID string, fingerprint *ServiceFingerPrint, maxBindings int) error {
+	bindings := 0
+	for id := range fingerprint.BindingMounts {
+		if id != bindingID {
+			bindings++
+		}
+	}
+	if bindings >= maxBindings {
+		return ErrMaxBindingsReached{InstanceID: instanceID, MaxBindings: maxBindings}
+	}
+	return nil
+}
+
+func isKnownDeviceType(deviceType string) bool {
+	return deviceType == DeviceTypeShared || deviceType == DeviceTypeDedicated
 }
 
 func (b *Broker) instanceConflicts(details brokerstore.ServiceInstance, instanceID string) bool {
@@ -375,43 +1332,250 @@ func (b *Broker) bindingConflicts(bindingID string, details brokerapi.BindDetail
 	return b.store.IsBindingConflict(bindingID, details)
 }
 
-func (b *Broker) probeController(serviceID string) error {
-	if !b.controllerProbed {
-		identityClient, err := b.servicesRegistry.IdentityClient(serviceID)
-		if err != nil {
-			return err
+// applyParameterSet merges the named parameter set into the request
+// parameters. Parameters supplied directly by the caller take precedence.
+func (b *Broker) applyParameterSet(configuration *csi.CreateVolumeRequest, name string) error {
+	if b.parameterSets == nil {
+		return ErrParameterSetNotFound{Name: name}
+	}
+
+	parameters, ok := b.parameterSets.Lookup(name)
+	if !ok {
+		return ErrParameterSetNotFound{Name: name}
+	}
+
+	if configuration.Parameters == nil {
+		configuration.Parameters = map[string]string{}
+	}
+	for key, value := range parameters {
+		if _, ok := configuration.Parameters[key]; !ok {
+			configuration.Parameters[key] = value
+		}
+	}
+
+	return nil
+}
+
+func (b *Broker) probeController(ctx context.Context, serviceID string) error {
+	generation := b.servicesRegistry.ConnectionGeneration(serviceID)
+	if !b.isProbed(serviceID, generation) {
+		if b.probeBreaker != nil {
+			if err := b.probeBreaker.allow(serviceID); err != nil {
+				return err
+			}
+		}
+		err := b.probeUnprobedController(ctx, serviceID)
+		if b.probeBreaker != nil {
+			b.probeBreaker.record(serviceID, err)
 		}
-		_, err = identityClient.Probe(context.TODO(), &csi.ProbeRequest{})
 		if err != nil {
 			return err
 		}
-		b.controllerProbed = true
+		b.checkNodePlugin(ctx, serviceID)
+		b.markProbed(serviceID, generation)
 	}
 	return nil
 }
 
-func evaluateContainerPath(parameters map[string]interface{}, volId string) string {
-	if containerPath, ok := parameters["mount"]; ok && containerPath != "" {
-		return containerPath.(string)
+// checkNodePlugin probes the service's node plugin when it runs apart from
+// the controller. The broker itself only calls the controller, so a node
+// plugin that does not answer is a warning, not a failure: the operation
+// succeeds but apps will not be able to mount the volume.
+func (b *Broker) checkNodePlugin(ctx context.Context, serviceID string) {
+	nodeClient, err := b.servicesRegistry.NodeIdentityClient(serviceID)
+	if err == nil && nodeClient == nil {
+		return
+	}
+	if err == nil {
+		err = b.probe(ctx, nodeClient, serviceID)
+	}
+	if err != nil {
+		b.logger.Error("node-plugin-unreachable", err, lager.Data{"serviceID": serviceID})
+	}
+}
+
+// probeUnprobedController probes the controller, retrying as the service
+// allows, and checks the CSI version it serves.
+func (b *Broker) probeUnprobedController(ctx context.Context, serviceID string) error {
+	identityClient, err := b.servicesRegistry.IdentityClient(serviceID)
+	if err != nil {
+		return err
 	}
 
-	return path.Join(DefaultContainerPath, volId)
+	service, _ := b.servicesRegistry.Service(serviceID)
+	retries := service.ProbeRetryOnFirstFailure
+
+	backoff := firstProbeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = b.probe(ctx, identityClient, serviceID)
+		if err == nil || attempt >= retries || status.Code(err) == codes.Unimplemented {
+			break
+		}
+
+		b.logger.Info("probe-retry", lager.Data{"serviceID": serviceID, "attempt": attempt + 1, "backoff": backoff.String(), "error": err.Error()})
+		select {
+		case <-b.clock.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+	return b.checkCSIVersion(ctx, identityClient, service, serviceID, err)
 }
 
-func evaluateId(parameters map[string]interface{}) map[string]string {
-	if _, ok := parameters["uid"]; !ok {
-		return nil
+func (b *Broker) isProbed(serviceID string, generation int) bool {
+	b.probeMutex.Lock()
+	defer b.probeMutex.Unlock()
+
+	probedGeneration, ok := b.probed[serviceID]
+	return ok && probedGeneration == generation
+}
+
+func (b *Broker) markProbed(serviceID string, generation int) {
+	b.probeMutex.Lock()
+	defer b.probeMutex.Unlock()
+
+	b.probed[serviceID] = generation
+}
+
+func (b *Broker) probe(ctx context.Context, identityClient csi.IdentityClient, serviceID string) error {
+	probeCtx, cancel := context.WithTimeout(ctx, b.probeTimeout)
+	defer cancel()
+
+	_, err := identityClient.Probe(probeCtx, &csi.ProbeRequest{})
+	if probeCtx.Err() == context.DeadlineExceeded {
+		return ErrDriverNotReady{ServiceID: serviceID, Timeout: b.probeTimeout}
 	}
-	if _, ok := parameters["gid"]; !ok {
+	return err
+}
+
+// rollbackVolumes deletes volumes created by a provision that then failed.
+// Failures are only logged so that the original error is reported.
+func (b *Broker) rollbackVolumes(ctx context.Context, logger lager.Logger, controllerClient csi.ControllerClient, volumes []*csi.Volume) {
+	for _, volume := range volumes {
+		callCtx, cancel := withRPCTimeout(ctx, b.rpcTimeouts.deleteVolume())
+		_, err := controllerClient.DeleteVolume(callCtx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		cancel()
+		if err != nil {
+			logger.Error("provision-rollback-delete-failed", err, lager.Data{"volumeID": volume.GetVolumeId()})
+		}
+	}
+}
+
+// redundantVolumes returns the volumes a provision created that the stored
+// instance does not own. Volumes the instance does own are left alone, since
+// drivers return the same volume when the same name is created twice. There
+// are none when no volume has been stored for the instance.
+func redundantVolumes(existing brokerstore.ServiceInstance, created []*csi.Volume) []*csi.Volume {
+	fingerprint, err := getFingerprint(existing.ServiceFingerPrint)
+	if err != nil || fingerprint.Volume == nil {
 		return nil
 	}
+
+	owned := map[string]bool{}
+	for _, volume := range append([]*csi.Volume{fingerprint.Volume}, fingerprint.AdditionalVolumes...) {
+		owned[volume.GetVolumeId()] = true
+	}
+
+	var redundant []*csi.Volume
+	for _, volume := range created {
+		if !owned[volume.GetVolumeId()] {
+			redundant = append(redundant, volume)
+		}
+	}
+	return redundant
+}
+
+// isNotFound reports whether a driver call failed because the volume or
+// snapshot it names does not exist. Every NotFound check goes through it.
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+func evaluateContainerPath(parameters map[string]interface{}, volId string, allowedPaths []string) (string, error) {
+	requested, ok := parameters["mount"]
+	if !ok || requested == "" {
+		return path.Join(DefaultContainerPath, volId), nil
+	}
+
+	containerPath, ok := requested.(string)
+	if !ok {
+		return "", ErrInvalidMountPath{Path: fmt.Sprintf("%v", requested), Reason: "must be a string"}
+	}
+	if !path.IsAbs(containerPath) {
+		return "", ErrInvalidMountPath{Path: containerPath, Reason: "must be absolute"}
+	}
+	for _, element := range strings.Split(containerPath, "/") {
+		if element == ".." {
+			return "", ErrInvalidMountPath{Path: containerPath, Reason: "must not contain \"..\""}
+		}
+	}
+	containerPath = path.Clean(containerPath)
+
+	if len(allowedPaths) == 0 {
+		return containerPath, nil
+	}
+	for _, allowed := range allowedPaths {
+		allowed = path.Clean(allowed)
+		if containerPath == allowed || strings.HasPrefix(containerPath, strings.TrimSuffix(allowed, "/")+"/") {
+			return containerPath, nil
+		}
+	}
+
+	return "", ErrInvalidMountPath{Path: containerPath, Reason: fmt.Sprintf("is outside the allowed mount paths %v", allowedPaths)}
+}
+
+// evaluateId resolves the uid and gid a volume is mounted as. Values the
+// caller passes win over the service defaults; both must resolve for either
+// to be used.
+func evaluateId(parameters map[string]interface{}, service Service) (map[string]string, error) {
+	uid, ok := parameters["uid"]
+	if !ok {
+		uid = service.DefaultUID
+	}
+	gid, ok := parameters["gid"]
+	if !ok {
+		gid = service.DefaultGID
+	}
+	if uid == nil || gid == nil {
+		return nil, nil
+	}
+
+	uidString, err := formatOwnerID(uid)
+	if err != nil {
+		return nil, err
+	}
+	gidString, err := formatOwnerID(gid)
+	if err != nil {
+		return nil, err
+	}
+
 	return map[string]string{
-		"uid": parameters["uid"].(string),
-		"gid": parameters["gid"].(string),
+		"uid": uidString,
+		"gid": gidString,
+	}, nil
+}
+
+// formatOwnerID accepts a uid or gid given either as a JSON string or as a
+// whole non-negative JSON number.
+func formatOwnerID(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		if value == "" {
+			return "", brokerapi.ErrRawParamsInvalid
+		}
+		return value, nil
+	case float64:
+		if value < 0 || value != float64(int64(value)) {
+			return "", brokerapi.ErrRawParamsInvalid
+		}
+		return strconv.FormatInt(int64(value), 10), nil
+	default:
+		return "", brokerapi.ErrRawParamsInvalid
 	}
 }
 
-func evaluateMode(parameters map[string]interface{}) (string, error) {
+func evaluateMode(parameters map[string]interface{}, defaultReadonly bool) (string, error) {
 
 	if ro, ok := parameters["readonly"]; ok {
 		switch ro := ro.(type) {
@@ -421,7 +1585,7 @@ func evaluateMode(parameters map[string]interface{}) (string, error) {
 			return "", brokerapi.ErrRawParamsInvalid
 		}
 	}
-	return "rw", nil
+	return readOnlyToMode(defaultReadonly), nil
 }
 
 func readOnlyToMode(ro bool) string {
@@ -431,19 +1595,56 @@ func readOnlyToMode(ro bool) string {
 	return "rw"
 }
 
-func getFingerprint(rawObject interface{}) (*ServiceFingerPrint, error) {
-	fingerprint, ok := rawObject.(*ServiceFingerPrint)
-	if ok {
-		return fingerprint, nil
+// replaceFingerprint stores the instance again with the given fingerprint.
+// The store has no update, so the record is deleted and recreated; callers
+// hold b.mutex and save afterwards. Should the recreate fail, the original
+// record is put back so that the save does not lose the instance.
+func (b *Broker) replaceFingerprint(logger lager.Logger, instanceID string, instanceDetails brokerstore.ServiceInstance, fingerprint *ServiceFingerPrint) error {
+	err := b.store.DeleteInstanceDetails(instanceID)
+	if err != nil {
+		return err
 	}
 
-	// casting didn't work--try marshalling and unmarshalling as the correct type
+	updated := instanceDetails
+	updated.ServiceFingerPrint = fingerprint
+	err = b.store.CreateInstanceDetails(instanceID, updated)
+	if err != nil {
+		if restoreErr := b.store.CreateInstanceDetails(instanceID, instanceDetails); restoreErr != nil {
+			logger.Error("restore-instance-details-failed", restoreErr, lager.Data{"instanceID": instanceID})
+		}
+		return fmt.Errorf("failed to store instance details %s: %v", instanceID, err)
+	}
+	return nil
+}
+
+// redactVolumeMounts copies the mounts with secret-looking attributes and
+// binding parameters redacted.
+func redactVolumeMounts(mounts []brokerapi.VolumeMount) []brokerapi.VolumeMount {
+	redacted := make([]brokerapi.VolumeMount, 0, len(mounts))
+	for _, mount := range mounts {
+		mountConfig := map[string]interface{}{}
+		for key, value := range mount.Device.MountConfig {
+			if values, ok := value.(map[string]string); ok {
+				value = redactSecrets(values)
+			}
+			mountConfig[key] = value
+		}
+		mount.Device.MountConfig = mountConfig
+		redacted = append(redacted, mount)
+	}
+	return redacted
+}
+
+// getFingerprint decodes a stored fingerprint into a copy of its own, even
+// when the store holds a *ServiceFingerPrint, so that callers can change it
+// without touching the stored record before they replace it.
+func getFingerprint(rawObject interface{}) (*ServiceFingerPrint, error) {
 	rawJson, err := json.Marshal(rawObject)
 	if err != nil {
 		return nil, err
 	}
 
-	fingerprint = &ServiceFingerPrint{}
+	fingerprint := &ServiceFingerPrint{}
 	err = json.Unmarshal(rawJson, fingerprint)
 	if err != nil {
 		return nil, err
@@ -23,6 +23,19 @@ type FakeServicesRegistry struct {
 		result1 csi.IdentityClient
 		result2 error
 	}
+	NodeIdentityClientStub        func(serviceID string) (csi.IdentityClient, error)
+	nodeIdentityClientMutex       sync.RWMutex
+	nodeIdentityClientArgsForCall []struct {
+		serviceID string
+	}
+	nodeIdentityClientReturns struct {
+		result1 csi.IdentityClient
+		result2 error
+	}
+	nodeIdentityClientReturnsOnCall map[int]struct {
+		result1 csi.IdentityClient
+		result2 error
+	}
 	ControllerClientStub        func(serviceID string) (csi.ControllerClient, error)
 	controllerClientMutex       sync.RWMutex
 	controllerClientArgsForCall []struct {
@@ -58,6 +71,39 @@ type FakeServicesRegistry struct {
 		result1 string
 		result2 error
 	}
+	ServiceStub        func(serviceID string) (csibroker.Service, error)
+	serviceMutex       sync.RWMutex
+	serviceArgsForCall []struct {
+		serviceID string
+	}
+	serviceReturns struct {
+		result1 csibroker.Service
+		result2 error
+	}
+	serviceReturnsOnCall map[int]struct {
+		result1 csibroker.Service
+		result2 error
+	}
+	ConnectionGenerationStub        func(serviceID string) int
+	connectionGenerationMutex       sync.RWMutex
+	connectionGenerationArgsForCall []struct {
+		serviceID string
+	}
+	connectionGenerationReturns struct {
+		result1 int
+	}
+	connectionGenerationReturnsOnCall map[int]struct {
+		result1 int
+	}
+	CloseStub        func() error
+	closeMutex       sync.RWMutex
+	closeArgsForCall []struct{}
+	closeReturns     struct {
+		result1 error
+	}
+	closeReturnsOnCall map[int]struct {
+		result1 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -113,6 +159,57 @@ func (fake *FakeServicesRegistry) IdentityClientReturnsOnCall(i int, result1 csi
 	}{result1, result2}
 }
 
+func (fake *FakeServicesRegistry) NodeIdentityClient(serviceID string) (csi.IdentityClient, error) {
+	fake.nodeIdentityClientMutex.Lock()
+	ret, specificReturn := fake.nodeIdentityClientReturnsOnCall[len(fake.nodeIdentityClientArgsForCall)]
+	fake.nodeIdentityClientArgsForCall = append(fake.nodeIdentityClientArgsForCall, struct {
+		serviceID string
+	}{serviceID})
+	fake.recordInvocation("NodeIdentityClient", []interface{}{serviceID})
+	fake.nodeIdentityClientMutex.Unlock()
+	if fake.NodeIdentityClientStub != nil {
+		return fake.NodeIdentityClientStub(serviceID)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.nodeIdentityClientReturns.result1, fake.nodeIdentityClientReturns.result2
+}
+
+func (fake *FakeServicesRegistry) NodeIdentityClientCallCount() int {
+	fake.nodeIdentityClientMutex.RLock()
+	defer fake.nodeIdentityClientMutex.RUnlock()
+	return len(fake.nodeIdentityClientArgsForCall)
+}
+
+func (fake *FakeServicesRegistry) NodeIdentityClientArgsForCall(i int) string {
+	fake.nodeIdentityClientMutex.RLock()
+	defer fake.nodeIdentityClientMutex.RUnlock()
+	return fake.nodeIdentityClientArgsForCall[i].serviceID
+}
+
+func (fake *FakeServicesRegistry) NodeIdentityClientReturns(result1 csi.IdentityClient, result2 error) {
+	fake.NodeIdentityClientStub = nil
+	fake.nodeIdentityClientReturns = struct {
+		result1 csi.IdentityClient
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeServicesRegistry) NodeIdentityClientReturnsOnCall(i int, result1 csi.IdentityClient, result2 error) {
+	fake.NodeIdentityClientStub = nil
+	if fake.nodeIdentityClientReturnsOnCall == nil {
+		fake.nodeIdentityClientReturnsOnCall = make(map[int]struct {
+			result1 csi.IdentityClient
+			result2 error
+		})
+	}
+	fake.nodeIdentityClientReturnsOnCall[i] = struct {
+		result1 csi.IdentityClient
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeServicesRegistry) ControllerClient(serviceID string) (csi.ControllerClient, error) {
 	fake.controllerClientMutex.Lock()
 	ret, specificReturn := fake.controllerClientReturnsOnCall[len(fake.controllerClientArgsForCall)]
@@ -255,17 +352,164 @@ func (fake *FakeServicesRegistry) DriverNameReturnsOnCall(i int, result1 string,
 	}{result1, result2}
 }
 
+func (fake *FakeServicesRegistry) Service(serviceID string) (csibroker.Service, error) {
+	fake.serviceMutex.Lock()
+	ret, specificReturn := fake.serviceReturnsOnCall[len(fake.serviceArgsForCall)]
+	fake.serviceArgsForCall = append(fake.serviceArgsForCall, struct {
+		serviceID string
+	}{serviceID})
+	fake.recordInvocation("Service", []interface{}{serviceID})
+	fake.serviceMutex.Unlock()
+	if fake.ServiceStub != nil {
+		return fake.ServiceStub(serviceID)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.serviceReturns.result1, fake.serviceReturns.result2
+}
+
+func (fake *FakeServicesRegistry) ServiceCallCount() int {
+	fake.serviceMutex.RLock()
+	defer fake.serviceMutex.RUnlock()
+	return len(fake.serviceArgsForCall)
+}
+
+func (fake *FakeServicesRegistry) ServiceArgsForCall(i int) string {
+	fake.serviceMutex.RLock()
+	defer fake.serviceMutex.RUnlock()
+	return fake.serviceArgsForCall[i].serviceID
+}
+
+func (fake *FakeServicesRegistry) ServiceReturns(result1 csibroker.Service, result2 error) {
+	fake.ServiceStub = nil
+	fake.serviceReturns = struct {
+		result1 csibroker.Service
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeServicesRegistry) ServiceReturnsOnCall(i int, result1 csibroker.Service, result2 error) {
+	fake.ServiceStub = nil
+	if fake.serviceReturnsOnCall == nil {
+		fake.serviceReturnsOnCall = make(map[int]struct {
+			result1 csibroker.Service
+			result2 error
+		})
+	}
+	fake.serviceReturnsOnCall[i] = struct {
+		result1 csibroker.Service
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeServicesRegistry) ConnectionGeneration(serviceID string) int {
+	fake.connectionGenerationMutex.Lock()
+	ret, specificReturn := fake.connectionGenerationReturnsOnCall[len(fake.connectionGenerationArgsForCall)]
+	fake.connectionGenerationArgsForCall = append(fake.connectionGenerationArgsForCall, struct {
+		serviceID string
+	}{serviceID})
+	fake.recordInvocation("ConnectionGeneration", []interface{}{serviceID})
+	fake.connectionGenerationMutex.Unlock()
+	if fake.ConnectionGenerationStub != nil {
+		return fake.ConnectionGenerationStub(serviceID)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fake.connectionGenerationReturns.result1
+}
+
+func (fake *FakeServicesRegistry) ConnectionGenerationCallCount() int {
+	fake.connectionGenerationMutex.RLock()
+	defer fake.connectionGenerationMutex.RUnlock()
+	return len(fake.connectionGenerationArgsForCall)
+}
+
+func (fake *FakeServicesRegistry) ConnectionGenerationArgsForCall(i int) string {
+	fake.connectionGenerationMutex.RLock()
+	defer fake.connectionGenerationMutex.RUnlock()
+	return fake.connectionGenerationArgsForCall[i].serviceID
+}
+
+func (fake *FakeServicesRegistry) ConnectionGenerationReturns(result1 int) {
+	fake.ConnectionGenerationStub = nil
+	fake.connectionGenerationReturns = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeServicesRegistry) ConnectionGenerationReturnsOnCall(i int, result1 int) {
+	fake.ConnectionGenerationStub = nil
+	if fake.connectionGenerationReturnsOnCall == nil {
+		fake.connectionGenerationReturnsOnCall = make(map[int]struct {
+			result1 int
+		})
+	}
+	fake.connectionGenerationReturnsOnCall[i] = struct {
+		result1 int
+	}{result1}
+}
+
+func (fake *FakeServicesRegistry) Close() error {
+	fake.closeMutex.Lock()
+	ret, specificReturn := fake.closeReturnsOnCall[len(fake.closeArgsForCall)]
+	fake.closeArgsForCall = append(fake.closeArgsForCall, struct{}{})
+	fake.recordInvocation("Close", []interface{}{})
+	fake.closeMutex.Unlock()
+	if fake.CloseStub != nil {
+		return fake.CloseStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fake.closeReturns.result1
+}
+
+func (fake *FakeServicesRegistry) CloseCallCount() int {
+	fake.closeMutex.RLock()
+	defer fake.closeMutex.RUnlock()
+	return len(fake.closeArgsForCall)
+}
+
+func (fake *FakeServicesRegistry) CloseReturns(result1 error) {
+	fake.CloseStub = nil
+	fake.closeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeServicesRegistry) CloseReturnsOnCall(i int, result1 error) {
+	fake.CloseStub = nil
+	if fake.closeReturnsOnCall == nil {
+		fake.closeReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.closeReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeServicesRegistry) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
 	fake.identityClientMutex.RLock()
 	defer fake.identityClientMutex.RUnlock()
+	fake.nodeIdentityClientMutex.RLock()
+	defer fake.nodeIdentityClientMutex.RUnlock()
 	fake.controllerClientMutex.RLock()
 	defer fake.controllerClientMutex.RUnlock()
 	fake.brokerServicesMutex.RLock()
 	defer fake.brokerServicesMutex.RUnlock()
 	fake.driverNameMutex.RLock()
 	defer fake.driverNameMutex.RUnlock()
+	fake.serviceMutex.RLock()
+	defer fake.serviceMutex.RUnlock()
+	fake.connectionGenerationMutex.RLock()
+	defer fake.connectionGenerationMutex.RUnlock()
+	fake.closeMutex.RLock()
+	defer fake.closeMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
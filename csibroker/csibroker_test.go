@@ -4,7 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/csibroker/csibroker"
 	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
 	"code.cloudfoundry.org/csishim/csi_fake"
@@ -17,8 +26,10 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var _ = Describe("Broker", func() {
@@ -31,6 +42,7 @@ var _ = Describe("Broker", func() {
 		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
 		fakeControllerClient *csi_fake.FakeControllerClient
 		fakeIdentityClient   *csi_fake.FakeIdentityClient
+		fakeClock            *fakeclock.FakeClock
 		err                  error
 	)
 
@@ -38,6 +50,7 @@ var _ = Describe("Broker", func() {
 		logger = lagertest.NewTestLogger("test-broker")
 		ctx = context.TODO()
 		fakeOs = &os_fake.FakeOs{}
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
 		fakeStore = &brokerstorefakes.FakeStore{}
 		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
 		fakeControllerClient = &csi_fake.FakeControllerClient{}
@@ -53,7 +66,7 @@ var _ = Describe("Broker", func() {
 			broker, err = csibroker.New(
 				logger,
 				fakeOs,
-				nil,
+				fakeClock,
 				fakeStore,
 				fakeServicesRegistry,
 			)
@@ -120,6 +133,49 @@ var _ = Describe("Broker", func() {
 					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
 				})
 
+				It("asks the driver for its plugin info", func() {
+					Expect(fakeIdentityClient.GetPluginInfoCallCount()).To(Equal(1))
+				})
+
+				Context("if the driver does not serve CSI v1", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{CSIVersion: "0.3", ProbeRetryOnFirstFailure: 2}, nil)
+						fakeIdentityClient.ProbeReturns(nil, grpc.Errorf(codes.Unimplemented, "unknown service csi.v1.Identity"))
+					})
+
+					It("reports the version mismatch without retrying", func() {
+						Expect(err).To(Equal(csibroker.ErrCSIVersionMismatch{ServiceID: provisionDetails.ServiceID, DriverVersion: "0.3"}))
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("if the service has a node plugin of its own", func() {
+					var fakeNodeClient *csi_fake.FakeIdentityClient
+
+					BeforeEach(func() {
+						fakeNodeClient = &csi_fake.FakeIdentityClient{}
+						fakeServicesRegistry.NodeIdentityClientReturns(fakeNodeClient, nil)
+					})
+
+					It("probes it too", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeNodeClient.ProbeCallCount()).To(Equal(1))
+					})
+
+					Context("if the node plugin does not answer", func() {
+						BeforeEach(func() {
+							fakeNodeClient.ProbeReturns(nil, errors.New("node badness"))
+						})
+
+						It("warns but still provisions", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+							Expect(string(logger.(*lagertest.TestLogger).Buffer().Contents())).To(ContainSubstring("node-plugin-unreachable"))
+						})
+					})
+				})
+
 				Context("if the probe fails", func() {
 					BeforeEach(func() {
 						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, grpc.Errorf(codes.Unknown, "probe badness"))
@@ -129,6 +185,154 @@ var _ = Describe("Broker", func() {
 						Expect(err).To(HaveOccurred())
 						Expect(err.Error()).To(Equal("rpc error: code = Unknown desc = probe badness"))
 					})
+
+					Context("when the service retries the first probe", func() {
+						var stopClock chan struct{}
+
+						BeforeEach(func() {
+							fakeServicesRegistry.ServiceReturns(csibroker.Service{ProbeRetryOnFirstFailure: 2}, nil)
+
+							stopClock = make(chan struct{})
+							go func() {
+								for {
+									select {
+									case <-stopClock:
+										return
+									case <-time.After(time.Millisecond):
+										if fakeClock.WatcherCount() > 0 {
+											fakeClock.Increment(time.Minute)
+										}
+									}
+								}
+							}()
+						})
+
+						AfterEach(func() {
+							close(stopClock)
+						})
+
+						It("gives up after the configured retries", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(3))
+						})
+
+						Context("when the driver becomes ready", func() {
+							BeforeEach(func() {
+								fakeIdentityClient.ProbeReturnsOnCall(1, &csi.ProbeResponse{}, nil)
+							})
+
+							It("proceeds with the operation", func() {
+								Expect(err).NotTo(HaveOccurred())
+								Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(2))
+								Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+							})
+						})
+					})
+				})
+
+				Context("if the probe does not answer in time", func() {
+					BeforeEach(func() {
+						broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithProbeTimeout(10*time.Millisecond))
+						Expect(err).NotTo(HaveOccurred())
+
+						fakeIdentityClient.ProbeStub = func(ctx context.Context, _ *csi.ProbeRequest, _ ...grpc.CallOption) (*csi.ProbeResponse, error) {
+							<-ctx.Done()
+							return nil, ctx.Err()
+						}
+					})
+
+					It("fails with a driver not ready error", func() {
+						Expect(err).To(Equal(csibroker.ErrDriverNotReady{ServiceID: provisionDetails.ServiceID, Timeout: 10 * time.Millisecond}))
+						Expect(err.Error()).To(HavePrefix("driver not ready"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+			})
+
+			Context("when a sync budget is configured", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithSyncBudget(time.Minute))
+					Expect(err).NotTo(HaveOccurred())
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{ExpectedOperationDuration: csibroker.Duration(5 * time.Minute)}, nil)
+				})
+
+				It("requires async for operations expected to outlast it", func() {
+					Expect(err).To(Equal(brokerapi.ErrAsyncRequired))
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(0))
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+				})
+
+				Context("when the platform allows async", func() {
+					BeforeEach(func() {
+						asyncAllowed = true
+					})
+
+					It("provisions", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+					})
+				})
+
+				Context("when the service expects operations within it", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{ExpectedOperationDuration: csibroker.Duration(30 * time.Second)}, nil)
+					})
+
+					It("provisions", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+					})
+				})
+			})
+
+			Context("when a probe breaker is configured", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithProbeBreaker(2, time.Minute, 30*time.Second))
+					Expect(err).NotTo(HaveOccurred())
+					fakeIdentityClient.ProbeReturns(nil, status.Error(codes.Unavailable, "driver down"))
+				})
+
+				JustBeforeEach(func() {
+					// the outer JustBeforeEach made the first failed probe
+					_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+					Expect(err).To(MatchError(ContainSubstring("driver down")))
+				})
+
+				It("fails fast without probing once the threshold is reached", func() {
+					_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+					Expect(err).To(Equal(csibroker.ErrDriverUnavailable{ServiceID: provisionDetails.ServiceID, RetryAfter: 30 * time.Second}))
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(2))
+				})
+
+				Context("when the failures are further apart than the window", func() {
+					It("keeps probing", func() {
+						fakeClock.Increment(time.Minute + time.Second)
+						_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+						Expect(err).To(MatchError(ContainSubstring("driver down")))
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(3))
+					})
+				})
+
+				Context("once the cooldown has elapsed", func() {
+					JustBeforeEach(func() {
+						fakeClock.Increment(30 * time.Second)
+					})
+
+					It("closes again after a successful probe", func() {
+						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
+						_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(3))
+					})
+
+					It("opens for another cooldown after a failed probe", func() {
+						_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+						Expect(err).To(MatchError(ContainSubstring("driver down")))
+
+						_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+						Expect(err).To(BeAssignableToTypeOf(csibroker.ErrDriverUnavailable{}))
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(3))
+					})
 				})
 			})
 
@@ -203,545 +407,3091 @@ var _ = Describe("Broker", func() {
 					Expect(fakeServiceInstance).To(Equal(expectedServiceInstance))
 					Expect(fakeStore.SaveCallCount()).Should(BeNumerically(">", 0))
 				})
+
+				Context("when the plan declares maintenance info", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{
+							MaintenanceInfo: map[string]csibroker.MaintenanceInfo{"CSI-Existing": {Version: "1.2.3"}},
+						}, nil)
+					})
+
+					It("records the maintenance version", func() {
+						_, fakeServiceInstance := fakeStore.CreateInstanceDetailsArgsForCall(0)
+						fingerprint := fakeServiceInstance.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+						Expect(fingerprint.MaintenanceVersion).To(Equal("1.2.3"))
+					})
+				})
 			})
-			Context("when the client returns an error", func() {
+			Context("when the service declares access types", func() {
 				BeforeEach(func() {
-					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{}, grpc.Errorf(codes.Unknown, "badness"))
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{
+						DefaultAccessType:    "mount",
+						SupportedAccessTypes: []string{"mount"},
+					}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
+				Context("when the caller omits the access type", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"access_mode": {"mode": "MULTI_NODE_MULTI_WRITER"}}]}`)
+					})
+
+					It("applies the default", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.VolumeCapabilities[0].GetMount()).NotTo(BeNil())
+						Expect(request.VolumeCapabilities[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER))
+					})
+				})
+
+				Context("when the caller requests an unsupported access type", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"block": {}}]}`)
+					})
+
+					It("is rejected before reaching the driver", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal(csibroker.ErrUnsupportedAccessType{AccessType: "block", Supported: []string{"mount"}}.Error()))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
 				})
 			})
 
-			Context("create-service was given invalid JSON", func() {
+			Context("when the service declares default volume capabilities", func() {
 				BeforeEach(func() {
-					badJson := []byte("{this is not json")
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(badJson)}
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{
+						DefaultVolumeCapabilities: json.RawMessage(`[{"mount": {"fs_type": "ext4"}, "access_mode": {"mode": "MULTI_NODE_MULTI_WRITER"}}]`),
+					}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage"}`)
 				})
 
-				It("errors", func() {
-					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				It("applies them when the caller gives none", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.VolumeCapabilities).To(HaveLen(1))
+					Expect(request.VolumeCapabilities[0].GetMount().GetFsType()).To(Equal("ext4"))
+					Expect(request.VolumeCapabilities[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER))
 				})
 
+				Context("when the caller gives capabilities", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"block": {}}]}`)
+					})
+
+					It("uses the caller's", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.VolumeCapabilities).To(HaveLen(1))
+						Expect(request.VolumeCapabilities[0].GetBlock()).NotTo(BeNil())
+					})
+				})
 			})
-			Context("create-service was given valid JSON but no 'name'", func() {
+
+			Context("when a content source is requested", func() {
 				BeforeEach(func() {
-					configuration := `
-					{
-            "volume_capabilities":[
-               {
-                  "mount":{
-                     "fsType":"fsType",
-                     "mountFlags":[
-                        "-o something",
-                        "-t anotherthing"
-                     ]
-                  }
-               }
-            ]
-          }`
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "volume_content_source": {"snapshot": {"snapshot_id": "some-snapshot-id"}}}`)
 				})
 
-				It("errors", func() {
-					Expect(err).To(Equal(errors.New("config requires a \"name\"")))
+				Context("when the snapshot exists", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ListSnapshotsReturns(&csi.ListSnapshotsResponse{
+							Entries: []*csi.ListSnapshotsResponse_Entry{{Snapshot: &csi.Snapshot{SnapshotId: "some-snapshot-id"}}},
+						}, nil)
+					})
+
+					It("looks it up and creates the volume from it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, listRequest, _ := fakeControllerClient.ListSnapshotsArgsForCall(0)
+						Expect(listRequest.SnapshotId).To(Equal("some-snapshot-id"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+					})
 				})
-			})
 
-			Context("create-service was given valid JSON but no 'volume_capabilities'", func() {
-				BeforeEach(func() {
-					configuration := `
-				  {
-				     "name":"csi-storage"
-				  }
-				  `
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+				Context("when the snapshot does not exist", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ListSnapshotsReturns(&csi.ListSnapshotsResponse{}, nil)
+					})
+
+					It("is rejected before reaching the driver", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal(`volume_content_source snapshot "some-snapshot-id" does not exist`))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
 				})
 
-				It("errors", func() {
-					Expect(err).To(Equal(errors.New("config requires \"volume_capabilities\"")))
+				Context("when the driver cannot list snapshots", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ListSnapshotsReturns(nil, status.Error(codes.Unimplemented, "no"))
+					})
+
+					It("leaves the check to the driver", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+					})
 				})
-			})
 
-			Context("when the service instance already exists with the same details", func() {
-				BeforeEach(func() {
-					fakeStore.IsInstanceConflictReturns(false)
+				Context("when the source volume does not exist", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "volume_content_source": {"volume": {"volume_id": "missing-volume-id"}}}`)
+						fakeControllerClient.ValidateVolumeCapabilitiesReturns(nil, status.Error(codes.NotFound, "gone"))
+					})
+
+					It("is rejected before reaching the driver", func() {
+						Expect(err).To(MatchError(`volume_content_source volume "missing-volume-id" does not exist`))
+						_, validateRequest, _ := fakeControllerClient.ValidateVolumeCapabilitiesArgsForCall(0)
+						Expect(validateRequest.VolumeId).To(Equal("missing-volume-id"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
 				})
 
-				It("should not error", func() {
-					Expect(err).NotTo(HaveOccurred())
+				Context("when both a snapshot and a volume are named", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "volume_content_source": {"snapshot": {"snapshot_id": "some-snapshot-id"}, "volume": {"volume_id": "some-volume-id"}}}`)
+					})
+
+					It("is rejected", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal("volume_content_source must name either a snapshot or a volume, not both"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
 				})
 			})
 
-			Context("when the service instance already exists with different details", func() {
+			Context("when the service declares a default access mode", func() {
 				BeforeEach(func() {
-					fakeStore.IsInstanceConflictReturns(true)
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DefaultAccessMode: "SINGLE_NODE_WRITER"}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
 				})
 
-				It("should error", func() {
-					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+				Context("when the caller omits the access mode", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
+					})
+
+					It("applies the default", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.VolumeCapabilities[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+					})
 				})
-			})
 
-			Context("when the service instance creation fails", func() {
-				BeforeEach(func() {
-					fakeStore.CreateInstanceDetailsReturns(errors.New("badness"))
+				Context("when the caller gives a valid access mode", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}, "access_mode": {"mode": "MULTI_NODE_READER_ONLY"}}]}`)
+					})
+
+					It("keeps it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.VolumeCapabilities[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY))
+					})
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
+				Context("when the caller gives the UNKNOWN access mode", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}, "access_mode": {"mode": "UNKNOWN"}}]}`)
+					})
+
+					It("is rejected before reaching the driver", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal("access_mode.mode UNKNOWN is not a usable access mode"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the caller gives an access mode outside the spec", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}, "access_mode": {"mode": 42}}]}`)
+					})
+
+					It("is rejected before reaching the driver", func() {
+						Expect(err).To(MatchError("access_mode.mode 42 is not a recognized access mode"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
 				})
 			})
 
-			Context("when the save fails", func() {
+			Context("when additional volumes are requested", func() {
 				BeforeEach(func() {
-					fakeStore.SaveReturns(errors.New("badness"))
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"volume_capabilities": [{"mount": {}}],
+						"additional_volumes": [
+							{"name": "csi-storage-logs", "volume_capabilities": [{"mount": {}}]}
+						]
+					}`)
+					fakeControllerClient.CreateVolumeReturnsOnCall(0, &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "primary-volume-id"}}, nil)
+					fakeControllerClient.CreateVolumeReturnsOnCall(1, &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "logs-volume-id"}}, nil)
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
+				It("creates every volume and records them on the instance", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(2))
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(1)
+					Expect(request.Name).To(Equal("csi-storage-logs"))
+
+					_, instance := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					fingerprint := instance.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+					Expect(fingerprint.Volume.VolumeId).To(Equal("primary-volume-id"))
+					Expect(fingerprint.AdditionalVolumes).To(HaveLen(1))
+					Expect(fingerprint.AdditionalVolumes[0].VolumeId).To(Equal("logs-volume-id"))
 				})
-			})
-		})
 
-		Context(".Deprovision", func() {
-			var (
-				instanceID         string
-				asyncAllowed       bool
-				deprovisionDetails brokerapi.DeprovisionDetails
-				err                error
-			)
+				Context("when an additional volume cannot be created", func() {
+					BeforeEach(func() {
+						fakeControllerClient.CreateVolumeReturnsOnCall(1, nil, errors.New("out of space"))
+					})
 
-			BeforeEach(func() {
-				instanceID = "some-instance-id"
-				deprovisionDetails = brokerapi.DeprovisionDetails{PlanID: "Existing", ServiceID: "some-service-id"}
-				asyncAllowed = true
-			})
+					It("deletes the volumes already created", func() {
+						Expect(err).To(MatchError("out of space"))
+						Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+						_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						Expect(request.VolumeId).To(Equal("primary-volume-id"))
+					})
+				})
 
-			JustBeforeEach(func() {
-				_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
+				Context("when an additional volume has no capabilities", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"volume_capabilities": [{"mount": {}}],
+							"additional_volumes": [{"name": "csi-storage-logs"}]
+						}`)
+					})
+
+					It("fails before creating anything", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal("additional volume 0 requires parameters 'name' and 'volume_capabilities'"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
 			})
 
-			Context("when the probe fails", func() {
+			Context("when the request carries an originating identity", func() {
 				BeforeEach(func() {
-					fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, grpc.Errorf(codes.Unknown, "probe badness"))
+					ctx = csibroker.ContextWithOriginatingIdentity(ctx, csibroker.OriginatingIdentity{
+						Platform: "cloudfoundry",
+						Value:    map[string]interface{}{"user_id": "some-user-id"},
+					})
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{OriginatingIdentityParameter: "requestedBy"}, nil)
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
-					Expect(err.Error()).To(Equal("rpc error: code = Unknown desc = probe badness"))
+				It("forwards it to the driver in the configured parameter", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(HaveKeyWithValue("requestedBy", `{"user_id":"some-user-id"}`))
 				})
-			})
 
-			Context("when the instance does not exist", func() {
-				BeforeEach(func() {
-					instanceID = "does-not-exist"
-					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, brokerapi.ErrInstanceDoesNotExist)
-				})
+				Context("when the service does not forward it", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{}, nil)
+					})
 
-				It("should fail", func() {
-					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+					It("leaves the parameters alone", func() {
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Parameters).NotTo(HaveKey("requestedBy"))
+					})
 				})
 			})
 
-			Context("given an existing instance", func() {
-				var (
-					previousSaveCallCount int
-				)
+			Context("when the service waits for volumes to be ready", func() {
+				var stopClock chan struct{}
 
 				BeforeEach(func() {
-					asyncAllowed = false
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{
+						WaitForReady:         csibroker.Duration(time.Minute),
+						WaitForReadyInterval: csibroker.Duration(10 * time.Second),
+					}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					fakeControllerClient.ValidateVolumeCapabilitiesReturns(&csi.ValidateVolumeCapabilitiesResponse{Message: "still creating"}, nil)
+					fakeControllerClient.ValidateVolumeCapabilitiesReturnsOnCall(2, &csi.ValidateVolumeCapabilitiesResponse{
+						Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{},
+					}, nil)
 
-					fingerprint := csibroker.ServiceFingerPrint{
-						Name:   "some-csi-storage",
-						Volume: &csi.Volume{VolumeId: "some-volume-id"},
-					}
+					stopClock = make(chan struct{})
+					go func() {
+						for {
+							select {
+							case <-stopClock:
+								return
+							case <-time.After(time.Millisecond):
+								if fakeClock.WatcherCount() > 0 {
+									fakeClock.Increment(10 * time.Second)
+								}
+							}
+						}
+					}()
+				})
 
-					// simulate untyped data loaded from a data file
-					jsonFingerprint := &map[string]interface{}{}
-					raw, err := json.Marshal(fingerprint)
-					Expect(err).ToNot(HaveOccurred())
-					err = json.Unmarshal(raw, jsonFingerprint)
-					Expect(err).ToNot(HaveOccurred())
+				AfterEach(func() {
+					close(stopClock)
+				})
 
-					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
-						ServiceID:          "some-service-id",
-						ServiceFingerPrint: jsonFingerprint,
-					}, nil)
-					previousSaveCallCount = fakeStore.SaveCallCount()
+				It("polls until the driver confirms the volume", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeControllerClient.ValidateVolumeCapabilitiesCallCount()).To(Equal(3))
+					_, request, _ := fakeControllerClient.ValidateVolumeCapabilitiesArgsForCall(0)
+					Expect(request.VolumeId).To(Equal("some-volume-id"))
+					Expect(request.VolumeCapabilities).To(HaveLen(1))
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
 				})
 
-				Context("if the controller has been probed already", func() {
-					JustBeforeEach(func() {
-						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
-						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
+				Context("when the volume does not become ready in time", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ValidateVolumeCapabilitiesReturnsOnCall(2, &csi.ValidateVolumeCapabilitiesResponse{}, nil)
 					})
 
-					It("does not probe the controller again for any future calls", func() {
-						_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
-						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+					It("fails and removes the volume", func() {
+						Expect(err).To(Equal(csibroker.ErrVolumeNotReady{VolumeID: "some-volume-id", Timeout: time.Minute}))
+						Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
 					})
 				})
 
-				It("probes the controller", func() {
-					_, request, _ := fakeIdentityClient.ProbeArgsForCall(0)
-					Expect(request).To(Equal(&csi.ProbeRequest{}))
-					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+				Context("when the driver cannot validate volumes", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ValidateVolumeCapabilitiesReturnsOnCall(0, nil, grpc.Errorf(codes.Unimplemented, "no"))
+					})
+
+					It("does not wait", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.ValidateVolumeCapabilitiesCallCount()).To(Equal(1))
+					})
 				})
+			})
 
-				It("should succeed", func() {
+			Context("when the service constrains volume names", func() {
+				var rules *csibroker.VolumeNameRules
+
+				BeforeEach(func() {
+					rules = &csibroker.VolumeNameRules{MaxLength: 8, Pattern: "[a-z]([-a-z0-9]*[a-z0-9])?"}
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{VolumeName: rules}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "My_Storage Volume", "volume_capabilities": [{"mount": {}}]}`)
+				})
+
+				It("rejects a name that breaks them", func() {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err.Error()).To(Equal(`volume name "My_Storage Volume" is invalid: longer than 8 characters`))
+				})
+
+				Context("when the service sanitizes names", func() {
+					BeforeEach(func() {
+						rules.Sanitize = true
+					})
+
+					It("creates the volume under the sanitized name", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Name).To(Equal("my-stora"))
+					})
+
+					Context("when the sanitized name still does not match", func() {
+						BeforeEach(func() {
+							provisionDetails.RawParameters = json.RawMessage(`{"name": "42 volumes", "volume_capabilities": [{"mount": {}}]}`)
+						})
+
+						It("rejects it", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("does not match"))
+						})
+					})
+				})
+			})
+
+			Context("when a pre-provision webhook is configured", func() {
+				var (
+					server            *httptest.Server
+					statusCode        int
+					responseBody      string
+					webhookBody       csibroker.PreProvisionWebhookRequest
+					failOnError       bool
+					createVolumeCalls int
+				)
+
+				BeforeEach(func() {
+					statusCode = http.StatusOK
+					responseBody = ""
+					failOnError = true
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						defer GinkgoRecover()
+						Expect(json.NewDecoder(r.Body).Decode(&webhookBody)).To(Succeed())
+						w.WriteHeader(statusCode)
+						w.Write([]byte(responseBody))
+					}))
+
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity_range": {"required_bytes": 1073741824}, "parameters": {"tier": "gold"}}`)
+				})
+
+				JustBeforeEach(func() {
+					// the outer JustBeforeEach has provisioned without the webhook
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithPreProvisionWebhook(csibroker.NewPreProvisionWebhook(server.URL, failOnError, time.Second)))
 					Expect(err).NotTo(HaveOccurred())
+					createVolumeCalls = fakeControllerClient.CreateVolumeCallCount()
+					_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
 				})
 
-				It("save state", func() {
-					Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
+				AfterEach(func() {
+					server.Close()
 				})
 
-				It("should send the request to the controller client", func() {
-					expectedRequest := &csi.DeleteVolumeRequest{
-						VolumeId: "some-volume-id",
-						Secrets:  map[string]string{},
-					}
-					Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
-					_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
-					Expect(request).To(Equal(expectedRequest))
+				It("posts the volume requests and provisions when they are allowed", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(webhookBody.InstanceID).To(Equal(instanceID))
+					Expect(webhookBody.OrganizationGUID).To(Equal("some-org-guid"))
+					Expect(webhookBody.Volumes).To(Equal([]csibroker.PreProvisionWebhookVolume{{Name: "csi-storage", RequiredBytes: 1073741824, Parameters: map[string]string{"tier": "gold"}}}))
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(createVolumeCalls + 1))
 				})
 
-				Context("when the client returns an error", func() {
+				Context("when the webhook rejects the provision", func() {
 					BeforeEach(func() {
-						fakeControllerClient.DeleteVolumeReturns(&csi.DeleteVolumeResponse{}, grpc.Errorf(codes.Unknown, "badness"))
+						statusCode = http.StatusForbidden
+						responseBody = `{"message": "volumes over 512MiB need approval"}`
 					})
 
-					It("should error", func() {
-						Expect(err).To(HaveOccurred())
+					It("fails with the webhook's message before reaching the driver", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err).To(MatchError("provision rejected by policy: volumes over 512MiB need approval"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(createVolumeCalls))
 					})
 				})
 
-				Context("when deletion of the instance fails", func() {
+				Context("when the webhook cannot be reached", func() {
 					BeforeEach(func() {
-						fakeStore.DeleteInstanceDetailsReturns(errors.New("badness"))
+						server.Close()
 					})
 
-					It("should error", func() {
-						Expect(err).To(HaveOccurred())
+					It("fails the provision", func() {
+						Expect(err).To(BeAssignableToTypeOf(csibroker.ErrPreProvisionWebhookFailed{}))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(createVolumeCalls))
+					})
+
+					Context("when webhook failures are only logged", func() {
+						BeforeEach(func() {
+							failOnError = false
+						})
+
+						It("provisions anyway", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(createVolumeCalls + 1))
+						})
 					})
 				})
+			})
 
-				Context("when the save fails", func() {
+			Context("when a provision webhook is configured", func() {
+				var (
+					server      *httptest.Server
+					statusCode  int
+					webhookBody csibroker.ProvisionWebhookRequest
+					failOnError bool
+				)
+
+				BeforeEach(func() {
+					statusCode = http.StatusOK
+					failOnError = true
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						defer GinkgoRecover()
+						Expect(json.NewDecoder(r.Body).Decode(&webhookBody)).To(Succeed())
+						w.WriteHeader(statusCode)
+						w.Write([]byte(`{"volume_context": {"cmdb_id": "ci-42", "share": "ignored"}}`))
+					}))
+
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{
+						VolumeId:      "some-volume-id",
+						VolumeContext: map[string]string{"share": "server:/"},
+					}}, nil)
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
+				})
+
+				JustBeforeEach(func() {
+					// the outer JustBeforeEach has provisioned without the webhook
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithProvisionWebhook(csibroker.NewProvisionWebhook(server.URL, failOnError, time.Second)))
+					Expect(err).NotTo(HaveOccurred())
+					_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+				})
+
+				AfterEach(func() {
+					server.Close()
+				})
+
+				It("posts the instance and adds the returned volume context", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(webhookBody.InstanceID).To(Equal(instanceID))
+					Expect(webhookBody.OrganizationGUID).To(Equal("some-org-guid"))
+					Expect(webhookBody.Volumes).To(Equal([]csibroker.ProvisionWebhookVolume{{VolumeID: "some-volume-id"}}))
+
+					_, stored := fakeStore.CreateInstanceDetailsArgsForCall(fakeStore.CreateInstanceDetailsCallCount() - 1)
+					volume := stored.ServiceFingerPrint.(csibroker.ServiceFingerPrint).Volume
+					Expect(volume.VolumeContext).To(Equal(map[string]string{"share": "server:/", "cmdb_id": "ci-42"}))
+				})
+
+				Context("when the webhook fails", func() {
 					BeforeEach(func() {
-						fakeStore.SaveReturns(errors.New("badness"))
+						statusCode = http.StatusInternalServerError
 					})
 
-					It("should error", func() {
-						Expect(err).To(HaveOccurred())
+					It("fails the provision and deletes the volume", func() {
+						Expect(err).To(MatchError("provision webhook failed: webhook returned 500"))
+						_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						Expect(request.VolumeId).To(Equal("some-volume-id"))
+					})
+
+					Context("when webhook failures are only logged", func() {
+						BeforeEach(func() {
+							failOnError = false
+						})
+
+						It("provisions anyway", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(0))
+						})
 					})
 				})
+			})
 
-				Context("delete-service was given no 'service_id'", func() {
+			Context("when the service requires parameters", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{RequiredParameters: []string{"zone", "tier"}, RequestedIDParameter: "tier"}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "parameters": {"zone": "a"}, "requested_id": "gold"}`)
+				})
+
+				It("provisions when parameters set by the broker supply them", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"zone": "a", "tier": "gold"}))
+				})
+
+				Context("when they are missing or empty", func() {
 					BeforeEach(func() {
-						deprovisionDetails = brokerapi.DeprovisionDetails{PlanID: "Existing"}
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "parameters": {"zone": ""}}`)
 					})
 
-					It("errors", func() {
-						Expect(err).To(Equal(errors.New("volume deletion requires \"service_id\"")))
+					It("is rejected listing the missing parameters", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err).To(MatchError(`volume "csi-storage" is missing required parameters: zone, tier`))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
 					})
 				})
+			})
 
-				Context("delete-service was given no 'plan_id'", func() {
+			Context("when the plan limits volume capacity", func() {
+				BeforeEach(func() {
+					service := csibroker.Service{PlanCapacities: map[string]csibroker.PlanCapacity{
+						"small-plan-id": {MinCapacity: "1Ki", MaxCapacity: "10Ki", DefaultCapacity: "2Ki"},
+					}}
+					service.Plans = []brokerapi.ServicePlan{{ID: "small-plan-id", Name: "small"}}
+					fakeServicesRegistry.ServiceReturns(service, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+
+					provisionDetails.PlanID = "small-plan-id"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity": "4Ki"}`)
+				})
+
+				It("provisions within the limits, capped at the plan's maximum", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.CapacityRange).To(Equal(&csi.CapacityRange{RequiredBytes: 4096, LimitBytes: 10240}))
+				})
+
+				Context("when no capacity is requested", func() {
 					BeforeEach(func() {
-						deprovisionDetails = brokerapi.DeprovisionDetails{ServiceID: "some-service-id"}
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
 					})
 
-					It("errors", func() {
-						Expect(err).To(Equal(errors.New("volume deletion requires \"plan_id\"")))
+					It("requests the plan's default", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.CapacityRange).To(Equal(&csi.CapacityRange{RequiredBytes: 2048, LimitBytes: 10240}))
 					})
 				})
 
-				Context("delete-service was given no instance id", func() {
+				Context("when more than the maximum is requested", func() {
 					BeforeEach(func() {
-						instanceID = ""
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity": "20Ki"}`)
 					})
 
-					It("errors", func() {
-						Expect(err).To(Equal(errors.New("volume deletion requires instance ID")))
+					It("is rejected naming the plan's limits", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err).To(MatchError(`plan "small" allows volumes of 1Ki to 10Ki: 20480 bytes requested`))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
 					})
 				})
 
-				Context("when the service instance already exists with the same details", func() {
+				Context("when less than the minimum is requested", func() {
 					BeforeEach(func() {
-						fakeStore.IsInstanceConflictReturns(false)
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity_range": {"required_bytes": 10}}`)
 					})
 
-					It("should not error", func() {
-						Expect(err).NotTo(HaveOccurred())
+					It("is rejected", func() {
+						Expect(err).To(MatchError(`plan "small" allows volumes of 1Ki to 10Ki: 10 bytes requested`))
 					})
 				})
 			})
-		})
 
-		Context(".Bind", func() {
-			var (
-				instanceID    string
-				serviceID     string
-				bindDetails   brokerapi.BindDetails
-				rawParameters json.RawMessage
-				params        map[string]interface{}
-			)
+			Context("when org quotas are configured", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithOrgQuota(3))
+					Expect(err).NotTo(HaveOccurred())
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{OrgQuota: &csibroker.OrgQuota{Instances: 2, Capacity: "100"}}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
 
-			BeforeEach(func() {
-				instanceID = "some-instance-id"
-				serviceID = "ServiceOne.ID"
-				params = make(map[string]interface{})
-				params["key"] = "value"
-				rawParameters, err = json.Marshal(params)
+					provisionDetails.ServiceID = "some-service-id"
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity_range": {"required_bytes": 10}}`)
 
-				fingerprint := csibroker.ServiceFingerPrint{
-					Name: "some-csi-storage",
-					Volume: &csi.Volume{
-						VolumeId:      instanceID,
-						VolumeContext: map[string]string{"foo": "bar"},
-					},
-				}
+					fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+						"instance-1": {ServiceID: "some-service-id", OrganizationGUID: "some-org-guid", ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{CapacityBytes: 40}}},
+						"instance-2": {ServiceID: "other-service-id", OrganizationGUID: "some-org-guid"},
+						"instance-3": {ServiceID: "some-service-id", OrganizationGUID: "other-org-guid", ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{CapacityBytes: 90}}},
+					}, nil)
+				})
 
-				// simulate untyped data loaded from a data file
-				jsonFingerprint := &map[string]interface{}{}
-				raw, err := json.Marshal(fingerprint)
-				Expect(err).ToNot(HaveOccurred())
-				err = json.Unmarshal(raw, jsonFingerprint)
-				Expect(err).ToNot(HaveOccurred())
+				It("provisions while the org is under its quotas", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+				})
 
-				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
-					ServiceID:          serviceID,
-					ServiceFingerPrint: jsonFingerprint,
-				}, nil)
+				Context("when the org is at the service's instance quota", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{OrgQuota: &csibroker.OrgQuota{Instances: 1}}, nil)
+					})
 
-				bindDetails = brokerapi.BindDetails{
-					AppGUID:       "guid",
-					ServiceID:     serviceID,
-					RawParameters: rawParameters,
-				}
+					It("rejects the provision before reaching the driver", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusForbidden))
+						Expect(err.Error()).To(Equal("quota exceeded for organization some-org-guid: at most 1 instances of this service are allowed"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the org is at the broker-wide instance quota", func() {
+					BeforeEach(func() {
+						broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithOrgQuota(2))
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("rejects the provision", func() {
+						Expect(err).To(MatchError("quota exceeded for organization some-org-guid: at most 2 instances are allowed"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the request would exceed the capacity quota", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "capacity_range": {"required_bytes": 61}}`)
+					})
+
+					It("rejects the provision", func() {
+						Expect(err).To(MatchError("quota exceeded for organization some-org-guid: instances of this service may hold at most 100, 40 bytes are in use and 61 requested"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
 			})
 
-			Context("when uid/gid is passed from binding config", func() {
+			Context("when the service maps plans to storage classes", func() {
 				BeforeEach(func() {
-					params["uid"] = "1000"
-					params["gid"] = "1001"
-					rawParameters, err = json.Marshal(params)
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{PlanToStorageClass: map[string]string{"CSI-Existing": "gold"}}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "parameters": {"storageClass": "platinum", "a": "b"}}`)
+				})
 
-					fingerprint := csibroker.ServiceFingerPrint{
-						Name: "some-csi-storage",
-						Volume: &csi.Volume{
-							VolumeId:      instanceID,
-							VolumeContext: map[string]string{"foo": "bar"},
-						},
-					}
+				It("sets the plan's storage class over the caller's", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"storageClass": "gold", "a": "b"}))
+				})
 
-					// simulate untyped data loaded from a data file
-					jsonFingerprint := &map[string]interface{}{}
-					raw, err := json.Marshal(fingerprint)
-					Expect(err).ToNot(HaveOccurred())
-					err = json.Unmarshal(raw, jsonFingerprint)
-					Expect(err).ToNot(HaveOccurred())
+				Context("when the service names the parameter", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{PlanToStorageClass: map[string]string{"CSI-Existing": "gold"}, StorageClassParameter: "tier"}, nil)
+					})
 
-					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
-						ServiceID:          serviceID,
-						ServiceFingerPrint: jsonFingerprint,
-					}, nil)
+					It("sets that parameter instead", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Parameters).To(Equal(map[string]string{"storageClass": "platinum", "tier": "gold", "a": "b"}))
+					})
+				})
+			})
 
-					bindDetails = brokerapi.BindDetails{
-						AppGUID:       "guid",
-						ServiceID:     serviceID,
-						RawParameters: rawParameters,
-					}
+			Context("when the service names its driver", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DriverName: "some-driver", ConnAddr: "0.0.0.0:1000"}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
 				})
 
-				It("should set bindingParams", func() {
-					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				It("records the driver in the stored fingerprint", func() {
 					Expect(err).NotTo(HaveOccurred())
-					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
-					Expect(bindingParams).To(Equal(map[string]string{"uid": "1000", "gid": "1001"}))
+					_, stored := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					fingerprint := stored.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+					Expect(fingerprint.DriverName).To(Equal("some-driver"))
+					Expect(fingerprint.ConnAddr).To(Equal("0.0.0.0:1000"))
 				})
 			})
 
-			Context("when no uid/gid is passed from binding config", func() {
-				It("bindingParams should be nil", func() {
-					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Context("when the service has a dashboard url template", func() {
+				var spec brokerapi.ProvisionedServiceSpec
+
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DashboardURLTemplate: "https://storage.example.com/{{.OrganizationGUID}}/volumes/{{.VolumeID}}?instance={{.InstanceID}}"}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
+				})
+
+				JustBeforeEach(func() {
+					spec, err = broker.Provision(ctx, "another-instance-id", provisionDetails, asyncAllowed)
+				})
+
+				It("returns the rendered dashboard url", func() {
 					Expect(err).NotTo(HaveOccurred())
-					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
-					Expect(bindingParams).Should(BeNil())
+					Expect(spec.DashboardURL).To(Equal("https://storage.example.com/some-org-guid/volumes/some-volume-id?instance=another-instance-id"))
 				})
 			})
 
-			Context("if the controller has not been probed yet", func() {
-				It("probes the controller", func() {
-					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-					_, request, _ := fakeIdentityClient.ProbeArgsForCall(0)
-					Expect(request).To(Equal(&csi.ProbeRequest{}))
-					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
-				})
+			Context("when a cloud events sink is configured", func() {
+				var (
+					server  *httptest.Server
+					events  chan csibroker.CloudEvent
+					process ifrit.Process
+				)
+
+				BeforeEach(func() {
+					events = make(chan csibroker.CloudEvent, 1)
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						var event csibroker.CloudEvent
+						json.NewDecoder(r.Body).Decode(&event)
+						events <- event
+					}))
+					emitter := csibroker.NewCloudEventEmitter(logger, fakeClock, server.URL, 1, time.Second)
+					process = ifrit.Invoke(emitter)
+
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithCloudEventEmitter(emitter))
+					Expect(err).NotTo(HaveOccurred())
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
+				})
+
+				AfterEach(func() {
+					process.Signal(os.Interrupt)
+					Eventually(process.Wait()).Should(Receive())
+					server.Close()
+				})
+
+				It("emits the outcome of the provision", func() {
+					Expect(err).NotTo(HaveOccurred())
+
+					var event csibroker.CloudEvent
+					Eventually(events).Should(Receive(&event))
+					Expect(event.Type).To(Equal("org.cloudfoundry.csibroker.provision.succeeded"))
+					Expect(event.Data.InstanceID).To(Equal(instanceID))
+					Expect(event.Data.ServiceID).To(Equal(provisionDetails.ServiceID))
+					Expect(event.Data.OrganizationGUID).To(Equal("some-org-guid"))
+				})
+			})
+
+			Context("when redact keys are configured", func() {
+				var testLogger *lagertest.TestLogger
+
+				BeforeEach(func() {
+					testLogger = lagertest.NewTestLogger("test-redaction")
+					broker, err = csibroker.New(testLogger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithRedactKeys([]string{"API_TOKEN"}))
+					Expect(err).NotTo(HaveOccurred())
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}], "parameters": {"api_token": "hunter2", "a": "b"}}`)
+				})
+
+				It("redacts their values from the logged parameters only", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(testLogger.Buffer().Contents())).NotTo(ContainSubstring("hunter2"))
+					Expect(string(testLogger.Buffer().Contents())).To(ContainSubstring(`"a":"b"`))
+
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters["api_token"]).To(Equal("hunter2"))
+				})
+			})
+
+			Context("when parameters are in protobuf text format", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithParameterFormat(csibroker.ParameterFormatProtoText))
+					Expect(err).NotTo(HaveOccurred())
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"capacity": "1Ki",
+						"create_volume_request": "name: 'csi-storage' volume_capabilities { mount {} access_mode { mode: SINGLE_NODE_WRITER } } parameters { key: 'a' value: 'b' }"
+					}`)
+				})
+
+				It("parses the request from the text", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Name).To(Equal("csi-storage"))
+					Expect(request.VolumeCapabilities[0].GetMount()).NotTo(BeNil())
+					Expect(request.VolumeCapabilities[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+					Expect(request.Parameters).To(Equal(map[string]string{"a": "b"}))
+					Expect(request.CapacityRange.RequiredBytes).To(Equal(int64(1024)))
+				})
+
+				Context("when the text does not parse", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"create_volume_request": "name: {"}`)
+					})
+
+					It("is rejected with a clear error", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(HavePrefix("parameter 'create_volume_request' must be a CreateVolumeRequest in protobuf text format"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the request is given as JSON", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "volume_capabilities": [{"mount": {}}]}`)
+					})
+
+					It("is rejected", func() {
+						Expect(err).To(MatchError("parameter 'create_volume_request' must be a CreateVolumeRequest in protobuf text format: missing"))
+					})
+				})
+			})
+
+			Context("when CF metadata labels are enabled", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithCFMetadataLabels("cf-", false))
+					Expect(err).NotTo(HaveOccurred())
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.SpaceGUID = "some-space-guid"
+				})
+
+				It("adds them to the driver parameters", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{
+						"a":              "b",
+						"cf-instance-id": instanceID,
+						"cf-org-guid":    "some-org-guid",
+						"cf-space-guid":  "some-space-guid",
+						"cf-plan-id":     "CSI-Existing",
+					}))
+				})
+
+				Context("when the caller sets one of the keys", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"volume_capabilities": [{"mount": {}}],
+							"parameters": {"cf-org-guid": "user-org"}
+						}`)
+					})
+
+					It("keeps the caller's value", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Parameters).To(HaveKeyWithValue("cf-org-guid", "user-org"))
+						Expect(request.Parameters).To(HaveKeyWithValue("cf-space-guid", "some-space-guid"))
+					})
+
+					Context("when collisions are errors", func() {
+						BeforeEach(func() {
+							broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+								csibroker.WithCFMetadataLabels("cf-", true))
+							Expect(err).NotTo(HaveOccurred())
+						})
+
+						It("rejects the provision", func() {
+							failure, ok := err.(*brokerapi.FailureResponse)
+							Expect(ok).To(BeTrue())
+							Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+							Expect(err.Error()).To(Equal("parameter 'cf-org-guid' is reserved for Cloud Foundry metadata"))
+							Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+						})
+					})
+				})
+			})
+
+			Context("when no plan is given", func() {
+				BeforeEach(func() {
+					provisionDetails.PlanID = ""
+				})
+
+				It("rejects the provision", func() {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err.Error()).To(Equal("plan_id is required"))
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+				})
+
+				Context("when the service has a default plan", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{DefaultPlanID: "default-plan-id"}, nil)
+					})
+
+					It("provisions the instance on it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, instance := fakeStore.CreateInstanceDetailsArgsForCall(0)
+						Expect(instance.PlanID).To(Equal("default-plan-id"))
+					})
+				})
+			})
+
+			Context("when the capacity range is inconsistent", func() {
+				expectRejected := func(message string) {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err.Error()).To(Equal(message))
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+				}
+
+				Context("when the limit is below the required size", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"capacity_range": {"required_bytes": 10, "limit_bytes": 5},
+							"volume_capabilities": [{"mount": {}}]
+						}`)
+					})
+
+					It("rejects it before reaching the driver", func() {
+						expectRejected("capacity_range.limit_bytes (5) must not be less than capacity_range.required_bytes (10)")
+					})
+				})
+
+				Context("when a bound is negative", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"capacity_range": {"required_bytes": -1},
+							"volume_capabilities": [{"mount": {}}]
+						}`)
+					})
+
+					It("rejects it before reaching the driver", func() {
+						expectRejected("capacity_range.required_bytes must not be negative, got -1")
+					})
+				})
+
+				Context("when an additional volume's limit is negative", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"volume_capabilities": [{"mount": {}}],
+							"additional_volumes": [
+								{"name": "csi-storage-logs", "capacity_range": {"limit_bytes": -5}, "volume_capabilities": [{"mount": {}}]}
+							]
+						}`)
+					})
+
+					It("rejects it before reaching the driver", func() {
+						expectRejected("capacity_range.limit_bytes must not be negative, got -5")
+					})
+				})
+			})
+
+			Context("when a human-readable capacity is given", func() {
+				BeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"capacity": "10Gi",
+						"volume_capabilities": [{"mount": {}}]
+					}`)
+				})
+
+				It("sends it to the driver in bytes", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.CapacityRange.RequiredBytes).To(Equal(int64(10737418240)))
+					Expect(request.Parameters).NotTo(HaveKey("capacity"))
+				})
+
+				Context("when the capacity is invalid", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"capacity": "10 gigs",
+							"volume_capabilities": [{"mount": {}}]
+						}`)
+					})
+
+					It("fails without creating a volume", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(ContainSubstring("10 gigs"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when required bytes are also given", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"capacity": "10Gi",
+							"capacity_range": {"required_bytes": 1},
+							"volume_capabilities": [{"mount": {}}]
+						}`)
+					})
+
+					It("rejects the conflict", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(ContainSubstring("conflicts with capacity_range.required_bytes"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+			})
+
+			Context("when a volume ID is requested", func() {
+				BeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"requested_id": "legacy-volume-id",
+						"volume_capabilities": [{"mount": {}}],
+						"parameters": {"a": "b"}
+					}`)
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{RequestedIDParameter: "volumeHandle"}, nil)
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "legacy-volume-id"}}, nil)
+				})
+
+				It("passes it to the driver in the mapped parameter", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"a": "b", "volumeHandle": "legacy-volume-id"}))
+				})
+
+				Context("when the service does not map it", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{}, nil)
+					})
+
+					It("fails without creating a volume", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal("parameter 'requested_id' is not supported by this service"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when the service enforces it", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{RequestedIDParameter: "volumeHandle", EnforceRequestedID: true}, nil)
+					})
+
+					It("succeeds when the driver honours it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
+					})
+
+					Context("when the driver assigns a different ID", func() {
+						BeforeEach(func() {
+							fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "other-volume-id"}}, nil)
+						})
+
+						It("fails and removes the created volume", func() {
+							Expect(err).To(Equal(csibroker.ErrRequestedIDMismatch{Requested: "legacy-volume-id", Actual: "other-volume-id"}))
+							Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+							Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+							_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+							Expect(request.VolumeId).To(Equal("other-volume-id"))
+						})
+					})
+				})
+			})
+
+			Context("when volumes are requested with access modes", func() {
+				BeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"volume_capabilities": [{"block": {}, "access_mode": {"mode": "SINGLE_NODE_WRITER"}}],
+						"additional_volumes": [{
+							"name": "csi-storage-shared",
+							"volume_capabilities": [
+								{"mount": {}, "access_mode": {"mode": "SINGLE_NODE_WRITER"}},
+								{"mount": {}, "access_mode": {"mode": "MULTI_NODE_READER_ONLY"}}
+							]
+						}]
+					}`)
+					fakeControllerClient.CreateVolumeStub = func(_ context.Context, request *csi.CreateVolumeRequest, _ ...grpc.CallOption) (*csi.CreateVolumeResponse, error) {
+						return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: request.Name + "-id"}}, nil
+					}
+				})
+
+				It("records each volume's mode, preferring a multi-node one", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, instance := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					fingerprint := instance.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+					Expect(fingerprint.AccessModes).To(Equal(map[string]string{
+						"csi-storage-id":        "SINGLE_NODE_WRITER",
+						"csi-storage-shared-id": "MULTI_NODE_READER_ONLY",
+					}))
+				})
+			})
+
+			Context("when the service templates parameter defaults", func() {
+				BeforeEach(func() {
+					provisionDetails.OrganizationGUID = "some-org-guid"
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"volume_capabilities": [{"mount": {}}],
+						"parameters": {"a": "b"}
+					}`)
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{ParameterTemplates: map[string]string{
+						"subdir": "{{.OrgGUID}}/{{.InstanceID}}",
+						"a":      "templated",
+					}}, nil)
+				})
+
+				It("renders them into the parameters the caller left unset", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{
+						"a":      "b",
+						"subdir": "some-org-guid/" + instanceID,
+					}))
+				})
+
+				Context("when the provision has additional volumes", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{
+							"name": "csi-storage",
+							"volume_capabilities": [{"mount": {}}],
+							"additional_volumes": [{"name": "csi-storage-logs", "volume_capabilities": [{"mount": {}}]}]
+						}`)
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{ParameterTemplates: map[string]string{"subdir": "{{.InstanceID}}/{{.Name}}"}}, nil)
+					})
+
+					It("renders them for each volume with its own name", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(2))
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Parameters).To(HaveKeyWithValue("subdir", instanceID+"/csi-storage"))
+						_, request, _ = fakeControllerClient.CreateVolumeArgsForCall(1)
+						Expect(request.Parameters).To(HaveKeyWithValue("subdir", instanceID+"/csi-storage-logs"))
+					})
+				})
+			})
+
+			Context("when labels are given", func() {
+				BeforeEach(func() {
+					provisionDetails.RawParameters = json.RawMessage(`{
+						"name": "csi-storage",
+						"labels": {"team": "payments", "cost-center": "42"},
+						"volume_capabilities": [{"mount": {}}],
+						"parameters": {"a": "b"}
+					}`)
+				})
+
+				It("records them in the fingerprint without passing them to the driver", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"a": "b"}))
+
+					_, instance := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					fingerprint := instance.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+					Expect(fingerprint.Labels).To(Equal(map[string]string{"team": "payments", "cost-center": "42"}))
+				})
+
+				Context("when the service maps a label to a parameter", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{LabelParameters: map[string]string{"cost-center": "costCenter"}}, nil)
+					})
+
+					It("passes only the mapped label to the driver", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Parameters).To(Equal(map[string]string{"a": "b", "costCenter": "42"}))
+					})
+				})
+
+				Context("when a label key contains '='", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "labels": {"team=x": "payments"}, "volume_capabilities": [{"mount": {}}]}`)
+					})
+
+					It("fails without creating a volume", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+
+				Context("when a label value is not a string", func() {
+					BeforeEach(func() {
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "labels": {"team": 7}, "volume_capabilities": [{"mount": {}}]}`)
+					})
+
+					It("fails without creating a volume", func() {
+						Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+			})
+
+			It("leaves the CreateVolume call without a deadline of its own", func() {
+				callCtx, _, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+				_, ok := callCtx.Deadline()
+				Expect(ok).To(BeFalse())
+			})
+
+			Context("when RPC timeouts are configured", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithRPCTimeouts(csibroker.RPCTimeouts{Default: time.Minute, CreateVolume: time.Hour}))
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("bounds CreateVolume by its own timeout", func() {
+					Expect(err).NotTo(HaveOccurred())
+					callCtx, _, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					deadline, ok := callCtx.Deadline()
+					Expect(ok).To(BeTrue())
+					Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+				})
+
+				Context("when a failed provision is rolled back", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{RequestedIDParameter: "volumeHandle", EnforceRequestedID: true}, nil)
+						provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "requested_id": "legacy-volume-id", "volume_capabilities": [{"mount": {}}]}`)
+						fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "other-volume-id"}}, nil)
+					})
+
+					It("bounds the DeleteVolume by the default", func() {
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+						callCtx, _, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						deadline, ok := callCtx.Deadline()
+						Expect(ok).To(BeTrue())
+						Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), 10*time.Second))
+					})
+				})
+			})
+
+			Context("when the driver already has a volume of that name with other parameters", func() {
+				var (
+					alreadyExists     *status.Status
+					deleteVolumeCalls int
+				)
+
+				BeforeEach(func() {
+					alreadyExists = status.New(codes.AlreadyExists, "volume exists with different parameters")
+				})
+
+				JustBeforeEach(func() {
+					// the outer JustBeforeEach has provisioned with a volume created
+					fakeControllerClient.CreateVolumeReturns(nil, alreadyExists.Err())
+					deleteVolumeCalls = fakeControllerClient.DeleteVolumeCallCount()
+					_, err = broker.Provision(ctx, instanceID, provisionDetails, asyncAllowed)
+				})
+
+				It("fails with a conflict naming the volume", func() {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusConflict))
+					Expect(err.Error()).To(ContainSubstring(`a volume named "csi-storage" already exists with incompatible parameters`))
+				})
+
+				Context("when existing volumes are adopted", func() {
+					BeforeEach(func() {
+						broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithAdoptExistingVolumes())
+						Expect(err).NotTo(HaveOccurred())
+						alreadyExists, err = alreadyExists.WithDetails(&csi.Volume{VolumeId: "existing-volume-id"})
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("provisions the instance on the volume the driver returned", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, instance := fakeStore.CreateInstanceDetailsArgsForCall(fakeStore.CreateInstanceDetailsCallCount() - 1)
+						fingerprint := instance.ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+						Expect(fingerprint.Volume.VolumeId).To(Equal("existing-volume-id"))
+					})
+
+					Context("when the provision fails afterwards", func() {
+						BeforeEach(func() {
+							fakeServicesRegistry.ServiceReturns(csibroker.Service{RequestedIDParameter: "volumeHandle", EnforceRequestedID: true}, nil)
+							provisionDetails.RawParameters = json.RawMessage(`{"name": "csi-storage", "requested_id": "legacy-volume-id", "volume_capabilities": [{"mount": {}}]}`)
+						})
+
+						It("leaves the adopted volume in place", func() {
+							Expect(err).To(Equal(csibroker.ErrRequestedIDMismatch{Requested: "legacy-volume-id", Actual: "existing-volume-id"}))
+							Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(deleteVolumeCalls))
+						})
+					})
+
+					Context("when the driver does not return the volume", func() {
+						BeforeEach(func() {
+							alreadyExists = status.New(codes.AlreadyExists, "volume exists with different parameters")
+						})
+
+						It("fails with a conflict", func() {
+							failure, ok := err.(*brokerapi.FailureResponse)
+							Expect(ok).To(BeTrue())
+							Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusConflict))
+						})
+					})
+				})
+			})
+
+			Context("when the client returns an error", func() {
+				BeforeEach(func() {
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{}, grpc.Errorf(codes.Unknown, "badness"))
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+
+			Context("create-service was given invalid JSON", func() {
+				BeforeEach(func() {
+					badJson := []byte("{this is not json")
+					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(badJson)}
+				})
+
+				It("errors", func() {
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				})
+
+			})
+			Context("create-service was given valid JSON but no 'name'", func() {
+				BeforeEach(func() {
+					configuration := `
+					{
+            "volume_capabilities":[
+               {
+                  "mount":{
+                     "fsType":"fsType",
+                     "mountFlags":[
+                        "-o something",
+                        "-t anotherthing"
+                     ]
+                  }
+               }
+            ]
+          }`
+					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+				})
+
+				It("errors", func() {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err.Error()).To(Equal("parameter 'name' is required"))
+				})
+			})
+
+			Context("create-service was given valid JSON but no 'volume_capabilities'", func() {
+				BeforeEach(func() {
+					configuration := `
+				  {
+				     "name":"csi-storage"
+				  }
+				  `
+					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+				})
+
+				It("errors", func() {
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err.Error()).To(Equal("parameter 'volume_capabilities' is required"))
+				})
+			})
+
+			Context("when no parameters are given", func() {
+				BeforeEach(func() {
+					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing"}
+				})
+
+				It("errors", func() {
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				})
+
+				Context("when the service has provision defaults", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{
+							ProvisionDefaults: json.RawMessage(`{"capacity_range":{"requiredBytes":"10"},"volume_capabilities":[{"mount":{"fsType":"ext4"}}]}`),
+						}, nil)
+					})
+
+					It("provisions using the defaults, named after the instance", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+						_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+						Expect(request.Name).To(Equal(instanceID))
+						Expect(request.GetCapacityRange().GetRequiredBytes()).To(Equal(int64(10)))
+						Expect(request.GetVolumeCapabilities()[0].GetMount().GetFsType()).To(Equal("ext4"))
+					})
+
+					Context("when parameters are given", func() {
+						BeforeEach(func() {
+							provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+						})
+
+						It("uses the given parameters", func() {
+							Expect(err).NotTo(HaveOccurred())
+							_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+							Expect(request.Name).To(Equal("csi-storage"))
+						})
+					})
+				})
+			})
+
+			Context("when a parameter set is referenced", func() {
+				BeforeEach(func() {
+					pwd, err := os.Getwd()
+					Expect(err).ToNot(HaveOccurred())
+					parameterSets, err := csibroker.NewParameterSets(logger, filepath.Join(pwd, "..", "fixtures", "parameter_sets.json"))
+					Expect(err).NotTo(HaveOccurred())
+
+					broker, err = csibroker.New(
+						logger,
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						fakeServicesRegistry,
+						csibroker.WithParameterSets(parameterSets),
+					)
+					Expect(err).NotTo(HaveOccurred())
+
+					configuration := `
+					{
+						"name":"csi-storage",
+						"parameter_set":"gold",
+						"volume_capabilities":[{"mount":{"fsType":"fsType"}}],
+						"parameters":{"tier":"custom"}
+					}`
+					provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+				})
+
+				It("merges the parameter set into the request parameters, keeping caller values", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(1))
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"tier": "custom", "replicas": "3"}))
+				})
+
+				Context("when the parameter set does not exist", func() {
+					BeforeEach(func() {
+						configuration := `
+						{
+							"name":"csi-storage",
+							"parameter_set":"bronze",
+							"volume_capabilities":[{"mount":{"fsType":"fsType"}}]
+						}`
+						provisionDetails = brokerapi.ProvisionDetails{PlanID: "CSI-Existing", RawParameters: json.RawMessage(configuration)}
+					})
+
+					It("is rejected as a bad request", func() {
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal(csibroker.ErrParameterSetNotFound{Name: "bronze"}.Error()))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
+			})
+
+			Context("when the service instance already exists with the same details", func() {
+				BeforeEach(func() {
+					fakeStore.IsInstanceConflictReturns(false)
+				})
+
+				It("should not error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("when the service instance already exists with different details", func() {
+				BeforeEach(func() {
+					fakeStore.IsInstanceConflictReturns(true)
+				})
+
+				It("should error", func() {
+					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+				})
+			})
+
+			Context("when a concurrent provision stored the instance while the volume was created", func() {
+				BeforeEach(func() {
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "other-volume-id"}},
+					}, nil)
+				})
+
+				It("deletes the redundant volume and reports the instance as existing", func() {
+					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+					Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+					_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+					Expect(request.VolumeId).To(Equal("some-volume-id"))
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+				})
+
+				Context("when the driver returned the stored volume", func() {
+					BeforeEach(func() {
+						fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+							ServiceFingerPrint: &csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "some-volume-id"}},
+						}, nil)
+					})
+
+					It("does not delete it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(0))
+					})
+				})
+			})
+
+			Context("when provisions run at once", func() {
+				var (
+					storeMutex sync.Mutex
+					stored     map[string]brokerstore.ServiceInstance
+					inFlight   int32
+					release    chan struct{}
+					volumes    int32
+				)
+
+				BeforeEach(func() {
+					stored = map[string]brokerstore.ServiceInstance{}
+					inFlight = 0
+					volumes = 0
+					release = make(chan struct{})
+
+					fakeStore.RetrieveInstanceDetailsStub = func(id string) (brokerstore.ServiceInstance, error) {
+						storeMutex.Lock()
+						defer storeMutex.Unlock()
+						instance, ok := stored[id]
+						if !ok {
+							return brokerstore.ServiceInstance{}, errors.New("not found")
+						}
+						return instance, nil
+					}
+					fakeStore.CreateInstanceDetailsStub = func(id string, instance brokerstore.ServiceInstance) error {
+						storeMutex.Lock()
+						defer storeMutex.Unlock()
+						stored[id] = instance
+						return nil
+					}
+					fakeStore.IsInstanceConflictReturns(false)
+					fakeControllerClient.DeleteVolumeReturns(&csi.DeleteVolumeResponse{}, nil)
+				})
+
+				JustBeforeEach(func() {
+					// set after the outer provision so that it does not block
+					fakeControllerClient.CreateVolumeStub = func(_ context.Context, _ *csi.CreateVolumeRequest, _ ...grpc.CallOption) (*csi.CreateVolumeResponse, error) {
+						volumeID := fmt.Sprintf("volume-%d", atomic.AddInt32(&volumes, 1))
+						atomic.AddInt32(&inFlight, 1)
+						defer atomic.AddInt32(&inFlight, -1)
+						<-release
+						return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: volumeID}}, nil
+					}
+				})
+
+				provisionAll := func(instanceIDs ...string) chan error {
+					errs := make(chan error, len(instanceIDs))
+					for _, id := range instanceIDs {
+						go func(id string) {
+							defer GinkgoRecover()
+							_, err := broker.Provision(ctx, id, provisionDetails, asyncAllowed)
+							errs <- err
+						}(id)
+					}
+					return errs
+				}
+
+				It("serializes provisions of the same instance and leaks no volume", func() {
+					errs := provisionAll("racing-instance-id", "racing-instance-id")
+
+					Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(Equal(int32(1)))
+					Consistently(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(Equal(int32(1)))
+					close(release)
+
+					results := []error{<-errs, <-errs}
+					Expect(results).To(ConsistOf(BeNil(), Equal(brokerapi.ErrInstanceAlreadyExists)))
+
+					Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+					_, deleted, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+					fingerprint := stored["racing-instance-id"].ServiceFingerPrint.(csibroker.ServiceFingerPrint)
+					Expect(deleted.VolumeId).NotTo(Equal(fingerprint.Volume.VolumeId))
+				})
+
+				It("provisions different instances concurrently", func() {
+					errs := provisionAll("first-instance-id", "second-instance-id")
+
+					Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(Equal(int32(2)))
+					close(release)
+
+					Expect(<-errs).To(Succeed())
+					Expect(<-errs).To(Succeed())
+					Expect(stored).To(HaveKey("first-instance-id"))
+					Expect(stored).To(HaveKey("second-instance-id"))
+				})
+			})
+
+			Context("when the service instance creation fails", func() {
+				BeforeEach(func() {
+					fakeStore.CreateInstanceDetailsReturns(errors.New("badness"))
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+
+			Context("when the save fails", func() {
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Context(".Deprovision", func() {
+			var (
+				instanceID         string
+				asyncAllowed       bool
+				deprovisionDetails brokerapi.DeprovisionDetails
+				err                error
+			)
+
+			BeforeEach(func() {
+				instanceID = "some-instance-id"
+				deprovisionDetails = brokerapi.DeprovisionDetails{PlanID: "Existing", ServiceID: "some-service-id"}
+				asyncAllowed = true
+			})
+
+			JustBeforeEach(func() {
+				_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
+			})
+
+			Context("when the probe fails", func() {
+				BeforeEach(func() {
+					fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, grpc.Errorf(codes.Unknown, "probe badness"))
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(Equal("rpc error: code = Unknown desc = probe badness"))
+				})
+			})
+
+			Context("when the instance does not exist", func() {
+				BeforeEach(func() {
+					instanceID = "does-not-exist"
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, brokerapi.ErrInstanceDoesNotExist)
+				})
+
+				It("should fail", func() {
+					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+				})
+			})
+
+			Context("given an existing instance", func() {
+				var (
+					previousSaveCallCount int
+				)
+
+				BeforeEach(func() {
+					asyncAllowed = false
+
+					fingerprint := csibroker.ServiceFingerPrint{
+						Name:   "some-csi-storage",
+						Volume: &csi.Volume{VolumeId: "some-volume-id"},
+					}
+
+					// simulate untyped data loaded from a data file
+					jsonFingerprint := &map[string]interface{}{}
+					raw, err := json.Marshal(fingerprint)
+					Expect(err).ToNot(HaveOccurred())
+					err = json.Unmarshal(raw, jsonFingerprint)
+					Expect(err).ToNot(HaveOccurred())
+
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID:          "some-service-id",
+						ServiceFingerPrint: jsonFingerprint,
+					}, nil)
+					previousSaveCallCount = fakeStore.SaveCallCount()
+				})
+
+				Context("when the request carries an originating identity", func() {
+					BeforeEach(func() {
+						ctx = csibroker.ContextWithOriginatingIdentity(ctx, csibroker.OriginatingIdentity{
+							Platform: "cloudfoundry",
+							Value:    map[string]interface{}{"user_id": "some-user-id"},
+						})
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{OriginatingIdentityParameter: "requestedBy"}, nil)
+					})
+
+					It("forwards it to the driver as a secret", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						Expect(request.Secrets).To(Equal(map[string]string{"requestedBy": `{"user_id":"some-user-id"}`}))
+					})
+				})
+
+				Context("if the controller has been probed already", func() {
+					JustBeforeEach(func() {
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
+					})
+
+					It("does not probe the controller again for any future calls", func() {
+						_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
+						Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+					})
+				})
+
+				It("probes the controller", func() {
+					_, request, _ := fakeIdentityClient.ProbeArgsForCall(0)
+					Expect(request).To(Equal(&csi.ProbeRequest{}))
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+				})
+
+				It("should succeed", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("save state", func() {
+					Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
+				})
+
+				It("should send the request to the controller client", func() {
+					expectedRequest := &csi.DeleteVolumeRequest{
+						VolumeId: "some-volume-id",
+						Secrets:  map[string]string{},
+					}
+					Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(1))
+					_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+					Expect(request).To(Equal(expectedRequest))
+				})
+
+				Context("when the instance has additional volumes", func() {
+					BeforeEach(func() {
+						fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+							ServiceID: "some-service-id",
+							ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+								Name:              "some-csi-storage",
+								Volume:            &csi.Volume{VolumeId: "some-volume-id"},
+								AdditionalVolumes: []*csi.Volume{{VolumeId: "second-volume-id"}},
+							},
+						}, nil)
+					})
+
+					It("deletes every volume", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(2))
+						_, request, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						Expect(request.VolumeId).To(Equal("second-volume-id"))
+						_, request, _ = fakeControllerClient.DeleteVolumeArgsForCall(1)
+						Expect(request.VolumeId).To(Equal("some-volume-id"))
+					})
+				})
+
+				Context("when a DeleteVolume timeout is configured", func() {
+					BeforeEach(func() {
+						broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+							csibroker.WithRPCTimeouts(csibroker.RPCTimeouts{Default: time.Hour, DeleteVolume: time.Minute}))
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("bounds the DeleteVolume call by it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						callCtx, _, _ := fakeControllerClient.DeleteVolumeArgsForCall(0)
+						deadline, ok := callCtx.Deadline()
+						Expect(ok).To(BeTrue())
+						Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), 10*time.Second))
+					})
+				})
+
+				Context("when the stored volume ID is empty", func() {
+					BeforeEach(func() {
+						fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+							ServiceID: "some-service-id",
+							ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+								Name:   "some-csi-storage",
+								Volume: &csi.Volume{},
+							},
+						}, nil)
+					})
+
+					It("fails without deleting anything", func() {
+						Expect(err).To(Equal(csibroker.ErrEmptyVolumeID{InstanceID: instanceID}))
+						Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(0))
+						Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(0))
+					})
+
+					Context("when deprovisioning such instances is allowed", func() {
+						JustBeforeEach(func() {
+							broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithAllowDeprovisionEmptyVolume())
+							Expect(err).NotTo(HaveOccurred())
+							_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
+						})
+
+						It("removes the instance from the store without calling the driver", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(0))
+							Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+							Expect(fakeStore.DeleteInstanceDetailsArgsForCall(0)).To(Equal(instanceID))
+							Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
+							Expect(logger.(*lagertest.TestLogger).Buffer().Contents()).To(ContainSubstring("stored-volume-id-empty"))
+						})
+					})
+
+					Context("when the fingerprint has no volume at all", func() {
+						BeforeEach(func() {
+							fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+								ServiceID:          "some-service-id",
+								ServiceFingerPrint: &csibroker.ServiceFingerPrint{Name: "some-csi-storage"},
+							}, nil)
+						})
+
+						It("fails the same way", func() {
+							Expect(err).To(Equal(csibroker.ErrEmptyVolumeID{InstanceID: instanceID}))
+						})
+					})
+				})
+
+				Context("when a deprovision webhook is configured", func() {
+					var (
+						server      *httptest.Server
+						statusCode  int
+						webhookBody csibroker.DeprovisionWebhookRequest
+						failOnError bool
+					)
+
+					BeforeEach(func() {
+						statusCode = http.StatusOK
+						failOnError = false
+						webhookBody = csibroker.DeprovisionWebhookRequest{}
+						server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+							defer GinkgoRecover()
+							Expect(json.NewDecoder(r.Body).Decode(&webhookBody)).To(Succeed())
+							w.WriteHeader(statusCode)
+						}))
+					})
+
+					JustBeforeEach(func() {
+						// the outer JustBeforeEach has deprovisioned without the webhook
+						broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+							csibroker.WithDeprovisionWebhook(csibroker.NewDeprovisionWebhook(server.URL, failOnError, time.Second)))
+						Expect(err).NotTo(HaveOccurred())
+						_, err = broker.Deprovision(ctx, instanceID, deprovisionDetails, asyncAllowed)
+					})
+
+					AfterEach(func() {
+						server.Close()
+					})
+
+					It("posts the deleted instance and its volumes", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(webhookBody.InstanceID).To(Equal(instanceID))
+						Expect(webhookBody.ServiceID).To(Equal("some-service-id"))
+						Expect(webhookBody.Name).To(Equal("some-csi-storage"))
+						Expect(webhookBody.VolumeIDs).To(Equal([]string{"some-volume-id"}))
+					})
+
+					Context("when the webhook fails", func() {
+						BeforeEach(func() {
+							statusCode = http.StatusInternalServerError
+						})
+
+						It("only logs the failure", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(string(logger.(*lagertest.TestLogger).Buffer().Contents())).To(ContainSubstring("deprovision-webhook.failed"))
+						})
+
+						Context("when webhook failures fail the deprovision", func() {
+							BeforeEach(func() {
+								failOnError = true
+							})
+
+							It("errors after the instance is deleted", func() {
+								Expect(err).To(MatchError("deprovision webhook failed: webhook returned 500"))
+								Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(2))
+							})
+						})
+					})
+				})
+
+				Context("when the client returns an error", func() {
+					BeforeEach(func() {
+						fakeControllerClient.DeleteVolumeReturns(&csi.DeleteVolumeResponse{}, grpc.Errorf(codes.Unknown, "badness"))
+					})
+
+					It("should error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+
+				Context("when the volume is already gone", func() {
+					BeforeEach(func() {
+						fakeControllerClient.DeleteVolumeReturns(nil, grpc.Errorf(codes.NotFound, "no such volume"))
+					})
+
+					It("removes the instance anyway", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+						Expect(fakeStore.SaveCallCount()).To(Equal(1))
+					})
+				})
+
+				Context("when deletion of the instance fails", func() {
+					BeforeEach(func() {
+						fakeStore.DeleteInstanceDetailsReturns(errors.New("badness"))
+					})
+
+					It("should error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+
+				Context("when the save fails", func() {
+					BeforeEach(func() {
+						fakeStore.SaveReturns(errors.New("badness"))
+					})
+
+					It("should error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+
+				Context("delete-service was given no 'service_id'", func() {
+					BeforeEach(func() {
+						deprovisionDetails = brokerapi.DeprovisionDetails{PlanID: "Existing"}
+					})
+
+					It("errors", func() {
+						Expect(err).To(Equal(errors.New("volume deletion requires \"service_id\"")))
+					})
+				})
+
+				Context("delete-service was given no 'plan_id'", func() {
+					BeforeEach(func() {
+						deprovisionDetails = brokerapi.DeprovisionDetails{ServiceID: "some-service-id"}
+					})
+
+					It("errors", func() {
+						Expect(err).To(Equal(errors.New("volume deletion requires \"plan_id\"")))
+					})
+				})
+
+				Context("delete-service was given no instance id", func() {
+					BeforeEach(func() {
+						instanceID = ""
+					})
+
+					It("errors", func() {
+						Expect(err).To(Equal(errors.New("volume deletion requires instance ID")))
+					})
+				})
+
+				Context("when the service instance already exists with the same details", func() {
+					BeforeEach(func() {
+						fakeStore.IsInstanceConflictReturns(false)
+					})
+
+					It("should not error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+			})
+		})
+
+		Context(".Bind", func() {
+			var (
+				instanceID    string
+				serviceID     string
+				bindDetails   brokerapi.BindDetails
+				rawParameters json.RawMessage
+				params        map[string]interface{}
+			)
+
+			BeforeEach(func() {
+				instanceID = "some-instance-id"
+				serviceID = "ServiceOne.ID"
+				params = make(map[string]interface{})
+				params["key"] = "value"
+				rawParameters, err = json.Marshal(params)
+
+				fingerprint := csibroker.ServiceFingerPrint{
+					Name: "some-csi-storage",
+					Volume: &csi.Volume{
+						VolumeId:      instanceID,
+						VolumeContext: map[string]string{"foo": "bar"},
+					},
+				}
+
+				// simulate untyped data loaded from a data file
+				jsonFingerprint := &map[string]interface{}{}
+				raw, err := json.Marshal(fingerprint)
+				Expect(err).ToNot(HaveOccurred())
+				err = json.Unmarshal(raw, jsonFingerprint)
+				Expect(err).ToNot(HaveOccurred())
+
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID:          serviceID,
+					ServiceFingerPrint: jsonFingerprint,
+				}, nil)
+
+				bindDetails = brokerapi.BindDetails{
+					AppGUID:       "guid",
+					ServiceID:     serviceID,
+					RawParameters: rawParameters,
+				}
+			})
+
+			Context("when the service does not support binding", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{
+						SupportedOperations: map[csibroker.Operation]bool{csibroker.OperationBind: false},
+					}, nil)
+				})
+
+				It("fails without probing the driver", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(Equal(csibroker.ErrOperationNotSupported(csibroker.OperationBind)))
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(0))
+					Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the service filters the volume context", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID: serviceID,
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Name: "some-csi-storage",
+							Volume: &csi.Volume{
+								VolumeId:      instanceID,
+								VolumeContext: map[string]string{"server": "nfs.example.com", "share": "/exports", "internalToken": "secret"},
+							},
+						},
+					}, nil)
+				})
+
+				Context("with an allow list", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{BindContextAllow: []string{"server", "share"}}, nil)
+					})
+
+					It("passes only the allowed keys", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"server": "nfs.example.com", "share": "/exports"}))
+					})
+				})
+
+				Context("with a deny list", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{BindContextDeny: []string{"internalToken"}}, nil)
+					})
+
+					It("withholds the denied keys", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"server": "nfs.example.com", "share": "/exports"}))
+					})
+				})
+			})
+
+			Context("when the instance has additional volumes", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID: serviceID,
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Name:   "some-csi-storage",
+							Volume: &csi.Volume{VolumeId: "primary-volume-id"},
+							AdditionalVolumes: []*csi.Volume{
+								{VolumeId: "second-volume-id", VolumeContext: map[string]string{"foo": "baz"}},
+							},
+						},
+					}, nil)
+				})
+
+				It("returns one mount per volume at distinct container paths", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts).To(HaveLen(2))
+
+					Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+					Expect(binding.VolumeMounts[0].Device.MountConfig["id"]).To(Equal("primary-volume-id"))
+
+					Expect(binding.VolumeMounts[1].ContainerDir).To(Equal("/var/vcap/data/some-instance-id-1"))
+					Expect(binding.VolumeMounts[1].Device.VolumeId).To(Equal("some-instance-id-volume-1"))
+					Expect(binding.VolumeMounts[1].Device.MountConfig["id"]).To(Equal("second-volume-id"))
+					Expect(binding.VolumeMounts[1].Device.MountConfig["attributes"]).To(Equal(map[string]string{"foo": "baz"}))
+				})
+			})
+
+			It("returns shared volume mounts by default", func() {
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].DeviceType).To(Equal("shared"))
+			})
+
+			Context("when the service is read-only by default", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DefaultReadonly: true}, nil)
+				})
+
+				It("mounts read-only", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+				})
+
+				Context("when the caller asks for a writable mount", func() {
+					BeforeEach(func() {
+						params["readonly"] = false
+						bindDetails.RawParameters, err = json.Marshal(params)
+						Expect(err).NotTo(HaveOccurred())
+					})
+
+					It("honours it", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+					})
+				})
+			})
+
+			Context("when the service configures a device type", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DeviceType: csibroker.DeviceTypeDedicated}, nil)
+				})
+
+				It("sets it on the volume mounts", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].DeviceType).To(Equal("dedicated"))
+				})
+			})
+
+			Context("when the instance recorded the access modes of its volumes", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID: serviceID,
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Name:              "some-csi-storage",
+							Volume:            &csi.Volume{VolumeId: "primary-volume-id"},
+							AdditionalVolumes: []*csi.Volume{{VolumeId: "second-volume-id"}},
+							AccessModes: map[string]string{
+								"primary-volume-id": "SINGLE_NODE_WRITER",
+								"second-volume-id":  "MULTI_NODE_MULTI_WRITER",
+							},
+						},
+					}, nil)
+				})
+
+				It("derives each mount's device type from its volume's access mode", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].DeviceType).To(Equal("dedicated"))
+					Expect(binding.VolumeMounts[1].DeviceType).To(Equal("shared"))
+				})
+
+				Context("when the service configures a device type", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{DeviceType: csibroker.DeviceTypeShared}, nil)
+					})
+
+					It("uses it for every mount", func() {
+						binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(binding.VolumeMounts[0].DeviceType).To(Equal("shared"))
+						Expect(binding.VolumeMounts[1].DeviceType).To(Equal("shared"))
+					})
+				})
+			})
+
+			It("stores the mounts it returns with secret attributes redacted", func() {
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID: serviceID,
+					ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+						Volume: &csi.Volume{VolumeId: instanceID, VolumeContext: map[string]string{"share": "server:/a", "password": "hunter2"}},
+					},
+				}, nil)
+
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).To(HaveKeyWithValue("password", "hunter2"))
+
+				Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+				Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
+				storedID, stored := fakeStore.CreateInstanceDetailsArgsForCall(0)
+				Expect(storedID).To(Equal(instanceID))
+				mounts := stored.ServiceFingerPrint.(*csibroker.ServiceFingerPrint).BindingMounts["binding-id"]
+				Expect(mounts).To(HaveLen(1))
+				Expect(mounts[0].ContainerDir).To(Equal(binding.VolumeMounts[0].ContainerDir))
+				Expect(mounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"share": "server:/a", "password": "[REDACTED]"}))
+			})
+
+			It("puts the instance back when it cannot be stored again", func() {
+				original := brokerstore.ServiceInstance{
+					ServiceID:          serviceID,
+					ServiceFingerPrint: map[string]interface{}{"Volume": map[string]interface{}{"volume_id": instanceID}},
+				}
+				fakeStore.RetrieveInstanceDetailsReturns(original, nil)
+				fakeStore.CreateInstanceDetailsReturnsOnCall(0, errors.New("store badness"))
+
+				_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).To(MatchError("failed to store instance details " + instanceID + ": store badness"))
+
+				Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(2))
+				restoredID, restored := fakeStore.CreateInstanceDetailsArgsForCall(1)
+				Expect(restoredID).To(Equal(instanceID))
+				Expect(restored).To(Equal(original))
+			})
+
+			It("leaves a stored fingerprint untouched when the bind cannot be stored", func() {
+				stored := &csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: instanceID}}
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{ServiceID: serviceID, ServiceFingerPrint: stored}, nil)
+				fakeStore.CreateInstanceDetailsReturnsOnCall(0, errors.New("store badness"))
+
+				_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).To(HaveOccurred())
+				Expect(stored.BindingMounts).To(BeEmpty())
+
+				_, restored := fakeStore.CreateInstanceDetailsArgsForCall(1)
+				Expect(restored.ServiceFingerPrint).To(BeIdenticalTo(stored))
+			})
+
+			Context("when uid/gid is passed from binding config", func() {
+				BeforeEach(func() {
+					params["uid"] = "1000"
+					params["gid"] = "1001"
+					rawParameters, err = json.Marshal(params)
+
+					fingerprint := csibroker.ServiceFingerPrint{
+						Name: "some-csi-storage",
+						Volume: &csi.Volume{
+							VolumeId:      instanceID,
+							VolumeContext: map[string]string{"foo": "bar"},
+						},
+					}
+
+					// simulate untyped data loaded from a data file
+					jsonFingerprint := &map[string]interface{}{}
+					raw, err := json.Marshal(fingerprint)
+					Expect(err).ToNot(HaveOccurred())
+					err = json.Unmarshal(raw, jsonFingerprint)
+					Expect(err).ToNot(HaveOccurred())
+
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID:          serviceID,
+						ServiceFingerPrint: jsonFingerprint,
+					}, nil)
+
+					bindDetails = brokerapi.BindDetails{
+						AppGUID:       "guid",
+						ServiceID:     serviceID,
+						RawParameters: rawParameters,
+					}
+				})
+
+				It("should set bindingParams", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
+					Expect(bindingParams).To(Equal(map[string]string{"uid": "1000", "gid": "1001"}))
+				})
+			})
+
+			Context("when no uid/gid is passed from binding config", func() {
+				It("bindingParams should be nil", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
+					Expect(bindingParams).Should(BeNil())
+				})
+			})
+
+			Context("when the service declares a default uid/gid", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{DefaultUID: float64(2000), DefaultGID: "2000"}, nil)
+				})
+
+				It("applies the defaults", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
+					Expect(bindingParams).To(Equal(map[string]string{"uid": "2000", "gid": "2000"}))
+				})
+
+				It("lets caller values override them, numeric or not", func() {
+					params["uid"] = 1000
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					bindingParams := binding.VolumeMounts[0].Device.MountConfig["binding-params"]
+					Expect(bindingParams).To(Equal(map[string]string{"uid": "1000", "gid": "2000"}))
+				})
+
+				It("rejects a uid that is not a whole number or string", func() {
+					params["uid"] = 10.5
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				})
+			})
+
+			Context("if the controller has not been probed yet", func() {
+				It("probes the controller", func() {
+					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					_, request, _ := fakeIdentityClient.ProbeArgsForCall(0)
+					Expect(request).To(Equal(&csi.ProbeRequest{}))
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+				})
+
+				Context("if the probe fails", func() {
+					BeforeEach(func() {
+						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, grpc.Errorf(codes.Unknown, "probe badness"))
+					})
+
+					It("should error", func() {
+						_, err = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(Equal("rpc error: code = Unknown desc = probe badness"))
+					})
+				})
+			})
+
+			Context("if the controller has been probed already", func() {
+				JustBeforeEach(func() {
+					fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
+					_, err = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+				})
+
+				It("does not probe the controller again for any future calls", func() {
+					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
+				})
+
+				It("probes the controller again once its connection has been re-dialled", func() {
+					fakeServicesRegistry.ConnectionGenerationReturns(1)
+					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(2))
+
+					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(2))
+				})
+			})
+
+			It("includes empty credentials to prevent CAPI crash", func() {
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.Credentials).NotTo(BeNil())
+			})
+
+			It("includes csi volume info in the service binding", func() {
+				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts).NotTo(BeEmpty())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(BeEmpty())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["id"]).To(Equal(instanceID))
+				Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).ToNot(BeEmpty())
+				attr, _ := binding.VolumeMounts[0].Device.MountConfig["attributes"].(map[string]string)
+				Expect(attr).ToNot(BeNil())
+				Expect(attr["foo"]).To(Equal("bar"))
+			})
+
+			It("uses the instance id in the default container path", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+			})
+
+			It("flows container path through", func() {
+				params["mount"] = "/var/vcap/otherdir/something"
+				bindDetails.RawParameters, err = json.Marshal(params)
+				Expect(err).NotTo(HaveOccurred())
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/otherdir/something"))
+			})
+
+			It("rejects relative container paths", func() {
+				params["mount"] = "var/vcap/otherdir"
+				bindDetails.RawParameters, err = json.Marshal(params)
+				Expect(err).NotTo(HaveOccurred())
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(Equal(csibroker.ErrInvalidMountPath{Path: "var/vcap/otherdir", Reason: "must be absolute"}))
+			})
+
+			It("rejects container paths that traverse upwards", func() {
+				params["mount"] = "/var/vcap/data/../../etc"
+				bindDetails.RawParameters, err = json.Marshal(params)
+				Expect(err).NotTo(HaveOccurred())
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+			})
+
+			Context("when mount config is passed through", func() {
+				BeforeEach(func() {
+					params["mount_config"] = map[string]interface{}{"cache": "none", "nconnect": 4}
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("merges it into the mount config", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("cache", "none"))
+					Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("nconnect", float64(4)))
+					Expect(binding.VolumeMounts[0].Device.MountConfig["id"]).To(Equal(instanceID))
+				})
+
+				It("refuses keys the broker sets itself", func() {
+					params["mount_config"] = map[string]interface{}{"id": "other-volume"}
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(Equal(csibroker.ErrInvalidMountConfig{Key: "id", Reason: "is reserved by the broker"}))
+					Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+				})
+
+				Context("when the service allows only some keys", func() {
+					BeforeEach(func() {
+						fakeServicesRegistry.ServiceReturns(csibroker.Service{AllowedMountConfigKeys: []string{"cache"}}, nil)
+					})
+
+					It("refuses the others", func() {
+						_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+						Expect(err).To(MatchError(ContainSubstring(`mount_config key "nconnect" is not allowed`)))
+					})
+				})
+			})
+
+			Context("when mount paths are restricted", func() {
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithAllowedMountPaths([]string{"/var/vcap/data", "/mnt/shared/"}))
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("allows paths below an allowed prefix", func() {
+					params["mount"] = "/mnt/shared/app"
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/mnt/shared/app"))
+				})
+
+				It("still allows the default container path", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+				})
+
+				It("rejects paths outside the allowlist, naming them", func() {
+					params["mount"] = "/var/vcap/database"
+					bindDetails.RawParameters, err = json.Marshal(params)
+					Expect(err).NotTo(HaveOccurred())
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring(`"/var/vcap/database"`))
+					Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the service enforces the plan's binding schema", func() {
+				BeforeEach(func() {
+					service := csibroker.Service{EnforceBindSchema: true}
+					service.Plans = []brokerapi.ServicePlan{{
+						ID: "some-plan-id",
+						Schemas: &brokerapi.ServiceSchemas{
+							Binding: brokerapi.ServiceBindingSchema{
+								Create: brokerapi.Schema{Parameters: map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"readonly": map[string]interface{}{"type": "boolean"},
+										"mount":    map[string]interface{}{"type": "string"},
+									},
+									"additionalProperties": false,
+								}},
+							},
+						},
+					}}
+					fakeServicesRegistry.ServiceReturns(service, nil)
+
+					instance, err := fakeStore.RetrieveInstanceDetails(instanceID)
+					Expect(err).NotTo(HaveOccurred())
+					instance.PlanID = "some-plan-id"
+					fakeStore.RetrieveInstanceDetailsReturns(instance, nil)
+				})
+
+				It("binds with parameters that match it", func() {
+					bindDetails.RawParameters = json.RawMessage(`{"readonly":true}`)
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+				})
+
+				It("rejects a misspelt parameter, suggesting the right one", func() {
+					bindDetails.RawParameters = json.RawMessage(`{"read_only":true}`)
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+					Expect(err).To(MatchError(`invalid bind parameters: parameter read_only is not allowed; did you mean "readonly"?`))
+					Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+				})
+
+				It("rejects a parameter of the wrong type", func() {
+					bindDetails.RawParameters = json.RawMessage(`{"readonly":"yes"}`)
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).To(MatchError("invalid bind parameters: parameter readonly must be of type boolean"))
+				})
+			})
+
+			It("uses rw as its default mode", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+			})
+
+			It("should write state", func() {
+				previousSaveCallCount := fakeStore.SaveCallCount()
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
+			})
+
+			It("errors if mode is not a boolean", func() {
+				params["readonly"] = ""
+				bindDetails.RawParameters, err = json.Marshal(params)
+				Expect(err).NotTo(HaveOccurred())
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			It("fills in the driver name", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("some-driver-name"))
+			})
+
+			It("fills in the volume id", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Device.VolumeId).To(ContainSubstring("some-instance-id"))
+			})
+
+			Context("when the binding already exists", func() {
+				It("doesn't error when binding the same details", func() {
+					fakeStore.IsBindingConflictReturns(false)
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("errors when binding different details", func() {
+					fakeStore.IsBindingConflictReturns(true)
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+				})
+			})
+
+			Context("when the details are not provided", func() {
+				BeforeEach(func() {
+					bindDetails.RawParameters = nil
+				})
+				It("succeeds", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("when the binding cannot be stored", func() {
+				var (
+					err error
+				)
+
+				BeforeEach(func() {
+					fakeStore.CreateBindingDetailsReturns(errors.New("badness"))
+					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+
+			})
+
+			Context("when the save fails", func() {
+				var (
+					err error
+				)
+				BeforeEach(func() {
+					fakeStore.SaveReturns(errors.New("badness"))
+					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				})
+
+				It("should error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+
+			It("errors when the service instance does not exist", func() {
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("Awesome!"))
+				_, err := broker.Bind(ctx, "nonexistent-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			Context("when a bind instance wait is configured", func() {
+				var done chan error
+
+				BeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry, csibroker.WithBindInstanceWait(time.Second))
+					Expect(err).NotTo(HaveOccurred())
+					done = make(chan error, 1)
+				})
+
+				It("binds an instance that is stored while it waits", func() {
+					fakeStore.RetrieveInstanceDetailsReturnsOnCall(0, brokerstore.ServiceInstance{}, errors.New("not yet"))
+					go func() {
+						_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+						done <- err
+					}()
+
+					fakeClock.WaitForWatcherAndIncrement(100 * time.Millisecond)
+					Eventually(done).Should(Receive(BeNil()))
+				})
+
+				It("errors once the wait elapses", func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("not found"))
+					go func() {
+						_, err := broker.Bind(ctx, "nonexistent-instance-id", "binding-id", bindDetails)
+						done <- err
+					}()
+
+					for i := 0; i < 10; i++ {
+						fakeClock.WaitForWatcherAndIncrement(100 * time.Millisecond)
+					}
+					Eventually(done).Should(Receive(Equal(brokerapi.ErrInstanceDoesNotExist)))
+				})
+			})
+
+			Context("when the service allows service keys", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{AllowServiceKeys: true}, nil)
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Volume: &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"password": "hunter2"}},
+						},
+					}, nil)
+				})
+
+				It("binds without an app guid and returns the redacted mounts as credentials", func() {
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts).To(BeEmpty())
+
+					mounts := binding.Credentials.(map[string]interface{})["volume_mounts"].([]brokerapi.VolumeMount)
+					Expect(mounts).To(HaveLen(1))
+					Expect(mounts[0].Device.MountConfig["id"]).To(Equal("some-volume-id"))
+					Expect(mounts[0].Device.MountConfig["attributes"]).To(Equal(map[string]string{"password": "[REDACTED]"}))
+				})
+			})
+
+			Context("when the service limits bindings per instance", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{MaxBindings: 2}, nil)
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Volume:        &csi.Volume{VolumeId: "some-volume-id"},
+							BindingMounts: map[string][]brokerapi.VolumeMount{"first-binding-id": nil},
+						},
+					}, nil)
+				})
+
+				It("binds while the instance is under the limit", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(1))
+				})
+
+				Context("when the instance is at the limit", func() {
+					BeforeEach(func() {
+						fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+							ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+								Volume:        &csi.Volume{VolumeId: "some-volume-id"},
+								BindingMounts: map[string][]brokerapi.VolumeMount{"first-binding-id": nil, "second-binding-id": nil},
+							},
+						}, nil)
+					})
+
+					It("refuses another binding", func() {
+						_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusForbidden))
+						Expect(err.Error()).To(Equal("instance some-instance-id already has the maximum of 2 bindings"))
+						Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+					})
+
+					It("still accepts a repeat of an existing binding", func() {
+						_, err := broker.Bind(ctx, "some-instance-id", "second-binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+			})
+
+			Context("when the service checks volumes on bind", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{CheckVolumeOnBind: true}, nil)
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Volume:            &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"share": "a"}},
+							AdditionalVolumes: []*csi.Volume{{VolumeId: "logs-volume-id"}},
+							AccessModes:       map[string]string{"some-volume-id": "SINGLE_NODE_WRITER"},
+						},
+					}, nil)
+				})
+
+				It("asks the driver about every volume of the instance", func() {
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeControllerClient.ValidateVolumeCapabilitiesCallCount()).To(Equal(2))
+
+					_, request, _ := fakeControllerClient.ValidateVolumeCapabilitiesArgsForCall(0)
+					Expect(request.GetVolumeId()).To(Equal("some-volume-id"))
+					Expect(request.GetVolumeContext()).To(Equal(map[string]string{"share": "a"}))
+					Expect(request.GetVolumeCapabilities()[0].GetAccessMode().GetMode()).To(Equal(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+					_, request, _ = fakeControllerClient.ValidateVolumeCapabilitiesArgsForCall(1)
+					Expect(request.GetVolumeId()).To(Equal("logs-volume-id"))
+				})
+
+				It("asks the driver without holding the store lock", func() {
+					fakeControllerClient.ValidateVolumeCapabilitiesStub = func(context.Context, *csi.ValidateVolumeCapabilitiesRequest, ...grpc.CallOption) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+						reconciled := make(chan struct{})
+						go func() {
+							defer close(reconciled)
+							broker.Reconcile(ctx)
+						}()
+						Eventually(reconciled).Should(BeClosed())
+						return &csi.ValidateVolumeCapabilitiesResponse{}, nil
+					}
+
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("bounds each call to the driver with a timeout", func() {
+					var deadlines []bool
+					fakeControllerClient.ValidateVolumeCapabilitiesStub = func(callCtx context.Context, _ *csi.ValidateVolumeCapabilitiesRequest, _ ...grpc.CallOption) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+						_, ok := callCtx.Deadline()
+						deadlines = append(deadlines, ok)
+						return &csi.ValidateVolumeCapabilitiesResponse{}, nil
+					}
+
+					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(deadlines).To(Equal([]bool{true, true}))
+				})
+
+				Context("when a volume no longer exists", func() {
+					BeforeEach(func() {
+						fakeControllerClient.ValidateVolumeCapabilitiesReturnsOnCall(1, nil, status.Error(codes.NotFound, "no such volume"))
+					})
+
+					It("fails the bind as gone without creating a binding", func() {
+						_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusGone))
+						Expect(err.Error()).To(Equal("the underlying volume logs-volume-id of instance some-instance-id no longer exists"))
+						Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(0))
+					})
+				})
+
+				for _, code := range []codes.Code{codes.Unimplemented, codes.Internal} {
+					code := code
+
+					It(fmt.Sprintf("binds when the check fails with %s", code), func() {
+						fakeControllerClient.ValidateVolumeCapabilitiesReturns(nil, status.Error(code, "no answer"))
+						_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeStore.CreateBindingDetailsCallCount()).To(Equal(1))
+					})
+				}
+			})
+
+			It("does not ask the driver about volumes unless the service checks them", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeControllerClient.ValidateVolumeCapabilitiesCallCount()).To(Equal(0))
+			})
+
+			It("errors when the app guid is not provided", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{})
+				Expect(err).To(Equal(brokerapi.ErrAppGuidNotProvided))
+			})
+		})
 
-				Context("if the probe fails", func() {
-					BeforeEach(func() {
-						fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, grpc.Errorf(codes.Unknown, "probe badness"))
-					})
+		Context(".LastOperation", func() {
+			var (
+				instanceID       string
+				provisionDetails brokerapi.ProvisionDetails
+			)
 
-					It("should error", func() {
-						_, err = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-						Expect(err).To(HaveOccurred())
-						Expect(err.Error()).To(Equal("rpc error: code = Unknown desc = probe badness"))
-					})
-				})
+			BeforeEach(func() {
+				instanceID = "some-instance-id"
+				provisionDetails = brokerapi.ProvisionDetails{
+					ServiceID:     "some-service-id",
+					PlanID:        "CSI-Existing",
+					RawParameters: json.RawMessage(`{"name":"csi-storage","volume_capabilities":[{"mount":{}}]}`),
+				}
+				fakeServicesRegistry.ServiceReturns(csibroker.Service{
+					PollInterval:              csibroker.Duration(10 * time.Second),
+					ExpectedOperationDuration: csibroker.Duration(time.Minute),
+				}, nil)
 			})
 
-			Context("if the controller has been probed already", func() {
-				JustBeforeEach(func() {
-					fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
-					_, err = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
-				})
-
-				It("does not probe the controller again for any future calls", func() {
-					_, _ = broker.Bind(ctx, instanceID, "binding-id", bindDetails)
-					Expect(fakeIdentityClient.ProbeCallCount()).To(Equal(1))
-				})
+			It("returns an empty operation for unknown instances", func() {
+				lastOperation, err := broker.LastOperation(ctx, "unknown-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation).To(Equal(brokerapi.LastOperation{}))
 			})
 
-			It("includes empty credentials to prevent CAPI crash", func() {
-				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+			It("reports in progress operations with their expected completion and poll interval", func() {
+				var lastOperation brokerapi.LastOperation
+				fakeControllerClient.CreateVolumeStub = func(_ context.Context, _ *csi.CreateVolumeRequest, _ ...grpc.CallOption) (*csi.CreateVolumeResponse, error) {
+					lastOperation, _ = broker.LastOperation(ctx, instanceID, "")
+					return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil
+				}
+
+				_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 
-				Expect(binding.Credentials).NotTo(BeNil())
+				Expect(lastOperation.State).To(Equal(brokerapi.InProgress))
+				Expect(lastOperation.Description).To(ContainSubstring(fakeClock.Now().Add(time.Minute).Format(time.RFC3339)))
+				Expect(lastOperation.Description).To(ContainSubstring("poll again in 10s"))
 			})
 
-			It("includes csi volume info in the service binding", func() {
-				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+			It("reports succeeded operations", func() {
+				_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 
-				Expect(binding.VolumeMounts).NotTo(BeEmpty())
-				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(BeEmpty())
-				Expect(binding.VolumeMounts[0].Device.MountConfig["id"]).To(Equal(instanceID))
-				Expect(binding.VolumeMounts[0].Device.MountConfig["attributes"]).ToNot(BeEmpty())
-				attr, _ := binding.VolumeMounts[0].Device.MountConfig["attributes"].(map[string]string)
-				Expect(attr).ToNot(BeNil())
-				Expect(attr["foo"]).To(Equal("bar"))
+				lastOperation, err := broker.LastOperation(ctx, instanceID, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation.State).To(Equal(brokerapi.Succeeded))
 			})
 
-			It("uses the instance id in the default container path", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			It("reports failed operations", func() {
+				fakeControllerClient.CreateVolumeReturns(nil, errors.New("badness"))
+
+				_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+				Expect(err).To(HaveOccurred())
+
+				lastOperation, err := broker.LastOperation(ctx, instanceID, "")
 				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/some-instance-id"))
+				Expect(lastOperation.State).To(Equal(brokerapi.Failed))
+				Expect(lastOperation.Description).To(ContainSubstring("badness"))
 			})
 
-			It("flows container path through", func() {
-				params["mount"] = "/var/vcap/otherdir/something"
-				bindDetails.RawParameters, err = json.Marshal(params)
+			It("forgets failed provisions once they are past retention", func() {
+				fakeControllerClient.CreateVolumeReturns(nil, errors.New("badness"))
+
+				for i := 0; i < 100; i++ {
+					_, err := broker.Provision(ctx, fmt.Sprintf("failed-instance-%d", i), provisionDetails, false)
+					Expect(err).To(HaveOccurred())
+				}
+				lastOperation, err := broker.LastOperation(ctx, "failed-instance-0", "")
 				Expect(err).NotTo(HaveOccurred())
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(lastOperation.State).To(Equal(brokerapi.Failed))
+
+				fakeClock.Increment(csibroker.OperationRetention + time.Second)
+				_, err = broker.Provision(ctx, instanceID, provisionDetails, false)
+				Expect(err).To(HaveOccurred())
+
+				for i := 0; i < 100; i++ {
+					lastOperation, err := broker.LastOperation(ctx, fmt.Sprintf("failed-instance-%d", i), "")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(lastOperation).To(Equal(brokerapi.LastOperation{}))
+				}
+				lastOperation, err = broker.LastOperation(ctx, instanceID, "")
 				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/otherdir/something"))
+				Expect(lastOperation.State).To(Equal(brokerapi.Failed))
 			})
 
-			It("uses rw as its default mode", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			It("hands out operation data that refers back to the instance", func() {
+				spec, err := broker.Provision(ctx, instanceID, provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
-			})
+				Expect(spec.OperationData).To(Equal("v1:provision:some-instance-id"))
 
-			It("should write state", func() {
-				previousSaveCallCount := fakeStore.SaveCallCount()
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				lastOperation, err := broker.LastOperation(ctx, instanceID, spec.OperationData)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
+				Expect(lastOperation.Description).To(Equal("provision succeeded"))
 			})
 
-			It("errors if mode is not a boolean", func() {
-				params["readonly"] = ""
-				bindDetails.RawParameters, err = json.Marshal(params)
+			It("reports binding operations when the operation data names a binding", func() {
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID:          "some-service-id",
+					ServiceFingerPrint: csibroker.ServiceFingerPrint{Name: "csi-storage", Volume: &csi.Volume{VolumeId: "some-volume-id"}},
+				}, nil)
+				_, err := broker.Bind(ctx, instanceID, "some-binding-id", brokerapi.BindDetails{AppGUID: "some-app-guid", ServiceID: "some-service-id"})
 				Expect(err).NotTo(HaveOccurred())
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
-			})
 
-			It("fills in the driver name", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				lastOperation, err := broker.LastOperation(ctx, instanceID, csibroker.OperationData{Operation: csibroker.OperationBind, Key: "some-binding-id"}.Encode())
 				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation.State).To(Equal(brokerapi.Succeeded))
+				Expect(lastOperation.Description).To(Equal("bind succeeded"))
 
-				Expect(binding.VolumeMounts[0].Driver).To(Equal("some-driver-name"))
+				lastOperation, err = broker.LastOperation(ctx, instanceID, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation).To(Equal(brokerapi.LastOperation{}))
 			})
 
-			It("fills in the volume id", func() {
-				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			It("forgets the operations on an instance once it is deprovisioned", func() {
+				_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID:          "some-service-id",
+					ServiceFingerPrint: csibroker.ServiceFingerPrint{Name: "csi-storage", Volume: &csi.Volume{VolumeId: "some-volume-id"}},
+				}, nil)
 
-				Expect(binding.VolumeMounts[0].Device.VolumeId).To(ContainSubstring("some-instance-id"))
+				_, err = broker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{ServiceID: "some-service-id", PlanID: "CSI-Existing"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				lastOperation, err := broker.LastOperation(ctx, instanceID, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation).To(Equal(brokerapi.LastOperation{}))
 			})
 
-			Context("when the binding already exists", func() {
-				It("doesn't error when binding the same details", func() {
-					fakeStore.IsBindingConflictReturns(false)
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-				})
+			It("keeps a failed deprovision to report on", func() {
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID:          "some-service-id",
+					ServiceFingerPrint: csibroker.ServiceFingerPrint{Name: "csi-storage", Volume: &csi.Volume{VolumeId: "some-volume-id"}},
+				}, nil)
+				fakeControllerClient.DeleteVolumeReturns(nil, errors.New("badness"))
 
-				It("errors when binding different details", func() {
-					fakeStore.IsBindingConflictReturns(true)
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
-				})
-			})
+				_, err := broker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{ServiceID: "some-service-id", PlanID: "CSI-Existing"}, false)
+				Expect(err).To(HaveOccurred())
 
-			Context("when the details are not provided", func() {
-				BeforeEach(func() {
-					bindDetails.RawParameters = nil
-				})
-				It("succeeds", func() {
-					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
-					Expect(err).NotTo(HaveOccurred())
-				})
+				lastOperation, err := broker.LastOperation(ctx, instanceID, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation.State).To(Equal(brokerapi.Failed))
 			})
 
-			Context("when the binding cannot be stored", func() {
-				var (
-					err error
-				)
-
-				BeforeEach(func() {
-					fakeStore.CreateBindingDetailsReturns(errors.New("badness"))
-					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			It("forgets the operations on a binding once it is unbound", func() {
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID:          "some-service-id",
+					ServiceFingerPrint: csibroker.ServiceFingerPrint{Name: "csi-storage", Volume: &csi.Volume{VolumeId: "some-volume-id"}},
+				}, nil)
+				bindDetails := brokerapi.BindDetails{AppGUID: "some-app-guid", ServiceID: "some-service-id"}
+				_, err := broker.Bind(ctx, instanceID, "some-binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				fakeStore.RetrieveBindingDetailsReturns(bindDetails, nil)
 
-				})
+				err = broker.Unbind(ctx, instanceID, "some-binding-id", brokerapi.UnbindDetails{ServiceID: "some-service-id"})
+				Expect(err).NotTo(HaveOccurred())
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
-				})
+				lastOperation, err := broker.LastOperation(ctx, instanceID, csibroker.OperationData{Operation: csibroker.OperationBind, Key: "some-binding-id"}.Encode())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperation).To(Equal(brokerapi.LastOperation{}))
+			})
 
+			It("rejects operation data it did not hand out", func() {
+				_, err := broker.LastOperation(ctx, instanceID, "v9:provision:some-instance-id")
+				failure, ok := err.(*brokerapi.FailureResponse)
+				Expect(ok).To(BeTrue())
+				Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
 			})
 
-			Context("when the save fails", func() {
-				var (
-					err error
-				)
+			Context("when the provision uses a deprecated parameter", func() {
+				var deprecation csibroker.ParameterDeprecation
+
 				BeforeEach(func() {
-					fakeStore.SaveReturns(errors.New("badness"))
-					_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+					deprecation = csibroker.ParameterDeprecation{Replacement: "parameter_set"}
+					provisionDetails.RawParameters = json.RawMessage(`{"name":"csi-storage","volume_capabilities":[{"mount":{}}],"parameters":{"a":"b"}}`)
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
+				JustBeforeEach(func() {
+					broker, err = csibroker.New(logger, fakeOs, fakeClock, fakeStore, fakeServicesRegistry,
+						csibroker.WithParameterDeprecations(csibroker.ParameterDeprecations{
+							csibroker.OperationProvision: {"parameters": deprecation},
+						}))
+					Expect(err).NotTo(HaveOccurred())
 				})
-			})
 
-			It("errors when the service instance does not exist", func() {
-				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("Awesome!"))
-				_, err := broker.Bind(ctx, "nonexistent-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
-				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
-			})
+				It("keeps honouring it and notes the deprecation", func() {
+					_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+					_, request, _ := fakeControllerClient.CreateVolumeArgsForCall(0)
+					Expect(request.Parameters).To(Equal(map[string]string{"a": "b"}))
 
-			It("errors when the app guid is not provided", func() {
-				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{})
-				Expect(err).To(Equal(brokerapi.ErrAppGuidNotProvided))
+					lastOperation, err := broker.LastOperation(ctx, instanceID, "")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(lastOperation.Description).To(Equal("provision succeeded (parameter 'parameters' is deprecated, use 'parameter_set' instead)"))
+				})
+
+				Context("when the parameter has been removed", func() {
+					BeforeEach(func() {
+						deprecation.Removed = true
+					})
+
+					It("rejects the provision", func() {
+						_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+						failure, ok := err.(*brokerapi.FailureResponse)
+						Expect(ok).To(BeTrue())
+						Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+						Expect(err.Error()).To(Equal("parameter 'parameters' is no longer supported, use 'parameter_set' instead"))
+						Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					})
+				})
 			})
 		})
 
@@ -821,6 +3571,31 @@ var _ = Describe("Broker", func() {
 				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
 			})
 
+			Context("when the instance records the binding's mounts", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+						ServiceID: "some-service-id",
+						ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+							Volume: &csi.Volume{VolumeId: "some-volume-id"},
+							BindingMounts: map[string][]brokerapi.VolumeMount{
+								"binding-id":       {{ContainerDir: "/var/vcap/data/a"}},
+								"other-binding-id": {{ContainerDir: "/var/vcap/data/b"}},
+							},
+						},
+					}, nil)
+				})
+
+				It("removes only that binding's mounts", func() {
+					err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
+					_, stored := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					mounts := stored.ServiceFingerPrint.(*csibroker.ServiceFingerPrint).BindingMounts
+					Expect(mounts).NotTo(HaveKey("binding-id"))
+					Expect(mounts).To(HaveKey("other-binding-id"))
+				})
+			})
+
 			It("should write state", func() {
 				previousCallCount := fakeStore.SaveCallCount()
 				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
@@ -850,6 +3625,100 @@ var _ = Describe("Broker", func() {
 				})
 			})
 		})
+		Context(".Update", func() {
+			var (
+				instanceID    string
+				updateDetails brokerapi.UpdateDetails
+			)
+
+			BeforeEach(func() {
+				instanceID = "some-instance-id"
+				updateDetails = brokerapi.UpdateDetails{
+					ServiceID:      "some-service-id",
+					PlanID:         "some-plan-id",
+					PreviousValues: brokerapi.PreviousValues{PlanID: "some-plan-id"},
+				}
+
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+					ServiceID: "some-service-id",
+					PlanID:    "some-plan-id",
+					ServiceFingerPrint: csibroker.ServiceFingerPrint{
+						Name:               "some-csi-storage",
+						Volume:             &csi.Volume{VolumeId: "some-volume-id"},
+						MaintenanceVersion: "1.0.0",
+					},
+				}, nil)
+				fakeServicesRegistry.ServiceReturns(csibroker.Service{
+					MaintenanceInfo: map[string]csibroker.MaintenanceInfo{
+						"some-plan-id": {Version: "2.0.0", Description: "new driver"},
+					},
+				}, nil)
+			})
+
+			JustBeforeEach(func() {
+				_, err = broker.Update(ctx, instanceID, updateDetails, false)
+			})
+
+			It("leaves the instance with the maintenance version it was provisioned with", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(1))
+				Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(0))
+				Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+			})
+
+			Context("when the service does not support updates", func() {
+				BeforeEach(func() {
+					fakeServicesRegistry.ServiceReturns(csibroker.Service{
+						SupportedOperations: map[csibroker.Operation]bool{csibroker.OperationUpdate: false},
+					}, nil)
+				})
+
+				It("responds with an unprocessable entity", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(Equal("This service does not support instance updates"))
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(422))
+					Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the plan changes", func() {
+				BeforeEach(func() {
+					updateDetails.PlanID = "some-other-plan-id"
+				})
+
+				It("is rejected", func() {
+					Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+				})
+			})
+
+			Context("when parameters are supplied", func() {
+				BeforeEach(func() {
+					updateDetails.RawParameters = json.RawMessage(`{"capacity_range":{"required_bytes":10}}`)
+				})
+
+				It("responds with an unprocessable entity", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(Equal("updating volume parameters is not supported"))
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(422))
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the instance does not exist", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("not found"))
+				})
+
+				It("fails", func() {
+					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+				})
+			})
+
+		})
 	})
 
 	Context("when creating for a subsequent time", func() {
@@ -857,7 +3726,7 @@ var _ = Describe("Broker", func() {
 			broker, err = csibroker.New(
 				logger,
 				fakeOs,
-				nil,
+				fakeClock,
 				fakeStore,
 				fakeServicesRegistry,
 			)
@@ -877,12 +3746,110 @@ var _ = Describe("Broker", func() {
 				broker, err = csibroker.New(
 					logger,
 					fakeOs,
-					nil,
+					fakeClock,
 					fakeStore,
 					fakeServicesRegistry,
 				)
 				Expect(err).To(MatchError("failed-to-load-store"))
 			})
+
+			Context("when the broker is started regardless", func() {
+				var provisionDetails brokerapi.ProvisionDetails
+
+				BeforeEach(func() {
+					broker, err = csibroker.New(
+						logger,
+						fakeOs,
+						fakeClock,
+						fakeStore,
+						fakeServicesRegistry,
+					)
+					Expect(err).To(HaveOccurred())
+
+					provisionDetails = brokerapi.ProvisionDetails{
+						ServiceID:     "some-service-id",
+						PlanID:        "CSI-Existing",
+						RawParameters: json.RawMessage(`{"name":"csi-storage","volume_capabilities":[{"mount":{}}]}`),
+					}
+					fakeControllerClient.CreateVolumeReturns(&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "some-volume-id"}}, nil)
+				})
+
+				It("refuses writes with 503 so that the empty state is never saved", func() {
+					_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+					failure, ok := err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusServiceUnavailable))
+					Expect(err.Error()).To(Equal(csibroker.ErrStateNotRestored.Error()))
+
+					_, err = broker.Bind(ctx, "some-instance-id", "some-binding-id", brokerapi.BindDetails{ServiceID: "some-service-id", AppGUID: "some-app-guid"})
+					failure, ok = err.(*brokerapi.FailureResponse)
+					Expect(ok).To(BeTrue())
+					Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusServiceUnavailable))
+
+					Expect(fakeControllerClient.CreateVolumeCallCount()).To(Equal(0))
+					Expect(fakeStore.SaveCallCount()).To(Equal(0))
+				})
+
+				It("accepts writes once a later restore succeeds", func() {
+					fakeStore.RestoreReturns(nil)
+
+					_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeStore.RestoreCallCount()).To(Equal(2))
+
+					_, err = broker.Provision(ctx, "some-other-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeStore.RestoreCallCount()).To(Equal(2))
+				})
+			})
+
+			Context("when restore retries are configured", func() {
+				newBroker := func() <-chan error {
+					errs := make(chan error, 1)
+					go func() {
+						defer GinkgoRecover()
+						_, err := csibroker.New(
+							logger,
+							fakeOs,
+							fakeClock,
+							fakeStore,
+							fakeServicesRegistry,
+							csibroker.WithRestoreRetries(2, time.Second),
+						)
+						errs <- err
+					}()
+					return errs
+				}
+
+				It("retries with doubling backoff until restoring succeeds", func() {
+					fakeStore.RestoreReturnsOnCall(2, nil)
+					errs := newBroker()
+
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(time.Second)
+					Eventually(fakeStore.RestoreCallCount).Should(Equal(2))
+
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(time.Second)
+					Consistently(fakeStore.RestoreCallCount).Should(Equal(2))
+					fakeClock.Increment(time.Second)
+
+					Eventually(errs).Should(Receive(BeNil()))
+					Expect(fakeStore.RestoreCallCount()).To(Equal(3))
+				})
+
+				It("returns the last error once the retries are used up", func() {
+					errs := newBroker()
+
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(time.Second)
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(2 * time.Second)
+
+					Eventually(errs).Should(Receive(MatchError("failed-to-load-store")))
+					Expect(fakeStore.RestoreCallCount()).To(Equal(3))
+				})
+			})
 		})
 	})
 })
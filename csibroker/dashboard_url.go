@@ -0,0 +1,55 @@
+package csibroker
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"text/template"
+)
+
+// DashboardURLData is what a service's dashboard_url_template is rendered
+// with, e.g. "https://storage.example.com/volumes/{{.VolumeID}}".
+type DashboardURLData struct {
+	InstanceID       string
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+	Name             string
+	VolumeID         string
+}
+
+// validateDashboardURLTemplate checks that the template parses, names only
+// known fields and renders an absolute URL.
+func validateDashboardURLTemplate(text string) error {
+	rendered, err := renderDashboardURL(text, DashboardURLData{
+		InstanceID: "instance-id",
+		ServiceID:  "service-id",
+		PlanID:     "plan-id",
+		Name:       "name",
+		VolumeID:   "volume-id",
+	})
+	if err != nil {
+		return err
+	}
+
+	dashboardURL, err := url.Parse(rendered)
+	if err != nil || !dashboardURL.IsAbs() {
+		return fmt.Errorf("dashboard_url_template does not render an absolute URL: %q", rendered)
+	}
+	return nil
+}
+
+func renderDashboardURL(text string, data DashboardURLData) (string, error) {
+	parsed, err := template.New("dashboard_url").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid dashboard_url_template: %s", err)
+	}
+
+	var rendered bytes.Buffer
+	err = parsed.Execute(&rendered, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid dashboard_url_template: %s", err)
+	}
+	return rendered.String(), nil
+}
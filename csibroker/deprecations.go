@@ -0,0 +1,116 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// ParameterDeprecation marks a request parameter as on its way out in favour
+// of Replacement. It keeps working, with a warning, until Removed is set.
+type ParameterDeprecation struct {
+	Replacement string `json:"replacement,omitempty"`
+	Removed     bool   `json:"removed,omitempty"`
+}
+
+func (d ParameterDeprecation) notice(key string) string {
+	state := "deprecated"
+	if d.Removed {
+		state = "no longer supported"
+	}
+	if d.Replacement == "" {
+		return fmt.Sprintf("parameter '%s' is %s", key, state)
+	}
+	return fmt.Sprintf("parameter '%s' is %s, use '%s' instead", key, state, d.Replacement)
+}
+
+// ParameterDeprecations lists the deprecated parameters of each operation,
+// e.g. {"bind": {"readonly": {"replacement": "access_mode"}}}.
+type ParameterDeprecations map[Operation]map[string]ParameterDeprecation
+
+type ErrInvalidParameterDeprecationsFile struct {
+	err error
+}
+
+func (e ErrInvalidParameterDeprecationsFile) Error() string {
+	return fmt.Sprintf("Invalid parameter deprecations file %s", e.err.Error())
+}
+
+func LoadParameterDeprecations(logger lager.Logger, path string) (ParameterDeprecations, error) {
+	logger = logger.Session("load-parameter-deprecations", lager.Data{"fileName": path})
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Error("failed-to-read-parameter-deprecations", err)
+		return nil, err
+	}
+
+	var deprecations ParameterDeprecations
+	err = json.Unmarshal(contents, &deprecations)
+	if err != nil {
+		logger.Error("failed-to-unmarshal-parameter-deprecations", err)
+		return nil, ErrInvalidParameterDeprecationsFile{err}
+	}
+
+	for operation := range deprecations {
+		if operation != OperationProvision && operation != OperationBind {
+			err = fmt.Errorf("operation %q takes no parameters", operation)
+			logger.Error("invalid-parameter-deprecations", err)
+			return nil, ErrInvalidParameterDeprecationsFile{err}
+		}
+	}
+
+	return deprecations, nil
+}
+
+// WithParameterDeprecations warns about, or once removed rejects, requests
+// that use deprecated parameters. Warnings are logged and, for provisions,
+// also reported in the instance's last operation description.
+func WithParameterDeprecations(deprecations ParameterDeprecations) Option {
+	return func(b *Broker) {
+		b.parameterDeprecations = deprecations
+	}
+}
+
+// checkDeprecatedParameters returns a notice for every deprecated parameter
+// among the top-level keys of the raw parameters, or a 400 failure if one of
+// them has been removed. Parameters that do not decode are left for the
+// operation to reject.
+func (b *Broker) checkDeprecatedParameters(logger lager.Logger, operation Operation, rawParameters json.RawMessage) ([]string, error) {
+	deprecations := b.parameterDeprecations[operation]
+	if len(deprecations) == 0 || hasNoParameters(rawParameters) {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &fields); err != nil {
+		return nil, nil
+	}
+
+	var keys []string
+	for key := range fields {
+		if _, ok := deprecations[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var notices []string
+	for _, key := range keys {
+		deprecation := deprecations[key]
+		if deprecation.Removed {
+			logger.Info("removed-parameter-rejected", lager.Data{"parameter": key, "replacement": deprecation.Replacement})
+			return nil, brokerapi.NewFailureResponse(fmt.Errorf("%s", deprecation.notice(key)), http.StatusBadRequest, "removed-parameter")
+		}
+
+		logger.Info("deprecated-parameter-used", lager.Data{"parameter": key, "replacement": deprecation.Replacement})
+		notices = append(notices, deprecation.notice(key))
+	}
+
+	return notices, nil
+}
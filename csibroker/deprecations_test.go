@@ -0,0 +1,69 @@
+package csibroker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadParameterDeprecations", func() {
+	var (
+		deprecations csibroker.ParameterDeprecations
+		path         string
+		logger       *lagertest.TestLogger
+		err          error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-parameter-deprecations")
+
+		pwd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(pwd, "..", "fixtures", "parameter_deprecations.json")
+	})
+
+	JustBeforeEach(func() {
+		deprecations, err = csibroker.LoadParameterDeprecations(logger, path)
+	})
+
+	It("loads the deprecations of each operation", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deprecations).To(Equal(csibroker.ParameterDeprecations{
+			csibroker.OperationBind:      {"readonly": {Replacement: "access_mode"}},
+			csibroker.OperationProvision: {"parameters": {Replacement: "parameter_set", Removed: true}},
+		}))
+	})
+
+	Context("when an operation takes no parameters", func() {
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "parameter-deprecations")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "deprecations.json")
+			Expect(ioutil.WriteFile(path, []byte(`{"deprovision": {"force": {}}}`), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(path))
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(BeAssignableToTypeOf(csibroker.ErrInvalidParameterDeprecationsFile{}))
+		})
+	})
+
+	Context("when the file does not exist", func() {
+		BeforeEach(func() {
+			path = "/does/not/exist.json"
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,113 @@
+package csibroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+)
+
+const DefaultDeprovisionWebhookTimeout = 30 * time.Second
+
+// DeprovisionWebhookRequest is the body POSTed to the deprovision webhook
+// once an instance's volumes are deleted and it is removed from the store.
+type DeprovisionWebhookRequest struct {
+	InstanceID       string   `json:"instance_id"`
+	ServiceID        string   `json:"service_id"`
+	PlanID           string   `json:"plan_id"`
+	OrganizationGUID string   `json:"organization_guid"`
+	SpaceGUID        string   `json:"space_guid"`
+	Name             string   `json:"name,omitempty"`
+	VolumeIDs        []string `json:"volume_ids"`
+}
+
+type ErrDeprovisionWebhookFailed struct {
+	Reason string
+}
+
+func (e ErrDeprovisionWebhookFailed) Error() string {
+	return fmt.Sprintf("deprovision webhook failed: %s", e.Reason)
+}
+
+// DeprovisionWebhook tells an operator's endpoint about every deprovisioned
+// instance, e.g. to decommission it in a CMDB or billing system.
+type DeprovisionWebhook struct {
+	url         string
+	failOnError bool
+	timeout     time.Duration
+	client      *http.Client
+}
+
+// NewDeprovisionWebhook POSTs to url, giving up after timeout. When
+// failOnError is set a failed call fails the deprovision, although the
+// instance is gone by then and a retry finds nothing to delete; otherwise it
+// is only logged.
+func NewDeprovisionWebhook(url string, failOnError bool, timeout time.Duration) *DeprovisionWebhook {
+	return &DeprovisionWebhook{
+		url:         url,
+		failOnError: failOnError,
+		timeout:     timeout,
+		client:      &http.Client{},
+	}
+}
+
+func (w *DeprovisionWebhook) call(ctx context.Context, logger lager.Logger, instanceID string, instance brokerstore.ServiceInstance, fingerprint *ServiceFingerPrint) error {
+	logger = logger.Session("deprovision-webhook")
+
+	err := w.post(ctx, instanceID, instance, fingerprint)
+	if err != nil {
+		logger.Error("failed", err, lager.Data{"failOnError": w.failOnError})
+		if w.failOnError {
+			return err
+		}
+		return nil
+	}
+
+	logger.Info("called")
+	return nil
+}
+
+func (w *DeprovisionWebhook) post(ctx context.Context, instanceID string, instance brokerstore.ServiceInstance, fingerprint *ServiceFingerPrint) error {
+	body := DeprovisionWebhookRequest{
+		InstanceID:       instanceID,
+		ServiceID:        instance.ServiceID,
+		PlanID:           instance.PlanID,
+		OrganizationGUID: instance.OrganizationGUID,
+		SpaceGUID:        instance.SpaceGUID,
+		Name:             fingerprint.Name,
+		VolumeIDs:        []string{fingerprint.Volume.GetVolumeId()},
+	}
+	for _, volume := range fingerprint.AdditionalVolumes {
+		body.VolumeIDs = append(body.VolumeIDs, volume.GetVolumeId())
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return ErrDeprovisionWebhookFailed{Reason: err.Error()}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return ErrDeprovisionWebhookFailed{Reason: fmt.Sprintf("webhook returned %d", response.StatusCode)}
+	}
+	return nil
+}
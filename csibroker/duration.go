@@ -0,0 +1,30 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration written in the specfile as a string such as
+// "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,163 @@
+package csibroker
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+)
+
+const StateEncryptionKeySize = 32
+
+var ErrInvalidStateEncryptionKey = fmt.Errorf("state encryption key must be %d base64 encoded bytes", StateEncryptionKeySize)
+
+// encryptedFingerprint is what an EncryptedStore hands to the wrapped store
+// in place of a fingerprint: AES-256-GCM ciphertext prefixed with its nonce.
+type encryptedFingerprint struct {
+	Encrypted string `json:"encrypted"`
+}
+
+// EncryptedStore encrypts instance fingerprints, which hold volume contexts
+// and other driver data, before they reach the wrapped store, and decrypts
+// them again when they are read. It works the same whether the wrapped store
+// is a file or a database. Binding records are stored as they are.
+//
+// There is one key and no rotation: fingerprints written with another key
+// fail to decrypt. Fingerprints stored before encryption was turned on are
+// read as they are and encrypted when their instance is next written.
+type EncryptedStore struct {
+	brokerstore.Store
+	aead cipher.AEAD
+}
+
+// ParseStateEncryptionKey decodes a base64 encoded AES-256 key.
+func ParseStateEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace([]byte(encoded))))
+	if err != nil || len(key) != StateEncryptionKeySize {
+		return nil, ErrInvalidStateEncryptionKey
+	}
+	return key, nil
+}
+
+func NewEncryptedStore(store brokerstore.Store, key []byte) (*EncryptedStore, error) {
+	if len(key) != StateEncryptionKeySize {
+		return nil, ErrInvalidStateEncryptionKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedStore{Store: store, aead: aead}, nil
+}
+
+func (s *EncryptedStore) RetrieveInstanceDetails(id string) (brokerstore.ServiceInstance, error) {
+	details, err := s.Store.RetrieveInstanceDetails(id)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+	return s.decrypt(details)
+}
+
+func (s *EncryptedStore) RetrieveAllInstanceDetails() (map[string]brokerstore.ServiceInstance, error) {
+	all, err := s.Store.RetrieveAllInstanceDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := map[string]brokerstore.ServiceInstance{}
+	for id, details := range all {
+		decrypted[id], err = s.decrypt(details)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decrypted, nil
+}
+
+func (s *EncryptedStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	encrypted, err := s.encrypt(details)
+	if err != nil {
+		return err
+	}
+	return s.Store.CreateInstanceDetails(id, encrypted)
+}
+
+// IsInstanceConflict compares plaintexts, since encrypting the same
+// fingerprint twice never gives the same ciphertext.
+func (s *EncryptedStore) IsInstanceConflict(id string, details brokerstore.ServiceInstance) bool {
+	existing, err := s.RetrieveInstanceDetails(id)
+	if err != nil {
+		return false
+	}
+
+	existingJSON, err := json.Marshal(existing)
+	if err != nil {
+		return true
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(existingJSON, detailsJSON)
+}
+
+func (s *EncryptedStore) encrypt(details brokerstore.ServiceInstance) (brokerstore.ServiceInstance, error) {
+	plaintext, err := json.Marshal(details.ServiceFingerPrint)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+
+	ciphertext := s.aead.Seal(nonce, nonce, plaintext, nil)
+	details.ServiceFingerPrint = encryptedFingerprint{Encrypted: base64.StdEncoding.EncodeToString(ciphertext)}
+	return details, nil
+}
+
+// decrypt replaces an encrypted fingerprint with its plaintext JSON, which
+// getFingerprint decodes like any other stored fingerprint.
+func (s *EncryptedStore) decrypt(details brokerstore.ServiceInstance) (brokerstore.ServiceInstance, error) {
+	raw, err := json.Marshal(details.ServiceFingerPrint)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+
+	var encrypted encryptedFingerprint
+	if json.Unmarshal(raw, &encrypted) != nil || encrypted.Encrypted == "" {
+		return details, nil
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted.Encrypted)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+	if len(ciphertext) < s.aead.NonceSize() {
+		return brokerstore.ServiceInstance{}, errors.New("encrypted fingerprint is truncated")
+	}
+
+	nonce, ciphertext := ciphertext[:s.aead.NonceSize()], ciphertext[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, fmt.Errorf("failed to decrypt fingerprint: %s", err)
+	}
+
+	details.ServiceFingerPrint = json.RawMessage(plaintext)
+	return details, nil
+}
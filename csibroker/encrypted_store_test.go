@@ -0,0 +1,123 @@
+package csibroker_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EncryptedStore", func() {
+	var (
+		fakeStore      *brokerstorefakes.FakeStore
+		key            []byte
+		encryptedStore *csibroker.EncryptedStore
+		instance       brokerstore.ServiceInstance
+	)
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		key = []byte("0123456789abcdef0123456789abcdef")
+
+		var err error
+		encryptedStore, err = csibroker.NewEncryptedStore(fakeStore, key)
+		Expect(err).NotTo(HaveOccurred())
+
+		instance = brokerstore.ServiceInstance{
+			ServiceID: "some-service-id",
+			PlanID:    "some-plan-id",
+			ServiceFingerPrint: &csibroker.ServiceFingerPrint{
+				Name:   "csi-storage",
+				Volume: &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"password": "secret"}},
+			},
+		}
+	})
+
+	storedInstance := func() brokerstore.ServiceInstance {
+		Expect(encryptedStore.CreateInstanceDetails("some-instance-id", instance)).To(Succeed())
+		_, stored := fakeStore.CreateInstanceDetailsArgsForCall(0)
+		return stored
+	}
+
+	It("hands only ciphertext of the fingerprint to the wrapped store", func() {
+		stored := storedInstance()
+		Expect(stored.ServiceID).To(Equal("some-service-id"))
+
+		encoded, err := json.Marshal(stored)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(encoded)).NotTo(ContainSubstring("some-volume-id"))
+		Expect(string(encoded)).NotTo(ContainSubstring("secret"))
+	})
+
+	It("decrypts fingerprints it reads back", func() {
+		fakeStore.RetrieveInstanceDetailsReturns(storedInstance(), nil)
+
+		retrieved, err := encryptedStore.RetrieveInstanceDetails("some-instance-id")
+		Expect(err).NotTo(HaveOccurred())
+
+		var fingerprint csibroker.ServiceFingerPrint
+		Expect(json.Unmarshal(retrieved.ServiceFingerPrint.(json.RawMessage), &fingerprint)).To(Succeed())
+		Expect(fingerprint.Volume.VolumeId).To(Equal("some-volume-id"))
+		Expect(fingerprint.Volume.VolumeContext).To(Equal(map[string]string{"password": "secret"}))
+	})
+
+	It("decrypts fingerprints restored as generic JSON", func() {
+		encoded, err := json.Marshal(storedInstance())
+		Expect(err).NotTo(HaveOccurred())
+		var restored brokerstore.ServiceInstance
+		Expect(json.Unmarshal(encoded, &restored)).To(Succeed())
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{"some-instance-id": restored}, nil)
+
+		all, err := encryptedStore.RetrieveAllInstanceDetails()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(all["some-instance-id"].ServiceFingerPrint.(json.RawMessage))).To(ContainSubstring("some-volume-id"))
+	})
+
+	It("reads fingerprints stored before encryption as they are", func() {
+		fakeStore.RetrieveInstanceDetailsReturns(instance, nil)
+
+		retrieved, err := encryptedStore.RetrieveInstanceDetails("some-instance-id")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retrieved).To(Equal(instance))
+	})
+
+	It("finds no conflict with the same instance", func() {
+		fakeStore.RetrieveInstanceDetailsReturns(storedInstance(), nil)
+
+		Expect(encryptedStore.IsInstanceConflict("some-instance-id", instance)).To(BeFalse())
+
+		instance.PlanID = "other-plan-id"
+		Expect(encryptedStore.IsInstanceConflict("some-instance-id", instance)).To(BeTrue())
+	})
+
+	Context("when the fingerprint was encrypted with another key", func() {
+		It("fails to read it", func() {
+			stored := storedInstance()
+			otherStore, err := csibroker.NewEncryptedStore(fakeStore, []byte("fedcba9876543210fedcba9876543210"))
+			Expect(err).NotTo(HaveOccurred())
+			fakeStore.RetrieveInstanceDetailsReturns(stored, nil)
+
+			_, err = otherStore.RetrieveInstanceDetails("some-instance-id")
+			Expect(err).To(MatchError(ContainSubstring("failed to decrypt fingerprint")))
+		})
+	})
+
+	Describe("ParseStateEncryptionKey", func() {
+		It("decodes a base64 encoded 32 byte key", func() {
+			parsed, err := csibroker.ParseStateEncryptionKey(base64.StdEncoding.EncodeToString(key) + "\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(key))
+		})
+
+		It("rejects keys of another size", func() {
+			_, err := csibroker.ParseStateEncryptionKey(base64.StdEncoding.EncodeToString([]byte("short")))
+			Expect(err).To(Equal(csibroker.ErrInvalidStateEncryptionKey))
+		})
+	})
+})
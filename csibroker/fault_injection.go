@@ -0,0 +1,190 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Fault describes the failures injected into one broker operation. FailEvery
+// fails every Nth call; Delay holds each call back before it reaches the
+// broker.
+type Fault struct {
+	FailEvery int      `json:"fail_every,omitempty"`
+	Delay     Duration `json:"delay,omitempty"`
+}
+
+type Faults map[Operation]Fault
+
+func (faults Faults) validate() error {
+	for operation, fault := range faults {
+		if !isKnownOperation(operation) {
+			return fmt.Errorf("unknown operation %q", operation)
+		}
+		if fault.FailEvery < 0 || fault.Delay < 0 {
+			return fmt.Errorf("fault for %q must not be negative", operation)
+		}
+	}
+	return nil
+}
+
+type ErrInjectedFault struct {
+	Operation Operation
+	Call      int
+}
+
+func (e ErrInjectedFault) Error() string {
+	return fmt.Sprintf("injected failure of %s call %d", e.Operation, e.Call)
+}
+
+// FaultInjector wraps a service broker and fails or delays its operations
+// as configured. It exists for exercising platform retry and cleanup paths
+// and should only be wired in when explicitly enabled.
+type FaultInjector struct {
+	brokerapi.ServiceBroker
+
+	logger lager.Logger
+	clock  clock.Clock
+
+	mutex  sync.Mutex
+	faults Faults
+	calls  map[Operation]int
+}
+
+func NewFaultInjector(logger lager.Logger, clock clock.Clock, broker brokerapi.ServiceBroker) *FaultInjector {
+	return &FaultInjector{
+		ServiceBroker: broker,
+		logger:        logger.Session("fault-injector"),
+		clock:         clock,
+		faults:        Faults{},
+		calls:         map[Operation]int{},
+	}
+}
+
+// SetFaults replaces the configured faults and restarts the call counts.
+func (f *FaultInjector) SetFaults(faults Faults) error {
+	if err := faults.validate(); err != nil {
+		return err
+	}
+	if faults == nil {
+		faults = Faults{}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.faults = faults
+	f.calls = map[Operation]int{}
+	f.logger.Info("faults-set", lager.Data{"faults": faults})
+	return nil
+}
+
+func (f *FaultInjector) Faults() Faults {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	faults := Faults{}
+	for operation, fault := range f.faults {
+		faults[operation] = fault
+	}
+	return faults
+}
+
+func (f *FaultInjector) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	if err := f.inject(ctx, OperationProvision); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	return f.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (f *FaultInjector) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	if err := f.inject(ctx, OperationDeprovision); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	return f.ServiceBroker.Deprovision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (f *FaultInjector) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	if err := f.inject(ctx, OperationBind); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	return f.ServiceBroker.Bind(ctx, instanceID, bindingID, details)
+}
+
+func (f *FaultInjector) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	if err := f.inject(ctx, OperationUnbind); err != nil {
+		return err
+	}
+	return f.ServiceBroker.Unbind(ctx, instanceID, bindingID, details)
+}
+
+func (f *FaultInjector) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	if err := f.inject(ctx, OperationUpdate); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	return f.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+}
+
+func (f *FaultInjector) inject(ctx context.Context, operation Operation) error {
+	f.mutex.Lock()
+	fault := f.faults[operation]
+	f.calls[operation]++
+	call := f.calls[operation]
+	f.mutex.Unlock()
+
+	if fault.Delay > 0 {
+		f.logger.Info("delaying-call", lager.Data{"operation": operation, "call": call, "delay": time.Duration(fault.Delay).String()})
+		select {
+		case <-f.clock.After(time.Duration(fault.Delay)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if fault.FailEvery > 0 && call%fault.FailEvery == 0 {
+		err := ErrInjectedFault{Operation: operation, Call: call}
+		f.logger.Info("failing-call", lager.Data{"operation": operation, "call": call})
+		return err
+	}
+
+	return nil
+}
+
+// NewFaultInjectionHandler serves the injector's faults at /admin/faults:
+// GET shows them, PUT replaces them and DELETE clears them. Like the other
+// admin endpoints it performs no authentication of its own.
+func NewFaultInjectionHandler(logger lager.Logger, injector *FaultInjector) http.Handler {
+	logger = logger.Session("admin-faults")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var faults Faults
+			if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "faults must be a JSON object keyed by operation")
+				return
+			}
+			if err := injector.SetFaults(faults); err != nil {
+				writeAdminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		case http.MethodDelete:
+			injector.SetFaults(nil)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		logger.Debug("faults", lager.Data{"method": r.Method})
+		writeAdminJSON(w, http.StatusOK, injector.Faults())
+	})
+}
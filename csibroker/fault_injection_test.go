@@ -0,0 +1,125 @@
+package csibroker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type countingBroker struct {
+	brokerapi.ServiceBroker
+	provisions int
+	binds      int
+}
+
+func (b *countingBroker) Provision(context.Context, string, brokerapi.ProvisionDetails, bool) (brokerapi.ProvisionedServiceSpec, error) {
+	b.provisions++
+	return brokerapi.ProvisionedServiceSpec{}, nil
+}
+
+func (b *countingBroker) Bind(context.Context, string, string, brokerapi.BindDetails) (brokerapi.Binding, error) {
+	b.binds++
+	return brokerapi.Binding{}, nil
+}
+
+var _ = Describe("FaultInjector", func() {
+	var (
+		broker    *countingBroker
+		fakeClock *fakeclock.FakeClock
+		injector  *csibroker.FaultInjector
+	)
+
+	BeforeEach(func() {
+		broker = &countingBroker{}
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
+		injector = csibroker.NewFaultInjector(lagertest.NewTestLogger("test-faults"), fakeClock, broker)
+	})
+
+	It("passes calls through when no faults are set", func() {
+		_, err := injector.Provision(context.TODO(), "some-instance-id", brokerapi.ProvisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(broker.provisions).To(Equal(1))
+	})
+
+	Context("when failing every Nth provision", func() {
+		BeforeEach(func() {
+			Expect(injector.SetFaults(csibroker.Faults{csibroker.OperationProvision: {FailEvery: 2}})).To(Succeed())
+		})
+
+		It("fails those calls without reaching the broker", func() {
+			var errs []error
+			for i := 0; i < 4; i++ {
+				_, err := injector.Provision(context.TODO(), "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				errs = append(errs, err)
+			}
+
+			Expect(errs[0]).NotTo(HaveOccurred())
+			Expect(errs[1]).To(Equal(csibroker.ErrInjectedFault{Operation: csibroker.OperationProvision, Call: 2}))
+			Expect(errs[2]).NotTo(HaveOccurred())
+			Expect(errs[3]).To(HaveOccurred())
+			Expect(broker.provisions).To(Equal(2))
+		})
+	})
+
+	Context("when delaying binds", func() {
+		BeforeEach(func() {
+			Expect(injector.SetFaults(csibroker.Faults{csibroker.OperationBind: {Delay: csibroker.Duration(time.Minute)}})).To(Succeed())
+		})
+
+		It("holds the call back until the delay has passed", func() {
+			done := make(chan error)
+			go func() {
+				_, err := injector.Bind(context.TODO(), "some-instance-id", "some-binding-id", brokerapi.BindDetails{})
+				done <- err
+			}()
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			Consistently(done).ShouldNot(Receive())
+
+			fakeClock.Increment(time.Minute)
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(broker.binds).To(Equal(1))
+		})
+	})
+
+	It("rejects faults for unknown operations", func() {
+		Expect(injector.SetFaults(csibroker.Faults{"explode": {FailEvery: 1}})).NotTo(Succeed())
+	})
+
+	Describe("NewFaultInjectionHandler", func() {
+		var recorder *httptest.ResponseRecorder
+
+		serve := func(method, body string) {
+			recorder = httptest.NewRecorder()
+			handler := csibroker.NewFaultInjectionHandler(lagertest.NewTestLogger("test-faults"), injector)
+			handler.ServeHTTP(recorder, httptest.NewRequest(method, "/admin/faults", strings.NewReader(body)))
+		}
+
+		It("replaces the faults on PUT and clears them on DELETE", func() {
+			serve("PUT", `{"provision": {"fail_every": 3, "delay": "2s"}}`)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(injector.Faults()).To(Equal(csibroker.Faults{
+				csibroker.OperationProvision: {FailEvery: 3, Delay: csibroker.Duration(2 * time.Second)},
+			}))
+
+			serve("DELETE", "")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(injector.Faults()).To(BeEmpty())
+		})
+
+		It("rejects invalid faults", func() {
+			serve("PUT", `{"provision": {"fail_every": -1}}`)
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,97 @@
+package csibroker
+
+import (
+	"bytes"
+	"encoding/json"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// fingerprintFields has every field of ServiceFingerPrint and none of its
+// methods, so that it can be encoded without recursing into MarshalJSON.
+type fingerprintFields ServiceFingerPrint
+
+// fingerprintJSON shadows the CSI volumes of a fingerprint with their raw
+// JSON. Every other field is encoded as plain JSON through the embedded
+// fields.
+type fingerprintJSON struct {
+	*fingerprintFields
+	Volume            json.RawMessage
+	AdditionalVolumes []json.RawMessage `json:",omitempty"`
+}
+
+// MarshalJSON encodes the CSI volumes with jsonpb so that oneof fields such
+// as the content source, which encoding/json cannot decode again, survive a
+// store round trip.
+func (f ServiceFingerPrint) MarshalJSON() ([]byte, error) {
+	encoded := fingerprintJSON{fingerprintFields: (*fingerprintFields)(&f)}
+
+	var err error
+	encoded.Volume, err = marshalVolume(f.Volume)
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range f.AdditionalVolumes {
+		raw, err := marshalVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		encoded.AdditionalVolumes = append(encoded.AdditionalVolumes, raw)
+	}
+
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON also reads fingerprints stored before the volumes were
+// encoded with jsonpb. Fields jsonpb does not recognise in those, such as
+// encoding/json's rendering of oneofs, are dropped.
+func (f *ServiceFingerPrint) UnmarshalJSON(data []byte) error {
+	decoded := fingerprintJSON{fingerprintFields: (*fingerprintFields)(f)}
+
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	f.Volume, err = unmarshalVolume(decoded.Volume)
+	if err != nil {
+		return err
+	}
+	f.AdditionalVolumes = nil
+	for _, raw := range decoded.AdditionalVolumes {
+		volume, err := unmarshalVolume(raw)
+		if err != nil {
+			return err
+		}
+		f.AdditionalVolumes = append(f.AdditionalVolumes, volume)
+	}
+
+	return nil
+}
+
+func marshalVolume(volume *csi.Volume) (json.RawMessage, error) {
+	if volume == nil {
+		return json.RawMessage("null"), nil
+	}
+
+	var buffer bytes.Buffer
+	err := (&jsonpb.Marshaler{OrigName: true}).Marshal(&buffer, volume)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func unmarshalVolume(raw json.RawMessage) (*csi.Volume, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	volume := &csi.Volume{}
+	err := (&jsonpb.Unmarshaler{AllowUnknownFields: true}).Unmarshal(bytes.NewReader(raw), volume)
+	if err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
@@ -0,0 +1,74 @@
+package csibroker_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ServiceFingerPrint", func() {
+	var volume *csi.Volume
+
+	BeforeEach(func() {
+		volume = &csi.Volume{
+			VolumeId:      "some-volume-id",
+			CapacityBytes: 10737418240,
+			VolumeContext: map[string]string{"share": "server:/export"},
+			ContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "some-snapshot-id"},
+				},
+			},
+			AccessibleTopology: []*csi.Topology{
+				{Segments: map[string]string{"zone": "z1"}},
+			},
+		}
+	})
+
+	It("round-trips every field of its volumes", func() {
+		original := csibroker.ServiceFingerPrint{
+			Name:              "some-name",
+			Volume:            volume,
+			SnapshotID:        "some-snapshot-id",
+			AdditionalVolumes: []*csi.Volume{volume},
+			Labels:            map[string]string{"team": "payments"},
+		}
+
+		raw, err := json.Marshal(original)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(raw)).To(ContainSubstring(`"Name":"some-name"`))
+
+		var decoded csibroker.ServiceFingerPrint
+		Expect(json.Unmarshal(raw, &decoded)).To(Succeed())
+
+		Expect(decoded.Name).To(Equal("some-name"))
+		Expect(decoded.SnapshotID).To(Equal("some-snapshot-id"))
+		Expect(proto.Equal(decoded.Volume, volume)).To(BeTrue(), decoded.Volume.String())
+		Expect(decoded.AdditionalVolumes).To(HaveLen(1))
+		Expect(proto.Equal(decoded.AdditionalVolumes[0], volume)).To(BeTrue())
+		Expect(decoded.Labels).To(Equal(map[string]string{"team": "payments"}))
+	})
+
+	It("reads fingerprints whose volume was stored as plain JSON", func() {
+		raw := []byte(`{"Name":"some-name","Volume":{"capacity_bytes":5,"volume_id":"some-volume-id","ContentSource":{"Type":{}}}}`)
+
+		var decoded csibroker.ServiceFingerPrint
+		Expect(json.Unmarshal(raw, &decoded)).To(Succeed())
+		Expect(decoded.Volume.VolumeId).To(Equal("some-volume-id"))
+		Expect(decoded.Volume.CapacityBytes).To(Equal(int64(5)))
+	})
+
+	It("keeps a missing volume nil", func() {
+		raw, err := json.Marshal(csibroker.ServiceFingerPrint{Name: "some-name"})
+		Expect(err).NotTo(HaveOccurred())
+
+		var decoded csibroker.ServiceFingerPrint
+		Expect(json.Unmarshal(raw, &decoded)).To(Succeed())
+		Expect(decoded.Volume).To(BeNil())
+	})
+})
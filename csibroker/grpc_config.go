@@ -0,0 +1,133 @@
+package csibroker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+const DefaultGRPCKeepaliveTimeout = 20 * time.Second
+
+// GRPCConfig holds the gRPC settings for dialling one service's driver. Each
+// setting given here takes precedence over the broker-wide flags.
+type GRPCConfig struct {
+	// Timeout bounds every call to the driver.
+	Timeout Duration `json:"timeout,omitempty"`
+	// MaxMessageSize caps, in bytes, the messages sent to and received from
+	// the driver.
+	MaxMessageSize int            `json:"max_message_size,omitempty"`
+	TLS            *GRPCTLSConfig `json:"tls,omitempty"`
+	// KeepaliveTime pings the driver after this much connection inactivity.
+	KeepaliveTime Duration `json:"keepalive_time,omitempty"`
+	// KeepaliveTimeout defaults to DefaultGRPCKeepaliveTimeout.
+	KeepaliveTimeout Duration `json:"keepalive_timeout,omitempty"`
+}
+
+// GRPCTLSConfig dials the driver over TLS. CACertFile verifies the driver,
+// falling back to the system roots; CertFile and KeyFile, which go together,
+// are presented as the broker's client certificate.
+type GRPCTLSConfig struct {
+	CACertFile string `json:"ca_cert_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+func (c GRPCConfig) validate() error {
+	if c.Timeout < 0 {
+		return errors.New("grpc timeout must not be negative")
+	}
+	if c.MaxMessageSize < 0 {
+		return errors.New("grpc max_message_size must not be negative")
+	}
+	if c.KeepaliveTime < 0 || c.KeepaliveTimeout < 0 {
+		return errors.New("grpc keepalive_time and keepalive_timeout must not be negative")
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("grpc tls cert_file and key_file must be given together")
+	}
+	return nil
+}
+
+// dialOptions turns the config into dial options, loading any TLS files.
+// The transport credentials are only among them when TLS is configured.
+func (c GRPCConfig) dialOptions() ([]grpc.DialOption, error) {
+	var options []grpc.DialOption
+
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.load()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	if c.KeepaliveTime > 0 {
+		timeout := time.Duration(c.KeepaliveTimeout)
+		if timeout == 0 {
+			timeout = DefaultGRPCKeepaliveTimeout
+		}
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(c.KeepaliveTime),
+			Timeout:             timeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	if c.MaxMessageSize > 0 {
+		options = append(options, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(c.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(c.MaxMessageSize),
+		))
+	}
+
+	if c.Timeout > 0 {
+		options = append(options, grpc.WithChainUnaryInterceptor(TimeoutUnaryClientInterceptor(time.Duration(c.Timeout))))
+	}
+
+	return options, nil
+}
+
+func (c GRPCTLSConfig) load() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: c.ServerName}
+
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("grpc tls ca_cert_file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("grpc tls ca_cert_file %q holds no PEM certificates", c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("grpc tls cert_file and key_file: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// TimeoutUnaryClientInterceptor fails every unary call that takes longer
+// than timeout. A caller's earlier deadline still applies.
+func TimeoutUnaryClientInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
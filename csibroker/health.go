@@ -0,0 +1,194 @@
+package csibroker
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/csibroker/version"
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const DefaultStoreProbeInterval = 10 * time.Second
+
+// ServiceHealth is reachable when all of the service's plugins answer a
+// Probe. Error is the controller plugin's; a node plugin probed apart from
+// it reports under Node.
+type ServiceHealth struct {
+	ServiceID   string        `json:"service_id"`
+	ServiceName string        `json:"service_name"`
+	Reachable   bool          `json:"reachable"`
+	Error       string        `json:"error,omitempty"`
+	Node        *PluginHealth `json:"node_plugin,omitempty"`
+}
+
+type PluginHealth struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type StoreHealth struct {
+	Reachable bool      `json:"reachable"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Healthy  bool            `json:"healthy"`
+	Services []ServiceHealth `json:"services"`
+	Store    StoreHealth     `json:"store"`
+	Version  version.Info    `json:"version"`
+}
+
+// StoreProbe checks that the broker's store backend answers, through ping.
+// It reuses its last result for interval so that frequent health checks do
+// not each reach the backend.
+type StoreProbe struct {
+	logger   lager.Logger
+	clock    clock.Clock
+	ping     func() error
+	interval time.Duration
+
+	mutex sync.Mutex
+	last  *StoreHealth
+}
+
+// NewStoreProbe probes the store with ping, normally the broker's PingStore.
+func NewStoreProbe(logger lager.Logger, clock clock.Clock, ping func() error, interval time.Duration) *StoreProbe {
+	return &StoreProbe{
+		logger:   logger.Session("store-probe"),
+		clock:    clock,
+		ping:     ping,
+		interval: interval,
+	}
+}
+
+func (p *StoreProbe) Check() StoreHealth {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	if p.last != nil && now.Sub(p.last.CheckedAt) < p.interval {
+		return *p.last
+	}
+
+	health := StoreHealth{CheckedAt: now}
+	err := p.ping()
+	if err != nil {
+		p.logger.Error("store-unreachable", err)
+		health.Error = err.Error()
+	} else {
+		health.Reachable = true
+	}
+
+	p.last = &health
+	return health
+}
+
+// storeProbeSentinelID names no instance. Looking it up costs the backend a
+// single keyed read.
+const storeProbeSentinelID = "csibroker-store-probe"
+
+// PingStore reads one sentinel record from the broker's store, through the
+// same wrappers the broker writes through, without loading every instance.
+// The record not existing is the expected answer.
+func (b *Broker) PingStore() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, err := b.store.RetrieveInstanceDetails(storeProbeSentinelID)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		return nil
+	}
+	return err
+}
+
+type healthHandler struct {
+	logger           lager.Logger
+	servicesRegistry ServicesRegistry
+	storeProbe       *StoreProbe
+	probeTimeout     time.Duration
+	version          version.Info
+}
+
+// NewHealthHandler serves GET /health: 200 when every service's CSI plugin
+// answers a Probe and the store is reachable, 503 otherwise. The body is a
+// HealthReport either way.
+func NewHealthHandler(logger lager.Logger, servicesRegistry ServicesRegistry, storeProbe *StoreProbe, probeTimeout time.Duration, versionInfo version.Info) http.Handler {
+	return &healthHandler{
+		logger:           logger.Session("health"),
+		servicesRegistry: servicesRegistry,
+		storeProbe:       storeProbe,
+		probeTimeout:     probeTimeout,
+		version:          versionInfo,
+	}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.probeTimeout)
+	defer cancel()
+
+	report := HealthReport{Healthy: true, Services: []ServiceHealth{}, Version: h.version}
+	for _, service := range h.servicesRegistry.BrokerServices() {
+		health := probeService(ctx, h.servicesRegistry, service.ID, service.Name)
+		if !health.Reachable {
+			report.Healthy = false
+		}
+		report.Services = append(report.Services, health)
+	}
+
+	report.Store = h.storeProbe.Check()
+	if !report.Store.Reachable {
+		report.Healthy = false
+	}
+
+	if !report.Healthy {
+		h.logger.Info("unhealthy", lager.Data{"report": report})
+		writeAdminJSON(w, http.StatusServiceUnavailable, report)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// probeService reports whether the service's CSI plugins, the controller
+// and any node plugin configured apart from it, answer a Probe.
+func probeService(ctx context.Context, servicesRegistry ServicesRegistry, serviceID, serviceName string) ServiceHealth {
+	health := ServiceHealth{ServiceID: serviceID, ServiceName: serviceName}
+
+	identityClient, err := servicesRegistry.IdentityClient(serviceID)
+	controller := probePlugin(ctx, identityClient, err)
+	health.Reachable = controller.Reachable
+	health.Error = controller.Error
+
+	nodeClient, err := servicesRegistry.NodeIdentityClient(serviceID)
+	if err != nil || nodeClient != nil {
+		node := probePlugin(ctx, nodeClient, err)
+		health.Node = &node
+		health.Reachable = health.Reachable && node.Reachable
+	}
+
+	return health
+}
+
+// probePlugin probes identityClient, or reports err from looking it up.
+func probePlugin(ctx context.Context, identityClient csi.IdentityClient, err error) PluginHealth {
+	if err != nil {
+		return PluginHealth{Error: err.Error()}
+	}
+
+	_, err = identityClient.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		return PluginHealth{Error: err.Error()}
+	}
+	return PluginHealth{Reachable: true}
+}
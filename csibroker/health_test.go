@@ -0,0 +1,155 @@
+package csibroker_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/csibroker/version"
+	"code.cloudfoundry.org/csishim/csi_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var (
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		fakeIdentityClient   *csi_fake.FakeIdentityClient
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeClock            *fakeclock.FakeClock
+		handler              http.Handler
+		method               string
+		recorder             *httptest.ResponseRecorder
+		report               csibroker.HealthReport
+	)
+
+	BeforeEach(func() {
+		logger := lagertest.NewTestLogger("test-health")
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeIdentityClient = &csi_fake.FakeIdentityClient{}
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
+
+		fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{{ID: "some-service-id", Name: "some-service"}})
+		fakeServicesRegistry.IdentityClientReturns(fakeIdentityClient, nil)
+
+		broker, err := csibroker.New(logger, &os_fake.FakeOs{}, fakeClock, fakeStore, fakeServicesRegistry)
+		Expect(err).NotTo(HaveOccurred())
+		storeProbe := csibroker.NewStoreProbe(logger, fakeClock, broker.PingStore, 10*time.Second)
+		handler = csibroker.NewHealthHandler(logger, fakeServicesRegistry, storeProbe, time.Second, version.Info{Version: "1.2.3", GitSHA: "abc123", CSISpecVersion: csibroker.CSIVersion})
+		method = "GET"
+	})
+
+	JustBeforeEach(func() {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, "/health", nil))
+		report = csibroker.HealthReport{}
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+	})
+
+	It("reports healthy when the controllers and the store are reachable", func() {
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(report.Healthy).To(BeTrue())
+		Expect(report.Services).To(Equal([]csibroker.ServiceHealth{{ServiceID: "some-service-id", ServiceName: "some-service", Reachable: true}}))
+		Expect(report.Store.Reachable).To(BeTrue())
+		Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(1))
+		Expect(fakeStore.RetrieveInstanceDetailsArgsForCall(0)).To(Equal("csibroker-store-probe"))
+		Expect(fakeStore.RetrieveAllInstanceDetailsCallCount()).To(Equal(0))
+		Expect(report.Version).To(Equal(version.Info{Version: "1.2.3", GitSHA: "abc123", CSISpecVersion: csibroker.CSIVersion}))
+	})
+
+	It("reuses the store result within the probe interval", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+		Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(1))
+
+		fakeClock.Increment(10 * time.Second)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+		Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(2))
+	})
+
+	Context("when the sentinel record does not exist", func() {
+		BeforeEach(func() {
+			fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, brokerapi.ErrInstanceDoesNotExist)
+		})
+
+		It("reports the store reachable", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(report.Store.Reachable).To(BeTrue())
+		})
+	})
+
+	Context("when the store is unreachable", func() {
+		BeforeEach(func() {
+			fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("connection refused"))
+		})
+
+		It("responds with service unavailable", func() {
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.Healthy).To(BeFalse())
+			Expect(report.Store.Reachable).To(BeFalse())
+			Expect(report.Store.Error).To(Equal("connection refused"))
+		})
+	})
+
+	Context("when a controller is unreachable", func() {
+		BeforeEach(func() {
+			fakeIdentityClient.ProbeReturns(nil, errors.New("unavailable"))
+		})
+
+		It("responds with service unavailable", func() {
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(report.Services[0].Reachable).To(BeFalse())
+			Expect(report.Services[0].Error).To(Equal("unavailable"))
+			Expect(report.Store.Reachable).To(BeTrue())
+		})
+	})
+
+	Context("when the service has a node plugin of its own", func() {
+		var fakeNodeClient *csi_fake.FakeIdentityClient
+
+		BeforeEach(func() {
+			fakeNodeClient = &csi_fake.FakeIdentityClient{}
+			fakeServicesRegistry.NodeIdentityClientReturns(fakeNodeClient, nil)
+		})
+
+		It("probes it too", func() {
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(fakeNodeClient.ProbeCallCount()).To(Equal(1))
+			Expect(report.Services[0].Node).To(Equal(&csibroker.PluginHealth{Reachable: true}))
+		})
+
+		Context("when only the node plugin is unreachable", func() {
+			BeforeEach(func() {
+				fakeNodeClient.ProbeReturns(nil, errors.New("node unavailable"))
+			})
+
+			It("responds with service unavailable, naming the node plugin", func() {
+				Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+				Expect(report.Services[0].Reachable).To(BeFalse())
+				Expect(report.Services[0].Error).To(BeEmpty())
+				Expect(report.Services[0].Node).To(Equal(&csibroker.PluginHealth{Error: "node unavailable"}))
+			})
+		})
+	})
+
+	Context("when the method is not GET", func() {
+		BeforeEach(func() {
+			method = "POST"
+		})
+
+		It("responds with method not allowed", func() {
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
@@ -0,0 +1,79 @@
+package csibroker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// validateLabels rejects label keys that could not be selected on with the
+// admin endpoint's key=value filter.
+func validateLabels(labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "" {
+			return errors.New("parameter 'labels' must not contain an empty key")
+		}
+		if strings.Contains(key, "=") {
+			return fmt.Errorf("label key %q must not contain '='", key)
+		}
+	}
+	return nil
+}
+
+// applyLabelParameters sets the labels named in the service's
+// label_parameters as parameters of each request. A parameter the caller set
+// explicitly is kept.
+func applyLabelParameters(service Service, labels map[string]string, requests []*csi.CreateVolumeRequest) {
+	for key, parameter := range service.LabelParameters {
+		value, ok := labels[key]
+		if !ok {
+			continue
+		}
+		for _, request := range requests {
+			if request.Parameters == nil {
+				request.Parameters = map[string]string{}
+			}
+			if _, set := request.Parameters[parameter]; !set {
+				request.Parameters[parameter] = value
+			}
+		}
+	}
+}
+
+type labelSelector struct {
+	key   string
+	value string
+}
+
+// parseLabelSelectors reads "key=value" selectors, as given in the label
+// query parameter of the admin instance listing.
+func parseLabelSelectors(selectors []string) ([]labelSelector, error) {
+	var parsed []labelSelector
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("label must be of the form key=value, got %q", selector)
+		}
+		parsed = append(parsed, labelSelector{key: parts[0], value: parts[1]})
+	}
+	return parsed, nil
+}
+
+// matchesLabels reports whether labels satisfy every selector.
+func matchesLabels(labels map[string]string, selectors []labelSelector) bool {
+	for _, selector := range selectors {
+		if actual, ok := labels[selector.key]; !ok || actual != selector.value {
+			return false
+		}
+	}
+	return true
+}
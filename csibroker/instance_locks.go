@@ -0,0 +1,48 @@
+package csibroker
+
+import "sync"
+
+// instanceLocks serializes the operations on each instance while letting
+// operations on different instances run concurrently. Store writes are still
+// guarded by the broker's mutex, which is only held briefly.
+type instanceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	sync.Mutex
+	// waiters counts the holder and those waiting, so that the lock can be
+	// dropped once nobody needs it.
+	waiters int
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{locks: map[string]*instanceLock{}}
+}
+
+// lock blocks until no other operation holds the instance and returns the
+// function that releases it.
+func (l *instanceLocks) lock(instanceID string) func() {
+	l.mutex.Lock()
+	entry, ok := l.locks[instanceID]
+	if !ok {
+		entry = &instanceLock{}
+		l.locks[instanceID] = entry
+	}
+	entry.waiters++
+	l.mutex.Unlock()
+
+	entry.Lock()
+
+	return func() {
+		entry.Unlock()
+
+		l.mutex.Lock()
+		entry.waiters--
+		if entry.waiters == 0 {
+			delete(l.locks, instanceID)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,77 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	LogFormatLager = "lager"
+	LogFormatJSON  = "json"
+)
+
+// jsonLogFields are the fields every line of the JSON log format has. Data
+// keys that clash with them are logged with a "data." prefix.
+var jsonLogFields = map[string]bool{
+	"timestamp": true,
+	"level":     true,
+	"source":    true,
+	"message":   true,
+}
+
+type jsonLogSink struct {
+	writer      io.Writer
+	minLogLevel lager.LogLevel
+	mutex       sync.Mutex
+}
+
+// NewJSONLogSink writes each log as one flat JSON object: the timestamp in
+// RFC 3339, the level by name, the source and message, and the data keys
+// alongside them rather than nested under "data". Wrap it in
+// lager.NewRedactingSink to redact secrets, as with lager's own sinks.
+func NewJSONLogSink(writer io.Writer, minLogLevel lager.LogLevel) lager.Sink {
+	return &jsonLogSink{writer: writer, minLogLevel: minLogLevel}
+}
+
+func (s *jsonLogSink) Log(log lager.LogFormat) {
+	if log.LogLevel < s.minLogLevel {
+		return
+	}
+
+	line := map[string]interface{}{
+		"timestamp": jsonLogTimestamp(log.Timestamp),
+		"level":     log.LogLevel.String(),
+		"source":    log.Source,
+		"message":   log.Message,
+	}
+	for key, value := range log.Data {
+		if jsonLogFields[key] {
+			key = "data." + key
+		}
+		line[key] = value
+	}
+
+	content, err := json.Marshal(line)
+	if err != nil {
+		// fall back to lager's own encoding, which copes with unmarshalable data
+		content = log.ToJSON()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writer.Write(append(content, '\n'))
+}
+
+// jsonLogTimestamp converts lager's Unix epoch timestamp to RFC 3339.
+func jsonLogTimestamp(timestamp string) string {
+	seconds, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil {
+		return timestamp
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))).UTC().Format(time.RFC3339Nano)
+}
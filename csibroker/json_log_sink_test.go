@@ -0,0 +1,64 @@
+package csibroker_test
+
+import (
+	"encoding/json"
+	"errors"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager"
+	"github.com/onsi/gomega/gbytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSONLogSink", func() {
+	var (
+		buffer *gbytes.Buffer
+		logger lager.Logger
+	)
+
+	BeforeEach(func() {
+		buffer = gbytes.NewBuffer()
+		sink, err := lager.NewRedactingSink(csibroker.NewJSONLogSink(buffer, lager.INFO), nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		logger = lager.NewLogger("csibroker")
+		logger.RegisterSink(sink)
+	})
+
+	lastLine := func() map[string]interface{} {
+		var line map[string]interface{}
+		Expect(json.Unmarshal(buffer.Contents(), &line)).To(Succeed())
+		return line
+	}
+
+	It("writes each log as a flat JSON object", func() {
+		logger.Session("provision").Info("start", lager.Data{"instanceID": "some-instance-id", "message": "clash"})
+
+		line := lastLine()
+		Expect(line).To(HaveKeyWithValue("level", "info"))
+		Expect(line).To(HaveKeyWithValue("source", "csibroker"))
+		Expect(line).To(HaveKeyWithValue("message", "csibroker.provision.start"))
+		Expect(line).To(HaveKeyWithValue("instanceID", "some-instance-id"))
+		Expect(line).To(HaveKeyWithValue("data.message", "clash"))
+		Expect(line["timestamp"]).To(MatchRegexp(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d+)?Z$`))
+		Expect(line).NotTo(HaveKey("data"))
+	})
+
+	It("includes the error", func() {
+		logger.Error("failed", errors.New("driver badness"))
+		Expect(lastLine()).To(HaveKeyWithValue("error", "driver badness"))
+		Expect(lastLine()).To(HaveKeyWithValue("level", "error"))
+	})
+
+	It("keeps secrets redacted", func() {
+		logger.Info("credentials", lager.Data{"password": "hunter2"})
+		Expect(string(buffer.Contents())).NotTo(ContainSubstring("hunter2"))
+		Expect(lastLine()).To(HaveKeyWithValue("password", "*REDACTED*"))
+	})
+
+	It("drops logs below its level", func() {
+		logger.Debug("noise")
+		Expect(buffer.Contents()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,218 @@
+package csibroker
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The broker validates parameters against the subset of JSON Schema that
+// catalog schemas commonly use: type, properties, required,
+// additionalProperties, items and enum. Other keywords, such as title and
+// description, are ignored.
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"boolean": true,
+	"integer": true,
+	"number":  true,
+	"null":    true,
+}
+
+// checkSchema reports schema keywords of the supported subset that are
+// malformed, so that a broken schema fails at startup.
+func checkSchema(schema map[string]interface{}, path string) error {
+	if value, ok := schema["type"]; ok {
+		schemaType, isString := value.(string)
+		if !isString || !schemaTypes[schemaType] {
+			return fmt.Errorf("%s: unsupported type %v", schemaPath(path), value)
+		}
+	}
+
+	if value, ok := schema["properties"]; ok {
+		properties, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%s: properties must be an object", schemaPath(path))
+		}
+		for name, property := range properties {
+			propertySchema, isObject := property.(map[string]interface{})
+			if !isObject {
+				return fmt.Errorf("%s: property %q must be a schema", schemaPath(path), name)
+			}
+			if err := checkSchema(propertySchema, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if value, ok := schema["required"]; ok {
+		required, isArray := value.([]interface{})
+		if !isArray {
+			return fmt.Errorf("%s: required must be an array", schemaPath(path))
+		}
+		for _, name := range required {
+			if _, isString := name.(string); !isString {
+				return fmt.Errorf("%s: required must list property names", schemaPath(path))
+			}
+		}
+	}
+
+	if value, ok := schema["additionalProperties"]; ok {
+		switch additional := value.(type) {
+		case bool:
+		case map[string]interface{}:
+			if err := checkSchema(additional, path+".*"); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: additionalProperties must be a boolean or a schema", schemaPath(path))
+		}
+	}
+
+	if value, ok := schema["items"]; ok {
+		items, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%s: items must be a schema", schemaPath(path))
+		}
+		if err := checkSchema(items, path+"[]"); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := schema["enum"]; ok {
+		if _, isArray := value.([]interface{}); !isArray {
+			return fmt.Errorf("%s: enum must be an array", schemaPath(path))
+		}
+	}
+
+	return nil
+}
+
+// validateSchema checks a decoded JSON value against schema, returning the
+// first violation found.
+func validateSchema(schema map[string]interface{}, value interface{}, path string) error {
+	if schemaType, ok := schema["type"].(string); ok && !hasSchemaType(value, schemaType) {
+		return fmt.Errorf("%s must be of type %s", schemaPath(path), schemaType)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", schemaPath(path), enum)
+		}
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return validateObject(schema, typed, path)
+	case []interface{}:
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range typed {
+			if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateObject(schema map[string]interface{}, object map[string]interface{}, path string) error {
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	required, _ := schema["required"].([]interface{})
+	for _, name := range required {
+		if _, ok := object[name.(string)]; !ok {
+			return fmt.Errorf("%s is required", schemaPath(path+"."+name.(string)))
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			if err := validateSchema(property, object[name], propertyPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				if suggestion := similarProperty(name, properties); suggestion != "" {
+					return fmt.Errorf("%s is not allowed; did you mean %q?", schemaPath(propertyPath), suggestion)
+				}
+				return fmt.Errorf("%s is not allowed", schemaPath(propertyPath))
+			}
+		case map[string]interface{}:
+			if err := validateSchema(additional, object[name], propertyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasSchemaType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == float64(int64(number))
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// similarProperty returns the property that name most likely misspells:
+// one equal to it but for case, underscores and dashes.
+func similarProperty(name string, properties map[string]interface{}) string {
+	normalize := func(s string) string {
+		return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(s))
+	}
+	for property := range properties {
+		if normalize(property) == normalize(name) {
+			return property
+		}
+	}
+	return ""
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "parameters"
+	}
+	return "parameter " + strings.TrimPrefix(path, ".")
+}
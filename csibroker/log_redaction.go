@@ -0,0 +1,56 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// redactParameters returns raw, for logging, with the values of the
+// broker's redactKeys replaced wherever they occur. Parameters that are not
+// JSON cannot be scrubbed and are replaced entirely.
+func (b *Broker) redactParameters(raw json.RawMessage) json.RawMessage {
+	if len(b.redactKeys) == 0 || hasNoParameters(raw) {
+		return raw
+	}
+
+	var parameters interface{}
+	if json.Unmarshal(raw, &parameters) != nil {
+		return json.RawMessage(`"` + redactedValue + `"`)
+	}
+
+	redacted, err := json.Marshal(redactKeys(parameters, b.redactKeys))
+	if err != nil {
+		return json.RawMessage(`"` + redactedValue + `"`)
+	}
+	return redacted
+}
+
+func (b *Broker) redactProvisionDetails(details brokerapi.ProvisionDetails) brokerapi.ProvisionDetails {
+	details.RawParameters = b.redactParameters(details.RawParameters)
+	return details
+}
+
+func (b *Broker) redactBindDetails(details brokerapi.BindDetails) brokerapi.BindDetails {
+	details.RawParameters = b.redactParameters(details.RawParameters)
+	return details
+}
+
+func redactKeys(value interface{}, keys map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if keys[strings.ToLower(key)] {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactKeys(field, keys)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactKeys(element, keys)
+		}
+	}
+	return value
+}
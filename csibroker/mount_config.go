@@ -0,0 +1,76 @@
+package csibroker
+
+import (
+	"fmt"
+	"sort"
+)
+
+const mountConfigKey = "mount_config"
+
+// reservedMountConfigKeys are set by the broker itself on every mount.
+var reservedMountConfigKeys = []string{"id", "attributes", "binding-params"}
+
+type ErrInvalidMountConfig struct {
+	Key    string
+	Reason string
+}
+
+func (e ErrInvalidMountConfig) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("mount_config %s", e.Reason)
+	}
+	return fmt.Sprintf("mount_config key %q %s", e.Key, e.Reason)
+}
+
+// evaluateMountConfig returns the "mount_config" bind parameter, whose
+// entries are passed to the driver's node side in the mount config of each
+// volume. Keys the broker sets itself are refused, as are keys outside the
+// service's allowlist when it has one.
+func evaluateMountConfig(parameters map[string]interface{}, service Service) (map[string]interface{}, error) {
+	raw, ok := parameters[mountConfigKey]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+
+	mountConfig, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidMountConfig{Reason: "must be an object"}
+	}
+
+	var keys []string
+	for key := range mountConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if containsString(reservedMountConfigKeys, key) {
+			return nil, ErrInvalidMountConfig{Key: key, Reason: "is reserved by the broker"}
+		}
+		if len(service.AllowedMountConfigKeys) > 0 && !containsString(service.AllowedMountConfigKeys, key) {
+			return nil, ErrInvalidMountConfig{Key: key, Reason: fmt.Sprintf("is not allowed by this service (allowed: %v)", service.AllowedMountConfigKeys)}
+		}
+	}
+
+	return mountConfig, nil
+}
+
+// filterVolumeContext returns the entries of a volume context that the
+// service passes to the node plugin.
+func filterVolumeContext(volumeContext map[string]string, service Service) map[string]string {
+	if len(service.BindContextAllow) == 0 && len(service.BindContextDeny) == 0 {
+		return volumeContext
+	}
+
+	filtered := map[string]string{}
+	for key, value := range volumeContext {
+		if len(service.BindContextAllow) > 0 && !containsString(service.BindContextAllow, key) {
+			continue
+		}
+		if containsString(service.BindContextDeny, key) {
+			continue
+		}
+		filtered[key] = value
+	}
+	return filtered
+}
@@ -0,0 +1,63 @@
+package csibroker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const operationDataVersion = "v1"
+
+// OperationData is the operation reference the broker hands out with an
+// operation response and gets back when the platform polls LastOperation.
+// It is encoded as "v1:<operation>:<key>", the key being the instance ID of
+// instance operations and the binding ID of binding operations, so that
+// further operations and encodings can be added without ambiguity.
+type OperationData struct {
+	Operation Operation
+	Key       string
+}
+
+func (d OperationData) Encode() string {
+	return strings.Join([]string{operationDataVersion, string(d.Operation), d.Key}, ":")
+}
+
+func (d OperationData) isBindingOperation() bool {
+	return d.Operation == OperationBind || d.Operation == OperationUnbind
+}
+
+type ErrInvalidOperationData struct {
+	OperationData string
+}
+
+func (e ErrInvalidOperationData) Error() string {
+	return fmt.Sprintf("invalid operation data %q", e.OperationData)
+}
+
+// DecodeOperationData also accepts the operation data of older brokers,
+// which was empty or a bare operation name, as referring to the instance.
+func DecodeOperationData(encoded string) (OperationData, error) {
+	if !strings.Contains(encoded, ":") {
+		if encoded != "" && !isKnownOperation(Operation(encoded)) {
+			return OperationData{}, ErrInvalidOperationData{OperationData: encoded}
+		}
+		return OperationData{Operation: Operation(encoded)}, nil
+	}
+
+	parts := strings.SplitN(encoded, ":", 3)
+	if len(parts) != 3 || parts[0] != operationDataVersion || !isKnownOperation(Operation(parts[1])) || parts[2] == "" {
+		return OperationData{}, ErrInvalidOperationData{OperationData: encoded}
+	}
+
+	return OperationData{Operation: Operation(parts[1]), Key: parts[2]}, nil
+}
+
+func bindingOperationKey(bindingID string) string {
+	return "binding:" + bindingID
+}
+
+func invalidOperationDataResponse(err error) error {
+	return brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-operation-data")
+}
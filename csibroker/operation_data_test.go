@@ -0,0 +1,36 @@
+package csibroker_test
+
+import (
+	"code.cloudfoundry.org/csibroker/csibroker"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OperationData", func() {
+	It("round-trips through its encoding", func() {
+		data := csibroker.OperationData{Operation: csibroker.OperationBind, Key: "some:binding-id"}
+		Expect(data.Encode()).To(Equal("v1:bind:some:binding-id"))
+
+		decoded, err := csibroker.DecodeOperationData(data.Encode())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(data))
+	})
+
+	It("reads the operation data of older brokers as referring to the instance", func() {
+		decoded, err := csibroker.DecodeOperationData("deprovision")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(csibroker.OperationData{Operation: csibroker.OperationDeprovision}))
+
+		decoded, err = csibroker.DecodeOperationData("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(csibroker.OperationData{}))
+	})
+
+	It("rejects malformed operation data", func() {
+		for _, encoded := range []string{"v2:bind:some-binding-id", "v1:resize:some-instance-id", "v1:bind:", "resize"} {
+			_, err := csibroker.DecodeOperationData(encoded)
+			Expect(err).To(Equal(csibroker.ErrInvalidOperationData{OperationData: encoded}), encoded)
+		}
+	})
+})
@@ -0,0 +1,79 @@
+package csibroker
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type Operation string
+
+const (
+	OperationProvision   Operation = "provision"
+	OperationDeprovision Operation = "deprovision"
+	OperationBind        Operation = "bind"
+	OperationUnbind      Operation = "unbind"
+	OperationUpdate      Operation = "update"
+)
+
+var unsupportedOperationMessages = map[Operation]string{
+	OperationProvision:   "This service does not support instance provisioning",
+	OperationDeprovision: "This service does not support instance deprovisioning",
+	OperationBind:        "This service does not support binding",
+	OperationUnbind:      "This service does not support unbinding",
+	OperationUpdate:      "This service does not support instance updates",
+}
+
+func isKnownOperation(operation Operation) bool {
+	_, ok := unsupportedOperationMessages[operation]
+	return ok
+}
+
+// Supports reports whether the service allows the operation. Operations
+// missing from SupportedOperations are allowed.
+func (s Service) Supports(operation Operation) bool {
+	supported, ok := s.SupportedOperations[operation]
+	return !ok || supported
+}
+
+func ErrOperationNotSupported(operation Operation) error {
+	return brokerapi.NewFailureResponse(errors.New(unsupportedOperationMessages[operation]), http.StatusUnprocessableEntity, "operation-not-supported")
+}
+
+func (b *Broker) checkOperationSupported(serviceID string, operation Operation) error {
+	service, err := b.servicesRegistry.Service(serviceID)
+	if err != nil {
+		return err
+	}
+
+	if !service.Supports(operation) {
+		return ErrOperationNotSupported(operation)
+	}
+
+	return nil
+}
+
+// checkSyncBudget refuses an operation with brokerapi.ErrAsyncRequired when
+// the platform does not accept an asynchronous response and the service
+// expects the operation to take longer than the synchronous budget. The
+// broker has no asynchronous path of its own, so an operation the platform
+// lets run asynchronously still runs synchronously.
+func (b *Broker) checkSyncBudget(serviceID string, asyncAllowed bool) error {
+	if asyncAllowed || b.syncBudget == 0 {
+		return nil
+	}
+
+	service, err := b.servicesRegistry.Service(serviceID)
+	if err != nil {
+		return err
+	}
+
+	if time.Duration(service.ExpectedOperationDuration) > b.syncBudget {
+		b.logger.Info("async-required", lager.Data{"serviceID": serviceID, "expectedOperationDuration": time.Duration(service.ExpectedOperationDuration).String(), "syncBudget": b.syncBudget.String()})
+		return brokerapi.ErrAsyncRequired
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package csibroker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// OperationRetention is how long the record of a finished operation is kept
+// for LastOperation. Without a bound, failed provisions and binds would keep
+// their records forever, since what they describe never comes to exist.
+const OperationRetention = time.Hour
+
+// operation records the progress of the most recent broker operation on a
+// service instance so that LastOperation can report on it.
+type operation struct {
+	Type                string
+	State               brokerapi.LastOperationState
+	Description         string
+	StartedAt           time.Time
+	FinishedAt          time.Time
+	EstimatedCompletion time.Time
+	PollInterval        time.Duration
+	// Notices, such as deprecation warnings, are appended to the description.
+	Notices []string
+}
+
+func (o operation) lastOperation() brokerapi.LastOperation {
+	description := o.Description
+	if o.State == brokerapi.InProgress {
+		description = fmt.Sprintf("%s in progress", o.Type)
+		if !o.EstimatedCompletion.IsZero() {
+			description = fmt.Sprintf("%s, expected to complete by %s", description, o.EstimatedCompletion.Format(time.RFC3339))
+		}
+		if o.PollInterval > 0 {
+			description = fmt.Sprintf("%s; poll again in %s", description, o.PollInterval)
+		}
+	}
+
+	if len(o.Notices) > 0 {
+		description = fmt.Sprintf("%s (%s)", description, strings.Join(o.Notices, "; "))
+	}
+
+	return brokerapi.LastOperation{State: o.State, Description: description}
+}
+
+type operations struct {
+	mutex   sync.Mutex
+	clock   clock.Clock
+	records map[string]operation
+}
+
+func newOperations(clock clock.Clock) *operations {
+	return &operations{clock: clock, records: map[string]operation{}}
+}
+
+func (o *operations) start(instanceID string, op operation) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.expire()
+	op.State = brokerapi.InProgress
+	o.records[instanceID] = op
+}
+
+func (o *operations) finish(instanceID string, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	op, ok := o.records[instanceID]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		op.State = brokerapi.Failed
+		op.Description = fmt.Sprintf("%s failed: %s", op.Type, err.Error())
+	} else {
+		op.State = brokerapi.Succeeded
+		op.Description = fmt.Sprintf("%s succeeded", op.Type)
+	}
+	op.FinishedAt = o.clock.Now()
+	o.records[instanceID] = op
+}
+
+// expire drops the records of operations that finished longer than
+// OperationRetention ago. Callers hold the mutex.
+func (o *operations) expire() {
+	for key, op := range o.records {
+		if o.expired(op) {
+			delete(o.records, key)
+		}
+	}
+}
+
+func (o *operations) expired(op operation) bool {
+	return op.State != brokerapi.InProgress && o.clock.Since(op.FinishedAt) > OperationRetention
+}
+
+// remove forgets the operations on an instance or binding that no longer
+// exists, so that records do not outlive what they describe.
+func (o *operations) remove(instanceID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	delete(o.records, instanceID)
+}
+
+func (o *operations) addNotices(instanceID string, notices []string) {
+	if len(notices) == 0 {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	op, ok := o.records[instanceID]
+	if !ok {
+		return
+	}
+	op.Notices = append(op.Notices, notices...)
+	o.records[instanceID] = op
+}
+
+func (o *operations) get(instanceID string) (operation, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	op, ok := o.records[instanceID]
+	if ok && o.expired(op) {
+		delete(o.records, instanceID)
+		return operation{}, false
+	}
+	return op, ok
+}
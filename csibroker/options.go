@@ -0,0 +1,156 @@
+package csibroker
+
+import (
+	"strings"
+	"time"
+)
+
+// Option configures optional Broker behaviour.
+type Option func(*Broker)
+
+// WithParameterSets lets provision requests reference a named set of CSI
+// parameters via {"parameter_set": "<name>"}.
+func WithParameterSets(parameterSets *ParameterSets) Option {
+	return func(b *Broker) {
+		b.parameterSets = parameterSets
+	}
+}
+
+// WithProbeTimeout bounds the Probe sent to a driver before its first
+// operation, so an unresponsive identity service fails the request quickly.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(b *Broker) {
+		b.probeTimeout = timeout
+	}
+}
+
+// WithAllowedMountPaths restricts the "mount" bind parameter to the given
+// absolute paths and the directories below them.
+func WithAllowedMountPaths(paths []string) Option {
+	return func(b *Broker) {
+		b.allowedMountPaths = paths
+	}
+}
+
+// WithRestoreRetries retries a failed restore of the broker's state up to
+// retries times, waiting backoff before the first retry and twice as long
+// before each one after.
+func WithRestoreRetries(retries int, backoff time.Duration) Option {
+	return func(b *Broker) {
+		b.restoreRetries = retries
+		b.restoreBackoff = backoff
+	}
+}
+
+// WithParameterFormat sets how the CreateVolumeRequest in provision
+// parameters is encoded: ParameterFormatJSON, the default, or
+// ParameterFormatProtoText.
+func WithParameterFormat(format string) Option {
+	return func(b *Broker) {
+		b.parameterFormat = format
+	}
+}
+
+// WithOrgQuota limits each org to the given number of instances across all
+// services.
+func WithOrgQuota(instances int) Option {
+	return func(b *Broker) {
+		b.orgQuota = instances
+	}
+}
+
+// WithProvisionWebhook calls the webhook for every instance once its
+// volumes have been created and before it is stored.
+func WithProvisionWebhook(webhook *ProvisionWebhook) Option {
+	return func(b *Broker) {
+		b.provisionWebhook = webhook
+	}
+}
+
+// WithBindInstanceWait lets Bind wait up to wait for an instance that is not
+// stored yet before failing with brokerapi.ErrInstanceDoesNotExist.
+func WithBindInstanceWait(wait time.Duration) Option {
+	return func(b *Broker) {
+		b.bindInstanceWait = wait
+	}
+}
+
+// WithRedactKeys redacts the values of the given provision and bind
+// parameter keys, matched case-insensitively at any depth, where the
+// parameters are logged.
+func WithRedactKeys(keys []string) Option {
+	return func(b *Broker) {
+		b.redactKeys = map[string]bool{}
+		for _, key := range keys {
+			b.redactKeys[strings.ToLower(key)] = true
+		}
+	}
+}
+
+// WithDeprovisionWebhook calls the webhook for every instance once its
+// volumes have been deleted and its deletion saved.
+func WithDeprovisionWebhook(webhook *DeprovisionWebhook) Option {
+	return func(b *Broker) {
+		b.deprovisionWebhook = webhook
+	}
+}
+
+// WithCloudEventEmitter emits a CloudEvent with the outcome of every
+// provision, deprovision, bind and unbind. The emitter must be running.
+func WithCloudEventEmitter(emitter *CloudEventEmitter) Option {
+	return func(b *Broker) {
+		b.cloudEvents = emitter
+	}
+}
+
+// WithProbeBreaker fails operations on a driver at once, without probing it,
+// for cooldown after threshold consecutive probe failures within window.
+func WithProbeBreaker(threshold int, window, cooldown time.Duration) Option {
+	return func(b *Broker) {
+		b.probeBreaker = newProbeBreaker(b.logger, b.clock, threshold, window, cooldown)
+	}
+}
+
+// WithSyncBudget refuses provisions and deprovisions that the platform wants
+// answered synchronously when the service's expected_operation_duration
+// exceeds budget.
+func WithSyncBudget(budget time.Duration) Option {
+	return func(b *Broker) {
+		b.syncBudget = budget
+	}
+}
+
+// WithPreProvisionWebhook has webhook approve every provision before the
+// driver is asked to create its volumes.
+func WithPreProvisionWebhook(webhook *PreProvisionWebhook) Option {
+	return func(b *Broker) {
+		b.preProvisionWebhook = webhook
+	}
+}
+
+// WithAllowDeprovisionEmptyVolume lets Deprovision remove instances whose
+// stored volume ID is empty from the store without calling DeleteVolume.
+// Without it such deprovisions fail with ErrEmptyVolumeID.
+func WithAllowDeprovisionEmptyVolume() Option {
+	return func(b *Broker) {
+		b.allowDeprovisionEmptyVolume = true
+	}
+}
+
+// WithRPCTimeouts bounds each CreateVolume and DeleteVolume call to a
+// driver, including those rolling back a failed provision.
+func WithRPCTimeouts(timeouts RPCTimeouts) Option {
+	return func(b *Broker) {
+		b.rpcTimeouts = timeouts
+	}
+}
+
+// WithAdoptExistingVolumes provisions an instance on the existing volume a
+// driver returns in the details of a CreateVolume AlreadyExists error,
+// despite its differing parameters, rather than failing with
+// ErrVolumeNameConflict.
+func WithAdoptExistingVolumes() Option {
+	return func(b *Broker) {
+		b.adoptExistingVolumes = true
+	}
+}
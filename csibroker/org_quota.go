@@ -0,0 +1,118 @@
+package csibroker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// OrgQuota limits what a single org may provision of a service.
+type OrgQuota struct {
+	// Instances is the most instances of the service an org may have. Zero
+	// means no limit.
+	Instances int `json:"instances,omitempty"`
+	// Capacity, e.g. "100Gi", is the most an org's instances of the service
+	// may add up to, counting the capacity of every volume they own.
+	Capacity string `json:"capacity,omitempty"`
+}
+
+type ErrOrgQuotaExceeded struct {
+	OrganizationGUID string
+	Reason           string
+}
+
+func (e ErrOrgQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded for organization %s: %s", e.OrganizationGUID, e.Reason)
+}
+
+func (q OrgQuota) validate() error {
+	if q.Instances < 0 {
+		return errors.New("org_quota instances must not be negative")
+	}
+	if q.Capacity != "" {
+		if _, err := ParseCapacity(q.Capacity); err != nil {
+			return fmt.Errorf("org_quota capacity: %s", err)
+		}
+	}
+	return nil
+}
+
+// orgUsage is what an org's instances already hold.
+type orgUsage struct {
+	instances        int
+	serviceInstances int
+	serviceCapacity  int64
+}
+
+// checkOrgQuota rejects a provision that would take its org past the
+// broker-wide instance quota or the service's own quota. Usage is counted
+// from the store, so deprovisioning an instance frees its share.
+func (b *Broker) checkOrgQuota(logger lager.Logger, service Service, details brokerapi.ProvisionDetails, requests []*csi.CreateVolumeRequest) error {
+	quota := service.OrgQuota
+	if b.orgQuota == 0 && quota == nil {
+		return nil
+	}
+
+	usage, err := b.orgUsage(details.OrganizationGUID, details.ServiceID)
+	if err != nil {
+		logger.Error("org-quota-usage-failed", err)
+		return err
+	}
+
+	var exceeded error
+	switch {
+	case b.orgQuota > 0 && usage.instances >= b.orgQuota:
+		exceeded = ErrOrgQuotaExceeded{OrganizationGUID: details.OrganizationGUID, Reason: fmt.Sprintf("at most %d instances are allowed", b.orgQuota)}
+	case quota != nil && quota.Instances > 0 && usage.serviceInstances >= quota.Instances:
+		exceeded = ErrOrgQuotaExceeded{OrganizationGUID: details.OrganizationGUID, Reason: fmt.Sprintf("at most %d instances of this service are allowed", quota.Instances)}
+	case quota != nil && quota.Capacity != "":
+		limit, _ := ParseCapacity(quota.Capacity)
+		requested := int64(0)
+		for _, request := range requests {
+			requested += request.GetCapacityRange().GetRequiredBytes()
+		}
+		if usage.serviceCapacity+requested > limit {
+			exceeded = ErrOrgQuotaExceeded{OrganizationGUID: details.OrganizationGUID, Reason: fmt.Sprintf("instances of this service may hold at most %s, %d bytes are in use and %d requested", quota.Capacity, usage.serviceCapacity, requested)}
+		}
+	}
+	if exceeded != nil {
+		logger.Info("org-quota-exceeded", lager.Data{"organizationGUID": details.OrganizationGUID, "reason": exceeded.Error()})
+		return brokerapi.NewFailureResponse(exceeded, http.StatusForbidden, "org-quota-exceeded")
+	}
+	return nil
+}
+
+func (b *Broker) orgUsage(organizationGUID, serviceID string) (orgUsage, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	instances, err := retrieveInstances(b.store)
+	if err != nil {
+		return orgUsage{}, err
+	}
+
+	var usage orgUsage
+	for _, instance := range instances {
+		if instance.OrganizationGUID != organizationGUID {
+			continue
+		}
+		usage.instances++
+		if instance.ServiceID != serviceID {
+			continue
+		}
+		usage.serviceInstances++
+
+		fingerprint, err := getFingerprint(instance.ServiceFingerPrint)
+		if err != nil {
+			continue
+		}
+		for _, volume := range append([]*csi.Volume{fingerprint.Volume}, fingerprint.AdditionalVolumes...) {
+			usage.serviceCapacity += volume.GetCapacityBytes()
+		}
+	}
+	return usage, nil
+}
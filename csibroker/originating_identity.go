@@ -0,0 +1,96 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+var ErrInvalidOriginatingIdentity = errors.New("originating identity header must be \"<platform> <base64-encoded JSON object>\"")
+
+// OriginatingIdentity is the platform user on whose behalf the broker was
+// called, as sent in the X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+// UserID returns the "user_id" the Cloud Foundry platform puts in the
+// identity value, or the empty string.
+func (o OriginatingIdentity) UserID() string {
+	userID, _ := o.Value["user_id"].(string)
+	return userID
+}
+
+func (o OriginatingIdentity) encodedValue() string {
+	encoded, _ := json.Marshal(o.Value)
+	return string(encoded)
+}
+
+func ParseOriginatingIdentity(header string) (OriginatingIdentity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return OriginatingIdentity{}, ErrInvalidOriginatingIdentity
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return OriginatingIdentity{}, ErrInvalidOriginatingIdentity
+	}
+
+	identity := OriginatingIdentity{Platform: parts[0]}
+	if err := json.Unmarshal(decoded, &identity.Value); err != nil || identity.Value == nil {
+		return OriginatingIdentity{}, ErrInvalidOriginatingIdentity
+	}
+
+	return identity, nil
+}
+
+type originatingIdentityKey struct{}
+
+func ContextWithOriginatingIdentity(ctx context.Context, identity OriginatingIdentity) context.Context {
+	return context.WithValue(ctx, originatingIdentityKey{}, identity)
+}
+
+func OriginatingIdentityFromContext(ctx context.Context) (OriginatingIdentity, bool) {
+	identity, ok := ctx.Value(originatingIdentityKey{}).(OriginatingIdentity)
+	return identity, ok
+}
+
+// NewOriginatingIdentityHandler decodes the originating identity header, if
+// present, into the request context seen by the broker. A malformed header
+// is logged and otherwise ignored so that it never fails a request.
+func NewOriginatingIdentityHandler(logger lager.Logger, next http.Handler) http.Handler {
+	logger = logger.Session("originating-identity")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(OriginatingIdentityHeader)
+		if header != "" {
+			identity, err := ParseOriginatingIdentity(header)
+			if err != nil {
+				logger.Error("invalid-header", err, lager.Data{"path": r.URL.Path})
+			} else {
+				r = r.WithContext(ContextWithOriginatingIdentity(r.Context(), identity))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withOriginatingIdentity adds the caller's identity, if known, to the data
+// of every line the logger writes.
+func withOriginatingIdentity(logger lager.Logger, ctx context.Context) lager.Logger {
+	identity, ok := OriginatingIdentityFromContext(ctx)
+	if !ok {
+		return logger
+	}
+	return logger.WithData(lager.Data{"originatingIdentity": identity})
+}
@@ -0,0 +1,97 @@
+package csibroker_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("OriginatingIdentity", func() {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	Describe("ParseOriginatingIdentity", func() {
+		It("decodes the platform and the JSON value", func() {
+			identity, err := csibroker.ParseOriginatingIdentity("cloudfoundry " + encode(`{"user_id":"some-user-id"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity.Platform).To(Equal("cloudfoundry"))
+			Expect(identity.UserID()).To(Equal("some-user-id"))
+		})
+
+		It("rejects a header without a value", func() {
+			_, err := csibroker.ParseOriginatingIdentity("cloudfoundry")
+			Expect(err).To(Equal(csibroker.ErrInvalidOriginatingIdentity))
+		})
+
+		It("rejects a value that is not base64", func() {
+			_, err := csibroker.ParseOriginatingIdentity("cloudfoundry not-base64!")
+			Expect(err).To(Equal(csibroker.ErrInvalidOriginatingIdentity))
+		})
+
+		It("rejects a value that is not a JSON object", func() {
+			_, err := csibroker.ParseOriginatingIdentity("cloudfoundry " + encode(`"some-user-id"`))
+			Expect(err).To(Equal(csibroker.ErrInvalidOriginatingIdentity))
+		})
+	})
+
+	Describe("NewOriginatingIdentityHandler", func() {
+		var (
+			logger   *lagertest.TestLogger
+			received context.Context
+			request  *http.Request
+		)
+
+		BeforeEach(func() {
+			logger = lagertest.NewTestLogger("test-originating-identity")
+			request = httptest.NewRequest("PUT", "/v2/service_instances/some-instance-id", nil)
+		})
+
+		JustBeforeEach(func() {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Context()
+			})
+			csibroker.NewOriginatingIdentityHandler(logger, next).ServeHTTP(httptest.NewRecorder(), request)
+		})
+
+		Context("when the header is present", func() {
+			BeforeEach(func() {
+				request.Header.Set(csibroker.OriginatingIdentityHeader, "cloudfoundry "+encode(`{"user_id":"some-user-id"}`))
+			})
+
+			It("makes the identity available to the broker", func() {
+				identity, ok := csibroker.OriginatingIdentityFromContext(received)
+				Expect(ok).To(BeTrue())
+				Expect(identity.UserID()).To(Equal("some-user-id"))
+			})
+		})
+
+		Context("when the header is malformed", func() {
+			BeforeEach(func() {
+				request.Header.Set(csibroker.OriginatingIdentityHeader, "garbage")
+			})
+
+			It("logs it and still serves the request", func() {
+				Expect(received).NotTo(BeNil())
+				_, ok := csibroker.OriginatingIdentityFromContext(received)
+				Expect(ok).To(BeFalse())
+				Expect(logger.Buffer()).To(gbytes.Say("invalid-header"))
+			})
+		})
+
+		Context("when the header is absent", func() {
+			It("adds nothing to the context", func() {
+				_, ok := csibroker.OriginatingIdentityFromContext(received)
+				Expect(ok).To(BeFalse())
+			})
+		})
+	})
+})
@@ -0,0 +1,90 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type ErrParameterSetNotFound struct {
+	Name string
+}
+
+func (e ErrParameterSetNotFound) Error() string {
+	return fmt.Sprintf("Parameter set %s not found", e.Name)
+}
+
+type ErrInvalidParameterSetsFile struct {
+	err error
+}
+
+func (e ErrInvalidParameterSetsFile) Error() string {
+	return fmt.Sprintf("Invalid parameter sets file %s", e.err.Error())
+}
+
+// ParameterSets holds named groups of CSI parameters, loaded from a JSON file
+// of the form {"gold": {"key": "value"}}, that provision requests can refer
+// to by name instead of inlining them.
+type ParameterSets struct {
+	path  string
+	mutex sync.RWMutex
+	sets  map[string]map[string]string
+}
+
+func NewParameterSets(logger lager.Logger, path string) (*ParameterSets, error) {
+	parameterSets := &ParameterSets{path: path}
+
+	err := parameterSets.Reload(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return parameterSets, nil
+}
+
+// Reload re-reads the parameter sets file. The previously loaded sets are
+// kept if the file cannot be read or parsed.
+func (p *ParameterSets) Reload(logger lager.Logger) error {
+	logger = logger.Session("reload-parameter-sets", lager.Data{"fileName": p.path})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	contents, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		logger.Error("failed-to-read-parameter-sets", err)
+		return err
+	}
+
+	var sets map[string]map[string]string
+	err = json.Unmarshal(contents, &sets)
+	if err != nil {
+		logger.Error("failed-to-unmarshal-parameter-sets", err)
+		return ErrInvalidParameterSetsFile{err}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sets = sets
+
+	logger.Info("parameter-sets-loaded", lager.Data{"count": len(sets)})
+	return nil
+}
+
+func (p *ParameterSets) Lookup(name string) (map[string]string, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	set, ok := p.sets[name]
+	if !ok {
+		return nil, false
+	}
+
+	parameters := make(map[string]string, len(set))
+	for key, value := range set {
+		parameters[key] = value
+	}
+	return parameters, true
+}
@@ -0,0 +1,108 @@
+package csibroker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParameterSets", func() {
+	var (
+		parameterSets *csibroker.ParameterSets
+		path          string
+		logger        *lagertest.TestLogger
+		err           error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-parameter-sets")
+
+		pwd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(pwd, "..", "fixtures", "parameter_sets.json")
+	})
+
+	JustBeforeEach(func() {
+		parameterSets, err = csibroker.NewParameterSets(logger, path)
+	})
+
+	It("loads the named parameter sets", func() {
+		Expect(err).NotTo(HaveOccurred())
+
+		parameters, ok := parameterSets.Lookup("gold")
+		Expect(ok).To(BeTrue())
+		Expect(parameters).To(Equal(map[string]string{"tier": "gold", "replicas": "3"}))
+	})
+
+	It("reports unknown parameter sets", func() {
+		_, ok := parameterSets.Lookup("bronze")
+		Expect(ok).To(BeFalse())
+	})
+
+	Context("when the file does not exist", func() {
+		BeforeEach(func() {
+			path = "/does/not/exist.json"
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the file is not valid JSON", func() {
+		BeforeEach(func() {
+			pwd, err := os.Getwd()
+			Expect(err).ToNot(HaveOccurred())
+			path = filepath.Join(pwd, "..", "fixtures", "empty_spec.json")
+		})
+
+		It("returns an error", func() {
+			Expect(err).To(BeAssignableToTypeOf(csibroker.ErrInvalidParameterSetsFile{}))
+		})
+	})
+
+	Context("when the file is reloaded", func() {
+		var tempFile string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "parameter-sets")
+			Expect(err).NotTo(HaveOccurred())
+			tempFile = filepath.Join(dir, "parameter_sets.json")
+			Expect(ioutil.WriteFile(tempFile, []byte(`{"gold": {"tier": "gold"}}`), 0644)).To(Succeed())
+			path = tempFile
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(tempFile))
+		})
+
+		It("picks up the new contents", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(tempFile, []byte(`{"platinum": {"tier": "platinum"}}`), 0644)).To(Succeed())
+
+			Expect(parameterSets.Reload(logger)).To(Succeed())
+
+			_, ok := parameterSets.Lookup("gold")
+			Expect(ok).To(BeFalse())
+			parameters, ok := parameterSets.Lookup("platinum")
+			Expect(ok).To(BeTrue())
+			Expect(parameters).To(Equal(map[string]string{"tier": "platinum"}))
+		})
+
+		It("keeps the previous contents when the new file is invalid", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(tempFile, []byte(`{not json`), 0644)).To(Succeed())
+
+			Expect(parameterSets.Reload(logger)).NotTo(Succeed())
+
+			_, ok := parameterSets.Lookup("gold")
+			Expect(ok).To(BeTrue())
+		})
+	})
+})
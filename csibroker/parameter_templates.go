@@ -0,0 +1,89 @@
+package csibroker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"text/template"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// ParameterTemplateData is what the values of a service's
+// parameter_templates are rendered with, e.g.
+// {"subdir": "{{.OrgGUID}}/{{.InstanceID}}"}. Name is the name of the
+// volume the parameter is set on.
+type ParameterTemplateData struct {
+	InstanceID string
+	ServiceID  string
+	PlanID     string
+	OrgGUID    string
+	SpaceGUID  string
+	Name       string
+}
+
+// validateParameterTemplates checks that every template parses and names
+// only known fields.
+func validateParameterTemplates(templates map[string]string) error {
+	for _, key := range sortedKeys(templates) {
+		if key == "" {
+			return errors.New("parameter_templates must not contain an empty parameter name")
+		}
+		_, err := renderParameterTemplate(key, templates[key], ParameterTemplateData{
+			InstanceID: "instance-id",
+			ServiceID:  "service-id",
+			PlanID:     "plan-id",
+			OrgGUID:    "org-guid",
+			SpaceGUID:  "space-guid",
+			Name:       "name",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyParameterTemplates sets each templated parameter the request does
+// not already carry, so that values given by the caller take precedence.
+func applyParameterTemplates(templates map[string]string, request *csi.CreateVolumeRequest, data ParameterTemplateData) error {
+	data.Name = request.Name
+	for _, key := range sortedKeys(templates) {
+		if _, ok := request.Parameters[key]; ok {
+			continue
+		}
+		value, err := renderParameterTemplate(key, templates[key], data)
+		if err != nil {
+			return err
+		}
+		if request.Parameters == nil {
+			request.Parameters = map[string]string{}
+		}
+		request.Parameters[key] = value
+	}
+	return nil
+}
+
+func renderParameterTemplate(key, text string, data ParameterTemplateData) (string, error) {
+	parsed, err := template.New(key).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid parameter_templates entry %q: %s", key, err)
+	}
+
+	var rendered bytes.Buffer
+	err = parsed.Execute(&rendered, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid parameter_templates entry %q: %s", key, err)
+	}
+	return rendered.String(), nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
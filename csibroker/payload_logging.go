@@ -0,0 +1,87 @@
+package csibroker
+
+import (
+	"context"
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// secretsField is the CSI field that holds driver credentials on every
+// request that takes them.
+const secretsField = "secrets"
+
+// unredactedPayloadFields are fields whose names look secret but are not,
+// such as pagination tokens.
+var unredactedPayloadFields = map[string]bool{"starting_token": true, "next_token": true}
+
+// PayloadLoggingUnaryClientInterceptor logs the request and response of
+// every unary CSI call at debug level. The values of "secrets" fields are
+// redacted, as are string fields and map entries whose names look secret.
+func PayloadLoggingUnaryClientInterceptor(logger lager.Logger) grpc.UnaryClientInterceptor {
+	logger = logger.Session("grpc-payload")
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		logger.Debug("request", lager.Data{"method": method, "payload": redactPayload(req)})
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			logger.Debug("error", lager.Data{"method": method, "code": status.Code(err).String(), "error": err.Error()})
+			return err
+		}
+
+		logger.Debug("response", lager.Data{"method": method, "payload": redactPayload(reply)})
+		return nil
+	}
+}
+
+func redactPayload(message interface{}) interface{} {
+	pb, ok := message.(proto.Message)
+	if !ok || pb == nil {
+		return nil
+	}
+
+	encoded, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(pb)
+	if err != nil {
+		return "unloggable payload: " + err.Error()
+	}
+
+	var payload interface{}
+	if json.Unmarshal([]byte(encoded), &payload) != nil {
+		return "unloggable payload"
+	}
+	return redactPayloadValue(payload)
+}
+
+func redactPayloadValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			switch {
+			case key == secretsField:
+				if entries, ok := field.(map[string]interface{}); ok {
+					for entry := range entries {
+						entries[entry] = redactedValue
+					}
+				}
+			case isSecretKey(key) && !unredactedPayloadFields[key]:
+				if _, ok := field.(string); ok {
+					v[key] = redactedValue
+				} else {
+					v[key] = redactPayloadValue(field)
+				}
+			default:
+				v[key] = redactPayloadValue(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactPayloadValue(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,73 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PayloadLoggingUnaryClientInterceptor", func() {
+	var (
+		logger    *lagertest.TestLogger
+		request   *csi.CreateVolumeRequest
+		invokeErr error
+		err       error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-payload")
+		request = &csi.CreateVolumeRequest{
+			Name:       "some-volume",
+			Parameters: map[string]string{"share": "server:/", "apiKey": "parameter-secret"},
+			Secrets:    map[string]string{"user": "admin", "password": "secret-password"},
+		}
+		invokeErr = nil
+	})
+
+	JustBeforeEach(func() {
+		interceptor := csibroker.PayloadLoggingUnaryClientInterceptor(logger)
+		err = interceptor(context.TODO(), "/csi.v1.Controller/CreateVolume", request, &csi.CreateVolumeResponse{}, nil,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				reply.(*csi.CreateVolumeResponse).Volume = &csi.Volume{VolumeId: "some-volume-id", VolumeContext: map[string]string{"token": "context-token"}}
+				return invokeErr
+			})
+	})
+
+	It("logs the request and response at debug level with secrets redacted", func() {
+		Expect(err).NotTo(HaveOccurred())
+
+		logs := logger.LogMessages()
+		Expect(logs).To(Equal([]string{"test-payload.grpc-payload.request", "test-payload.grpc-payload.response"}))
+		Expect(logger.Logs()[0].LogLevel).To(Equal(lager.DEBUG))
+		Expect(logger.Logs()[0].Data["payload"]).To(Equal(map[string]interface{}{
+			"name":       "some-volume",
+			"parameters": map[string]interface{}{"share": "server:/", "apiKey": "[REDACTED]"},
+			"secrets":    map[string]interface{}{"user": "[REDACTED]", "password": "[REDACTED]"},
+		}))
+
+		contents := string(logger.Buffer().Contents())
+		Expect(contents).To(ContainSubstring("some-volume-id"))
+		Expect(contents).NotTo(ContainSubstring("secret-password"))
+		Expect(contents).NotTo(ContainSubstring("parameter-secret"))
+		Expect(contents).NotTo(ContainSubstring("context-token"))
+	})
+
+	Context("when the call fails", func() {
+		BeforeEach(func() {
+			invokeErr = errors.New("driver badness")
+		})
+
+		It("logs the error instead of a response", func() {
+			Expect(err).To(MatchError("driver badness"))
+			Expect(logger.LogMessages()).To(Equal([]string{"test-payload.grpc-payload.request", "test-payload.grpc-payload.error"}))
+		})
+	})
+})
@@ -0,0 +1,138 @@
+package csibroker
+
+import (
+	"errors"
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// PlanCapacity bounds the size of the volumes provisioned on a plan. Sizes
+// are human-readable, e.g. "10Gi"; an empty bound is not enforced.
+type PlanCapacity struct {
+	MinCapacity string `json:"min_capacity,omitempty"`
+	MaxCapacity string `json:"max_capacity,omitempty"`
+	// DefaultCapacity is requested for volumes that ask for no capacity.
+	// Without it they are requested at MinCapacity.
+	DefaultCapacity string `json:"default_capacity,omitempty"`
+}
+
+type ErrPlanCapacityExceeded struct {
+	PlanName string
+	Limits   PlanCapacity
+	Reason   string
+}
+
+func (e ErrPlanCapacityExceeded) Error() string {
+	switch {
+	case e.Limits.MinCapacity != "" && e.Limits.MaxCapacity != "":
+		return fmt.Sprintf("plan %q allows volumes of %s to %s: %s", e.PlanName, e.Limits.MinCapacity, e.Limits.MaxCapacity, e.Reason)
+	case e.Limits.MinCapacity != "":
+		return fmt.Sprintf("plan %q allows volumes of at least %s: %s", e.PlanName, e.Limits.MinCapacity, e.Reason)
+	default:
+		return fmt.Sprintf("plan %q allows volumes of at most %s: %s", e.PlanName, e.Limits.MaxCapacity, e.Reason)
+	}
+}
+
+// planCapacityBytes is a PlanCapacity in bytes, zero where unset.
+type planCapacityBytes struct {
+	min, max, defaultCapacity int64
+}
+
+func (c PlanCapacity) bytes() (planCapacityBytes, error) {
+	var (
+		result planCapacityBytes
+		err    error
+	)
+
+	if c.MinCapacity != "" {
+		if result.min, err = ParseCapacity(c.MinCapacity); err != nil {
+			return planCapacityBytes{}, fmt.Errorf("min_capacity: %s", err)
+		}
+	}
+	if c.MaxCapacity != "" {
+		if result.max, err = ParseCapacity(c.MaxCapacity); err != nil {
+			return planCapacityBytes{}, fmt.Errorf("max_capacity: %s", err)
+		}
+	}
+	if c.DefaultCapacity != "" {
+		if result.defaultCapacity, err = ParseCapacity(c.DefaultCapacity); err != nil {
+			return planCapacityBytes{}, fmt.Errorf("default_capacity: %s", err)
+		}
+	}
+	return result, nil
+}
+
+func (c PlanCapacity) validate() error {
+	limits, err := c.bytes()
+	if err != nil {
+		return err
+	}
+	if limits.min == 0 && limits.max == 0 {
+		return errors.New("sets neither min_capacity nor max_capacity")
+	}
+	if limits.max > 0 && limits.min > limits.max {
+		return fmt.Errorf("min_capacity %s is more than max_capacity %s", c.MinCapacity, c.MaxCapacity)
+	}
+	if limits.defaultCapacity > 0 && (limits.defaultCapacity < limits.min || limits.max > 0 && limits.defaultCapacity > limits.max) {
+		return fmt.Errorf("default_capacity %s is outside the plan's limits", c.DefaultCapacity)
+	}
+	return nil
+}
+
+// applyPlanCapacity requests the plan's default size for a request that
+// asks for none, caps it at the plan's maximum, and rejects a request whose
+// capacity range falls outside the plan's limits.
+func applyPlanCapacity(service Service, planID string, request *csi.CreateVolumeRequest) error {
+	capacity, ok := service.PlanCapacities[planID]
+	if !ok {
+		return nil
+	}
+	limits, err := capacity.bytes()
+	if err != nil {
+		return err
+	}
+
+	if request.CapacityRange == nil {
+		request.CapacityRange = &csi.CapacityRange{}
+	}
+	capacityRange := request.CapacityRange
+	if capacityRange.RequiredBytes == 0 && capacityRange.LimitBytes == 0 {
+		capacityRange.RequiredBytes = limits.defaultCapacity
+		if capacityRange.RequiredBytes == 0 {
+			capacityRange.RequiredBytes = limits.min
+		}
+		capacityRange.LimitBytes = limits.max
+		return nil
+	}
+
+	exceeded := ErrPlanCapacityExceeded{PlanName: planName(service, planID), Limits: capacity}
+	switch {
+	case limits.max > 0 && capacityRange.RequiredBytes > limits.max:
+		exceeded.Reason = fmt.Sprintf("%d bytes requested", capacityRange.RequiredBytes)
+		return exceeded
+	case limits.min > 0 && capacityRange.LimitBytes > 0 && capacityRange.LimitBytes < limits.min:
+		exceeded.Reason = fmt.Sprintf("limit of %d bytes requested", capacityRange.LimitBytes)
+		return exceeded
+	case limits.min > 0 && capacityRange.RequiredBytes > 0 && capacityRange.RequiredBytes < limits.min:
+		exceeded.Reason = fmt.Sprintf("%d bytes requested", capacityRange.RequiredBytes)
+		return exceeded
+	}
+
+	if capacityRange.RequiredBytes == 0 {
+		capacityRange.RequiredBytes = limits.min
+	}
+	if limits.max > 0 && (capacityRange.LimitBytes == 0 || capacityRange.LimitBytes > limits.max) {
+		capacityRange.LimitBytes = limits.max
+	}
+	return nil
+}
+
+func planName(service Service, planID string) string {
+	for _, plan := range service.Plans {
+		if plan.ID == planID {
+			return plan.Name
+		}
+	}
+	return planID
+}
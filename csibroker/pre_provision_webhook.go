@@ -0,0 +1,146 @@
+package csibroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	DefaultPreProvisionWebhookTimeout = 10 * time.Second
+
+	// preProvisionRejectionLimit bounds how much of a rejection body is read
+	// for its message.
+	preProvisionRejectionLimit = 4096
+)
+
+// PreProvisionWebhookRequest is the body POSTed to the pre-provision webhook
+// before the driver is asked to create an instance's volumes.
+type PreProvisionWebhookRequest struct {
+	InstanceID       string                      `json:"instance_id"`
+	ServiceID        string                      `json:"service_id"`
+	PlanID           string                      `json:"plan_id"`
+	OrganizationGUID string                      `json:"organization_guid"`
+	SpaceGUID        string                      `json:"space_guid"`
+	Volumes          []PreProvisionWebhookVolume `json:"volumes"`
+}
+
+// PreProvisionWebhookVolume is one CreateVolumeRequest the provision would
+// send. Secrets are left out and secret-looking parameters redacted.
+type PreProvisionWebhookVolume struct {
+	Name          string            `json:"name"`
+	RequiredBytes int64             `json:"required_bytes,omitempty"`
+	LimitBytes    int64             `json:"limit_bytes,omitempty"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+}
+
+// PreProvisionWebhookRejection is the optional JSON body of a rejecting
+// response. A body that is not of this form is used as the message as is.
+type PreProvisionWebhookRejection struct {
+	Message string `json:"message"`
+}
+
+type ErrPreProvisionWebhookFailed struct {
+	Reason string
+}
+
+func (e ErrPreProvisionWebhookFailed) Error() string {
+	return fmt.Sprintf("pre-provision webhook failed: %s", e.Reason)
+}
+
+// PreProvisionWebhook lets an operator's policy endpoint veto provisions:
+// any response other than a 2xx rejects the provision with its message.
+type PreProvisionWebhook struct {
+	url         string
+	failOnError bool
+	client      *http.Client
+}
+
+// NewPreProvisionWebhook POSTs to url. When failOnError is set a webhook
+// that cannot be reached fails the provision; otherwise the provision goes
+// ahead and the failure is only logged.
+func NewPreProvisionWebhook(url string, failOnError bool, timeout time.Duration) *PreProvisionWebhook {
+	return &PreProvisionWebhook{
+		url:         url,
+		failOnError: failOnError,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+// check asks the webhook whether the provision may go ahead.
+func (w *PreProvisionWebhook) check(ctx context.Context, logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails, requests []*csi.CreateVolumeRequest) error {
+	logger = logger.Session("pre-provision-webhook")
+
+	body := PreProvisionWebhookRequest{
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Volumes:          []PreProvisionWebhookVolume{},
+	}
+	for _, request := range requests {
+		body.Volumes = append(body.Volumes, PreProvisionWebhookVolume{
+			Name:          request.GetName(),
+			RequiredBytes: request.GetCapacityRange().GetRequiredBytes(),
+			LimitBytes:    request.GetCapacityRange().GetLimitBytes(),
+			Parameters:    redactSecrets(request.GetParameters()),
+		})
+	}
+
+	response, err := w.post(ctx, body)
+	if err != nil {
+		logger.Error("failed", err, lager.Data{"failOnError": w.failOnError})
+		if w.failOnError {
+			return ErrPreProvisionWebhookFailed{Reason: err.Error()}
+		}
+		return nil
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		logger.Info("allowed")
+		return nil
+	}
+
+	message := rejectionMessage(response)
+	logger.Info("rejected", lager.Data{"status": response.StatusCode, "message": message})
+	return brokerapi.NewFailureResponse(fmt.Errorf("provision rejected by policy: %s", message), http.StatusBadRequest, "pre-provision-webhook-rejected")
+}
+
+func (w *PreProvisionWebhook) post(ctx context.Context, body PreProvisionWebhookRequest) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	return w.client.Do(request.WithContext(ctx))
+}
+
+func rejectionMessage(response *http.Response) string {
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, preProvisionRejectionLimit))
+	if err != nil || len(bytes.TrimSpace(content)) == 0 {
+		return fmt.Sprintf("webhook returned %d", response.StatusCode)
+	}
+
+	var rejection PreProvisionWebhookRejection
+	if json.Unmarshal(content, &rejection) == nil && rejection.Message != "" {
+		return rejection.Message
+	}
+	return strings.TrimSpace(string(content))
+}
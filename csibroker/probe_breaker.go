@@ -0,0 +1,116 @@
+package csibroker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultProbeBreakerWindow   = time.Minute
+	DefaultProbeBreakerCooldown = 30 * time.Second
+)
+
+type ErrDriverUnavailable struct {
+	ServiceID  string
+	RetryAfter time.Duration
+}
+
+func (e ErrDriverUnavailable) Error() string {
+	return fmt.Sprintf("driver unavailable: service %s keeps failing its probe; retrying in %s", e.ServiceID, e.RetryAfter)
+}
+
+// probeBreaker stops probing a driver, and fails operations on it at once,
+// for cooldown after threshold consecutive probe failures within window.
+// Once the cooldown has passed a single operation probes again: success
+// closes the breaker, failure opens it for another cooldown.
+type probeBreaker struct {
+	logger    lager.Logger
+	clock     clock.Clock
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mutex  sync.Mutex
+	states map[string]*probeBreakerState
+}
+
+type probeBreakerState struct {
+	failures       int
+	firstFailureAt time.Time
+	openUntil      time.Time
+	trialInFlight  bool
+}
+
+func newProbeBreaker(logger lager.Logger, clock clock.Clock, threshold int, window, cooldown time.Duration) *probeBreaker {
+	return &probeBreaker{
+		logger:    logger.Session("probe-breaker"),
+		clock:     clock,
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		states:    map[string]*probeBreakerState{},
+	}
+}
+
+// allow returns ErrDriverUnavailable while the breaker for the service is
+// open, and while another operation makes the trial probe.
+func (p *probeBreaker) allow(serviceID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state, ok := p.states[serviceID]
+	if !ok || state.openUntil.IsZero() {
+		return nil
+	}
+
+	now := p.clock.Now()
+	if now.Before(state.openUntil) {
+		return ErrDriverUnavailable{ServiceID: serviceID, RetryAfter: state.openUntil.Sub(now)}
+	}
+	if state.trialInFlight {
+		return ErrDriverUnavailable{ServiceID: serviceID}
+	}
+	state.trialInFlight = true
+	return nil
+}
+
+func (p *probeBreaker) record(serviceID string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err == nil {
+		if state, ok := p.states[serviceID]; ok && !state.openUntil.IsZero() {
+			p.logger.Info("closed", lager.Data{"serviceID": serviceID})
+		}
+		delete(p.states, serviceID)
+		return
+	}
+
+	state, ok := p.states[serviceID]
+	if !ok {
+		state = &probeBreakerState{}
+		p.states[serviceID] = state
+	}
+
+	now := p.clock.Now()
+	if state.trialInFlight {
+		state.trialInFlight = false
+		state.openUntil = now.Add(p.cooldown)
+		p.logger.Info("reopened", lager.Data{"serviceID": serviceID, "cooldown": p.cooldown.String(), "error": err.Error()})
+		return
+	}
+
+	if state.failures == 0 || now.Sub(state.firstFailureAt) > p.window {
+		state.failures = 0
+		state.firstFailureAt = now
+	}
+	state.failures++
+	if state.failures >= p.threshold {
+		state.openUntil = now.Add(p.cooldown)
+		p.logger.Info("opened", lager.Data{"serviceID": serviceID, "failures": state.failures, "cooldown": p.cooldown.String(), "error": err.Error()})
+	}
+}
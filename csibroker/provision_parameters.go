@@ -0,0 +1,269 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	parameterSetKey = "parameter_set"
+	requestedIDKey  = "requested_id"
+	// capacityKey is a human-readable size, e.g. "10Gi", that becomes the
+	// request's capacity_range.required_bytes.
+	capacityKey = "capacity"
+	// additionalVolumesKey lists further CreateVolumeRequests whose volumes
+	// belong to the same instance and are mounted alongside the first.
+	additionalVolumesKey = "additional_volumes"
+	// labelsKey holds string labels the broker records on the instance. They
+	// reach the driver only through the service's label_parameters.
+	labelsKey = "labels"
+	// createVolumeRequestKey holds the CreateVolumeRequest in protobuf text
+	// format when the broker parses parameters as ParameterFormatProtoText.
+	createVolumeRequestKey = "create_volume_request"
+)
+
+const (
+	ParameterFormatJSON      = "json"
+	ParameterFormatProtoText = "prototext"
+)
+
+// ErrInvalidParameterFormat reports provision parameters that do not parse
+// as ParameterFormatProtoText. JSON that does not parse is reported as
+// brokerapi.ErrRawParamsInvalid.
+type ErrInvalidParameterFormat struct {
+	Err error
+}
+
+func (e ErrInvalidParameterFormat) Error() string {
+	return fmt.Sprintf("parameter '%s' must be a CreateVolumeRequest in protobuf text format: %s", createVolumeRequestKey, e.Err)
+}
+
+// provisionParameters are the keys of the provision RawParameters that the
+// broker interprets itself and never forwards to the driver.
+type provisionParameters struct {
+	ParameterSet string
+	RequestedID  string
+	Capacity     string
+	Labels       map[string]string
+
+	AdditionalVolumes []*csi.CreateVolumeRequest
+}
+
+// parseProvisionParameters splits a provision's parameters into the broker's
+// own keys and the CreateVolumeRequest for the driver. The broker's keys are
+// always JSON. With ParameterFormatProtoText the request, and each of the
+// additional volumes, is a string in protobuf text format instead of a JSON
+// object.
+func parseProvisionParameters(rawParameters json.RawMessage, format string) (*csi.CreateVolumeRequest, provisionParameters, error) {
+	var (
+		fields       map[string]json.RawMessage
+		brokerParams provisionParameters
+	)
+
+	err := json.Unmarshal(rawParameters, &fields)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+
+	err = checkContentSource(fields)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+	err = extractString(fields, parameterSetKey, &brokerParams.ParameterSet)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+	err = extractString(fields, requestedIDKey, &brokerParams.RequestedID)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+	err = extractString(fields, capacityKey, &brokerParams.Capacity)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+	if value, ok := fields[labelsKey]; ok {
+		err = json.Unmarshal(value, &brokerParams.Labels)
+		if err != nil {
+			return nil, provisionParameters{}, err
+		}
+		delete(fields, labelsKey)
+	}
+	if value, ok := fields[additionalVolumesKey]; ok {
+		brokerParams.AdditionalVolumes, err = parseAdditionalVolumes(value, format)
+		if err != nil {
+			return nil, provisionParameters{}, err
+		}
+		delete(fields, additionalVolumesKey)
+	}
+
+	if format == ParameterFormatProtoText {
+		raw, ok := fields[createVolumeRequestKey]
+		if !ok {
+			return nil, provisionParameters{}, ErrInvalidParameterFormat{Err: errors.New("missing")}
+		}
+		if len(fields) > 1 {
+			return nil, provisionParameters{}, ErrInvalidParameterFormat{Err: errors.New("request fields must not also be given as JSON")}
+		}
+		configuration, err := parseCreateVolumeRequest(raw, format)
+		return configuration, brokerParams, err
+	}
+
+	csiParameters, err := json.Marshal(fields)
+	if err != nil {
+		return nil, provisionParameters{}, err
+	}
+
+	configuration, err := parseCreateVolumeRequest(csiParameters, format)
+	return configuration, brokerParams, err
+}
+
+func parseCreateVolumeRequest(raw json.RawMessage, format string) (*csi.CreateVolumeRequest, error) {
+	var configuration csi.CreateVolumeRequest
+
+	if format == ParameterFormatProtoText {
+		var text string
+		err := json.Unmarshal(raw, &text)
+		if err != nil {
+			return nil, ErrInvalidParameterFormat{Err: errors.New("expected a string")}
+		}
+		err = proto.UnmarshalText(text, &configuration)
+		if err != nil {
+			return nil, ErrInvalidParameterFormat{Err: err}
+		}
+		return &configuration, nil
+	}
+
+	err := jsonpb.UnmarshalString(string(raw), &configuration)
+	if err != nil {
+		return nil, err
+	}
+	return &configuration, nil
+}
+
+func parseAdditionalVolumes(raw json.RawMessage, format string) ([]*csi.CreateVolumeRequest, error) {
+	var rawVolumes []json.RawMessage
+	err := json.Unmarshal(raw, &rawVolumes)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*csi.CreateVolumeRequest
+	for _, rawVolume := range rawVolumes {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(rawVolume, &fields) == nil {
+			err = checkContentSource(fields)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		volume, err := parseCreateVolumeRequest(rawVolume, format)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// errInvalidProvisionParameters rejects a provision with a 400 whose
+// description the platform shows to the user as is.
+func errInvalidProvisionParameters(description string) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf("%s", description), http.StatusBadRequest, "invalid-provision-parameters")
+}
+
+// parseVolumeCapabilities decodes a JSON array of CSI VolumeCapabilities.
+func parseVolumeCapabilities(raw json.RawMessage) ([]*csi.VolumeCapability, error) {
+	var rawCapabilities []json.RawMessage
+	err := json.Unmarshal(raw, &rawCapabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	var capabilities []*csi.VolumeCapability
+	for _, rawCapability := range rawCapabilities {
+		var capability csi.VolumeCapability
+		err = jsonpb.UnmarshalString(string(rawCapability), &capability)
+		if err != nil {
+			return nil, err
+		}
+		capabilities = append(capabilities, &capability)
+	}
+	return capabilities, nil
+}
+
+// validateDefaultVolumeCapabilities checks that a service's
+// default_volume_capabilities decode and are complete: each names an access
+// type and a usable access mode.
+func validateDefaultVolumeCapabilities(raw json.RawMessage) error {
+	capabilities, err := parseVolumeCapabilities(raw)
+	if err != nil {
+		return fmt.Errorf("default_volume_capabilities: %s", err)
+	}
+	if len(capabilities) == 0 {
+		return errors.New("default_volume_capabilities must not be empty")
+	}
+	for i, capability := range capabilities {
+		if accessTypeOf(capability) == "" {
+			return fmt.Errorf("default_volume_capabilities[%d] names no access type", i)
+		}
+		if !isKnownAccessMode(capability.GetAccessMode().GetMode().String()) {
+			return fmt.Errorf("default_volume_capabilities[%d] names no usable access mode", i)
+		}
+	}
+	return nil
+}
+
+// missingParameters lists, in the service's order, the required parameters
+// the request lacks or leaves empty.
+func missingParameters(service Service, request *csi.CreateVolumeRequest) []string {
+	var missing []string
+	for _, key := range service.RequiredParameters {
+		if request.GetParameters()[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+func extractString(fields map[string]json.RawMessage, key string, value *string) error {
+	raw, ok := fields[key]
+	if !ok {
+		return nil
+	}
+	delete(fields, key)
+
+	return json.Unmarshal(raw, value)
+}
+
+func hasNoParameters(rawParameters json.RawMessage) bool {
+	trimmed := strings.TrimSpace(string(rawParameters))
+	return trimmed == "" || trimmed == "null" || trimmed == "{}"
+}
+
+// defaultCreateVolumeRequest builds the request used for a provision without
+// parameters from the service's configured defaults, naming the volume after
+// the instance unless the defaults name it.
+func defaultCreateVolumeRequest(defaults json.RawMessage, instanceID string) (*csi.CreateVolumeRequest, error) {
+	var configuration csi.CreateVolumeRequest
+
+	err := jsonpb.UnmarshalString(string(defaults), &configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if configuration.Name == "" {
+		configuration.Name = instanceID
+	}
+
+	return &configuration, nil
+}
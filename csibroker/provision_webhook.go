@@ -0,0 +1,142 @@
+package csibroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const DefaultProvisionWebhookTimeout = 30 * time.Second
+
+// ProvisionWebhookRequest is the body POSTed to the provision webhook once
+// the driver has created an instance's volumes. Volume contexts are left out
+// since they may hold credentials.
+type ProvisionWebhookRequest struct {
+	InstanceID       string                   `json:"instance_id"`
+	ServiceID        string                   `json:"service_id"`
+	PlanID           string                   `json:"plan_id"`
+	OrganizationGUID string                   `json:"organization_guid"`
+	SpaceGUID        string                   `json:"space_guid"`
+	Name             string                   `json:"name"`
+	Parameters       map[string]string        `json:"parameters,omitempty"`
+	Volumes          []ProvisionWebhookVolume `json:"volumes"`
+}
+
+type ProvisionWebhookVolume struct {
+	VolumeID      string `json:"volume_id"`
+	CapacityBytes int64  `json:"capacity_bytes,omitempty"`
+}
+
+// ProvisionWebhookResponse is the optional body of the webhook's response.
+// VolumeContext entries are added to the context of the instance's first
+// volume, which binds hand to the driver's node plugin. Entries the driver
+// set itself are kept.
+type ProvisionWebhookResponse struct {
+	VolumeContext map[string]string `json:"volume_context,omitempty"`
+}
+
+type ErrProvisionWebhookFailed struct {
+	Reason string
+}
+
+func (e ErrProvisionWebhookFailed) Error() string {
+	return fmt.Sprintf("provision webhook failed: %s", e.Reason)
+}
+
+// ProvisionWebhook calls out to an operator's endpoint for every provisioned
+// instance, e.g. to register it with a CMDB.
+type ProvisionWebhook struct {
+	url         string
+	failOnError bool
+	client      *http.Client
+}
+
+// NewProvisionWebhook POSTs to url. When failOnError is set a failed call
+// fails the provision and deletes its volumes; otherwise it is only logged.
+func NewProvisionWebhook(url string, failOnError bool, timeout time.Duration) *ProvisionWebhook {
+	return &ProvisionWebhook{
+		url:         url,
+		failOnError: failOnError,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+// call notifies the webhook and applies its response to the first volume.
+func (w *ProvisionWebhook) call(ctx context.Context, logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails, configuration *csi.CreateVolumeRequest, volumes []*csi.Volume) error {
+	logger = logger.Session("provision-webhook")
+
+	response, err := w.post(ctx, instanceID, details, configuration, volumes)
+	if err != nil {
+		logger.Error("failed", err, lager.Data{"failOnError": w.failOnError})
+		if w.failOnError {
+			return err
+		}
+		return nil
+	}
+
+	volume := volumes[0]
+	for key, value := range response.VolumeContext {
+		if volume.VolumeContext == nil {
+			volume.VolumeContext = map[string]string{}
+		}
+		if _, ok := volume.VolumeContext[key]; !ok {
+			volume.VolumeContext[key] = value
+		}
+	}
+	logger.Info("called", lager.Data{"volumeContextKeys": len(response.VolumeContext)})
+	return nil
+}
+
+func (w *ProvisionWebhook) post(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, configuration *csi.CreateVolumeRequest, volumes []*csi.Volume) (ProvisionWebhookResponse, error) {
+	body := ProvisionWebhookRequest{
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Name:             configuration.GetName(),
+		Parameters:       redactSecrets(configuration.GetParameters()),
+		Volumes:          []ProvisionWebhookVolume{},
+	}
+	for _, volume := range volumes {
+		body.Volumes = append(body.Volumes, ProvisionWebhookVolume{VolumeID: volume.GetVolumeId(), CapacityBytes: volume.GetCapacityBytes()})
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return ProvisionWebhookResponse{}, err
+	}
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(encoded))
+	if err != nil {
+		return ProvisionWebhookResponse{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return ProvisionWebhookResponse{}, ErrProvisionWebhookFailed{Reason: err.Error()}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return ProvisionWebhookResponse{}, ErrProvisionWebhookFailed{Reason: fmt.Sprintf("webhook returned %d", response.StatusCode)}
+	}
+
+	var result ProvisionWebhookResponse
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err == io.EOF {
+		return result, nil
+	}
+	if err != nil {
+		return ProvisionWebhookResponse{}, ErrProvisionWebhookFailed{Reason: fmt.Sprintf("invalid response: %s", err)}
+	}
+	return result, nil
+}
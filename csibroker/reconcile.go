@@ -0,0 +1,201 @@
+package csibroker
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type ReconcileInstance struct {
+	InstanceID string `json:"instance_id"`
+	ServiceID  string `json:"service_id"`
+	VolumeID   string `json:"volume_id"`
+}
+
+type ReconcileVolume struct {
+	ServiceID string `json:"service_id"`
+	VolumeID  string `json:"volume_id"`
+}
+
+// ReconcileReport lists the differences between the store and the drivers.
+// OrphanedInstances are stored instances whose volume the driver no longer
+// reports; UnknownVolumes are driver volumes no stored instance refers to.
+type ReconcileReport struct {
+	OrphanedInstances []ReconcileInstance `json:"orphaned_instances"`
+	UnknownVolumes    []ReconcileVolume   `json:"unknown_volumes"`
+	SkippedServices   []string            `json:"skipped_services,omitempty"`
+	PrunedInstances   []string            `json:"pruned_instances,omitempty"`
+}
+
+// WithReconcilePageSize sets max_entries on the ListVolumes requests made
+// while reconciling. Zero leaves the page size to the driver.
+func WithReconcilePageSize(pageSize int32) Option {
+	return func(b *Broker) {
+		b.reconcilePageSize = pageSize
+	}
+}
+
+// Reconcile compares the stored instances of every service with the volumes
+// its driver lists. Services whose driver does not implement ListVolumes are
+// skipped.
+func (b *Broker) Reconcile(ctx context.Context) (report ReconcileReport, e error) {
+	logger := b.logger.Session("reconcile")
+	logger.Info("start")
+	defer logger.Info("end")
+	defer func() { b.recordReconcile(logger, report, e) }()
+
+	b.mutex.Lock()
+	instances, err := retrieveInstances(b.store)
+	b.mutex.Unlock()
+	if err != nil {
+		logger.Error("retrieve-instances-failed", err)
+		return ReconcileReport{}, err
+	}
+
+	stored := map[string]map[string]string{}
+	for instanceID, instance := range instances {
+		fingerprint, err := getFingerprint(instance.ServiceFingerPrint)
+		if err != nil || fingerprint.Volume == nil {
+			logger.Info("skipping-instance-without-volume", lager.Data{"instanceID": instanceID})
+			continue
+		}
+		if stored[instance.ServiceID] == nil {
+			stored[instance.ServiceID] = map[string]string{}
+		}
+		stored[instance.ServiceID][fingerprint.Volume.VolumeId] = instanceID
+		for _, volume := range fingerprint.AdditionalVolumes {
+			stored[instance.ServiceID][volume.VolumeId] = instanceID
+		}
+	}
+
+	report = ReconcileReport{
+		OrphanedInstances: []ReconcileInstance{},
+		UnknownVolumes:    []ReconcileVolume{},
+	}
+	for _, service := range b.servicesRegistry.BrokerServices() {
+		controllerClient, err := b.servicesRegistry.ControllerClient(service.ID)
+		if err != nil {
+			return ReconcileReport{}, err
+		}
+
+		volumes, err := listAllVolumes(ctx, controllerClient, b.reconcilePageSize)
+		if status.Code(err) == codes.Unimplemented {
+			logger.Info("list-volumes-unsupported", lager.Data{"serviceID": service.ID})
+			report.SkippedServices = append(report.SkippedServices, service.ID)
+			continue
+		}
+		if err != nil {
+			logger.Error("list-volumes-failed", err, lager.Data{"serviceID": service.ID})
+			return ReconcileReport{}, err
+		}
+
+		listed := map[string]bool{}
+		for _, volume := range volumes {
+			listed[volume.VolumeId] = true
+			if _, ok := stored[service.ID][volume.VolumeId]; !ok {
+				report.UnknownVolumes = append(report.UnknownVolumes, ReconcileVolume{ServiceID: service.ID, VolumeID: volume.VolumeId})
+			}
+		}
+		for volumeID, instanceID := range stored[service.ID] {
+			if !listed[volumeID] {
+				report.OrphanedInstances = append(report.OrphanedInstances, ReconcileInstance{InstanceID: instanceID, ServiceID: service.ID, VolumeID: volumeID})
+			}
+		}
+	}
+
+	logger.Info("reconcile-report", lager.Data{
+		"orphanedInstances": len(report.OrphanedInstances),
+		"unknownVolumes":    len(report.UnknownVolumes),
+		"skippedServices":   report.SkippedServices,
+	})
+	return report, nil
+}
+
+// PruneOrphanedInstances removes the store records of the report's orphaned
+// instances whose primary volume is gone from the driver, and returns their
+// IDs. Driver volumes are never touched.
+func (b *Broker) PruneOrphanedInstances(report ReconcileReport) (pruned []string, e error) {
+	logger := b.logger.Session("prune-orphaned-instances")
+	logger.Info("start")
+	defer logger.Info("end")
+	// deferred first so that it sees the outcome of saving the store
+	defer func() { b.recordPrune(logger, pruned, e) }()
+
+	err := b.ensureRestored(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := map[string]map[string]bool{}
+	for _, orphan := range report.OrphanedInstances {
+		if missing[orphan.InstanceID] == nil {
+			missing[orphan.InstanceID] = map[string]bool{}
+		}
+		missing[orphan.InstanceID][orphan.VolumeID] = true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	pruned = []string{}
+	defer func() {
+		if len(pruned) == 0 {
+			return
+		}
+		out := b.store.Save(logger)
+		if e == nil {
+			e = out
+		}
+	}()
+
+	for instanceID, volumeIDs := range missing {
+		instance, err := b.store.RetrieveInstanceDetails(instanceID)
+		if err != nil {
+			continue
+		}
+		fingerprint, err := getFingerprint(instance.ServiceFingerPrint)
+		if err != nil || fingerprint.Volume == nil || !volumeIDs[fingerprint.Volume.VolumeId] {
+			continue
+		}
+
+		err = b.store.DeleteInstanceDetails(instanceID)
+		if err != nil {
+			return pruned, err
+		}
+		logger.Info("pruned-instance", lager.Data{"instanceID": instanceID, "volumeID": fingerprint.Volume.VolumeId})
+		pruned = append(pruned, instanceID)
+	}
+
+	return pruned, nil
+}
+
+// listAllVolumes follows ListVolumes pagination until the driver stops
+// returning a next token.
+func listAllVolumes(ctx context.Context, controllerClient csi.ControllerClient, pageSize int32) ([]*csi.Volume, error) {
+	var (
+		volumes []*csi.Volume
+		token   string
+	)
+
+	for {
+		response, err := controllerClient.ListVolumes(ctx, &csi.ListVolumesRequest{
+			MaxEntries:    pageSize,
+			StartingToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range response.GetEntries() {
+			volumes = append(volumes, entry.GetVolume())
+		}
+
+		token = response.GetNextToken()
+		if token == "" {
+			return volumes, nil
+		}
+	}
+}
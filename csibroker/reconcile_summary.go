@@ -0,0 +1,133 @@
+package csibroker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// ReconcileSummary is the outcome of the most recent reconcile: the counts
+// of its report, the instances pruned after it and, if it failed, why.
+type ReconcileSummary struct {
+	Time              time.Time `json:"time"`
+	OrphanedInstances int       `json:"orphaned_instances"`
+	UnknownVolumes    int       `json:"unknown_volumes"`
+	SkippedServices   []string  `json:"skipped_services,omitempty"`
+	PrunedInstances   []string  `json:"pruned_instances,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+type reconcileSummaries struct {
+	mutex sync.Mutex
+	last  *ReconcileSummary
+	// file, when set, keeps the summary across restarts.
+	file string
+}
+
+// WithReconcileSummaryFile writes the summary of every reconcile to path and
+// reads it back after a restart, until the next reconcile replaces it.
+func WithReconcileSummaryFile(path string) Option {
+	return func(b *Broker) {
+		b.reconcileSummaries.file = path
+	}
+}
+
+// LastReconcile returns the summary of the most recent reconcile, from the
+// startup or the admin endpoint, and false if there has been none.
+func (b *Broker) LastReconcile() (ReconcileSummary, bool) {
+	s := &b.reconcileSummaries
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.last == nil && s.file != "" {
+		contents, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				b.logger.Error("read-reconcile-summary-failed", err, lager.Data{"file": s.file})
+			}
+			return ReconcileSummary{}, false
+		}
+		var summary ReconcileSummary
+		err = json.Unmarshal(contents, &summary)
+		if err != nil {
+			b.logger.Error("read-reconcile-summary-failed", err, lager.Data{"file": s.file})
+			return ReconcileSummary{}, false
+		}
+		s.last = &summary
+	}
+
+	if s.last == nil {
+		return ReconcileSummary{}, false
+	}
+	return *s.last, true
+}
+
+func (b *Broker) recordReconcile(logger lager.Logger, report ReconcileReport, err error) {
+	summary := ReconcileSummary{
+		Time:              b.clock.Now().UTC(),
+		OrphanedInstances: len(report.OrphanedInstances),
+		UnknownVolumes:    len(report.UnknownVolumes),
+		SkippedServices:   report.SkippedServices,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	b.saveReconcileSummary(logger, summary)
+}
+
+// recordPrune adds the outcome of pruning to the summary of the reconcile
+// whose report was pruned.
+func (b *Broker) recordPrune(logger lager.Logger, pruned []string, err error) {
+	summary, ok := b.LastReconcile()
+	if !ok {
+		return
+	}
+	summary.PrunedInstances = pruned
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	b.saveReconcileSummary(logger, summary)
+}
+
+func (b *Broker) saveReconcileSummary(logger lager.Logger, summary ReconcileSummary) {
+	s := &b.reconcileSummaries
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last = &summary
+	if s.file == "" {
+		return
+	}
+
+	contents, err := json.Marshal(summary)
+	if err == nil {
+		err = writeFileAtomically(s.file, contents)
+	}
+	if err != nil {
+		logger.Error("write-reconcile-summary-failed", err, lager.Data{"file": s.file})
+	}
+}
+
+// writeFileAtomically replaces path with contents through a temporary file
+// in the same directory, so that a crash never leaves it half written.
+func writeFileAtomically(path string, contents []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(contents)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
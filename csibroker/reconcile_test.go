@@ -0,0 +1,239 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/csishim/csi_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconcile", func() {
+	var (
+		broker               *csibroker.Broker
+		fakeStore            *brokerstorefakes.FakeStore
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		fakeControllerClient *csi_fake.FakeControllerClient
+		report               csibroker.ReconcileReport
+		err                  error
+	)
+
+	volumePage := func(nextToken string, volumeIDs ...string) *csi.ListVolumesResponse {
+		response := &csi.ListVolumesResponse{NextToken: nextToken}
+		for _, volumeID := range volumeIDs {
+			response.Entries = append(response.Entries, &csi.ListVolumesResponse_Entry{Volume: &csi.Volume{VolumeId: volumeID}})
+		}
+		return response
+	}
+
+	BeforeEach(func() {
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+		fakeControllerClient = &csi_fake.FakeControllerClient{}
+
+		fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{{ID: "some-service-id"}})
+		fakeServicesRegistry.ControllerClientReturns(fakeControllerClient, nil)
+
+		fakeStore.RetrieveAllInstanceDetailsReturns(map[string]brokerstore.ServiceInstance{
+			"instance-one": {
+				ServiceID:          "some-service-id",
+				ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "volume-one"}},
+			},
+			"instance-two": {
+				ServiceID:          "some-service-id",
+				ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "volume-two"}},
+			},
+		}, nil)
+
+		fakeControllerClient.ListVolumesReturnsOnCall(0, volumePage("page-2", "volume-one"), nil)
+		fakeControllerClient.ListVolumesReturnsOnCall(1, volumePage("page-3", "volume-stray"), nil)
+		fakeControllerClient.ListVolumesReturnsOnCall(2, volumePage(""), nil)
+
+		broker, err = csibroker.New(
+			lagertest.NewTestLogger("test-reconcile"),
+			&os_fake.FakeOs{},
+			fakeclock.NewFakeClock(time.Unix(1500000000, 0)),
+			fakeStore,
+			fakeServicesRegistry,
+			csibroker.WithReconcilePageSize(1),
+		)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		report, err = broker.Reconcile(context.TODO())
+	})
+
+	It("follows ListVolumes pagination until there is no next token", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeControllerClient.ListVolumesCallCount()).To(Equal(3))
+
+		_, request, _ := fakeControllerClient.ListVolumesArgsForCall(0)
+		Expect(request.MaxEntries).To(Equal(int32(1)))
+		Expect(request.StartingToken).To(BeEmpty())
+		_, request, _ = fakeControllerClient.ListVolumesArgsForCall(1)
+		Expect(request.StartingToken).To(Equal("page-2"))
+		_, request, _ = fakeControllerClient.ListVolumesArgsForCall(2)
+		Expect(request.StartingToken).To(Equal("page-3"))
+	})
+
+	It("reports the differences across all pages", func() {
+		Expect(report.OrphanedInstances).To(ConsistOf(csibroker.ReconcileInstance{
+			InstanceID: "instance-two",
+			ServiceID:  "some-service-id",
+			VolumeID:   "volume-two",
+		}))
+		Expect(report.UnknownVolumes).To(ConsistOf(csibroker.ReconcileVolume{
+			ServiceID: "some-service-id",
+			VolumeID:  "volume-stray",
+		}))
+	})
+
+	Context("when a self-check record outlived its run", func() {
+		BeforeEach(func() {
+			instances, _ := fakeStore.RetrieveAllInstanceDetails()
+			instances["csibroker-self-check-0123abcd"] = brokerstore.ServiceInstance{
+				ServiceID:          "some-service-id",
+				ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "volume-three"}},
+			}
+		})
+
+		It("does not report it as orphaned", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.OrphanedInstances).To(HaveLen(1))
+			Expect(report.OrphanedInstances[0].InstanceID).To(Equal("instance-two"))
+		})
+	})
+
+	Context("when the driver does not implement ListVolumes", func() {
+		BeforeEach(func() {
+			fakeControllerClient.ListVolumesReturnsOnCall(0, nil, status.Error(codes.Unimplemented, "nope"))
+		})
+
+		It("skips the service", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.SkippedServices).To(ConsistOf("some-service-id"))
+			Expect(report.OrphanedInstances).To(BeEmpty())
+		})
+	})
+
+	Context("when listing a page fails", func() {
+		BeforeEach(func() {
+			fakeControllerClient.ListVolumesReturnsOnCall(1, nil, errors.New("badness"))
+		})
+
+		It("returns the error", func() {
+			Expect(err).To(MatchError("badness"))
+		})
+	})
+
+	Context("when the store cannot be read", func() {
+		BeforeEach(func() {
+			fakeStore.RetrieveAllInstanceDetailsReturns(nil, errors.New("store badness"))
+		})
+
+		It("returns the error", func() {
+			Expect(err).To(MatchError("store badness"))
+			Expect(fakeControllerClient.ListVolumesCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("LastReconcile", func() {
+		It("summarises the reconcile", func() {
+			summary, ok := broker.LastReconcile()
+			Expect(ok).To(BeTrue())
+			Expect(summary).To(Equal(csibroker.ReconcileSummary{
+				Time:              time.Unix(1500000000, 0).UTC(),
+				OrphanedInstances: 1,
+				UnknownVolumes:    1,
+			}))
+		})
+
+		Context("when the reconcile fails", func() {
+			BeforeEach(func() {
+				fakeStore.RetrieveAllInstanceDetailsReturns(nil, errors.New("store badness"))
+			})
+
+			It("records the error", func() {
+				summary, ok := broker.LastReconcile()
+				Expect(ok).To(BeTrue())
+				Expect(summary.Error).To(Equal("store badness"))
+			})
+		})
+
+		Context("when the summary is kept in a file", func() {
+			var summaryFile string
+
+			BeforeEach(func() {
+				dir, err := ioutil.TempDir("", "reconcile-summary")
+				Expect(err).NotTo(HaveOccurred())
+				summaryFile = filepath.Join(dir, "last-reconcile.json")
+
+				broker, err = csibroker.New(lagertest.NewTestLogger("test-reconcile"), &os_fake.FakeOs{}, fakeclock.NewFakeClock(time.Unix(1500000000, 0)), fakeStore, fakeServicesRegistry,
+					csibroker.WithReconcileSummaryFile(summaryFile))
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(filepath.Dir(summaryFile))
+			})
+
+			It("is read back by a restarted broker", func() {
+				restarted, err := csibroker.New(lagertest.NewTestLogger("test-reconcile"), &os_fake.FakeOs{}, fakeclock.NewFakeClock(time.Unix(1600000000, 0)), fakeStore, fakeServicesRegistry,
+					csibroker.WithReconcileSummaryFile(summaryFile))
+				Expect(err).NotTo(HaveOccurred())
+
+				summary, ok := restarted.LastReconcile()
+				Expect(ok).To(BeTrue())
+				Expect(summary.Time).To(BeTemporally("==", time.Unix(1500000000, 0)))
+				Expect(summary.OrphanedInstances).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("PruneOrphanedInstances", func() {
+		var pruned []string
+
+		JustBeforeEach(func() {
+			Expect(err).NotTo(HaveOccurred())
+			fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{
+				ServiceID:          "some-service-id",
+				ServiceFingerPrint: csibroker.ServiceFingerPrint{Volume: &csi.Volume{VolumeId: "volume-two"}},
+			}, nil)
+			pruned, err = broker.PruneOrphanedInstances(report)
+		})
+
+		It("deletes the store records of orphaned instances and saves", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pruned).To(ConsistOf("instance-two"))
+			Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+			Expect(fakeStore.DeleteInstanceDetailsArgsForCall(0)).To(Equal("instance-two"))
+			Expect(fakeStore.SaveCallCount()).To(Equal(1))
+			Expect(fakeControllerClient.DeleteVolumeCallCount()).To(Equal(0))
+		})
+
+		It("adds the pruned instances to the last reconcile's summary", func() {
+			summary, ok := broker.LastReconcile()
+			Expect(ok).To(BeTrue())
+			Expect(summary.OrphanedInstances).To(Equal(1))
+			Expect(summary.PrunedInstances).To(ConsistOf("instance-two"))
+		})
+	})
+})
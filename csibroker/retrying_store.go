@@ -0,0 +1,134 @@
+package csibroker
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+)
+
+const DefaultStoreSaveBackoff = 100 * time.Millisecond
+
+// MaxStoreSaveWait caps the time a Save spends waiting between retries. The
+// broker saves with its store lock held, so every other request waits out
+// the retries too; the cap keeps that well under the HTTP write timeout.
+const MaxStoreSaveWait = 10 * time.Second
+
+// RetryingStore retries a failed Save of the wrapped store when the failure
+// is transient, such as a deadlock or a dropped connection, waiting backoff
+// before the first retry and twice as long before each one after, for at most
+// MaxStoreSaveWait in all. Other failures, such as constraint violations, are
+// returned at once.
+type RetryingStore struct {
+	brokerstore.Store
+	logger  lager.Logger
+	clock   clock.Clock
+	retries int
+	backoff time.Duration
+}
+
+func NewRetryingStore(logger lager.Logger, store brokerstore.Store, clock clock.Clock, retries int, backoff time.Duration) *RetryingStore {
+	return &RetryingStore{
+		Store:   store,
+		logger:  logger.Session("retrying-store"),
+		clock:   clock,
+		retries: retries,
+		backoff: backoff,
+	}
+}
+
+func (s *RetryingStore) Save(logger lager.Logger) error {
+	backoff := s.backoff
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		err := s.Store.Save(logger)
+		if err == nil {
+			return nil
+		}
+		if !isTransientStoreError(err) {
+			s.logger.Error("save-failed-permanently", err)
+			return err
+		}
+		if attempt >= s.retries || waited >= MaxStoreSaveWait {
+			return err
+		}
+		if backoff > MaxStoreSaveWait-waited {
+			backoff = MaxStoreSaveWait - waited
+		}
+
+		s.logger.Error("save-failed-retrying", err, lager.Data{"attempt": attempt + 1, "retries": s.retries, "backoff": backoff.String()})
+		s.clock.Sleep(backoff)
+		waited += backoff
+		backoff *= 2
+	}
+}
+
+// sqlStateError is implemented by the errors of the PostgreSQL drivers.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// transientSQLStates are the SQLSTATE codes, and the classes of them, worth
+// retrying: serialization failures, deadlocks, connection exceptions, and
+// the server shutting down or running out of connections.
+var transientSQLStates = map[string]bool{
+	"40001": true,
+	"40P01": true,
+	"08":    true,
+	"53300": true,
+	"55P03": true,
+	"57P01": true,
+	"57P02": true,
+	"57P03": true,
+}
+
+// mySQLErrorPattern matches the number in the MySQL driver's errors, e.g.
+// "Error 1213: Deadlock found" or "Error 1213 (40001): Deadlock found".
+var mySQLErrorPattern = regexp.MustCompile(`^Error (\d+)(?: \(\w+\))?: `)
+
+// transientMySQLErrors are lock wait timeouts, deadlocks, too many
+// connections, and connections refused or lost.
+var transientMySQLErrors = map[int]bool{
+	1040: true,
+	1205: true,
+	1213: true,
+	2002: true,
+	2003: true,
+	2006: true,
+	2013: true,
+}
+
+// isTransientStoreError reports whether a failed Save may succeed if tried
+// again. Errors it does not recognise are taken to be permanent.
+func isTransientStoreError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var stateErr sqlStateError
+	if errors.As(err, &stateErr) {
+		state := stateErr.SQLState()
+		return transientSQLStates[state] || (len(state) == 5 && transientSQLStates[state[:2]])
+	}
+
+	if match := mySQLErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+		number, _ := strconv.Atoi(match[1])
+		return transientMySQLErrors[number]
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package csibroker_test
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// sqlStateError stands in for a PostgreSQL driver error.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+var _ = Describe("RetryingStore", func() {
+	var (
+		logger    *lagertest.TestLogger
+		fakeStore *brokerstorefakes.FakeStore
+		fakeClock *fakeclock.FakeClock
+		store     *csibroker.RetryingStore
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-retrying-store")
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeClock = fakeclock.NewFakeClock(time.Unix(1500000000, 0))
+		store = csibroker.NewRetryingStore(logger, fakeStore, fakeClock, 2, time.Second)
+	})
+
+	save := func() chan error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- store.Save(logger)
+		}()
+		return errs
+	}
+
+	It("saves once when the save succeeds", func() {
+		Expect(store.Save(logger)).To(Succeed())
+		Expect(fakeStore.SaveCallCount()).To(Equal(1))
+	})
+
+	Context("when the save fails transiently", func() {
+		BeforeEach(func() {
+			fakeStore.SaveReturns(errors.New("Error 1213 (40001): Deadlock found when trying to get lock; try restarting transaction"))
+		})
+
+		It("retries with doubling backoff until saving succeeds", func() {
+			fakeStore.SaveReturnsOnCall(2, nil)
+			errs := save()
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(time.Second)
+			Eventually(fakeStore.SaveCallCount).Should(Equal(2))
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(time.Second)
+			Consistently(fakeStore.SaveCallCount).Should(Equal(2))
+			fakeClock.Increment(time.Second)
+
+			Eventually(errs).Should(Receive(BeNil()))
+			Expect(fakeStore.SaveCallCount()).To(Equal(3))
+		})
+
+		It("returns the last error once the retries are used up", func() {
+			errs := save()
+			for i := 0; i < 2; i++ {
+				Eventually(fakeClock.WatcherCount).Should(Equal(1))
+				fakeClock.Increment(time.Duration(1<<uint(i)) * time.Second)
+			}
+
+			Eventually(errs).Should(Receive(MatchError(ContainSubstring("Deadlock found"))))
+			Expect(fakeStore.SaveCallCount()).To(Equal(3))
+		})
+	})
+
+	Context("when the retries would wait longer than MaxStoreSaveWait", func() {
+		BeforeEach(func() {
+			store = csibroker.NewRetryingStore(logger, fakeStore, fakeClock, 10, 4*time.Second)
+			fakeStore.SaveReturns(errors.New("Error 1213 (40001): Deadlock found when trying to get lock; try restarting transaction"))
+		})
+
+		It("gives up once the waits add up to the cap", func() {
+			errs := save()
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(4 * time.Second)
+			Eventually(fakeStore.SaveCallCount).Should(Equal(2))
+
+			Eventually(fakeClock.WatcherCount).Should(Equal(1))
+			fakeClock.Increment(csibroker.MaxStoreSaveWait - 4*time.Second)
+
+			Eventually(errs).Should(Receive(MatchError(ContainSubstring("Deadlock found"))))
+			Expect(fakeStore.SaveCallCount()).To(Equal(3))
+		})
+	})
+
+	Context("when the save fails permanently", func() {
+		BeforeEach(func() {
+			fakeStore.SaveReturns(errors.New("Error 1062: Duplicate entry 'some-instance-id' for key 'PRIMARY'"))
+		})
+
+		It("fails at once", func() {
+			Expect(store.Save(logger)).To(MatchError(ContainSubstring("Duplicate entry")))
+			Expect(fakeStore.SaveCallCount()).To(Equal(1))
+		})
+	})
+
+	Describe("classifying save errors", func() {
+		examples := []struct {
+			description string
+			err         error
+			transient   bool
+		}{
+			{"a bad connection", fmt.Errorf("saving: %w", driver.ErrBadConn), true},
+			{"a MySQL lock wait timeout", errors.New("Error 1205: Lock wait timeout exceeded"), true},
+			{"a MySQL lost connection", errors.New("Error 2013: Lost connection to MySQL server during query"), true},
+			{"a PostgreSQL deadlock", sqlStateError("40P01"), true},
+			{"a PostgreSQL connection failure", sqlStateError("08006"), true},
+			{"a PostgreSQL unique violation", sqlStateError("23505"), false},
+			{"a MySQL foreign key violation", errors.New("Error 1452: Cannot add or update a child row"), false},
+			{"an unrecognised error", errors.New("disk full"), false},
+		}
+
+		for _, example := range examples {
+			example := example
+
+			It(fmt.Sprintf("retries %s only if it is transient", example.description), func() {
+				fakeStore.SaveReturnsOnCall(0, example.err)
+				errs := save()
+				if example.transient {
+					Eventually(fakeClock.WatcherCount).Should(Equal(1))
+					fakeClock.Increment(time.Second)
+					Eventually(errs).Should(Receive(BeNil()))
+					Expect(fakeStore.SaveCallCount()).To(Equal(2))
+				} else {
+					Eventually(errs).Should(Receive(Equal(example.err)))
+					Expect(fakeStore.SaveCallCount()).To(Equal(1))
+				}
+			})
+		}
+	})
+})
@@ -0,0 +1,47 @@
+package csibroker
+
+import (
+	"context"
+	"time"
+)
+
+// RPCTimeouts bound the CreateVolume and DeleteVolume calls the broker makes
+// to drivers. CreateVolume and DeleteVolume fall back to Default when zero,
+// and a call whose timeout is zero is bounded only by the request's context.
+// The volume check made on bind is always bounded, by
+// DefaultVolumeCheckTimeout when Default is zero.
+type RPCTimeouts struct {
+	Default      time.Duration
+	CreateVolume time.Duration
+	DeleteVolume time.Duration
+}
+
+func (t RPCTimeouts) createVolume() time.Duration {
+	if t.CreateVolume > 0 {
+		return t.CreateVolume
+	}
+	return t.Default
+}
+
+func (t RPCTimeouts) deleteVolume() time.Duration {
+	if t.DeleteVolume > 0 {
+		return t.DeleteVolume
+	}
+	return t.Default
+}
+
+func (t RPCTimeouts) volumeCheck() time.Duration {
+	if t.Default > 0 {
+		return t.Default
+	}
+	return DefaultVolumeCheckTimeout
+}
+
+// withRPCTimeout derives the context for a single call from ctx. A caller's
+// earlier deadline still applies.
+func withRPCTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
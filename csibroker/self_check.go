@@ -0,0 +1,198 @@
+package csibroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// selfCheckInstancePrefix starts the ID of the record the self-check writes
+// to test the store. Each run writes a record of its own, so that brokers
+// sharing a store never race on one, and retrieveInstances hides the record
+// from every listing should it outlive the run.
+const selfCheckInstancePrefix = "csibroker-self-check-"
+
+type ServiceCheck struct {
+	ServiceID              string   `json:"service_id"`
+	ServiceName            string   `json:"service_name"`
+	DriverName             string   `json:"driver_name"`
+	ControllerReachable    bool     `json:"controller_reachable"`
+	PluginName             string   `json:"plugin_name,omitempty"`
+	PluginVersion          string   `json:"plugin_version,omitempty"`
+	PluginCapabilities     []string `json:"plugin_capabilities,omitempty"`
+	ControllerCapabilities []string `json:"controller_capabilities,omitempty"`
+	Error                  string   `json:"error,omitempty"`
+}
+
+type SelfCheckReport struct {
+	Services      []ServiceCheck `json:"services"`
+	StoreWritable bool           `json:"store_writable"`
+	StoreError    string         `json:"store_error,omitempty"`
+}
+
+func (r SelfCheckReport) Healthy() bool {
+	if !r.StoreWritable {
+		return false
+	}
+
+	for _, service := range r.Services {
+		if !service.ControllerReachable {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SelfCheck reports, for every configured service, whether its CSI plugin
+// is reachable and what it advertises, and whether the store accepts a test
+// write.
+func SelfCheck(ctx context.Context, logger lager.Logger, registry ServicesRegistry, store brokerstore.Store) SelfCheckReport {
+	logger = logger.Session("self-check")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	report := SelfCheckReport{}
+	for _, service := range registry.BrokerServices() {
+		report.Services = append(report.Services, checkService(ctx, registry, service.ID, service.Name))
+	}
+
+	err := checkStore(logger, store)
+	if err != nil {
+		report.StoreError = err.Error()
+	} else {
+		report.StoreWritable = true
+	}
+
+	logger.Info("self-check-report", lager.Data{"report": report, "healthy": report.Healthy()})
+	return report
+}
+
+func checkService(ctx context.Context, registry ServicesRegistry, serviceID, serviceName string) ServiceCheck {
+	check := ServiceCheck{ServiceID: serviceID, ServiceName: serviceName}
+
+	driverName, err := registry.DriverName(serviceID)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.DriverName = driverName
+
+	identityClient, err := registry.IdentityClient(serviceID)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	_, err = identityClient.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.ControllerReachable = true
+
+	pluginInfo, err := identityClient.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.PluginName = pluginInfo.GetName()
+	check.PluginVersion = pluginInfo.GetVendorVersion()
+
+	pluginCapabilities, err := identityClient.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	for _, capability := range pluginCapabilities.GetCapabilities() {
+		check.PluginCapabilities = append(check.PluginCapabilities, capability.GetService().GetType().String())
+	}
+
+	controllerClient, err := registry.ControllerClient(serviceID)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	controllerCapabilities, err := controllerClient.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	for _, capability := range controllerCapabilities.GetCapabilities() {
+		check.ControllerCapabilities = append(check.ControllerCapabilities, capability.GetRpc().GetType().String())
+	}
+
+	return check
+}
+
+func checkStore(logger lager.Logger, store brokerstore.Store) error {
+	instanceID := newSelfCheckInstanceID()
+	sentinel := brokerstore.ServiceInstance{ServiceID: instanceID}
+
+	err := store.CreateInstanceDetails(instanceID, sentinel)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.DeleteInstanceDetails(instanceID); err != nil {
+			logger.Error("self-check-cleanup-failed", err, lager.Data{"instanceID": instanceID})
+			return
+		}
+		if err := store.Save(logger); err != nil {
+			logger.Error("self-check-cleanup-failed", err, lager.Data{"instanceID": instanceID})
+		}
+	}()
+
+	err = store.Save(logger)
+	if err != nil {
+		return err
+	}
+
+	stored, err := store.RetrieveInstanceDetails(instanceID)
+	if err != nil {
+		return err
+	}
+	if stored.ServiceID != sentinel.ServiceID {
+		return errors.New("store returned different details than were written")
+	}
+
+	return nil
+}
+
+func newSelfCheckInstanceID() string {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s%d", selfCheckInstancePrefix, time.Now().UnixNano())
+	}
+	return selfCheckInstancePrefix + hex.EncodeToString(suffix)
+}
+
+func isSelfCheckInstance(instanceID string) bool {
+	return strings.HasPrefix(instanceID, selfCheckInstancePrefix)
+}
+
+// retrieveInstances returns the store's instances less self-check records.
+// Everything that lists, counts or reconciles instances goes through it.
+func retrieveInstances(store brokerstore.Store) (map[string]brokerstore.ServiceInstance, error) {
+	all, err := store.RetrieveAllInstanceDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]brokerstore.ServiceInstance, len(all))
+	for instanceID, instance := range all {
+		if !isSelfCheckInstance(instanceID) {
+			instances[instanceID] = instance
+		}
+	}
+	return instances, nil
+}
@@ -0,0 +1,125 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/csibroker/csibroker_fake"
+	"code.cloudfoundry.org/csishim/csi_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SelfCheck", func() {
+	var (
+		fakeServicesRegistry *csibroker_fake.FakeServicesRegistry
+		fakeIdentityClient   *csi_fake.FakeIdentityClient
+		fakeControllerClient *csi_fake.FakeControllerClient
+		fakeStore            *brokerstorefakes.FakeStore
+		logger               *lagertest.TestLogger
+		report               csibroker.SelfCheckReport
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-self-check")
+		fakeStore = &brokerstorefakes.FakeStore{}
+		fakeIdentityClient = &csi_fake.FakeIdentityClient{}
+		fakeControllerClient = &csi_fake.FakeControllerClient{}
+		fakeServicesRegistry = &csibroker_fake.FakeServicesRegistry{}
+
+		fakeServicesRegistry.BrokerServicesReturns([]brokerapi.Service{{ID: "some-service-id", Name: "some-service"}})
+		fakeServicesRegistry.DriverNameReturns("some-driver-name", nil)
+		fakeServicesRegistry.IdentityClientReturns(fakeIdentityClient, nil)
+		fakeServicesRegistry.ControllerClientReturns(fakeControllerClient, nil)
+
+		fakeIdentityClient.ProbeReturns(&csi.ProbeResponse{}, nil)
+		fakeIdentityClient.GetPluginInfoReturns(&csi.GetPluginInfoResponse{Name: "some-plugin", VendorVersion: "1.2.3"}, nil)
+		fakeIdentityClient.GetPluginCapabilitiesReturns(&csi.GetPluginCapabilitiesResponse{
+			Capabilities: []*csi.PluginCapability{{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			}},
+		}, nil)
+		fakeControllerClient.ControllerGetCapabilitiesReturns(&csi.ControllerGetCapabilitiesResponse{
+			Capabilities: []*csi.ControllerServiceCapability{{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+				},
+			}},
+		}, nil)
+		fakeStore.CreateInstanceDetailsStub = func(instanceID string, instance brokerstore.ServiceInstance) error {
+			fakeStore.RetrieveInstanceDetailsReturns(instance, nil)
+			return nil
+		}
+	})
+
+	JustBeforeEach(func() {
+		report = csibroker.SelfCheck(context.TODO(), logger, fakeServicesRegistry, fakeStore)
+	})
+
+	It("reports each service's plugin info and capabilities", func() {
+		Expect(report.Healthy()).To(BeTrue())
+		Expect(report.Services).To(Equal([]csibroker.ServiceCheck{{
+			ServiceID:              "some-service-id",
+			ServiceName:            "some-service",
+			DriverName:             "some-driver-name",
+			ControllerReachable:    true,
+			PluginName:             "some-plugin",
+			PluginVersion:          "1.2.3",
+			PluginCapabilities:     []string{"CONTROLLER_SERVICE"},
+			ControllerCapabilities: []string{"CREATE_DELETE_VOLUME"},
+		}}))
+	})
+
+	It("writes, reads and removes a sentinel record of its own in the store", func() {
+		Expect(report.StoreWritable).To(BeTrue())
+		Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(1))
+		instanceID, sentinel := fakeStore.CreateInstanceDetailsArgsForCall(0)
+		Expect(instanceID).To(HavePrefix("csibroker-self-check-"))
+		Expect(fakeStore.RetrieveInstanceDetailsCallCount()).To(Equal(1))
+		Expect(fakeStore.RetrieveInstanceDetailsArgsForCall(0)).To(Equal(instanceID))
+		Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+		Expect(fakeStore.DeleteInstanceDetailsArgsForCall(0)).To(Equal(instanceID))
+
+		Expect(sentinel.ServiceID).To(Equal(instanceID))
+	})
+
+	It("uses a different record on each run", func() {
+		csibroker.SelfCheck(context.TODO(), logger, fakeServicesRegistry, fakeStore)
+		first, _ := fakeStore.CreateInstanceDetailsArgsForCall(0)
+		second, _ := fakeStore.CreateInstanceDetailsArgsForCall(1)
+		Expect(second).NotTo(Equal(first))
+	})
+
+	Context("when the controller cannot be probed", func() {
+		BeforeEach(func() {
+			fakeIdentityClient.ProbeReturns(nil, errors.New("probe badness"))
+		})
+
+		It("reports the service as unreachable", func() {
+			Expect(report.Healthy()).To(BeFalse())
+			Expect(report.Services[0].ControllerReachable).To(BeFalse())
+			Expect(report.Services[0].Error).To(Equal("probe badness"))
+		})
+	})
+
+	Context("when the store cannot be written", func() {
+		BeforeEach(func() {
+			fakeStore.CreateInstanceDetailsReturns(errors.New("store badness"))
+		})
+
+		It("reports the store as not writable", func() {
+			Expect(report.Healthy()).To(BeFalse())
+			Expect(report.StoreWritable).To(BeFalse())
+			Expect(report.StoreError).To(Equal("store badness"))
+		})
+	})
+})
@@ -4,13 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
 
+	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/csishim"
 	"code.cloudfoundry.org/goshims/grpcshim"
 	"code.cloudfoundry.org/lager"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pivotal-cf/brokerapi"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 )
 
 type ErrServiceNotFound struct {
@@ -24,17 +27,41 @@ func (e ErrServiceNotFound) Error() string {
 //go:generate counterfeiter -o csibroker_fake/fake_services_registry.go . ServicesRegistry
 type ServicesRegistry interface {
 	IdentityClient(serviceID string) (csi.IdentityClient, error)
+	// NodeIdentityClient returns the identity client of the service's node
+	// plugin, or nil when the service has no node plugin of its own to
+	// probe.
+	NodeIdentityClient(serviceID string) (csi.IdentityClient, error)
 	ControllerClient(serviceID string) (csi.ControllerClient, error)
 	BrokerServices() []brokerapi.Service
 	DriverName(serviceID string) (string, error)
+	Service(serviceID string) (Service, error)
+	// ConnectionGeneration counts the times the service's driver
+	// connections have been re-dialled after breaking.
+	ConnectionGeneration(serviceID string) int
+	Close() error
 }
 
 type servicesRegistry struct {
-	csiShim           csishim.Csi
-	grpcShim          grpcshim.Grpc
-	services          []Service
+	logger       lager.Logger
+	csiShim      csishim.Csi
+	grpcShim     grpcshim.Grpc
+	services     []Service
+	dialOptions  []grpc.DialOption
+	connPoolSize int
+
+	// serviceDialOptions holds the dial options specific to a service, such
+	// as its auth token interceptor, keyed by service ID.
+	serviceDialOptions map[string][]grpc.DialOption
+	// tlsServices holds the IDs of the services dialled over TLS rather than
+	// insecurely.
+	tlsServices map[string]bool
+
+	mutex             sync.Mutex
+	conns             map[string][]*grpc.ClientConn
 	identityClients   map[string]csi.IdentityClient
-	controllerClients map[string]csi.ControllerClient
+	nodeClients       map[string]csi.IdentityClient
+	controllerClients map[string]*controllerClientPool
+	generations       map[string]int
 }
 
 func NewServicesRegistry(
@@ -42,6 +69,8 @@ func NewServicesRegistry(
 	grpcShim grpcshim.Grpc,
 	serviceSpecPath string,
 	logger lager.Logger,
+	connPoolSize int,
+	dialOptions ...grpc.DialOption,
 ) (ServicesRegistry, error) {
 	serviceSpec, err := ioutil.ReadFile(serviceSpecPath)
 
@@ -64,24 +93,234 @@ func NewServicesRegistry(
 		return nil, ErrEmptySpecFile
 	}
 
+	planServices := map[string]string{}
+	serviceDialOptions := map[string][]grpc.DialOption{}
+	tlsServices := map[string]bool{}
 	for i, service := range services {
 		if service.ID == "" || service.Name == "" || service.Description == "" || service.Plans == nil {
 			err = ErrInvalidService{Index: i}
 			logger.Error("invalid-service-spec-file", err, lager.Data{"fileName": serviceSpecPath, "index": i, "service": service})
 			return nil, err
 		}
+
+		for j, plan := range service.Plans {
+			var reason string
+			if plan.ID == "" {
+				reason = fmt.Sprintf("plan at index %d has no id", j)
+			} else if otherService, ok := planServices[plan.ID]; ok {
+				reason = fmt.Sprintf("plan id %q is already used by service %q", plan.ID, otherService)
+			}
+			if reason != "" {
+				err = ErrInvalidService{Index: i, Reason: reason}
+				logger.Error("invalid-plan", err, lager.Data{"fileName": serviceSpecPath, "index": i, "planIndex": j})
+				return nil, err
+			}
+			planServices[plan.ID] = service.ID
+		}
+
+		if len(service.ProvisionDefaults) > 0 {
+			defaults, err := defaultCreateVolumeRequest(service.ProvisionDefaults, "")
+			if err != nil || len(defaults.GetVolumeCapabilities()) == 0 {
+				logger.Error("invalid-provision-defaults", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i}
+			}
+		}
+
+		if len(service.DefaultVolumeCapabilities) > 0 {
+			if err := validateDefaultVolumeCapabilities(service.DefaultVolumeCapabilities); err != nil {
+				logger.Error("invalid-default-volume-capabilities", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		if !validDefaultOwner(service.DefaultUID) || !validDefaultOwner(service.DefaultGID) {
+			logger.Error("invalid-default-owner", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+			return nil, ErrInvalidService{Index: i}
+		}
+
+		if !validAccessTypes(service) {
+			logger.Error("invalid-access-types", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+			return nil, ErrInvalidService{Index: i}
+		}
+
+		if service.DefaultAccessMode != "" && !isKnownAccessMode(service.DefaultAccessMode) {
+			logger.Error("invalid-default-access-mode", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "accessMode": service.DefaultAccessMode})
+			return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("unknown default access mode %q", service.DefaultAccessMode)}
+		}
+
+		if service.DeviceType != "" && !isKnownDeviceType(service.DeviceType) {
+			logger.Error("invalid-device-type", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "deviceType": service.DeviceType})
+			return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("unknown device type %q", service.DeviceType)}
+		}
+
+		if service.WaitForReady < 0 || service.WaitForReadyInterval < 0 {
+			logger.Error("invalid-wait-for-ready", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+			return nil, ErrInvalidService{Index: i, Reason: "wait_for_ready and wait_for_ready_interval must not be negative"}
+		}
+
+		if service.CSIVersion != "" {
+			major, ok := csiMajorVersion(service.CSIVersion)
+			if !ok {
+				logger.Error("invalid-csi-version", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "csiVersion": service.CSIVersion})
+				return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("csi_version %q is not of the form major.minor", service.CSIVersion)}
+			}
+			if major != 1 {
+				logger.Info("csi-version-mismatch", lager.Data{"index": i, "csiVersion": service.CSIVersion, "brokerCSIVersion": CSIVersion})
+			}
+		}
+
+		if service.MaxBindings < 0 {
+			logger.Error("invalid-max-bindings", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+			return nil, ErrInvalidService{Index: i, Reason: "max_bindings must not be negative"}
+		}
+
+		if service.ProbeRetryOnFirstFailure < 0 {
+			logger.Error("invalid-probe-retry-on-first-failure", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+			return nil, ErrInvalidService{Index: i}
+		}
+
+		if service.AuthToken != nil {
+			if err := service.AuthToken.validate(); err != nil {
+				logger.Error("invalid-auth-token", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+			serviceDialOptions[service.ID] = []grpc.DialOption{
+				grpc.WithChainUnaryInterceptor(AuthTokenUnaryClientInterceptor(clock.NewClock(), *service.AuthToken)),
+			}
+		}
+
+		if service.GRPC != nil {
+			err := service.GRPC.validate()
+			var grpcOptions []grpc.DialOption
+			if err == nil {
+				grpcOptions, err = service.GRPC.dialOptions()
+			}
+			if err != nil {
+				logger.Error("invalid-grpc-config", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+			serviceDialOptions[service.ID] = append(serviceDialOptions[service.ID], grpcOptions...)
+			tlsServices[service.ID] = service.GRPC.TLS != nil
+		}
+
+		if service.DashboardURLTemplate != "" {
+			if err := validateDashboardURLTemplate(service.DashboardURLTemplate); err != nil {
+				logger.Error("invalid-dashboard-url-template", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		if service.VolumeName != nil {
+			if err := service.VolumeName.validate(); err != nil {
+				logger.Error("invalid-volume-name-rules", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		if service.OrgQuota != nil {
+			if err := service.OrgQuota.validate(); err != nil {
+				logger.Error("invalid-org-quota", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		for operation := range service.SupportedOperations {
+			if !isKnownOperation(operation) {
+				logger.Error("invalid-supported-operations", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "operation": operation})
+				return nil, ErrInvalidService{Index: i}
+			}
+		}
+
+		if service.DefaultPlanID != "" && !hasPlan(service, service.DefaultPlanID) {
+			logger.Error("invalid-default-plan-id", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "planID": service.DefaultPlanID})
+			return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("default_plan_id %q is not one of its plans", service.DefaultPlanID)}
+		}
+
+		for _, key := range service.RequiredParameters {
+			if key == "" {
+				logger.Error("invalid-required-parameters", nil, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: "required_parameters must not contain an empty name"}
+			}
+		}
+
+		for planID, capacity := range service.PlanCapacities {
+			if !hasPlan(service, planID) {
+				logger.Error("invalid-plan-capacities", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "planID": planID})
+				return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("plan_capacities names %q, which is not one of its plans", planID)}
+			}
+			if err := capacity.validate(); err != nil {
+				logger.Error("invalid-plan-capacities", err, lager.Data{"fileName": serviceSpecPath, "index": i, "planID": planID})
+				return nil, ErrInvalidService{Index: i, Reason: fmt.Sprintf("plan_capacities for %q: %s", planID, err)}
+			}
+		}
+
+		if len(service.PlanToStorageClass) > 0 {
+			if err := validatePlanStorageClasses(service); err != nil {
+				logger.Error("invalid-plan-to-storage-class", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		if len(service.ParameterTemplates) > 0 {
+			if err := validateParameterTemplates(service.ParameterTemplates); err != nil {
+				logger.Error("invalid-parameter-templates", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		if service.EnforceBindSchema {
+			if err := validateBindSchemas(service); err != nil {
+				logger.Error("invalid-bind-schema", err, lager.Data{"fileName": serviceSpecPath, "index": i})
+				return nil, ErrInvalidService{Index: i, Reason: err.Error()}
+			}
+		}
+
+		for planID, maintenanceInfo := range service.MaintenanceInfo {
+			if maintenanceInfo.Version == "" || !hasPlan(service, planID) {
+				logger.Error("invalid-maintenance-info", nil, lager.Data{"fileName": serviceSpecPath, "index": i, "planID": planID})
+				return nil, ErrInvalidService{Index: i}
+			}
+		}
+	}
+
+	err = advertiseCapacities(serviceSpec, services)
+	if err != nil {
+		logger.Error("invalid-advertised-capacity", err, lager.Data{"fileName": serviceSpecPath})
+		return nil, err
+	}
+
+	err = orderCatalog(serviceSpec, services)
+	if err != nil {
+		logger.Error("failed-to-order-catalog", err, lager.Data{"fileName": serviceSpecPath})
+		return nil, ErrInvalidSpecFile{err}
+	}
+
+	if connPoolSize < 1 {
+		connPoolSize = 1
 	}
 
 	return &servicesRegistry{
-		csiShim:           csiShim,
-		grpcShim:          grpcShim,
-		services:          services,
-		identityClients:   map[string]csi.IdentityClient{},
-		controllerClients: map[string]csi.ControllerClient{},
+		logger:             logger.Session("services-registry"),
+		csiShim:            csiShim,
+		grpcShim:           grpcShim,
+		services:           services,
+		dialOptions:        dialOptions,
+		connPoolSize:       connPoolSize,
+		serviceDialOptions: serviceDialOptions,
+		tlsServices:        tlsServices,
+		conns:              map[string][]*grpc.ClientConn{},
+		identityClients:    map[string]csi.IdentityClient{},
+		nodeClients:        map[string]csi.IdentityClient{},
+		controllerClients:  map[string]*controllerClientPool{},
+		generations:        map[string]int{},
 	}, nil
 }
 
 func (r *servicesRegistry) IdentityClient(serviceID string) (csi.IdentityClient, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.redialIfBroken(serviceID)
 	if identityClient, ok := r.identityClients[serviceID]; ok {
 		return identityClient, nil
 	}
@@ -95,7 +334,7 @@ func (r *servicesRegistry) IdentityClient(serviceID string) (csi.IdentityClient,
 		return new(NoopIdentityClient), nil
 	}
 
-	conn, err := r.grpcShim.Dial(service.ConnAddr, grpc.WithInsecure())
+	conn, err := r.dial(service, service.ConnAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -106,9 +345,44 @@ func (r *servicesRegistry) IdentityClient(serviceID string) (csi.IdentityClient,
 	return identityClient, nil
 }
 
+func (r *servicesRegistry) NodeIdentityClient(serviceID string) (csi.IdentityClient, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.redialIfBroken(serviceID)
+	if nodeClient, ok := r.nodeClients[serviceID]; ok {
+		return nodeClient, nil
+	}
+
+	service, found := r.findServiceByID(serviceID)
+	if !found {
+		return nil, ErrServiceNotFound{ID: serviceID}
+	}
+
+	if service.NodeConnAddr == "" || service.NodeConnAddr == service.ConnAddr {
+		return nil, nil
+	}
+
+	conn, err := r.dial(service, service.NodeConnAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeClient := r.csiShim.NewIdentityClient(conn)
+	r.nodeClients[serviceID] = nodeClient
+
+	return nodeClient, nil
+}
+
+// ControllerClient round-robins over a pool of connections to the service's
+// driver, dialling the pool on first use.
 func (r *servicesRegistry) ControllerClient(serviceID string) (csi.ControllerClient, error) {
-	if controllerClient, ok := r.controllerClients[serviceID]; ok {
-		return controllerClient, nil
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.redialIfBroken(serviceID)
+	if pool, ok := r.controllerClients[serviceID]; ok {
+		return pool.nextClient(), nil
 	}
 
 	service, found := r.findServiceByID(serviceID)
@@ -120,14 +394,107 @@ func (r *servicesRegistry) ControllerClient(serviceID string) (csi.ControllerCli
 		return new(NoopControllerClient), nil
 	}
 
-	conn, err := r.grpcShim.Dial(service.ConnAddr, grpc.WithInsecure())
+	pool := &controllerClientPool{}
+	for i := 0; i < r.connPoolSize; i++ {
+		conn, err := r.dial(service, service.ConnAddr)
+		if err != nil {
+			return nil, err
+		}
+		pool.clients = append(pool.clients, r.csiShim.NewControllerClient(conn))
+	}
+	r.controllerClients[serviceID] = pool
+
+	return pool.nextClient(), nil
+}
+
+// Close closes every driver connection the registry has dialled.
+func (r *servicesRegistry) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var firstErr error
+	for serviceID := range r.conns {
+		if err := r.closeConns(serviceID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	r.identityClients = map[string]csi.IdentityClient{}
+	r.nodeClients = map[string]csi.IdentityClient{}
+	r.controllerClients = map[string]*controllerClientPool{}
+	return firstErr
+}
+
+func (r *servicesRegistry) ConnectionGeneration(serviceID string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.generations[serviceID]
+}
+
+// redialIfBroken drops a service's clients when any of its connections is
+// in TRANSIENT_FAILURE, as after a driver restart, so that they are dialled
+// again instead of waiting out gRPC's reconnect backoff.
+func (r *servicesRegistry) redialIfBroken(serviceID string) {
+	broken := false
+	for _, conn := range r.conns[serviceID] {
+		if conn != nil && conn.GetState() == connectivity.TransientFailure {
+			broken = true
+			break
+		}
+	}
+	if !broken {
+		return
+	}
+
+	r.logger.Info("redialling-driver", lager.Data{"serviceID": serviceID})
+	if err := r.closeConns(serviceID); err != nil {
+		r.logger.Error("close-broken-connection-failed", err, lager.Data{"serviceID": serviceID})
+	}
+	delete(r.identityClients, serviceID)
+	delete(r.nodeClients, serviceID)
+	delete(r.controllerClients, serviceID)
+	r.generations[serviceID]++
+}
+
+func (r *servicesRegistry) closeConns(serviceID string) error {
+	var firstErr error
+	for _, conn := range r.conns[serviceID] {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	delete(r.conns, serviceID)
+	return firstErr
+}
+
+func (r *servicesRegistry) dial(service Service, addr string) (*grpc.ClientConn, error) {
+	// options specific to the service come last so that they win
+	var dialOptions []grpc.DialOption
+	if !r.tlsServices[service.ID] {
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	}
+	dialOptions = append(append(dialOptions, r.dialOptions...), r.serviceDialOptions[service.ID]...)
+	conn, err := r.grpcShim.Dial(addr, dialOptions...)
 	if err != nil {
 		return nil, err
 	}
-	controllerClient := r.csiShim.NewControllerClient(conn)
-	r.controllerClients[serviceID] = controllerClient
+	r.conns[service.ID] = append(r.conns[service.ID], conn)
+	return conn, nil
+}
+
+type controllerClientPool struct {
+	clients []csi.ControllerClient
+	next    int
+}
 
-	return controllerClient, nil
+func (p *controllerClientPool) nextClient() csi.ControllerClient {
+	client := p.clients[p.next]
+	p.next = (p.next + 1) % len(p.clients)
+	return client
 }
 
 func (r *servicesRegistry) BrokerServices() []brokerapi.Service {
@@ -148,6 +515,15 @@ func (r *servicesRegistry) DriverName(serviceID string) (string, error) {
 	return service.DriverName, nil
 }
 
+func (r *servicesRegistry) Service(serviceID string) (Service, error) {
+	service, found := r.findServiceByID(serviceID)
+	if !found {
+		return Service{}, ErrServiceNotFound{ID: serviceID}
+	}
+
+	return service, nil
+}
+
 func (r *servicesRegistry) findServiceByID(serviceID string) (Service, bool) {
 	for _, service := range r.services {
 		if service.ID == serviceID {
@@ -157,3 +533,37 @@ func (r *servicesRegistry) findServiceByID(serviceID string) (Service, bool) {
 
 	return Service{}, false
 }
+
+func hasPlan(service Service, planID string) bool {
+	for _, plan := range service.Plans {
+		if plan.ID == planID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validAccessTypes(service Service) bool {
+	for _, accessType := range service.SupportedAccessTypes {
+		if !isKnownAccessType(accessType) {
+			return false
+		}
+	}
+
+	if service.DefaultAccessType == "" {
+		return true
+	}
+	if !isKnownAccessType(service.DefaultAccessType) {
+		return false
+	}
+	return len(service.SupportedAccessTypes) == 0 || containsString(service.SupportedAccessTypes, service.DefaultAccessType)
+}
+
+func validDefaultOwner(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	_, err := formatOwnerID(value)
+	return err == nil
+}
@@ -1,14 +1,22 @@
 package csibroker_test
 
 import (
+	"errors"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"code.cloudfoundry.org/csibroker/csibroker"
 	"code.cloudfoundry.org/csishim/csi_fake"
 	"code.cloudfoundry.org/goshims/grpcshim/grpc_fake"
 	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -23,6 +31,8 @@ var _ = Describe("ServicesRegistry", func() {
 		pwd          string
 		initErr      error
 		logger       *lagertest.TestLogger
+		dialOptions  []grpc.DialOption
+		connPoolSize int
 	)
 
 	BeforeEach(func() {
@@ -38,6 +48,8 @@ var _ = Describe("ServicesRegistry", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		specFilepath = filepath.Join(pwd, "..", "fixtures", "service_spec.json")
+		dialOptions = nil
+		connPoolSize = 1
 	})
 
 	JustBeforeEach(func() {
@@ -46,6 +58,8 @@ var _ = Describe("ServicesRegistry", func() {
 			fakeGrpc,
 			specFilepath,
 			logger,
+			connPoolSize,
+			dialOptions...,
 		)
 	})
 
@@ -83,6 +97,41 @@ var _ = Describe("ServicesRegistry", func() {
 			})
 		})
 
+		Context("when services and plans give an order", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "ordered_catalog_spec.json")
+			})
+
+			It("lists them by order, then the rest in specfile order", func() {
+				Expect(initErr).ToNot(HaveOccurred())
+
+				services := registry.BrokerServices()
+				Expect(services).To(HaveLen(3))
+				Expect(services[0].ID).To(Equal("First.ID"))
+				Expect(services[1].ID).To(Equal("Second.ID"))
+				Expect(services[2].ID).To(Equal("Unordered.ID"))
+
+				Expect(services[2].Plans).To(HaveLen(2))
+				Expect(services[2].Plans[0].ID).To(Equal("Unordered.Plans.Featured.ID"))
+				Expect(services[2].Plans[1].ID).To(Equal("Unordered.Plans.Default.ID"))
+			})
+		})
+
+		Context("when plans advertise a capacity", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "advertised_capacity_spec.json")
+			})
+
+			It("shows it among their bullets", func() {
+				Expect(initErr).ToNot(HaveOccurred())
+
+				plans := registry.BrokerServices()[0].Plans
+				Expect(plans[0].Metadata.Bullets).To(Equal([]string{"Capacity: up to 10Gi"}))
+				Expect(plans[1].Metadata.Bullets).To(Equal([]string{"SSD backed", "Capacity: up to 100Gi"}))
+				Expect(plans[2].Metadata).To(BeNil())
+			})
+		})
+
 		Context("when the specfile is invalid", func() {
 			BeforeEach(func() {
 				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_spec.json")
@@ -103,6 +152,220 @@ var _ = Describe("ServicesRegistry", func() {
 			})
 		})
 
+		Context("when a service has provision defaults without volume capabilities", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_provision_defaults_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0}))
+			})
+		})
+
+		Context("when a service declares maintenance info for an unknown plan", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_maintenance_info_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0}))
+			})
+		})
+
+		Context("when a service defaults to an access type it does not support", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_access_type_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0}))
+			})
+		})
+
+		Context("when a service names an unknown device type", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_device_type_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `unknown device type "exclusive"`}))
+			})
+		})
+
+		Context("when a service's default volume capabilities name no access mode", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_default_volume_capabilities_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: "default_volume_capabilities[0] names no usable access mode"}))
+			})
+		})
+
+		Context("when a service requires a parameter with an empty name", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_required_parameters_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: "required_parameters must not contain an empty name"}))
+			})
+		})
+
+		Context("when a plan's minimum capacity is above its maximum", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_plan_capacities_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `plan_capacities for "Service.Plans.ID": min_capacity 10Gi is more than max_capacity 1Gi`}))
+			})
+		})
+
+		Context("when a service's grpc tls config has a key but no certificate", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_grpc_config_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: "grpc tls cert_file and key_file must be given together"}))
+			})
+		})
+
+		Context("when a service's dashboard url template names an unknown field", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_dashboard_url_template_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(BeAssignableToTypeOf(csibroker.ErrInvalidService{}))
+				Expect(initErr.Error()).To(ContainSubstring("can't evaluate field VolumeId"))
+			})
+		})
+
+		Context("when a service's parameter template names an unknown field", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_parameter_templates_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(BeAssignableToTypeOf(csibroker.ErrInvalidService{}))
+				Expect(initErr.Error()).To(ContainSubstring(`invalid parameter_templates entry "subdir"`))
+				Expect(initErr.Error()).To(ContainSubstring("can't evaluate field OrganizationGUID"))
+			})
+		})
+
+		Context("when a service leaves a plan without a storage class", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_plan_to_storage_class_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `plan_to_storage_class has no storage class for plan "Service.Plans.ID"`}))
+			})
+		})
+
+		Context("when a service enforces an invalid binding schema", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_bind_schema_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `binding schema of plan "Service.Plans.ID": parameter readonly: unsupported type flag`}))
+			})
+		})
+
+		Context("when a plan advertises a malformed capacity", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_advertised_capacity_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `advertised_capacity of plan "Service.Plans.Large": invalid capacity "lots": expected a number optionally followed by a unit such as GB or GiB`}))
+			})
+		})
+
+		Context("when a service has an invalid org quota", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_org_quota_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `org_quota capacity: invalid capacity "lots": expected a number optionally followed by a unit such as GB or GiB`}))
+			})
+		})
+
+		Context("when a service defaults to an unknown access mode", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_access_mode_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `unknown default access mode "UNKNOWN"`}))
+			})
+		})
+
+		Context("when a service sets both an auth token file and endpoint", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_auth_token_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `auth_token requires exactly one of "file" and "endpoint"`}))
+			})
+		})
+
+		Context("when a service has an invalid volume name pattern", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_volume_name_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(BeAssignableToTypeOf(csibroker.ErrInvalidService{}))
+				Expect(initErr.Error()).To(ContainSubstring("volume_name pattern"))
+			})
+		})
+
+		Context("when a service gives a malformed CSI version", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_csi_version_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `csi_version "latest" is not of the form major.minor`}))
+			})
+		})
+
+		Context("when a service defaults to a plan it does not have", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_default_plan_spec.json")
+			})
+
+			It("returns an error", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: `default_plan_id "Other.Plans.ID" is not one of its plans`}))
+			})
+		})
+
+		Context("when a plan has no id", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "empty_plan_id_spec.json")
+			})
+
+			It("returns an error naming the plan", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 0, Reason: "plan at index 0 has no id"}))
+			})
+		})
+
+		Context("when two plans share an id", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "duplicate_plan_id_spec.json")
+			})
+
+			It("returns an error naming the plan and the service already using it", func() {
+				Expect(initErr).To(Equal(csibroker.ErrInvalidService{Index: 1, Reason: `plan id "Shared.Plans.ID" is already used by service "ServiceOne.ID"`}))
+			})
+		})
+
 		Context("when the specfile has invalid service", func() {
 			BeforeEach(func() {
 				specFilepath = filepath.Join(pwd, "..", "fixtures", "invalid_service_spec.json")
@@ -114,6 +377,23 @@ var _ = Describe("ServicesRegistry", func() {
 		})
 	})
 
+	Describe("Service", func() {
+		It("returns the configured service", func() {
+			service, err := registry.Service("ServiceOne.ID")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(service.DriverName).To(Equal("some-driver-one"))
+			Expect(service.ConnAddr).To(Equal("0.0.0.0:1000"))
+			Expect(service.PollInterval).To(Equal(csibroker.Duration(10 * time.Second)))
+		})
+
+		Context("when service does not exist", func() {
+			It("returns an error", func() {
+				_, err := registry.Service("non-existent-service-id")
+				Expect(err).To(Equal(csibroker.ErrServiceNotFound{ID: "non-existent-service-id"}))
+			})
+		})
+	})
+
 	Describe("IdentityClient", func() {
 		Context("when service exists", func() {
 			Context("when service has connection address", func() {
@@ -126,6 +406,27 @@ var _ = Describe("ServicesRegistry", func() {
 					Expect(fakeCsi.NewIdentityClientCallCount()).To(Equal(1))
 				})
 
+				Context("when keepalive dial options are given", func() {
+					BeforeEach(func() {
+						dialOptions = []grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{
+							Time:    time.Minute,
+							Timeout: 10 * time.Second,
+						})}
+					})
+
+					It("passes them through to the grpc shim", func() {
+						_, err := registry.IdentityClient("ServiceOne.ID")
+						Expect(err).NotTo(HaveOccurred())
+						_, opts := fakeGrpc.DialArgsForCall(0)
+						Expect(opts).To(HaveLen(2))
+
+						_, err = registry.ControllerClient("ServiceOne.ID")
+						Expect(err).NotTo(HaveOccurred())
+						_, opts = fakeGrpc.DialArgsForCall(1)
+						Expect(opts).To(HaveLen(2))
+					})
+				})
+
 				Context("when called second time", func() {
 					It("returns the same identity client", func() {
 						client1, err := registry.IdentityClient("ServiceOne.ID")
@@ -143,6 +444,73 @@ var _ = Describe("ServicesRegistry", func() {
 				})
 			})
 
+			Context("when the driver restarts", func() {
+				var (
+					address string
+					server  *grpc.Server
+					mutex   sync.Mutex
+					conns   []*grpc.ClientConn
+				)
+
+				lastConn := func() *grpc.ClientConn {
+					mutex.Lock()
+					defer mutex.Unlock()
+					return conns[len(conns)-1]
+				}
+
+				BeforeEach(func() {
+					listener, err := net.Listen("tcp", "127.0.0.1:0")
+					Expect(err).NotTo(HaveOccurred())
+					address = listener.Addr().String()
+					Expect(listener.Close()).To(Succeed())
+
+					conns = nil
+					fakeGrpc.DialStub = func(_ string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+						conn, err := grpc.Dial(address, opts...)
+						mutex.Lock()
+						conns = append(conns, conn)
+						mutex.Unlock()
+						return conn, err
+					}
+				})
+
+				AfterEach(func() {
+					registry.Close()
+					if server != nil {
+						server.Stop()
+					}
+				})
+
+				It("re-dials a failed connection and keeps it once the driver is back", func() {
+					_, err := registry.IdentityClient("ServiceOne.ID")
+					Expect(err).NotTo(HaveOccurred())
+
+					Eventually(func() int {
+						registry.IdentityClient("ServiceOne.ID")
+						return registry.ConnectionGeneration("ServiceOne.ID")
+					}, 5*time.Second).Should(BeNumerically(">", 0))
+					Expect(fakeGrpc.DialCallCount()).To(BeNumerically(">", 1))
+					Expect(fakeCsi.NewIdentityClientCallCount()).To(Equal(fakeGrpc.DialCallCount()))
+
+					listener, err := net.Listen("tcp", address)
+					Expect(err).NotTo(HaveOccurred())
+					server = grpc.NewServer()
+					go server.Serve(listener)
+
+					Eventually(func() connectivity.State {
+						registry.IdentityClient("ServiceOne.ID")
+						return lastConn().GetState()
+					}, 5*time.Second).Should(Equal(connectivity.Ready))
+
+					generation := registry.ConnectionGeneration("ServiceOne.ID")
+					dials := fakeGrpc.DialCallCount()
+					_, err = registry.IdentityClient("ServiceOne.ID")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(registry.ConnectionGeneration("ServiceOne.ID")).To(Equal(generation))
+					Expect(fakeGrpc.DialCallCount()).To(Equal(dials))
+				})
+			})
+
 			Context("when service does not have connection address", func() {
 				It("returns noop identity client", func() {
 					client, err := registry.IdentityClient("ServiceTwo.ID")
@@ -163,6 +531,42 @@ var _ = Describe("ServicesRegistry", func() {
 		})
 	})
 
+	Describe("NodeIdentityClient", func() {
+		Context("when the service has no node connection address", func() {
+			It("returns no client", func() {
+				client, err := registry.NodeIdentityClient("ServiceOne.ID")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(client).To(BeNil())
+				Expect(fakeGrpc.DialCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the service has a node connection address", func() {
+			BeforeEach(func() {
+				specFilepath = filepath.Join(pwd, "..", "fixtures", "node_plugin_spec.json")
+			})
+
+			It("dials the node plugin once", func() {
+				client, err := registry.NodeIdentityClient("Service.ID")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(client).NotTo(BeNil())
+
+				_, err = registry.NodeIdentityClient("Service.ID")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeGrpc.DialCallCount()).To(Equal(1))
+				addr, _ := fakeGrpc.DialArgsForCall(0)
+				Expect(addr).To(Equal("0.0.0.0:1001"))
+			})
+		})
+
+		Context("when service does not exist", func() {
+			It("returns an error", func() {
+				_, err := registry.NodeIdentityClient("non-existent-service-id")
+				Expect(err).To(Equal(csibroker.ErrServiceNotFound{ID: "non-existent-service-id"}))
+			})
+		})
+	})
+
 	Describe("ControllerClient", func() {
 		Context("when service exists", func() {
 			Context("when service has connection address", func() {
@@ -190,6 +594,72 @@ var _ = Describe("ServicesRegistry", func() {
 						Expect(client2).To(Equal(client1))
 					})
 				})
+
+				Context("when the connection pool holds several connections", func() {
+					var clients []*csi_fake.FakeControllerClient
+
+					BeforeEach(func() {
+						connPoolSize = 3
+						clients = []*csi_fake.FakeControllerClient{{}, {}, {}}
+						for i, client := range clients {
+							fakeCsi.NewControllerClientReturnsOnCall(i, client)
+						}
+					})
+
+					It("dials the whole pool once and round-robins over it", func() {
+						var returned []csi.ControllerClient
+						for i := 0; i < 4; i++ {
+							client, err := registry.ControllerClient("ServiceOne.ID")
+							Expect(err).NotTo(HaveOccurred())
+							returned = append(returned, client)
+						}
+
+						Expect(fakeGrpc.DialCallCount()).To(Equal(3))
+						Expect(fakeCsi.NewControllerClientCallCount()).To(Equal(3))
+						Expect(returned[0]).To(BeIdenticalTo(clients[0]))
+						Expect(returned[1]).To(BeIdenticalTo(clients[1]))
+						Expect(returned[2]).To(BeIdenticalTo(clients[2]))
+						Expect(returned[3]).To(BeIdenticalTo(clients[0]))
+					})
+				})
+
+				Context("when the service requires an auth token", func() {
+					BeforeEach(func() {
+						specFilepath = filepath.Join(pwd, "..", "fixtures", "auth_token_spec.json")
+					})
+
+					It("dials with an interceptor on top of the shared options", func() {
+						_, err := registry.ControllerClient("Service.ID")
+						Expect(err).NotTo(HaveOccurred())
+						_, opts := fakeGrpc.DialArgsForCall(0)
+						Expect(opts).To(HaveLen(2))
+					})
+				})
+
+				Context("when the service has its own grpc config", func() {
+					BeforeEach(func() {
+						specFilepath = filepath.Join(pwd, "..", "fixtures", "grpc_config_spec.json")
+						dialOptions = []grpc.DialOption{grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: time.Minute})}
+					})
+
+					It("dials with its options after the shared ones", func() {
+						_, err := registry.ControllerClient("Service.ID")
+						Expect(err).NotTo(HaveOccurred())
+						_, opts := fakeGrpc.DialArgsForCall(0)
+						Expect(opts).To(HaveLen(5))
+					})
+				})
+
+				Context("when dialling fails", func() {
+					BeforeEach(func() {
+						fakeGrpc.DialReturns(nil, errors.New("dial badness"))
+					})
+
+					It("returns the error", func() {
+						_, err := registry.ControllerClient("ServiceOne.ID")
+						Expect(err).To(MatchError("dial badness"))
+					})
+				})
 			})
 
 			Context("when service does not have connection address", func() {
@@ -211,4 +681,18 @@ var _ = Describe("ServicesRegistry", func() {
 			})
 		})
 	})
+
+	Describe("Close", func() {
+		It("forgets the dialled clients so the next call dials again", func() {
+			_, err := registry.ControllerClient("ServiceOne.ID")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeGrpc.DialCallCount()).To(Equal(1))
+
+			Expect(registry.Close()).To(Succeed())
+
+			_, err = registry.ControllerClient("ServiceOne.ID")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeGrpc.DialCallCount()).To(Equal(2))
+		})
+	})
 })
@@ -0,0 +1,45 @@
+package csibroker
+
+import (
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const DefaultStorageClassParameter = "storageClass"
+
+// validatePlanStorageClasses checks that plan_to_storage_class maps every
+// plan of the service, and nothing else, to a storage class.
+func validatePlanStorageClasses(service Service) error {
+	for planID := range service.PlanToStorageClass {
+		if !hasPlan(service, planID) {
+			return fmt.Errorf("plan_to_storage_class names %q, which is not one of its plans", planID)
+		}
+	}
+	for _, plan := range service.Plans {
+		if service.PlanToStorageClass[plan.ID] == "" {
+			return fmt.Errorf("plan_to_storage_class has no storage class for plan %q", plan.ID)
+		}
+	}
+	return nil
+}
+
+// applyStorageClass sets the storage class of the plan as a parameter of
+// every request, replacing any value given by the caller.
+func applyStorageClass(service Service, planID string, requests []*csi.CreateVolumeRequest) {
+	storageClass, ok := service.PlanToStorageClass[planID]
+	if !ok {
+		return
+	}
+
+	key := service.StorageClassParameter
+	if key == "" {
+		key = DefaultStorageClassParameter
+	}
+	for _, request := range requests {
+		if request.Parameters == nil {
+			request.Parameters = map[string]string{}
+		}
+		request.Parameters[key] = storageClass
+	}
+}
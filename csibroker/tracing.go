@@ -0,0 +1,53 @@
+package csibroker
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "code.cloudfoundry.org/csibroker"
+
+// startSpan starts a span for a broker operation. Until main installs a
+// tracer provider the global one is a no-op, so spans cost next to nothing.
+func startSpan(ctx context.Context, operation Operation, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "csibroker."+string(operation), trace.WithAttributes(attributes...))
+}
+
+// endSpan records the outcome of an operation, including the gRPC status of
+// a failed driver call, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			span.SetAttributes(attribute.String("rpc.grpc.status_code", s.Code().String()))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracingUnaryClientInterceptor traces every unary CSI call in a client span
+// carrying the method and its gRPC status.
+func TracingUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := otel.Tracer(tracerName).Start(ctx, method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", method)),
+		)
+		defer span.End()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
@@ -0,0 +1,49 @@
+package csibroker_test
+
+import (
+	"context"
+	"errors"
+
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TracingUnaryClientInterceptor", func() {
+	var (
+		invokedMethod string
+		invokeErr     error
+		err           error
+	)
+
+	BeforeEach(func() {
+		invokedMethod = ""
+		invokeErr = nil
+	})
+
+	JustBeforeEach(func() {
+		interceptor := csibroker.TracingUnaryClientInterceptor()
+		err = interceptor(context.TODO(), "/csi.v1.Controller/CreateVolume", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				invokedMethod = method
+				return invokeErr
+			})
+	})
+
+	It("invokes the call", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(invokedMethod).To(Equal("/csi.v1.Controller/CreateVolume"))
+	})
+
+	Context("when the call fails", func() {
+		BeforeEach(func() {
+			invokeErr = errors.New("badness")
+		})
+
+		It("returns the error unchanged", func() {
+			Expect(err).To(Equal(invokeErr))
+		})
+	})
+})
@@ -0,0 +1,87 @@
+package csibroker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrVolumeNameConflict reports a CreateVolume the driver refused with
+// AlreadyExists: a volume of that name exists but was created with
+// parameters or capabilities incompatible with the request.
+type ErrVolumeNameConflict struct {
+	Name string
+}
+
+func (e ErrVolumeNameConflict) Error() string {
+	return fmt.Sprintf("a volume named %q already exists with incompatible parameters; choose another name or match its parameters", e.Name)
+}
+
+// createVolume sends request to the driver. A refusal with AlreadyExists is
+// reported as ErrVolumeNameConflict, unless the broker adopts existing
+// volumes and the driver names the volume in the error's details. adopted
+// is true for such a volume, which the provision did not create.
+func (b *Broker) createVolume(ctx context.Context, logger lager.Logger, controllerClient csi.ControllerClient, request *csi.CreateVolumeRequest) (_ *csi.Volume, adopted bool, _ error) {
+	callCtx, cancel := withRPCTimeout(ctx, b.rpcTimeouts.createVolume())
+	response, err := controllerClient.CreateVolume(callCtx, request)
+	cancel()
+	if err == nil {
+		return response.GetVolume(), false, nil
+	}
+
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.AlreadyExists {
+		return nil, false, err
+	}
+
+	if b.adoptExistingVolumes {
+		if volume := existingVolume(s); volume != nil {
+			logger.Info("adopted-existing-volume", lager.Data{"name": request.GetName(), "volumeID": volume.GetVolumeId()})
+			return volume, true, nil
+		}
+	}
+
+	conflict := ErrVolumeNameConflict{Name: request.GetName()}
+	logger.Error("volume-name-conflict", err, lager.Data{"name": request.GetName()})
+	return nil, false, brokerapi.NewFailureResponse(conflict, http.StatusConflict, "volume-name-conflict")
+}
+
+// existingVolume returns the volume a driver attached to an AlreadyExists
+// status, as a Volume or a CreateVolumeResponse. ListVolumes cannot stand in
+// for it since the volumes it lists carry no names.
+func existingVolume(s *status.Status) *csi.Volume {
+	for _, detail := range s.Details() {
+		switch typed := detail.(type) {
+		case *csi.Volume:
+			if typed.GetVolumeId() != "" {
+				return typed
+			}
+		case *csi.CreateVolumeResponse:
+			if typed.GetVolume().GetVolumeId() != "" {
+				return typed.GetVolume()
+			}
+		}
+	}
+	return nil
+}
+
+// withoutVolumes returns volumes less those whose IDs are in excluded, so
+// that rolling back a provision leaves adopted volumes alone.
+func withoutVolumes(volumes []*csi.Volume, excluded map[string]bool) []*csi.Volume {
+	if len(excluded) == 0 {
+		return volumes
+	}
+	var kept []*csi.Volume
+	for _, volume := range volumes {
+		if !excluded[volume.GetVolumeId()] {
+			kept = append(kept, volume)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,98 @@
+package csibroker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pivotal-cf/brokerapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultVolumeCheckTimeout bounds each driver call of the volume check made
+// on bind when no default RPC timeout is configured.
+const DefaultVolumeCheckTimeout = 10 * time.Second
+
+// ErrVolumeGone reports a bind to an instance whose volume the driver no
+// longer has, typically because it was deleted on the backend.
+type ErrVolumeGone struct {
+	InstanceID string
+	VolumeID   string
+}
+
+func (e ErrVolumeGone) Error() string {
+	return fmt.Sprintf("the underlying volume %s of instance %s no longer exists", e.VolumeID, e.InstanceID)
+}
+
+// checkVolumesOnBind runs the volume check for a bind to a service that asks
+// for one. It is called with the instance lock held but not the store lock,
+// so that a slow driver holds up only operations on this instance.
+func (b *Broker) checkVolumesOnBind(ctx context.Context, logger lager.Logger, instanceID string, serviceID string) error {
+	service, err := b.servicesRegistry.Service(serviceID)
+	if err != nil || !service.CheckVolumeOnBind {
+		return err
+	}
+
+	b.mutex.Lock()
+	instanceDetails, err := b.store.RetrieveInstanceDetails(instanceID)
+	b.mutex.Unlock()
+	if err != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	fingerprint, err := getFingerprint(instanceDetails.ServiceFingerPrint)
+	if err != nil {
+		return err
+	}
+
+	controllerClient, err := b.servicesRegistry.ControllerClient(serviceID)
+	if err != nil {
+		return err
+	}
+	return b.checkVolumesExist(ctx, logger, controllerClient, instanceID, fingerprint)
+}
+
+// checkVolumesExist asks the driver whether each of an instance's volumes
+// still exists. ValidateVolumeCapabilities serves as the lookup because every
+// controller must implement it and answer NotFound for unknown volumes. Any
+// other failure is only logged: the check exists to catch missing volumes,
+// not to make binds depend on the driver's view of capabilities.
+func (b *Broker) checkVolumesExist(ctx context.Context, logger lager.Logger, controllerClient csi.ControllerClient, instanceID string, fingerprint *ServiceFingerPrint) error {
+	volumes := append([]*csi.Volume{fingerprint.Volume}, fingerprint.AdditionalVolumes...)
+	for _, volume := range volumes {
+		callCtx, cancel := withRPCTimeout(ctx, b.rpcTimeouts.volumeCheck())
+		_, err := controllerClient.ValidateVolumeCapabilities(callCtx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           volume.GetVolumeId(),
+			VolumeContext:      volume.GetVolumeContext(),
+			VolumeCapabilities: []*csi.VolumeCapability{existenceCheckCapability(fingerprint.AccessModes[volume.GetVolumeId()])},
+		})
+		cancel()
+
+		switch {
+		case err == nil:
+		case isNotFound(err):
+			gone := ErrVolumeGone{InstanceID: instanceID, VolumeID: volume.GetVolumeId()}
+			logger.Error("volume-gone", gone)
+			return brokerapi.NewFailureResponse(gone, http.StatusGone, "volume-gone")
+		case status.Code(err) == codes.Unimplemented:
+			logger.Info("volume-existence-unchecked", lager.Data{"volumeID": volume.GetVolumeId()})
+		default:
+			logger.Error("volume-existence-check-failed", err, lager.Data{"volumeID": volume.GetVolumeId()})
+		}
+	}
+	return nil
+}
+
+// existenceCheckCapability is a mount capability with the access mode the
+// volume was provisioned with, where that was recorded.
+func existenceCheckCapability(accessMode string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[accessMode]),
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package csibroker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// VolumeNameRules constrains the names of the volumes a service creates.
+type VolumeNameRules struct {
+	// MaxLength is the longest name accepted. Zero means no limit.
+	MaxLength int `json:"max_length,omitempty"`
+	// Pattern is a regular expression a name must match in full.
+	Pattern string `json:"pattern,omitempty"`
+	// Sanitize rewrites names as DNS labels, i.e. lower case letters, digits
+	// and inner dashes, truncated to MaxLength, before checking them.
+	Sanitize bool `json:"sanitize,omitempty"`
+}
+
+type ErrInvalidVolumeName struct {
+	Name   string
+	Reason string
+}
+
+func (e ErrInvalidVolumeName) Error() string {
+	return fmt.Sprintf("volume name %q is invalid: %s", e.Name, e.Reason)
+}
+
+var nonDNSLabelCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
+
+func (r VolumeNameRules) validate() error {
+	if r.MaxLength < 0 {
+		return errors.New("volume_name max_length must not be negative")
+	}
+	if _, err := r.pattern(); err != nil {
+		return fmt.Errorf("volume_name pattern: %s", err)
+	}
+	return nil
+}
+
+func (r VolumeNameRules) pattern() (*regexp.Regexp, error) {
+	if r.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + r.Pattern + ")$")
+}
+
+// apply returns the name, sanitized if the rules ask for it, or an
+// ErrInvalidVolumeName if it breaks them.
+func (r VolumeNameRules) apply(name string) (string, error) {
+	valid := name
+	if r.Sanitize {
+		valid = sanitizeVolumeName(name, r.MaxLength)
+		if valid == "" {
+			return "", ErrInvalidVolumeName{Name: name, Reason: "nothing is left after sanitizing it"}
+		}
+	}
+
+	if r.MaxLength > 0 && len(valid) > r.MaxLength {
+		return "", ErrInvalidVolumeName{Name: name, Reason: fmt.Sprintf("longer than %d characters", r.MaxLength)}
+	}
+
+	pattern, err := r.pattern()
+	if err != nil {
+		return "", err
+	}
+	if pattern != nil && !pattern.MatchString(valid) {
+		return "", ErrInvalidVolumeName{Name: name, Reason: fmt.Sprintf("does not match %q", r.Pattern)}
+	}
+
+	return valid, nil
+}
+
+func sanitizeVolumeName(name string, maxLength int) string {
+	sanitized := nonDNSLabelCharacters.ReplaceAllString(strings.ToLower(name), "-")
+	sanitized = strings.Trim(sanitized, "-")
+	if maxLength > 0 && len(sanitized) > maxLength {
+		sanitized = strings.TrimRight(sanitized[:maxLength], "-")
+	}
+	return sanitized
+}
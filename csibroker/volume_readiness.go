@@ -0,0 +1,68 @@
+package csibroker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const DefaultWaitForReadyInterval = time.Second
+
+type ErrVolumeNotReady struct {
+	VolumeID string
+	Timeout  time.Duration
+}
+
+func (e ErrVolumeNotReady) Error() string {
+	return fmt.Sprintf("volume not ready: %s was not confirmed by the driver within %s", e.VolumeID, e.Timeout)
+}
+
+// waitForVolumeReady polls ValidateVolumeCapabilities until the driver
+// confirms the capabilities the volume was created with, taking that as the
+// sign that it can be bound. Drivers that do not implement the call are
+// trusted to have returned a usable volume.
+func (b *Broker) waitForVolumeReady(ctx context.Context, logger lager.Logger, controllerClient csi.ControllerClient, service Service, request *csi.CreateVolumeRequest, volume *csi.Volume) error {
+	timeout := time.Duration(service.WaitForReady)
+	interval := time.Duration(service.WaitForReadyInterval)
+	if interval == 0 {
+		interval = DefaultWaitForReadyInterval
+	}
+	deadline := b.clock.Now().Add(timeout)
+
+	for {
+		response, err := controllerClient.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           volume.GetVolumeId(),
+			VolumeContext:      volume.GetVolumeContext(),
+			VolumeCapabilities: request.GetVolumeCapabilities(),
+			Parameters:         request.GetParameters(),
+		})
+		if status.Code(err) == codes.Unimplemented {
+			logger.Info("volume-readiness-unknown", lager.Data{"volumeID": volume.GetVolumeId()})
+			return nil
+		}
+		if err == nil && response.GetConfirmed() != nil {
+			logger.Info("volume-ready", lager.Data{"volumeID": volume.GetVolumeId()})
+			return nil
+		}
+
+		data := lager.Data{"volumeID": volume.GetVolumeId(), "message": response.GetMessage()}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		logger.Info("volume-not-ready", data)
+
+		if !b.clock.Now().Before(deadline) {
+			return ErrVolumeNotReady{VolumeID: volume.GetVolumeId(), Timeout: timeout}
+		}
+		select {
+		case <-b.clock.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
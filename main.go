@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/csibroker/csibroker"
 	"code.cloudfoundry.org/csibroker/utils"
+	"code.cloudfoundry.org/csibroker/version"
 	"code.cloudfoundry.org/csishim"
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/goshims/grpcshim"
@@ -19,9 +29,21 @@ import (
 	"code.cloudfoundry.org/lager/lagerflags"
 	"code.cloudfoundry.org/service-broker-store/brokerstore"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
-	"github.com/tedsuo/ifrit/http_server"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	selfCheckTimeout = 30 * time.Second
+	reconcileTimeout = 5 * time.Minute
 )
 
 var dataDir = flag.String(
@@ -30,12 +52,42 @@ var dataDir = flag.String(
 	"[REQUIRED] - Broker's state will be stored here to persist across reboots",
 )
 
+var stateFileName = flag.String(
+	"stateFileName",
+	"csi-general-services.json",
+	"(optional) name of the state file within dataDir; give each broker sharing a dataDir its own",
+)
+
+var stateEncryptionKeyFile = flag.String(
+	"stateEncryptionKeyFile",
+	"",
+	"(optional) file holding a base64 encoded 32 byte AES key used to encrypt instance fingerprints in the state store; may also be given in CSIBROKER_STATE_ENCRYPTION_KEY. Changing the key makes previously stored instances unreadable",
+)
+
 var atAddress = flag.String(
 	"listenAddr",
 	"0.0.0.0:8999",
 	"host:port to serve service broker API",
 )
 
+var httpReadTimeout = flag.Duration(
+	"httpReadTimeout",
+	30*time.Second,
+	"(optional) how long the broker API waits to read a whole request; 0 waits forever",
+)
+
+var httpWriteTimeout = flag.Duration(
+	"httpWriteTimeout",
+	5*time.Minute,
+	"(optional) how long the broker API may take to write a response, counted from the end of reading the request; must exceed the slowest synchronous driver call; 0 waits forever",
+)
+
+var httpIdleTimeout = flag.Duration(
+	"httpIdleTimeout",
+	2*time.Minute,
+	"(optional) how long the broker API keeps an idle keep-alive connection open; 0 uses httpReadTimeout",
+)
+
 var username = flag.String(
 	"username",
 	"admin",
@@ -89,9 +141,329 @@ var cfServiceName = flag.String(
 	"(optional) For CF pushed apps, the service name in VCAP_SERVICES where we should find database credentials.  dbDriver must be defined if this option is set, but all other db parameters will be extracted from the service binding.",
 )
 
+var cfServiceInstanceName = flag.String(
+	"cfServiceInstanceName",
+	"",
+	"(optional) For CF pushed apps, the name of the service instance to take database credentials from when cfServiceName has more than one binding in VCAP_SERVICES.",
+)
+
+var parameterSetsFile = flag.String(
+	"parameterSetsFile",
+	"",
+	"(optional) file path of a JSON file of named CSI parameter sets that provision requests can reference with \"parameter_set\". Reloaded on SIGHUP",
+)
+
+var paramFormat = flag.String(
+	"paramFormat",
+	csibroker.ParameterFormatJSON,
+	"(optional) \"json\" reads the CreateVolumeRequest in provision parameters as JSON; \"prototext\" reads it as protobuf text from the \"create_volume_request\" parameter",
+)
+
+var parameterDeprecationsFile = flag.String(
+	"parameterDeprecationsFile",
+	"",
+	"(optional) JSON file of deprecated provision and bind parameters, e.g. {\"bind\": {\"readonly\": {\"replacement\": \"access_mode\"}}}; requests using them are warned about, or rejected once marked \"removed\"",
+)
+
+var selfCheckReport = flag.String(
+	"selfCheckReport",
+	"",
+	"(optional) file path where the startup self-check report is written as JSON",
+)
+
+var selfCheckFatal = flag.Bool(
+	"selfCheckFatal",
+	false,
+	"(optional) exit if the startup self-check finds an unreachable driver or an unwritable store",
+)
+
+var probeBreakerThreshold = flag.Int(
+	"probeBreakerThreshold",
+	0,
+	"(optional) after this many consecutive failed probes of a CSI plugin within probeBreakerWindow, fail its operations at once for probeBreakerCooldown; 0 disables",
+)
+
+var probeBreakerWindow = flag.Duration(
+	"probeBreakerWindow",
+	csibroker.DefaultProbeBreakerWindow,
+	"(optional) window in which probeBreakerThreshold probe failures open the breaker",
+)
+
+var probeBreakerCooldown = flag.Duration(
+	"probeBreakerCooldown",
+	csibroker.DefaultProbeBreakerCooldown,
+	"(optional) how long an open probe breaker fails operations before probing the plugin again",
+)
+
+var validateConnectivity = flag.String(
+	"validateConnectivity",
+	"",
+	"(optional) probe every service's CSI plugin at startup, within probeTimeout, and \"warn\" about or \"fail\" on any that are unreachable",
+)
+
+var grpcKeepaliveTime = flag.Duration(
+	"grpcKeepaliveTime",
+	0,
+	"(optional) ping CSI drivers after this much connection inactivity; 0 disables keepalive",
+)
+
+var grpcKeepaliveTimeout = flag.Duration(
+	"grpcKeepaliveTimeout",
+	csibroker.DefaultGRPCKeepaliveTimeout,
+	"(optional) how long to wait for a keepalive ping acknowledgement before closing the CSI driver connection",
+)
+
+var grpcConnPoolSize = flag.Int(
+	"grpcConnPoolSize",
+	1,
+	"(optional) number of connections to keep open to each CSI driver; controller calls are spread across them",
+)
+
+var probeTimeout = flag.Duration(
+	"probeTimeout",
+	csibroker.DefaultProbeTimeout,
+	"(optional) how long to wait for a CSI driver to answer the probe sent before its first operation",
+)
+
+var csiRequestTimeout = flag.Duration(
+	"csiRequestTimeout",
+	0,
+	"(optional) how long a CreateVolume or DeleteVolume call to a CSI driver may take, unless createVolumeTimeout or deleteVolumeTimeout says otherwise; 0 leaves calls unbounded",
+)
+
+var createVolumeTimeout = flag.Duration(
+	"createVolumeTimeout",
+	0,
+	"(optional) how long a CreateVolume call to a CSI driver may take; 0 uses csiRequestTimeout",
+)
+
+var deleteVolumeTimeout = flag.Duration(
+	"deleteVolumeTimeout",
+	0,
+	"(optional) how long a DeleteVolume call to a CSI driver, including one rolling back a failed provision, may take; 0 uses csiRequestTimeout",
+)
+
+var bindInstanceWait = flag.Duration(
+	"bindInstanceWait",
+	0,
+	"(optional) how long a bind waits for its instance to be stored before failing as not found",
+)
+
+var syncBudget = flag.Duration(
+	"syncBudget",
+	0,
+	"(optional) refuse, as requiring async, provisions and deprovisions the platform wants answered synchronously on services whose expected_operation_duration exceeds this; 0 disables",
+)
+
+var redactKeys = flag.String(
+	"redactKeys",
+	"",
+	"(optional) comma separated provision and bind parameter keys whose values are redacted where the parameters are logged",
+)
+
+var allowedMountPaths = flag.String(
+	"allowedMountPaths",
+	"",
+	"(optional) comma separated absolute paths below which apps may mount volumes with the \"mount\" bind parameter; any absolute path is allowed when unset",
+)
+
+var storeSaveMode = flag.String(
+	"storeSaveMode",
+	"sync",
+	"(optional) \"sync\" writes broker state after every operation; \"batched\" writes it at most once per storeSaveWindow and on shutdown, so a crash can lose the most recent operations",
+)
+
+var storeSaveWindow = flag.Duration(
+	"storeSaveWindow",
+	time.Second,
+	"(optional) how often batched store saves are flushed",
+)
+
+var storeProbeInterval = flag.Duration(
+	"storeProbeInterval",
+	csibroker.DefaultStoreProbeInterval,
+	"(optional) how long GET /health reuses its last read of the store backend before reading it again",
+)
+
+var logFormat = flag.String(
+	"logFormat",
+	csibroker.LogFormatLager,
+	"(optional) \"lager\" writes logs in lager's format; \"json\" writes each as a flat JSON object with an RFC 3339 timestamp, the level by name and the data fields at the top level",
+)
+
+var provisionWebhook = flag.String(
+	"provisionWebhook",
+	"",
+	"(optional) URL POSTed the metadata of every provisioned instance once its volumes are created; a \"volume_context\" in the response is added to the instance's first volume",
+)
+
+var provisionWebhookFailure = flag.String(
+	"provisionWebhookFailure",
+	"fail",
+	"(optional) \"fail\" fails the provision and deletes its volumes when the provisionWebhook call fails; \"continue\" only logs the failure",
+)
+
+var preProvisionWebhook = flag.String(
+	"preProvisionWebhook",
+	"",
+	"(optional) URL POSTed every provision's volume requests before they are sent to the driver; a response other than 2xx rejects the provision with the response's message",
+)
+
+var preProvisionWebhookFailure = flag.String(
+	"preProvisionWebhookFailure",
+	"fail",
+	"(optional) \"fail\" fails the provision when the preProvisionWebhook cannot be reached; \"continue\" only logs the failure and provisions",
+)
+
+var deprovisionWebhook = flag.String(
+	"deprovisionWebhook",
+	"",
+	"(optional) URL POSTed the metadata of every deprovisioned instance once its volumes are deleted and it is removed from the store",
+)
+
+var deprovisionWebhookFailure = flag.String(
+	"deprovisionWebhookFailure",
+	"continue",
+	"(optional) \"continue\" only logs a failed deprovisionWebhook call; \"fail\" also fails the deprovision, though the instance is already deleted",
+)
+
+var cloudEventsSink = flag.String(
+	"cloudEventsSink",
+	"",
+	"(optional) URL to which a CloudEvent is POSTed, best-effort, for every provision, deprovision, bind and unbind",
+)
+
+var orgQuota = flag.Int(
+	"orgQuota",
+	0,
+	"(optional) the most service instances a single org may have across all services; 0 means no limit",
+)
+
+var storeRestoreRetries = flag.Int(
+	"storeRestoreRetries",
+	0,
+	"(optional) how many times to retry restoring broker state at startup before giving up",
+)
+
+var storeRestoreBackoff = flag.Duration(
+	"storeRestoreBackoff",
+	time.Second,
+	"(optional) how long to wait before the first restore retry; the wait doubles after each retry",
+)
+
+var storeSaveRetries = flag.Int(
+	"storeSaveRetries",
+	0,
+	fmt.Sprintf("(optional) how many times to retry saving broker state after a transient database error, such as a deadlock or dropped connection; other errors are not retried. Saves hold the store lock, so all broker requests wait while a save retries, for at most %s of backoff", csibroker.MaxStoreSaveWait),
+)
+
+var storeSaveBackoff = flag.Duration(
+	"storeSaveBackoff",
+	csibroker.DefaultStoreSaveBackoff,
+	"(optional) how long to wait before the first save retry; the wait doubles after each retry",
+)
+
+var ignoreRestoreErrors = flag.Bool(
+	"ignoreRestoreErrors",
+	false,
+	"(optional) start with empty broker state when restoring it fails after all retries, instead of exiting; provisions, binds and their removals are refused with 503 until a later restore succeeds, so that the empty state never overwrites the store",
+)
+
+var strictCatalog = flag.Bool(
+	"strictCatalog",
+	false,
+	"(optional) exit at startup if stored instances belong to services missing from the serviceSpec",
+)
+
+var allowIncompatibleSpecChange = flag.Bool(
+	"allowIncompatibleSpecChange",
+	false,
+	"(optional) start even though the serviceSpec changed the driver_name or connection_address of a service with stored instances",
+)
+
+var allowDeprovisionEmptyVolume = flag.Bool(
+	"allowDeprovisionEmptyVolume",
+	false,
+	"(optional) let deprovisions of instances whose stored volume ID is empty just remove the instance from the store, since there is no volume to delete",
+)
+
+var adoptExistingVolumes = flag.Bool(
+	"adoptExistingVolumes",
+	false,
+	"(optional) when a CSI driver refuses a CreateVolume with AlreadyExists but returns the existing volume in the error details, provision the instance on that volume instead of failing",
+)
+
+var reconcileOnStartup = flag.Bool(
+	"reconcileOnStartup",
+	false,
+	"(optional) compare stored instances with the volumes each driver lists at startup and log the differences",
+)
+
+var reconcileSummaryFile = flag.String(
+	"reconcileSummaryFile",
+	"",
+	"(optional) file the summary of the last reconcile, served at GET /admin/reconcile/last, is written to so that it survives restarts; kept in memory only when unset",
+)
+
+var listVolumesPageSize = flag.Int(
+	"listVolumesPageSize",
+	0,
+	"(optional) max_entries requested per ListVolumes page while reconciling; 0 lets the driver decide",
+)
+
+var addCfMetadataLabels = flag.Bool(
+	"addCfMetadataLabels",
+	false,
+	"(optional) add the instance ID, org GUID, space GUID and plan ID of a provision to the CSI parameters of the volumes it creates",
+)
+
+var cfMetadataLabelPrefix = flag.String(
+	"cfMetadataLabelPrefix",
+	csibroker.DefaultCFMetadataLabelPrefix,
+	"(optional) prefix of the parameter keys added by addCfMetadataLabels",
+)
+
+var cfMetadataLabelCollision = flag.String(
+	"cfMetadataLabelCollision",
+	"user-wins",
+	"(optional) what to do when a provision sets a parameter added by addCfMetadataLabels: \"user-wins\" keeps the caller's value, \"error\" rejects the provision",
+)
+
+var logGrpcPayloads = flag.Bool(
+	"logGrpcPayloads",
+	false,
+	"(optional) log every CSI request and response at debug level, with secrets redacted",
+)
+
+var otlpEndpoint = flag.String(
+	"otlpEndpoint",
+	"",
+	"(optional) host:port of an OTLP gRPC collector (plaintext) to export traces of broker operations and CSI calls to; tracing is off when unset",
+)
+
+var enableBatchAdmin = flag.Bool(
+	"enableBatchAdmin",
+	false,
+	"(optional) serve POST /admin/batch-provision, which provisions an array of instances outside the OSB API",
+)
+
+var batchProvisionConcurrency = flag.Int(
+	"batchProvisionConcurrency",
+	csibroker.DefaultBatchProvisionConcurrency,
+	"(optional) how many provisions of one POST /admin/batch-provision run at once",
+)
+
+var enableFaultInjection = flag.Bool(
+	"enableFaultInjection",
+	false,
+	"(optional) TESTING ONLY: fail or delay broker operations as configured by CSIBROKER_FAULTS or PUT /admin/faults",
+)
+
 var (
-	dbUsername string
-	dbPassword string
+	dbUsername         string
+	dbPassword         string
+	faultsJSON         string
+	stateEncryptionKey string
 )
 
 func main() {
@@ -101,16 +473,20 @@ func main() {
 	checkParams()
 
 	logger, logSink := newLogger()
-	logger.Info("starting")
+	logger.Info("starting", lager.Data{"version": version.Get(csibroker.CSIVersion)})
 	defer logger.Info("ends")
 
-	server := createServer(logger)
+	members := createServer(logger)
 
 	if dbgAddr := debugserver.DebugAddress(flag.CommandLine); dbgAddr != "" {
-		server = utils.ProcessRunnerFor(grouper.Members{
+		members = append(grouper.Members{
 			{Name: "debug-server", Runner: debugserver.Runner(dbgAddr, logSink)},
-			{Name: "broker-api", Runner: server},
-		})
+		}, members...)
+	}
+
+	server := members[0].Runner
+	if len(members) > 1 {
+		server = utils.ProcessRunnerFor(members)
 	}
 
 	process := ifrit.Invoke(server)
@@ -136,9 +512,137 @@ func checkParams() {
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	if *stateFileName == "" || filepath.Base(*stateFileName) != *stateFileName {
+		fmt.Fprint(os.Stderr, "\nERROR: stateFileName must be a plain file name.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *grpcConnPoolSize < 1 {
+		fmt.Fprint(os.Stderr, "\nERROR: grpcConnPoolSize must be at least 1.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *storeSaveMode != "sync" && *storeSaveMode != "batched" {
+		fmt.Fprint(os.Stderr, "\nERROR: storeSaveMode must be \"sync\" or \"batched\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *httpReadTimeout < 0 || *httpWriteTimeout < 0 || *httpIdleTimeout < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: httpReadTimeout, httpWriteTimeout and httpIdleTimeout must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *probeTimeout < 0 || *csiRequestTimeout < 0 || *createVolumeTimeout < 0 || *deleteVolumeTimeout < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: probeTimeout, csiRequestTimeout, createVolumeTimeout and deleteVolumeTimeout must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *paramFormat != csibroker.ParameterFormatJSON && *paramFormat != csibroker.ParameterFormatProtoText {
+		fmt.Fprint(os.Stderr, "\nERROR: paramFormat must be \"json\" or \"prototext\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *logFormat != csibroker.LogFormatLager && *logFormat != csibroker.LogFormatJSON {
+		fmt.Fprint(os.Stderr, "\nERROR: logFormat must be \"lager\" or \"json\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *provisionWebhookFailure != "fail" && *provisionWebhookFailure != "continue" {
+		fmt.Fprint(os.Stderr, "\nERROR: provisionWebhookFailure must be \"fail\" or \"continue\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *probeBreakerThreshold < 0 || *probeBreakerWindow <= 0 || *probeBreakerCooldown <= 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: probeBreakerThreshold must not be negative, and probeBreakerWindow and probeBreakerCooldown must be positive.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *validateConnectivity != "" && *validateConnectivity != "warn" && *validateConnectivity != "fail" {
+		fmt.Fprint(os.Stderr, "\nERROR: validateConnectivity must be \"warn\" or \"fail\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *preProvisionWebhookFailure != "fail" && *preProvisionWebhookFailure != "continue" {
+		fmt.Fprint(os.Stderr, "\nERROR: preProvisionWebhookFailure must be \"fail\" or \"continue\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *deprovisionWebhookFailure != "fail" && *deprovisionWebhookFailure != "continue" {
+		fmt.Fprint(os.Stderr, "\nERROR: deprovisionWebhookFailure must be \"fail\" or \"continue\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *orgQuota < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: orgQuota must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *batchProvisionConcurrency <= 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: batchProvisionConcurrency must be positive.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *bindInstanceWait < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: bindInstanceWait must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *syncBudget < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: syncBudget must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *storeProbeInterval < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: storeProbeInterval must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *storeSaveRetries < 0 || *storeSaveBackoff < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: storeSaveRetries and storeSaveBackoff must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *storeRestoreRetries < 0 || *storeRestoreBackoff < 0 {
+		fmt.Fprint(os.Stderr, "\nERROR: storeRestoreRetries and storeRestoreBackoff must not be negative.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *cfMetadataLabelCollision != "user-wins" && *cfMetadataLabelCollision != "error" {
+		fmt.Fprint(os.Stderr, "\nERROR: cfMetadataLabelCollision must be \"user-wins\" or \"error\".\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
 }
 
 func newLogger() (lager.Logger, *lager.ReconfigurableSink) {
+	if *logFormat == csibroker.LogFormatJSON {
+		sink, err := lager.NewRedactingSink(csibroker.NewJSONLogSink(os.Stdout, lager.DEBUG), nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		return lagerflags.NewFromSink("csibroker", sink)
+	}
+
 	lagerConfig := lagerflags.ConfigFromFlags()
 	lagerConfig.RedactSecrets = true
 
@@ -167,7 +671,10 @@ func parseVcapServices(logger lager.Logger, os osshim.Os) {
 		logger.Fatal("missing-service-binding", errors.New("VCAP_SERVICES missing specified db service"), lager.Data{"stuff": stuff})
 	}
 
-	stuff3 := stuff2[0].(map[string]interface{})
+	stuff3, err := selectVcapBinding(stuff2, *cfServiceName, *cfServiceInstanceName)
+	if err != nil {
+		logger.Fatal("ambiguous-service-binding", err)
+	}
 
 	credentials := stuff3["credentials"].(map[string]interface{})
 	logger.Debug("credentials-parsed", lager.Data{"credentials": credentials})
@@ -181,30 +688,323 @@ func parseVcapServices(logger lager.Logger, os osshim.Os) {
 	*dbName = credentials["name"].(string)
 }
 
+// selectVcapBinding picks the binding named instanceName or, without one,
+// the only binding of the service. Taking the first of several would
+// silently connect to whichever database CF happened to list first.
+func selectVcapBinding(bindings []interface{}, serviceName, instanceName string) (map[string]interface{}, error) {
+	var (
+		names   []string
+		matched []map[string]interface{}
+	)
+	for _, entry := range bindings {
+		binding, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := binding["name"].(string)
+		names = append(names, strconv.Quote(name))
+		if instanceName == "" || name == instanceName {
+			matched = append(matched, binding)
+		}
+	}
+
+	switch {
+	case len(matched) == 1:
+		return matched[0], nil
+	case len(names) == 0:
+		return nil, fmt.Errorf("VCAP_SERVICES has no bindings of service %q", serviceName)
+	case len(matched) == 0:
+		return nil, fmt.Errorf("no binding of service %q is named %q; found %s", serviceName, instanceName, strings.Join(names, ", "))
+	default:
+		return nil, fmt.Errorf("service %q has %d bindings named %s; set cfServiceInstanceName to choose one", serviceName, len(matched), strings.Join(names, ", "))
+	}
+}
+
 func parseEnvironment() {
 	dbUsername, _ = os.LookupEnv("DB_USERNAME")
 	dbPassword, _ = os.LookupEnv("DB_PASSWORD")
+	faultsJSON, _ = os.LookupEnv("CSIBROKER_FAULTS")
+	stateEncryptionKey, _ = os.LookupEnv("CSIBROKER_STATE_ENCRYPTION_KEY")
+}
+
+func newEncryptedStore(logger lager.Logger, store brokerstore.Store) brokerstore.Store {
+	encodedKey := stateEncryptionKey
+	if *stateEncryptionKeyFile != "" {
+		contents, err := ioutil.ReadFile(*stateEncryptionKeyFile)
+		if err != nil {
+			logger.Error("failed-to-read-state-encryption-key", err, lager.Data{"fileName": *stateEncryptionKeyFile})
+			os.Exit(1)
+		}
+		encodedKey = string(contents)
+	}
+
+	key, err := csibroker.ParseStateEncryptionKey(encodedKey)
+	if err != nil {
+		logger.Error("invalid-state-encryption-key", err)
+		os.Exit(1)
+	}
+
+	encryptedStore, err := csibroker.NewEncryptedStore(store, key)
+	if err != nil {
+		logger.Error("encrypted-store-initialize-error", err)
+		os.Exit(1)
+	}
+	return encryptedStore
+}
+
+func reloadOnHangup(logger lager.Logger, parameterSets *csibroker.ParameterSets) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			if err := parameterSets.Reload(logger); err != nil {
+				logger.Error("parameter-sets-reload-error", err)
+			}
+		}
+	}()
+}
+
+func runSelfCheck(logger lager.Logger, servicesRegistry csibroker.ServicesRegistry, store brokerstore.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+
+	report := csibroker.SelfCheck(ctx, logger, servicesRegistry, store)
+
+	if *selfCheckReport != "" {
+		contents, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*selfCheckReport, contents, 0644)
+		}
+		if err != nil {
+			logger.Error("self-check-report-write-error", err, lager.Data{"fileName": *selfCheckReport})
+		}
+	}
+
+	if *selfCheckFatal && !report.Healthy() {
+		logger.Error("self-check-failed", errors.New("startup self-check failed"), lager.Data{"report": report})
+		os.Exit(1)
+	}
+}
+
+func checkSpecChanges(logger lager.Logger, servicesRegistry csibroker.ServicesRegistry, store brokerstore.Store) {
+	changes, err := csibroker.IncompatibleSpecChanges(store, servicesRegistry)
+	if err != nil {
+		logger.Error("spec-change-check-failed", err)
+		return
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, change := range changes {
+		logger.Error("incompatible-spec-change",
+			errors.New("the serviceSpec points stored instances at a different driver than provisioned them"),
+			lager.Data{"serviceID": change.ServiceID, "field": change.Field, "previous": change.Previous, "current": change.Current, "instanceIDs": change.InstanceIDs})
+	}
+	if !*allowIncompatibleSpecChange {
+		logger.Error("refusing-to-start", errors.New("pass -allowIncompatibleSpecChange to start anyway"))
+		os.Exit(1)
+	}
+}
+
+func runConnectivityValidation(logger lager.Logger, servicesRegistry csibroker.ServicesRegistry) {
+	report := csibroker.ValidateConnectivity(context.Background(), logger, servicesRegistry, *probeTimeout)
+	if report.AllReachable() {
+		return
+	}
+
+	if *validateConnectivity == "fail" {
+		logger.Error("connectivity-validation-failed", errors.New("some CSI plugins are unreachable"), lager.Data{"unreachable": report.Unreachable})
+		os.Exit(1)
+	}
+	logger.Info("unreachable-services", lager.Data{"unreachable": report.Unreachable})
+}
+
+func checkCatalog(logger lager.Logger, servicesRegistry csibroker.ServicesRegistry, store brokerstore.Store) {
+	stranded, err := csibroker.StrandedInstances(store, servicesRegistry)
+	if err != nil {
+		logger.Error("catalog-check-failed", err)
+		return
+	}
+	if len(stranded) == 0 {
+		return
+	}
+
+	logger.Error("stored-instances-reference-unknown-services",
+		errors.New("the serviceSpec no longer defines services that stored instances belong to; these instances cannot be bound, unbound or deprovisioned"),
+		lager.Data{"instancesByServiceID": stranded})
+	if *strictCatalog {
+		os.Exit(1)
+	}
+}
+
+func reconcile(logger lager.Logger, serviceBroker *csibroker.Broker) {
+	ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+	defer cancel()
+
+	report, err := serviceBroker.Reconcile(ctx)
+	if err != nil {
+		logger.Error("reconcile-failed", err)
+		return
+	}
+	logger.Info("reconciled", lager.Data{"report": report})
 }
 
-func createServer(logger lager.Logger) ifrit.Runner {
-	fileName := filepath.Join(*dataDir, "csi-general-services.json")
+func createServer(logger lager.Logger) grouper.Members {
+	fileName := filepath.Join(*dataDir, *stateFileName)
 
 	// if we are CF pushed
 	if *cfServiceName != "" {
 		parseVcapServices(logger, &osshim.OsShim{})
 	}
 
+	var members grouper.Members
+
 	store := brokerstore.NewStore(logger, *dbDriver, dbUsername, dbPassword, *dbHostname, *dbPort, *dbName, *dbCACert, "", "", "", "", "", fileName, "")
+	if stateEncryptionKey != "" || *stateEncryptionKeyFile != "" {
+		store = newEncryptedStore(logger, store)
+	}
+	if *storeSaveRetries > 0 {
+		store = csibroker.NewRetryingStore(logger, store, clock.NewClock(), *storeSaveRetries, *storeSaveBackoff)
+	}
+	if *storeSaveMode == "batched" {
+		batchedStore := csibroker.NewBatchedStore(logger, store, clock.NewClock(), *storeSaveWindow)
+		members = append(members, grouper.Member{Name: "store-flusher", Runner: batchedStore})
+		store = batchedStore
+	}
+
+	var dialOptions []grpc.DialOption
+	if *grpcKeepaliveTime > 0 {
+		dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                *grpcKeepaliveTime,
+			Timeout:             *grpcKeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	if *otlpEndpoint != "" {
+		tracerProvider := newTracerProvider(logger)
+		members = append(members, grouper.Member{Name: "tracer-provider", Runner: onShutdown(logger, "shutdown-tracer-provider", func() error {
+			return tracerProvider.Shutdown(context.Background())
+		})})
+		dialOptions = append(dialOptions, grpc.WithChainUnaryInterceptor(csibroker.TracingUnaryClientInterceptor()))
+	}
+	if *logGrpcPayloads {
+		dialOptions = append(dialOptions, grpc.WithChainUnaryInterceptor(csibroker.PayloadLoggingUnaryClientInterceptor(logger)))
+	}
+
 	servicesRegistry, err := csibroker.NewServicesRegistry(
 		&csishim.CsiShim{},
 		&grpcshim.GrpcShim{},
 		*serviceSpec,
 		logger,
+		*grpcConnPoolSize,
+		dialOptions...,
 	)
 	if err != nil {
 		logger.Error("services-registry-initialize-error", err)
 		os.Exit(1)
 	}
+	members = append(members, grouper.Member{Name: "driver-connections", Runner: onShutdown(logger, "close-driver-connections", servicesRegistry.Close)})
+
+	if *validateConnectivity != "" {
+		runConnectivityValidation(logger, servicesRegistry)
+	}
+
+	var brokerOptions []csibroker.Option
+	brokerOptions = append(brokerOptions,
+		csibroker.WithReconcilePageSize(int32(*listVolumesPageSize)),
+		csibroker.WithProbeTimeout(*probeTimeout),
+		csibroker.WithBindInstanceWait(*bindInstanceWait),
+	)
+	if *redactKeys != "" {
+		var keys []string
+		for _, key := range strings.Split(*redactKeys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		brokerOptions = append(brokerOptions, csibroker.WithRedactKeys(keys))
+	}
+	if *allowedMountPaths != "" {
+		paths := strings.Split(*allowedMountPaths, ",")
+		for _, allowedPath := range paths {
+			if !filepath.IsAbs(allowedPath) {
+				logger.Error("invalid-allowed-mount-path", errors.New("allowed mount paths must be absolute"), lager.Data{"path": allowedPath})
+				os.Exit(1)
+			}
+		}
+		brokerOptions = append(brokerOptions, csibroker.WithAllowedMountPaths(paths))
+	}
+	if *parameterDeprecationsFile != "" {
+		deprecations, err := csibroker.LoadParameterDeprecations(logger, *parameterDeprecationsFile)
+		if err != nil {
+			logger.Error("parameter-deprecations-initialize-error", err)
+			os.Exit(1)
+		}
+		brokerOptions = append(brokerOptions, csibroker.WithParameterDeprecations(deprecations))
+	}
+	if *addCfMetadataLabels {
+		brokerOptions = append(brokerOptions, csibroker.WithCFMetadataLabels(*cfMetadataLabelPrefix, *cfMetadataLabelCollision == "error"))
+	}
+	if *parameterSetsFile != "" {
+		parameterSets, err := csibroker.NewParameterSets(logger, *parameterSetsFile)
+		if err != nil {
+			logger.Error("parameter-sets-initialize-error", err)
+			os.Exit(1)
+		}
+		reloadOnHangup(logger, parameterSets)
+		brokerOptions = append(brokerOptions, csibroker.WithParameterSets(parameterSets))
+	}
+	if *paramFormat != csibroker.ParameterFormatJSON {
+		brokerOptions = append(brokerOptions, csibroker.WithParameterFormat(*paramFormat))
+	}
+	if *provisionWebhook != "" {
+		webhook := csibroker.NewProvisionWebhook(*provisionWebhook, *provisionWebhookFailure == "fail", csibroker.DefaultProvisionWebhookTimeout)
+		brokerOptions = append(brokerOptions, csibroker.WithProvisionWebhook(webhook))
+	}
+	if *preProvisionWebhook != "" {
+		webhook := csibroker.NewPreProvisionWebhook(*preProvisionWebhook, *preProvisionWebhookFailure == "fail", csibroker.DefaultPreProvisionWebhookTimeout)
+		brokerOptions = append(brokerOptions, csibroker.WithPreProvisionWebhook(webhook))
+	}
+	if *deprovisionWebhook != "" {
+		webhook := csibroker.NewDeprovisionWebhook(*deprovisionWebhook, *deprovisionWebhookFailure == "fail", csibroker.DefaultDeprovisionWebhookTimeout)
+		brokerOptions = append(brokerOptions, csibroker.WithDeprovisionWebhook(webhook))
+	}
+	if *cloudEventsSink != "" {
+		emitter := csibroker.NewCloudEventEmitter(logger, clock.NewClock(), *cloudEventsSink, csibroker.DefaultCloudEventsBufferSize, csibroker.DefaultCloudEventsTimeout)
+		members = append(members, grouper.Member{Name: "cloud-events", Runner: emitter})
+		brokerOptions = append(brokerOptions, csibroker.WithCloudEventEmitter(emitter))
+	}
+	if *probeBreakerThreshold > 0 {
+		brokerOptions = append(brokerOptions, csibroker.WithProbeBreaker(*probeBreakerThreshold, *probeBreakerWindow, *probeBreakerCooldown))
+	}
+	if *syncBudget > 0 {
+		brokerOptions = append(brokerOptions, csibroker.WithSyncBudget(*syncBudget))
+	}
+	if *csiRequestTimeout > 0 || *createVolumeTimeout > 0 || *deleteVolumeTimeout > 0 {
+		brokerOptions = append(brokerOptions, csibroker.WithRPCTimeouts(csibroker.RPCTimeouts{
+			Default:      *csiRequestTimeout,
+			CreateVolume: *createVolumeTimeout,
+			DeleteVolume: *deleteVolumeTimeout,
+		}))
+	}
+	if *reconcileSummaryFile != "" {
+		brokerOptions = append(brokerOptions, csibroker.WithReconcileSummaryFile(*reconcileSummaryFile))
+	}
+	if *adoptExistingVolumes {
+		brokerOptions = append(brokerOptions, csibroker.WithAdoptExistingVolumes())
+	}
+	if *allowDeprovisionEmptyVolume {
+		brokerOptions = append(brokerOptions, csibroker.WithAllowDeprovisionEmptyVolume())
+	}
+	if *orgQuota > 0 {
+		brokerOptions = append(brokerOptions, csibroker.WithOrgQuota(*orgQuota))
+	}
+	if *storeRestoreRetries > 0 {
+		brokerOptions = append(brokerOptions, csibroker.WithRestoreRetries(*storeRestoreRetries, *storeRestoreBackoff))
+	}
 
 	serviceBroker, err := csibroker.New(
 		logger,
@@ -212,16 +1012,132 @@ func createServer(logger lager.Logger) ifrit.Runner {
 		clock.NewClock(),
 		store,
 		servicesRegistry,
+		brokerOptions...,
 	)
 	logger.Info("listenAddr: " + *atAddress + ", serviceSpec: " + *serviceSpec)
 
-	if err != nil {
+	if err != nil && *ignoreRestoreErrors {
+		logger.Error("csibroker-restore-error-ignored", err)
+	} else if err != nil {
 		logger.Error("csibroker-initialize-error", err)
 		os.Exit(1)
 	}
 
+	// the self-check saves the store, which would overwrite it with the empty
+	// state left by a failed restore
+	if err == nil {
+		runSelfCheck(logger, servicesRegistry, store)
+	}
+	checkCatalog(logger, servicesRegistry, store)
+	checkSpecChanges(logger, servicesRegistry, store)
+
+	if *reconcileOnStartup {
+		reconcile(logger, serviceBroker)
+	}
+
+	handler := http.NewServeMux()
+	storeProbe := csibroker.NewStoreProbe(logger, clock.NewClock(), serviceBroker.PingStore, *storeProbeInterval)
+	versionInfo := version.Get(csibroker.CSIVersion)
+	handler.Handle("/version", version.Handler(versionInfo))
+	handler.Handle("/health", csibroker.NewHealthHandler(logger, servicesRegistry, storeProbe, *probeTimeout, versionInfo))
+	adminAuth := auth.NewWrapper(*username, *password)
+	handler.Handle("/admin/", adminAuth.Wrap(csibroker.NewAdminHandler(logger, serviceBroker, servicesRegistry, serviceBroker, serviceBroker)))
+
+	var apiBroker brokerapi.ServiceBroker = serviceBroker
+	if *enableFaultInjection {
+		faultInjector := newFaultInjector(logger, serviceBroker)
+		handler.Handle("/admin/faults", adminAuth.Wrap(csibroker.NewFaultInjectionHandler(logger, faultInjector)))
+		apiBroker = faultInjector
+	}
+	if *enableBatchAdmin {
+		handler.Handle("/admin/batch-provision", adminAuth.Wrap(csibroker.NewBatchProvisionHandler(logger, apiBroker, *batchProvisionConcurrency)))
+	}
+
 	credentials := brokerapi.BrokerCredentials{Username: *username, Password: *password}
-	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
+	brokerHandler := brokerapi.New(apiBroker, logger.Session("broker-api"), credentials)
+	handler.Handle("/", csibroker.NewOriginatingIdentityHandler(logger, brokerHandler))
+
+	members = append(members, grouper.Member{Name: "broker-api", Runner: newHTTPServer(*atAddress, handler)})
+	return members
+}
+
+func newFaultInjector(logger lager.Logger, serviceBroker brokerapi.ServiceBroker) *csibroker.FaultInjector {
+	logger.Info("fault-injection-enabled")
+	faultInjector := csibroker.NewFaultInjector(logger, clock.NewClock(), serviceBroker)
+
+	if faultsJSON != "" {
+		var faults csibroker.Faults
+		err := json.Unmarshal([]byte(faultsJSON), &faults)
+		if err == nil {
+			err = faultInjector.SetFaults(faults)
+		}
+		if err != nil {
+			logger.Error("invalid-faults", err)
+			os.Exit(1)
+		}
+	}
+
+	return faultInjector
+}
+
+func newTracerProvider(logger lager.Logger) *sdktrace.TracerProvider {
+	exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(*otlpEndpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		logger.Error("otlp-exporter-initialize-error", err)
+		os.Exit(1)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "csibroker"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	logger.Info("tracing-enabled", lager.Data{"otlpEndpoint": *otlpEndpoint})
+
+	return tracerProvider
+}
+
+// newHTTPServer serves the handler with the configured timeouts. On a signal
+// it stops accepting connections and waits for requests in flight.
+func newHTTPServer(address string, handler http.Handler) ifrit.Runner {
+	server := &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		ReadTimeout:  *httpReadTimeout,
+		WriteTimeout: *httpWriteTimeout,
+		IdleTimeout:  *httpIdleTimeout,
+	}
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(listener)
+		}()
+		close(ready)
+
+		select {
+		case err := <-served:
+			return err
+		case <-signals:
+			return server.Shutdown(context.Background())
+		}
+	})
+}
 
-	return http_server.New(*atAddress, handler)
+// onShutdown runs action once the process is signalled, logging rather than
+// returning its error so that the rest of the group still shuts down.
+func onShutdown(logger lager.Logger, action string, fn func() error) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+		<-signals
+		if err := fn(); err != nil {
+			logger.Error(action+"-failed", err)
+		}
+		return nil
+	})
 }
@@ -6,7 +6,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 
+	"code.cloudfoundry.org/csibroker/csibroker"
+	"code.cloudfoundry.org/csibroker/version"
 	"code.cloudfoundry.org/goshims/osshim/os_fake"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
@@ -135,21 +138,25 @@ var _ = Describe("csibroker Main", func() {
 
 	Context("Parse VCAP_SERVICES tests", func() {
 		var (
-			port   string
-			fakeOs os_fake.FakeOs = os_fake.FakeOs{}
-			logger lager.Logger
+			port          string
+			otherBindings string
+			fakeOs        os_fake.FakeOs = os_fake.FakeOs{}
+			logger        lager.Logger
 		)
 
 		BeforeEach(func() {
 			*dbDriver = "postgres"
 			*cfServiceName = "postgresql"
+			*cfServiceInstanceName = ""
+			otherBindings = ""
+			port = `"9999"`
 			logger = lagertest.NewTestLogger("test-broker-main")
 		})
 
 		JustBeforeEach(func() {
 			env := fmt.Sprintf(`
 				{
-					"postgresql":[
+					"postgresql":[%s
 						{
 							"credentials":{
 								"dbType":"postgresql",
@@ -172,7 +179,7 @@ var _ = Describe("csibroker Main", func() {
 							"volume_mounts":[]
 						}
 					]
-				}`, port)
+				}`, otherBindings, port)
 			fakeOs.LookupEnvReturns(env, true)
 		})
 
@@ -205,6 +212,37 @@ var _ = Describe("csibroker Main", func() {
 				Expect(func() { parseVcapServices(logger, &fakeOs) }).To(Panic())
 			})
 		})
+		Context("when the service has several bindings", func() {
+			BeforeEach(func() {
+				otherBindings = `{"name": "otherdb", "credentials": {"hostname": "9.9.9.9", "name": "bar", "password": "bar", "port": "1111", "username": "bar"}},`
+			})
+
+			It("should panic listing the bindings", func() {
+				Expect(func() { parseVcapServices(logger, &fakeOs) }).To(Panic())
+				Expect(logger.(*lagertest.TestLogger).Buffer()).To(gbytes.Say(`service \\"postgresql\\" has 2 bindings named \\"otherdb\\", \\"foobroker\\"`))
+			})
+
+			Context("when the instance name is given", func() {
+				BeforeEach(func() {
+					*cfServiceInstanceName = "foobroker"
+				})
+
+				It("should use that binding", func() {
+					Expect(func() { parseVcapServices(logger, &fakeOs) }).NotTo(Panic())
+					Expect(*dbHostname).To(Equal("8.8.8.8"))
+				})
+			})
+
+			Context("when no binding has the instance name", func() {
+				BeforeEach(func() {
+					*cfServiceInstanceName = "missingdb"
+				})
+
+				It("should panic", func() {
+					Expect(func() { parseVcapServices(logger, &fakeOs) }).To(Panic())
+				})
+			})
+		})
 	})
 
 	Context("Missing required args", func() {
@@ -232,6 +270,186 @@ var _ = Describe("csibroker Main", func() {
 
 		})
 
+		It("rejects a state file name that is a path", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-stateFileName", "../elsewhere.json"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "stateFileName must be a plain file name",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects negative HTTP timeouts", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-httpWriteTimeout", "-1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects negative CSI request timeouts", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-createVolumeTimeout", "-1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "csiRequestTimeout, createVolumeTimeout and deleteVolumeTimeout must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown provision webhook failure mode", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-provisionWebhookFailure", "retry"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "provisionWebhookFailure must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative probe breaker threshold", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-probeBreakerThreshold", "-1"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "probeBreakerThreshold must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown connectivity validation mode", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-validateConnectivity", "strict"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "validateConnectivity must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("fails to start when connectivity validation finds an unreachable plugin", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-validateConnectivity", "fail", "-probeTimeout", "1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "connectivity-validation-failed",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown pre-provision webhook failure policy", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-preProvisionWebhookFailure", "retry"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "preProvisionWebhookFailure must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown deprovision webhook failure policy", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-deprovisionWebhookFailure", "retry"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "deprovisionWebhookFailure must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown log format", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-logFormat", "logfmt"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "logFormat must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown parameter format", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-paramFormat", "yaml"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "paramFormat must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative store save retry count", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-storeSaveRetries", "-1"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "storeSaveRetries and storeSaveBackoff must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative store restore retry count", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-storeRestoreRetries", "-1"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "storeRestoreRetries and storeRestoreBackoff must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a batch provision concurrency of zero", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-batchProvisionConcurrency", "0"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "batchProvisionConcurrency must be positive",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative bind instance wait", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-bindInstanceWait", "-1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "bindInstanceWait must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative sync budget", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-syncBudget", "-1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "syncBudget must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects a negative store probe interval", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-storeProbeInterval", "-1s"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "storeProbeInterval must not be negative",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("rejects an unknown CF metadata label collision policy", func() {
+			args := []string{"-dataDir", tempDir, "-serviceSpec", specFilepath, "-cfMetadataLabelCollision", "merge"}
+			volmanRunner := failRunner{
+				Name:       "csibroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "cfMetadataLabelCollision must be",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
 		AfterEach(func() {
 			ginkgomon.Kill(process) // this is only if incorrect implementation leaves process running
 		})
@@ -286,6 +504,56 @@ var _ = Describe("csibroker Main", func() {
 			Expect(resp.StatusCode).To(Equal(200))
 		})
 
+		It("should serve the admin instances endpoint", func() {
+			resp, err := httpDoWithAuth("GET", "/admin/instances", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+		})
+
+		It("should require credentials for the admin endpoints", func() {
+			resp, err := http.Get("http://" + listenAddr + "/admin/instances")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(401))
+		})
+
+		It("should serve the health endpoint without credentials", func() {
+			resp, err := http.Get("http://" + listenAddr + "/health")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).NotTo(Equal(401))
+
+			var report csibroker.HealthReport
+			Expect(json.NewDecoder(resp.Body).Decode(&report)).To(Succeed())
+			Expect(report.Store.Reachable).To(BeTrue())
+		})
+
+		It("should not serve batch provisioning unless enabled", func() {
+			resp, err := httpDoWithAuth("POST", "/admin/batch-provision", ioutil.NopCloser(strings.NewReader("[]")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(404))
+		})
+
+		Context("with batch provisioning enabled", func() {
+			BeforeEach(func() {
+				args = append(args, "-enableBatchAdmin")
+			})
+
+			It("should serve batch provisioning", func() {
+				resp, err := httpDoWithAuth("POST", "/admin/batch-provision", ioutil.NopCloser(strings.NewReader("[]")))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+			})
+		})
+
+		It("should serve the version endpoint without credentials", func() {
+			resp, err := http.Get("http://" + listenAddr + "/version")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+
+			var info version.Info
+			Expect(json.NewDecoder(resp.Body).Decode(&info)).To(Succeed())
+			Expect(info.CSISpecVersion).To(Equal(csibroker.CSIVersion))
+		})
+
 		Context("given arguments", func() {
 			BeforeEach(func() {
 				args = append(args, "-serviceSpec", specFilepath)
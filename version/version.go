@@ -0,0 +1,46 @@
+// Package version reports how the broker was built. Version and GitSHA are
+// set at build time, e.g.
+//
+//	go build -ldflags "-X code.cloudfoundry.org/csibroker/version.Version=1.2.3 -X code.cloudfoundry.org/csibroker/version.GitSHA=$(git rev-parse HEAD)"
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+var (
+	Version = "dev"
+	GitSHA  = "unknown"
+)
+
+type Info struct {
+	Version        string `json:"version"`
+	GitSHA         string `json:"git_sha"`
+	CSISpecVersion string `json:"csi_spec_version"`
+}
+
+// Get returns the build information of the running broker, which speaks
+// the given CSI spec version.
+func Get(csiSpecVersion string) Info {
+	return Info{
+		Version:        Version,
+		GitSHA:         GitSHA,
+		CSISpecVersion: csiSpecVersion,
+	}
+}
+
+// Handler serves GET /version. The information carries no secrets and needs
+// no authentication.
+func Handler(info Info) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
@@ -0,0 +1,36 @@
+package version_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/csibroker/version"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Version", func() {
+	It("reports the build variables with the CSI spec version", func() {
+		Expect(version.Get("1.0.0")).To(Equal(version.Info{Version: "dev", GitSHA: "unknown", CSISpecVersion: "1.0.0"}))
+	})
+
+	Describe("Handler", func() {
+		var recorder *httptest.ResponseRecorder
+
+		BeforeEach(func() {
+			recorder = httptest.NewRecorder()
+		})
+
+		It("serves the info as JSON", func() {
+			version.Handler(version.Info{Version: "1.2.3", GitSHA: "abc123", CSISpecVersion: "1.0.0"}).ServeHTTP(recorder, httptest.NewRequest("GET", "/version", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(MatchJSON(`{"version": "1.2.3", "git_sha": "abc123", "csi_spec_version": "1.0.0"}`))
+		})
+
+		It("only serves GET", func() {
+			version.Handler(version.Info{}).ServeHTTP(recorder, httptest.NewRequest("POST", "/version", nil))
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})